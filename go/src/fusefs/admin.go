@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The administrative directory, ".mawfs" in the root of the filesystem.
+// This is the equivalent of the admin files in fuse.crk.
+
+package fusefs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"os"
+	"syscall"
+)
+
+// The name of the administrative directory.
+const adminDirName = ".mawfs"
+
+// The name of the file in the administrative directory that returns a new
+// one-time login nonce every time it's read.
+const otpFileName = "otp"
+
+// A source of one-time login nonces.  This is implemented by
+// rpc.NonceManager.
+type NonceSource interface {
+	Get() ([]byte, error)
+}
+
+// Enables the administrative directory and serves the nonces from 'nonces'
+// from its otp file.  Reading a nonce from the otp file requires access to
+// the mounted filesystem, so it proves to the RPC server that the client is
+// local.
+func (f *FS) SetNonceSource(nonces NonceSource) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonces = nonces
+}
+
+// Returns the administrative directory if 'n' is the root and the directory
+// is enabled, nil if not.  Must be called with the lock held.
+func (n *Node) getAdminDir() (fs.Node, error) {
+	if n.fs.nonces == nil {
+		return nil, nil
+	}
+	root, err := n.fs.head.GetRoot()
+	if err != nil || n.rep != root {
+		return nil, err
+	}
+	return &adminDir{n.fs}, nil
+}
+
+// The administrative directory.  It isn't listed in the root directory.
+type adminDir struct {
+	fs *FS
+}
+
+// Implements fs.Node.
+func (d *adminDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0700
+	attr.Nlink = 1
+	attr.Uid = d.fs.uid
+	attr.Gid = d.fs.gid
+	return nil
+}
+
+// Implements fs.NodeStringLookuper.
+func (d *adminDir) Lookup(ctx context.Context, name string) (fs.Node,
+	error) {
+
+	if name == otpFileName {
+		return &otpFile{d.fs}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// Implements fs.HandleReadDirAller.
+func (d *adminDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{{Name: otpFileName, Type: fuse.DT_File}}, nil
+}
+
+// The otp file.  Every open of the file gets a new nonce.
+type otpFile struct {
+	fs *FS
+}
+
+// Implements fs.Node.
+func (o *otpFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0400
+	attr.Nlink = 1
+	attr.Size = 32 // The size of an rpc nonce.
+	attr.Uid = o.fs.uid
+	attr.Gid = o.fs.gid
+	return nil
+}
+
+// Implements fs.NodeOpener.
+func (o *otpFile) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	o.fs.mu.Lock()
+	nonces := o.fs.nonces
+	o.fs.mu.Unlock()
+	nonce, err := nonces.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	// The nonce is different for every handle, so don't let the kernel
+	// cache it.
+	resp.Flags |= fuse.OpenDirectIO
+	return otpHandle(nonce), nil
+}
+
+// An open otp file, holds the nonce returned for it.
+type otpHandle []byte
+
+// Implements fs.HandleReadAller.
+func (h otpHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return h, nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// FUSE front end.  Serves the CachedNode tree of a branch head, this is the
+// Go equivalent of fuse.crk.
+
+package fusefs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	pb "mawfs"
+	"os"
+	blockstore "store"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returns the current time as seconds since the epoch.
+func getPosixTime() int32 {
+	return int32(time.Now().Unix())
+}
+
+// Implements fs.FS.
+//
+// All operations are serialized through a single lock because the cache is
+// not thread-safe.
+type FS struct {
+	mu   sync.Mutex
+	head *blockstore.Head
+
+	// Nodes that the kernel currently knows about.  Each of these holds an
+	// external reference to its CachedNode so that it doesn't get garbage
+	// collected out from under us.
+	nodes map[*blockstore.CachedNode]*Node
+
+	uid, gid uint32
+
+	// The source of the nonces served by .mawfs/otp, nil if the
+	// administrative directory is disabled.
+	nonces NonceSource
+}
+
+// Creates a new filesystem serving the tree of 'head'.
+func New(head *blockstore.Head) *FS {
+	return &FS{head: head,
+		nodes: make(map[*blockstore.CachedNode]*Node),
+		uid:   uint32(os.Getuid()),
+		gid:   uint32(os.Getgid()),
+	}
+}
+
+// Returns the Node wrapping 'rep', creating it if necessary.  Must be called
+// with the lock held.
+func (f *FS) getNode(rep *blockstore.CachedNode) *Node {
+	if node, ok := f.nodes[rep]; ok {
+		return node
+	}
+	node := &Node{fs: f, rep: rep.AddExtRef()}
+	f.nodes[rep] = node
+	return node
+}
+
+// Implements fs.FS.
+func (f *FS) Root() (fs.Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	root, err := f.head.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+	return f.getNode(root), nil
+}
+
+// Commits all outstanding changes.  'metadata' may be nil.
+func (f *FS) Commit(metadata *pb.CommitMetadata) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.head.Commit(metadata)
+	return err
+}
+
+// Returns the branch that the filesystem's head is on.
+func (f *FS) GetBranch() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.head.GetBranch()
+}
+
+// A file or directory.  Nodes are also used as their own handles.
+type Node struct {
+	fs  *FS
+	rep *blockstore.CachedNode
+}
+
+// Fills in 'attr' from the node.  The only attributes in the underlying
+// filesystem are "directory" and "executable", everything else is a normal
+// file.
+func (n *Node) fillAttr(attr *fuse.Attr) {
+	switch {
+	case n.rep.IsDir():
+		attr.Mode = os.ModeDir | 0755
+	case n.rep.GetMode()&blockstore.MODE_EXE != 0:
+		attr.Mode = 0755
+	default:
+		attr.Mode = 0644
+	}
+	attr.Size = n.rep.GetSize()
+	attr.Nlink = 1
+	attr.Uid = n.fs.uid
+	attr.Gid = n.fs.gid
+	attr.Mtime = time.Unix(int64(n.rep.GetTime()), 0)
+}
+
+// Implements fs.Node.
+func (n *Node) Attr(ctx context.Context, attr *fuse.Attr) error {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	n.fillAttr(attr)
+	return nil
+}
+
+// Implements fs.NodeForgetter.
+func (n *Node) Forget() {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if n.fs.nodes[n.rep] == n {
+		delete(n.fs.nodes, n.rep)
+		n.rep.ReleaseExtRef()
+	}
+}
+
+// Implements fs.NodeStringLookuper.
+func (n *Node) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if !n.rep.IsDir() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	if name == adminDirName {
+		if admin, err := n.getAdminDir(); admin != nil || err != nil {
+			return admin, err
+		}
+	}
+	child, err := n.rep.GetChildByName(name)
+	if err != nil {
+		return nil, err
+	} else if child == nil {
+		return nil, fuse.ENOENT
+	}
+	return n.fs.getNode(child), nil
+}
+
+// Implements fs.HandleReadDirAller.
+func (n *Node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if !n.rep.IsDir() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+
+	// We don't fill in the types, that would require loading every child.
+	result := make([]fuse.Dirent, 0, n.rep.GetChildCount())
+	for i := 0; i < n.rep.GetChildCount(); i++ {
+		name, err := n.rep.GetChildName(i)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fuse.Dirent{Name: name})
+	}
+	return result, nil
+}
+
+// Implements fs.HandleReader.
+func (n *Node) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if n.rep.IsDir() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	buf := make([]byte, req.Size)
+	count, err := n.rep.Read(uint64(req.Offset), buf)
+	if err != nil {
+		return err
+	}
+	resp.Data = buf[:count]
+	return nil
+}
+
+// Implements fs.HandleWriter.
+func (n *Node) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) error {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if n.rep.IsDir() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	err := n.rep.Write(uint64(req.Offset), req.Data, getPosixTime())
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Adds a new child node, returns EEXIST if it already exists.  Must be
+// called with the lock held.
+func (n *Node) addChild(name string, mode int32) (*Node, error) {
+	if !n.rep.IsDir() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	if existing, err := n.rep.GetChildByName(name); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, fuse.EEXIST
+	}
+	child, err := n.rep.AddChild(name, &pb.Node{Mode: &mode},
+		getPosixTime())
+	if err != nil {
+		return nil, err
+	}
+	return n.fs.getNode(child), nil
+}
+
+// Implements fs.NodeCreater.
+func (n *Node) Create(ctx context.Context, req *fuse.CreateRequest,
+	resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	var mode int32
+	if req.Mode&0111 != 0 {
+		mode = blockstore.MODE_EXE
+	}
+	child, err := n.addChild(req.Name, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	child.fillAttr(&resp.Attr)
+	return child, child, nil
+}
+
+// Implements fs.NodeMkdirer.
+func (n *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node,
+	error) {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.addChild(req.Name, blockstore.MODE_DIR)
+}
+
+// Implements fs.NodeRemover.  This does both unlink and rmdir.
+func (n *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	child, err := n.rep.GetChildByName(req.Name)
+	if err != nil {
+		return err
+	} else if child == nil {
+		return fuse.ENOENT
+	}
+
+	if req.Dir {
+		if !child.IsDir() {
+			return fuse.Errno(syscall.ENOTDIR)
+		} else if child.GetChildCount() > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	} else if child.IsDir() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	_, err = n.rep.DeleteChild(req.Name, getPosixTime())
+	return err
+}
+
+// Implements fs.NodeRenamer.
+func (n *Node) Rename(ctx context.Context, req *fuse.RenameRequest,
+	newDir fs.Node) error {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	target, ok := newDir.(*Node)
+	if !ok || !target.rep.IsDir() {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if child, err := n.rep.GetChildByName(req.OldName); err != nil {
+		return err
+	} else if child == nil {
+		return fuse.ENOENT
+	}
+	return n.rep.Rename(req.OldName, target.rep, req.NewName,
+		getPosixTime())
+}
+
+// Implements fs.NodeSetattrer.  This covers truncate and utimens.  Changes
+// to the mode and ownership are silently ignored.
+func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest,
+	resp *fuse.SetattrResponse) error {
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if req.Valid.Size() {
+		if n.rep.IsDir() {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if err := n.rep.Resize(req.Size, getPosixTime()); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Mtime() {
+		if err := n.rep.SetTime(int32(req.Mtime.Unix())); err != nil {
+			return err
+		}
+	}
+	n.fillAttr(&resp.Attr)
+	return nil
+}
+
+// Implements fs.NodeFsyncer, which gets both fsync and fsyncdir.  Like
+// _fsyncdir in the Crack implementation, fsyncdir commits all outstanding
+// changes on the branch.  fsync on a file does nothing: the changes are
+// already in the journal, which is written synchronously.
+func (n *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if !req.Dir {
+		return nil
+	}
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	_, err := n.fs.head.Commit(nil)
+	return err
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusefs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"context"
+	"os"
+	blockstore "store"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// These tests call the node methods directly rather than mounting the
+// filesystem, mounting requires privileges that we don't have in tests.
+
+func newTestFS(t *testing.T) (*FS, *blockstore.FakeFileSys, *Node) {
+	backing := blockstore.NewFakeFileSys()
+	store := blockstore.NewChunkStore(blockstore.NewFSInfo("password"),
+		backing)
+	head, err := blockstore.NewCache(store).GetHead("master")
+	if err != nil {
+		t.Fatalf("GetHead: %s", err)
+	}
+	fsys := New(head)
+	root, err := fsys.Root()
+	if err != nil {
+		t.Fatalf("Root: %s", err)
+	}
+	return fsys, backing, root.(*Node)
+}
+
+func expectErrno(t *testing.T, err error, errno syscall.Errno) {
+	if e, ok := err.(fuse.Errno); !ok || syscall.Errno(e) != errno {
+		t.Errorf("expected %s, got %v", errno, err)
+	}
+}
+
+func lookup(t *testing.T, dir *Node, name string) *Node {
+	node, err := dir.Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Lookup(%s): %s", name, err)
+	}
+	return node.(*Node)
+}
+
+func readAll(t *testing.T, node *Node) string {
+	resp := &fuse.ReadResponse{}
+	err := node.Read(context.Background(), &fuse.ReadRequest{Size: 4096},
+		resp)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	return string(resp.Data)
+}
+
+func TestFileOperations(t *testing.T) {
+	ctx := context.Background()
+	_, _, root := newTestFS(t)
+
+	node, handle, err := root.Create(ctx,
+		&fuse.CreateRequest{Name: "file", Mode: 0644},
+		&fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	file := node.(*Node)
+	if handle.(*Node) != file {
+		t.Error("handle is not the node")
+	}
+	if lookup(t, root, "file") != file {
+		t.Error("Lookup returned a different node")
+	}
+
+	resp := &fuse.WriteResponse{}
+	err = file.Write(ctx, &fuse.WriteRequest{Data: []byte("hello world")},
+		resp)
+	if err != nil || resp.Size != 11 {
+		t.Fatalf("Write: %d, %v", resp.Size, err)
+	}
+	if data := readAll(t, file); data != "hello world" {
+		t.Errorf("got %q", data)
+	}
+
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	if attr.Mode != 0644 || attr.Size != 11 || attr.Nlink != 1 {
+		t.Errorf("bad attributes: %v", attr)
+	}
+
+	// Truncate and set the modification time.
+	mtime := time.Unix(1234, 0)
+	err = file.Setattr(ctx,
+		&fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMtime,
+			Size: 5, Mtime: mtime,
+		},
+		&fuse.SetattrResponse{})
+	if err != nil {
+		t.Fatalf("Setattr: %s", err)
+	}
+	file.Attr(ctx, &attr)
+	if attr.Size != 5 || !attr.Mtime.Equal(mtime) {
+		t.Errorf("bad attributes after Setattr: %v", attr)
+	}
+	if data := readAll(t, file); data != "hello" {
+		t.Errorf("got %q", data)
+	}
+
+	// Executables.
+	node, _, err = root.Create(ctx,
+		&fuse.CreateRequest{Name: "exe", Mode: 0755},
+		&fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	node.Attr(ctx, &attr)
+	if attr.Mode != 0755 {
+		t.Errorf("bad executable mode: %s", attr.Mode)
+	}
+
+	_, _, err = root.Create(ctx, &fuse.CreateRequest{Name: "file"},
+		&fuse.CreateResponse{})
+	expectErrno(t, err, syscall.EEXIST)
+
+	expectErrno(t, root.Remove(ctx, &fuse.RemoveRequest{Name: "file",
+		Dir: true}), syscall.ENOTDIR)
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	_, err = root.Lookup(ctx, "file")
+	expectErrno(t, err, syscall.ENOENT)
+}
+
+func TestDirectoryOperations(t *testing.T) {
+	ctx := context.Background()
+	fsys, backing, root := newTestFS(t)
+
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+	dir := node.(*Node)
+	var attr fuse.Attr
+	dir.Attr(ctx, &attr)
+	if attr.Mode != os.ModeDir|0755 {
+		t.Errorf("bad directory mode: %s", attr.Mode)
+	}
+	_, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	expectErrno(t, err, syscall.EEXIST)
+
+	_, _, err = dir.Create(ctx, &fuse.CreateRequest{Name: "file"},
+		&fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+
+	expectErrno(t, root.Remove(ctx, &fuse.RemoveRequest{Name: "dir",
+		Dir: true}), syscall.ENOTEMPTY)
+	expectErrno(t, root.Remove(ctx, &fuse.RemoveRequest{Name: "dir"}),
+		syscall.EISDIR)
+	expectErrno(t, dir.Read(ctx, &fuse.ReadRequest{Size: 10},
+		&fuse.ReadResponse{}), syscall.EISDIR)
+
+	// Move the file up to the root.
+	err = dir.Rename(ctx, &fuse.RenameRequest{OldName: "file",
+		NewName: "moved"}, root)
+	if err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	err = dir.Rename(ctx, &fuse.RenameRequest{OldName: "file",
+		NewName: "moved"}, root)
+	expectErrno(t, err, syscall.ENOENT)
+
+	entries, err := root.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatalf("ReadDirAll: %s", err)
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name] = true
+	}
+	if len(entries) != 2 || !names["dir"] || !names["moved"] {
+		t.Errorf("got entries %v", entries)
+	}
+
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "dir",
+		Dir: true}); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+
+	// fsync on a file leaves the changes in the journal.
+	baseline := fsys.head.GetBaselineCommit()
+	err = lookup(t, root, "moved").Fsync(ctx, &fuse.FsyncRequest{})
+	if err != nil {
+		t.Fatalf("Fsync: %s", err)
+	}
+	if !bytes.Equal(fsys.head.GetBaselineCommit(), baseline) ||
+		!backing.Exists("journals/master") {
+		t.Error("file fsync committed the branch")
+	}
+
+	// fsyncdir should commit the branch.
+	err = root.Fsync(ctx, &fuse.FsyncRequest{Dir: true})
+	if err != nil {
+		t.Fatalf("Fsync: %s", err)
+	}
+	if bytes.Equal(fsys.head.GetBaselineCommit(), baseline) {
+		t.Error("no commit after fsyncdir")
+	}
+	root.Forget()
+	if len(fsys.nodes) != 2 {
+		t.Errorf("%d nodes still referenced", len(fsys.nodes))
+	}
+}
+
+// Returns a different nonce every time.
+type fakeNonces struct {
+	count byte
+}
+
+func (n *fakeNonces) Get() ([]byte, error) {
+	n.count++
+	return []byte{n.count}, nil
+}
+
+func readOTP(t *testing.T, otp fs.Node) string {
+	ctx := context.Background()
+	resp := &fuse.OpenResponse{}
+	handle, err := otp.(fs.NodeOpener).Open(ctx,
+		&fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if resp.Flags&fuse.OpenDirectIO == 0 {
+		t.Error("otp file is not opened for direct I/O")
+	}
+	data, err := handle.(fs.HandleReadAller).ReadAll(ctx)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	return string(data)
+}
+
+func TestAdminDir(t *testing.T) {
+	ctx := context.Background()
+	fsys, _, root := newTestFS(t)
+	_, err := root.Lookup(ctx, ".mawfs")
+	expectErrno(t, err, syscall.ENOENT)
+
+	fsys.SetNonceSource(&fakeNonces{})
+	admin, err := root.Lookup(ctx, ".mawfs")
+	if err != nil {
+		t.Fatalf("Lookup(.mawfs): %s", err)
+	}
+	otp, err := admin.(fs.NodeStringLookuper).Lookup(ctx, "otp")
+	if err != nil {
+		t.Fatalf("Lookup(otp): %s", err)
+	}
+
+	// Every open gets a new nonce.
+	if data := readOTP(t, otp); data != "\x01" {
+		t.Errorf("got nonce %q", data)
+	}
+	if data := readOTP(t, otp); data != "\x02" {
+		t.Errorf("got nonce %q", data)
+	}
+	_, err = otp.(fs.NodeOpener).Open(ctx,
+		&fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	expectErrno(t, err, syscall.EACCES)
+
+	// The admin directory is only in the root and isn't listed.
+	dir, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "subdir"})
+	_, err = dir.(*Node).Lookup(ctx, ".mawfs")
+	expectErrno(t, err, syscall.ENOENT)
+	entries, _ := root.ReadDirAll(ctx)
+	if len(entries) != 1 || entries[0].Name != "subdir" {
+		t.Errorf("got entries %v", entries)
+	}
+}
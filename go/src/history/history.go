@@ -0,0 +1,253 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Walking the commit graph: common ancestors, ancestry checks and commit
+// logs.
+//
+// This only depends on the protos so that the store package can use it, any
+// NodeStore satisfies the interfaces here.
+
+package history
+
+import (
+	"bytes"
+	pb "mawfs"
+	"strings"
+)
+
+// The source of commits.
+type CommitStore interface {
+	LoadCommit(digest []byte) (*pb.Commit, error)
+}
+
+// The source of commits and nodes, needed to look at the trees of commits.
+type NodeStore interface {
+	CommitStore
+	LoadNode(digest []byte) (*pb.Node, error)
+}
+
+// Walks the commit graph breadth-first from a set of commits, following
+// Commit.Parent.  Every commit is returned once, commits are returned in
+// order of their distance from the starting commits.
+type Walker struct {
+	store   CommitStore
+	queue   [][]byte
+	visited map[string]bool
+}
+
+// Creates a walker starting from 'digests'.
+func NewWalker(store CommitStore, digests ...[]byte) *Walker {
+	return &Walker{store, append([][]byte(nil), digests...),
+		make(map[string]bool),
+	}
+}
+
+// Returns the next commit and its digest.  Returns a nil digest and commit
+// when there are no more commits.
+func (w *Walker) Next() ([]byte, *pb.Commit, error) {
+	for len(w.queue) > 0 {
+		digest := w.queue[0]
+		w.queue = w.queue[1:]
+		if w.visited[string(digest)] {
+			continue
+		}
+		w.visited[string(digest)] = true
+
+		commit, err := w.store.LoadCommit(digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.queue = append(w.queue, commit.Parent...)
+		return digest, commit, nil
+	}
+	return nil, nil, nil
+}
+
+// Returns true if 'digest' has been returned by Next().
+func (w *Walker) Visited(digest []byte) bool {
+	return w.visited[string(digest)]
+}
+
+// Returns the digest of a commit that is an ancestor of (or the same as)
+// both 'alpha' and 'beta'.  Returns nil if there is none, which means that
+// the commits are from different filesystems (or the history is broken).
+//
+// Like findCommonCommit() in util.crk, this walks back from both commits in
+// lock step, so the commit found is the nearest to them.
+func FindCommonCommit(store CommitStore, alpha, beta []byte) ([]byte,
+	error) {
+
+	walkers := []*Walker{NewWalker(store, alpha), NewWalker(store, beta)}
+	for done := false; !done; {
+		done = true
+		for i, walker := range walkers {
+			digest, _, err := walker.Next()
+			if err != nil {
+				return nil, err
+			} else if digest == nil {
+				continue
+			}
+			done = false
+			if walkers[1-i].Visited(digest) {
+				return digest, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns true if the commit 'ancestor' is 'digest' or one of its
+// ancestors.
+func IsAncestor(store CommitStore, ancestor, digest []byte) (bool, error) {
+	walker := NewWalker(store, digest)
+	for {
+		cur, _, err := walker.Next()
+		if err != nil || cur == nil {
+			return false, err
+		} else if bytes.Equal(cur, ancestor) {
+			return true, nil
+		}
+	}
+}
+
+// Options for Log().
+type LogOptions struct {
+	// The maximum number of commits to return, zero for no limit.
+	Limit int
+
+	// If not empty, only commits that change something under one of these
+	// slash-separated paths are returned.
+	Paths []string
+}
+
+// An entry in the commit log.
+type LogEntry struct {
+	Digest []byte
+	Commit *pb.Commit
+}
+
+// Iterates over the commits in the history of a commit, see Log().
+type LogIter struct {
+	store   NodeStore
+	walker  *Walker
+	options LogOptions
+	count   int
+	elem    *LogEntry
+}
+
+// Returns an iterator over the history of the commit 'head', starting with
+// 'head' itself and walking back breadth-first.
+func Log(store NodeStore, head []byte, options LogOptions) (*LogIter,
+	error) {
+
+	iter := &LogIter{store: store, walker: NewWalker(store, head),
+		options: options,
+	}
+	return iter, iter.Next()
+}
+
+// Returns false when there are no more commits.
+func (iter *LogIter) IsValid() bool {
+	return iter.elem != nil
+}
+
+// Returns the current commit.
+func (iter *LogIter) Elem() *LogEntry {
+	return iter.elem
+}
+
+// Moves to the next commit.
+func (iter *LogIter) Next() error {
+	iter.elem = nil
+	if iter.options.Limit > 0 && iter.count >= iter.options.Limit {
+		return nil
+	}
+	for {
+		digest, commit, err := iter.walker.Next()
+		if err != nil || digest == nil {
+			return err
+		}
+		if changed, err := iter.changesPaths(commit); err != nil {
+			return err
+		} else if changed {
+			iter.elem = &LogEntry{digest, commit}
+			iter.count++
+			return nil
+		}
+	}
+}
+
+// Returns true if 'commit' changes any of the paths in the options (always
+// true if there are none).  A commit changes a path if what's at the path
+// is different from what's at the path in each of its parents, so a merge
+// commit only counts if it changes the path with respect to both parents.
+func (iter *LogIter) changesPaths(commit *pb.Commit) (bool, error) {
+	if len(iter.options.Paths) == 0 {
+		return true, nil
+	}
+	for _, path := range iter.options.Paths {
+		digest, err := lookUp(iter.store, commit.Root, path)
+		if err != nil {
+			return false, err
+		}
+		if len(commit.Parent) == 0 && digest != nil {
+			return true, nil
+		}
+		changed := len(commit.Parent) > 0
+		for _, parentDigest := range commit.Parent {
+			parent, err := iter.store.LoadCommit(parentDigest)
+			if err != nil {
+				return false, err
+			}
+			parentPathDigest, err := lookUp(iter.store, parent.Root, path)
+			if err != nil {
+				return false, err
+			}
+			if bytes.Equal(digest, parentPathDigest) {
+				changed = false
+				break
+			}
+		}
+		if changed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the digest of the node at the slash-separated 'path' in the tree
+// whose root is 'root', nil if there's nothing there.
+func lookUp(store NodeStore, root []byte, path string) ([]byte, error) {
+	digest := root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		node, err := store.LoadNode(digest)
+		if err != nil {
+			return nil, err
+		}
+		digest = nil
+		for _, child := range node.Children {
+			if child.GetName() == name {
+				digest = child.Hash
+				break
+			}
+		}
+		if digest == nil {
+			return nil, nil
+		}
+	}
+	return digest, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"reflect"
+	"testing"
+)
+
+// A store of commits and nodes named by test-provided digests.  (The store
+// package can't be used here, it depends on this one.)
+type fakeStore struct {
+	commits map[string]*pb.Commit
+	nodes   map[string]*pb.Node
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{make(map[string]*pb.Commit), make(map[string]*pb.Node)}
+}
+
+func (fs *fakeStore) LoadCommit(digest []byte) (*pb.Commit, error) {
+	if commit, ok := fs.commits[string(digest)]; ok {
+		return commit, nil
+	}
+	return nil, errors.New("no commit " + string(digest))
+}
+
+func (fs *fakeStore) LoadNode(digest []byte) (*pb.Node, error) {
+	if node, ok := fs.nodes[string(digest)]; ok {
+		return node, nil
+	}
+	return nil, errors.New("no node " + string(digest))
+}
+
+// Adds a commit named 'name' with the tree 'root' and 'parents'.
+func (fs *fakeStore) commit(name, root string, parents ...string) {
+	commit := &pb.Commit{Root: []byte(root)}
+	for _, parent := range parents {
+		commit.Parent = append(commit.Parent, []byte(parent))
+	}
+	fs.commits[name] = commit
+}
+
+// Adds a directory node named 'name' with children mapping names to the
+// names of their nodes.
+func (fs *fakeStore) dir(name string, children ...string) {
+	node := &pb.Node{}
+	for i := 0; i < len(children); i += 2 {
+		node.Children = append(node.Children, &pb.Entry{
+			Name: proto.String(children[i]),
+			Hash: []byte(children[i+1]),
+		})
+	}
+	fs.nodes[name] = node
+}
+
+// Creates the history:
+//
+//	root <- a <- b <- merged
+//	    \           /
+//	     <--- c <---
+func newHistory() *fakeStore {
+	fs := newFakeStore()
+	fs.dir("empty")
+	for _, file := range []string{"x1", "x2", "y1", "z1"} {
+		fs.nodes[file] = &pb.Node{Contents: proto.String(file)}
+	}
+	fs.dir("tree1", "x", "x1")
+	fs.dir("tree2", "x", "x1", "y", "y1")
+	fs.dir("tree3", "x", "x2", "y", "y1")
+	fs.dir("tree4", "x", "x2")
+	fs.dir("tree5", "x", "x2", "y", "y1", "z", "z1")
+	fs.commit("root", "empty")
+	fs.commit("a", "tree1", "root")
+	fs.commit("b", "tree2", "a")
+	fs.commit("c", "tree4", "root")
+	fs.commit("merged", "tree3", "b", "c")
+	fs.commit("later", "tree5", "merged")
+	return fs
+}
+
+func walk(t *testing.T, store CommitStore, digests ...[]byte) []string {
+	var result []string
+	walker := NewWalker(store, digests...)
+	for {
+		digest, commit, err := walker.Next()
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		} else if digest == nil {
+			return result
+		}
+		if commit == nil {
+			t.Fatalf("No commit for %s", digest)
+		}
+		result = append(result, string(digest))
+	}
+}
+
+func TestWalker(t *testing.T) {
+	fs := newHistory()
+	got := walk(t, fs, []byte("merged"))
+	if !reflect.DeepEqual(got, []string{"merged", "b", "c", "a", "root"}) {
+		t.Errorf("got %v", got)
+	}
+	got = walk(t, fs, []byte("b"), []byte("c"))
+	if !reflect.DeepEqual(got, []string{"b", "c", "a", "root"}) {
+		t.Errorf("got %v", got)
+	}
+
+	walker := NewWalker(fs, []byte("missing"))
+	if _, _, err := walker.Next(); err == nil {
+		t.Errorf("Walked a missing commit")
+	}
+}
+
+func TestFindCommonCommit(t *testing.T) {
+	fs := newHistory()
+	fs.commit("unrelated", "empty")
+	check := func(alpha, beta, expected string) {
+		common, err := FindCommonCommit(fs, []byte(alpha), []byte(beta))
+		if err != nil {
+			t.Fatalf("FindCommonCommit: %s", err)
+		}
+		if string(common) != expected {
+			t.Errorf("FindCommonCommit(%s, %s) = %q, expected %q", alpha,
+				beta, common, expected)
+		}
+	}
+	check("b", "c", "root")
+	check("c", "b", "root")
+	check("merged", "a", "a")
+	check("later", "c", "c")
+	check("a", "a", "a")
+	check("merged", "unrelated", "")
+}
+
+func TestIsAncestor(t *testing.T) {
+	fs := newHistory()
+	check := func(ancestor, digest string, expected bool) {
+		result, err := IsAncestor(fs, []byte(ancestor), []byte(digest))
+		if err != nil {
+			t.Fatalf("IsAncestor: %s", err)
+		}
+		if result != expected {
+			t.Errorf("IsAncestor(%s, %s) = %v", ancestor, digest, result)
+		}
+	}
+	check("root", "merged", true)
+	check("c", "merged", true)
+	check("merged", "merged", true)
+	check("merged", "c", false)
+	check("b", "c", false)
+}
+
+func log(t *testing.T, store NodeStore, options LogOptions) []string {
+	var result []string
+	iter, err := Log(store, []byte("later"), options)
+	for ; err == nil && iter.IsValid(); err = iter.Next() {
+		result = append(result, string(iter.Elem().Digest))
+	}
+	if err != nil {
+		t.Fatalf("Log: %s", err)
+	}
+	return result
+}
+
+func TestLog(t *testing.T) {
+	fs := newHistory()
+	check := func(options LogOptions, expected ...string) {
+		if got := log(t, fs, options); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Log(%v) = %v, expected %v", options, got, expected)
+		}
+	}
+	check(LogOptions{}, "later", "merged", "b", "c", "a", "root")
+	check(LogOptions{Limit: 2}, "later", "merged")
+
+	// "x" changes in "a" and "c", the merge takes c's version so it's the
+	// same as one of its parents.
+	check(LogOptions{Paths: []string{"x"}}, "c", "a")
+	check(LogOptions{Paths: []string{"/y"}}, "b")
+	check(LogOptions{Paths: []string{"z", "y"}, Limit: 1}, "later")
+	check(LogOptions{Paths: []string{"x/nothing"}})
+}
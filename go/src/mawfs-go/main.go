@@ -0,0 +1,521 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command line front end for the Go implementation of mawfs.
+
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"fusefs"
+	"history"
+	"merge"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"rpc"
+	blockstore "store"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+    %s run [-b branch] [-l addr] [-q] [-r addr] <backing> <mountpoint>
+        Mount the filesystem in <backing> on <mountpoint>.  With -l, also
+        serve it to peers on <addr> ("host:port").  With -q, corrupt
+        objects are moved to <backing>/quarantine, and with -r they are
+        also replaced with the copies from the peer at <addr>.
+    %s pull [-n name] <backing> <addr> <branch>
+        Pull <branch> from the peer at <addr> into the filesystem in
+        <backing>.  If the branches have diverged, the peer's branch is
+        stored as "<name>:<branch>", <name> defaults to the peer's host.
+    %s push [-n name] [-t full|delta|none] <backing> <addr> <branch>
+        Push <branch> of the filesystem in <backing> to the peer at <addr>.
+        The peer stores a diverged branch, or the branch it has mounted, as
+        "<name>:<branch>", <name> defaults to this host's name.  With -t
+        full or delta (the default), the peer also pulls the branch's
+        history, delta skips everything it has already traversed.
+    %s log [-b branch] [-n limit] <backing> [path...]
+        Show the history of <branch> (a branch name or a commit digest) in
+        <backing>, starting from its head.  With paths, only show the
+        commits that change them.
+    %s migrate <backing>
+        Move the objects in <backing> from the flat layout of older
+        versions to the fan-out layout.  Nothing else may be using
+        <backing> while this runs.
+    %s verify <backing>
+        Check everything reachable from the branches of the filesystem in
+        <backing> and write a report in JSON.  Exits with a nonzero status
+        if any problems are found.
+    %s gc [-n] [-g grace] <backing>
+        Remove the objects in <backing> that can't be reached from any
+        branch or pending merge.  Files modified in the last <grace> (a
+        duration like "30m", one hour by default) are kept.  With -n,
+        just list what would be removed.
+    %s rekey <backing>
+        Change the password of the filesystem in <backing>.  For a
+        filesystem created before it had a params file, the key derived
+        from the old password becomes the master key, so the old password
+        can still decrypt its contents.  Only copying everything to a new
+        filesystem revokes it.
+    %s scratch <mountpoint>
+        Mount an empty filesystem that is only stored in memory.
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	os.Exit(1)
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	os.Exit(1)
+}
+
+// Returns true if stdin is a terminal.
+func isatty() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Runs stty with the given arguments against stdin.
+func stty(args ...string) error {
+	cmd := exec.Command("/bin/stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// Shared so that reading multiple passwords doesn't lose buffered input.
+var stdin = bufio.NewReader(os.Stdin)
+
+// Reads a password from standard input.  If standard input is a terminal,
+// prompts for it with 'prompt' and turns off echo while it's being typed.
+func readPassword(prompt string) (string, error) {
+	if isatty() {
+		if err := stty("-echo"); err != nil {
+			return "", fmt.Errorf("Got an error from stty; terminal may be "+
+				"in a bad state: %s", err)
+		}
+		defer stty("echo")
+		fmt.Print(prompt)
+		defer fmt.Println()
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Mounts the filesystem and serves it until it is unmounted.
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	branch := flags.String("b", "master", "branch to mount")
+	listen := flags.String("l", "", "address to serve peers on")
+	quarantine := flags.Bool("q", false, "quarantine corrupt objects")
+	replace := flags.String("r", "",
+		"address of a peer to replace corrupt objects from")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	backing, mountpoint := flags.Arg(0), flags.Arg(1)
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(backing, 0700); err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(backing)
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, true)
+	if err != nil {
+		return err
+	}
+	store := blockstore.NewChunkStore(fsInfo, backingDir)
+	if *replace != "" {
+		proxy, err := rpc.DialSecure(*replace, fsInfo)
+		if err != nil {
+			return err
+		}
+		defer proxy.Close()
+		store.EnableQuarantine(proxy)
+	} else if *quarantine {
+		store.EnableQuarantine(nil)
+	}
+	var server *rpc.Server
+	if *listen != "" {
+		server = rpc.NewServer(fsInfo, store, store.GetRawChunkReader())
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		go server.ServeSecure(listener)
+		defer server.Close()
+	}
+	return serve(store, *branch, mountpoint, server)
+}
+
+// Mounts an empty filesystem that is only stored in memory.  Everything in
+// it is lost when it is unmounted.
+func scratch(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	store := blockstore.NewMemStore(blockstore.NewFSInfo(""))
+	return serve(store, "master", args[0], nil)
+}
+
+// Serves 'branch' of 'store' on 'mountpoint' until it is unmounted.  If
+// 'server' is not nil, it is hooked up to the filesystem so that peers can
+// commit and local clients can log in with nonces from .mawfs/otp.
+func serve(store blockstore.NodeStore, branch, mountpoint string,
+	server *rpc.Server) error {
+
+	head, err := blockstore.NewCache(store).GetHead(branch)
+	if err != nil {
+		return err
+	}
+
+	conn, err := fuse.Mount(mountpoint, fuse.FSName("mawfs"),
+		fuse.Subtype("mawfs"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unmount when we get an interrupt, this causes Serve() to return.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fuse.Unmount(mountpoint)
+	}()
+
+	filesys := fusefs.New(head)
+	if server != nil {
+		server.SetCommitter(filesys)
+		filesys.SetNonceSource(server.GetNonceManager())
+	}
+	if err := fs.Serve(conn, filesys); err != nil {
+		return err
+	}
+
+	// Don't leave anything in the journal that we don't have to.
+	return filesys.Commit(nil)
+}
+
+// Pulls a branch from a peer.
+func pull(args []string) error {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	name := flags.String("n", "", "name of the peer")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		usage()
+	}
+	backing, addr, branch := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	if *name == "" {
+		*name = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			*name = host
+		}
+	}
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(backing)
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, false)
+	if err != nil {
+		return err
+	}
+	proxy, err := rpc.DialSecure(addr, fsInfo)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	store := blockstore.NewChunkStore(fsInfo, backingDir)
+	result, err := blockstore.PullBranch(store, fsInfo, *name, proxy, branch)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pulled into branch %s\n", result)
+	return nil
+}
+
+// Maps the values of the push -t flag to traversal algorithms.
+var traversals = map[string]int{
+	"full":  rpc.TRAVERSE_FULL,
+	"delta": rpc.TRAVERSE_DELTA,
+	"none":  rpc.TRAVERSE_NONE,
+}
+
+// Pushes a branch to a peer.
+func push(args []string) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	name := flags.String("n", "", "name to give the peer for this host")
+	traverseFlag := flags.String("t", "delta", "traversal: full, delta, none")
+	flags.Parse(args)
+	traverse, ok := traversals[*traverseFlag]
+	if flags.NArg() != 3 || !ok {
+		usage()
+	}
+	backing, addr, branch := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	if *name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		*name = host
+	}
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(backing)
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, false)
+	if err != nil {
+		return err
+	}
+	proxy, err := rpc.DialSecure(addr, fsInfo)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	store := blockstore.NewChunkStore(fsInfo, backingDir)
+	proxy.ServeReader(store.GetRawChunkReader())
+	if err := proxy.PeerConnected(*name); err != nil {
+		return err
+	}
+	result, err := proxy.PushBranch(branch, traverse)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pushed to branch %s\n", result)
+	return nil
+}
+
+// Shows the commit history of a branch.
+func log(args []string) error {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	branch := flags.String("b", "master", "branch or commit to start from")
+	limit := flags.Int("n", 0, "maximum number of commits to show")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(flags.Arg(0))
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, false)
+	if err != nil {
+		return err
+	}
+	store := blockstore.NewChunkStore(fsInfo, backingDir)
+	head, _, err := blockstore.LookUpCommit(store, *branch)
+	if err != nil {
+		return err
+	}
+
+	iter, err := history.Log(store, head,
+		history.LogOptions{Limit: *limit, Paths: flags.Args()[1:]})
+	for ; err == nil && iter.IsValid(); err = iter.Next() {
+		entry := iter.Elem()
+		fmt.Printf("commit %s\n", blockstore.AltEncode(entry.Digest))
+		if len(entry.Commit.Parent) > 1 {
+			var parents []string
+			for _, parent := range entry.Commit.Parent {
+				parents = append(parents, blockstore.AltEncode(parent))
+			}
+			fmt.Printf("Merge: %s\n", strings.Join(parents, " "))
+		}
+		metadata := entry.Commit.GetMetadata()
+		if metadata.GetCommitter() != "" {
+			fmt.Printf("Committer: %s\n", metadata.GetCommitter())
+		}
+		if timestamp := entry.Commit.GetTimestamp(); timestamp != 0 {
+			fmt.Printf("Date: %s\n",
+				time.Unix(int64(timestamp), 0).Format(time.UnixDate))
+		}
+		if metadata.GetComment() != "" {
+			fmt.Printf("\n    %s\n", strings.Replace(metadata.GetComment(),
+				"\n", "\n    ", -1))
+		}
+		fmt.Println()
+	}
+	return err
+}
+
+// Converts a backing store to the fan-out object layout.
+func migrate(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	count, err := blockstore.MigrateToFanOut(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d objects\n", count)
+	return nil
+}
+
+// Verifies a filesystem and writes the report to stdout.
+func verify(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(args[0])
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, false)
+	if err != nil {
+		return err
+	}
+	branches, err := blockstore.ListBranches(backingDir)
+	if err != nil {
+		return err
+	}
+
+	report := blockstore.Verify(blockstore.NewChunkStore(fsInfo, backingDir),
+		branches)
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if !report.OK() {
+		return fmt.Errorf("Found %d problems", len(report.Problems))
+	}
+	return nil
+}
+
+// Collects the garbage in a filesystem.
+func gc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list what would be removed")
+	grace := flags.Duration("g", time.Hour, "grace period")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	backingDir := blockstore.NewBackingDir(flags.Arg(0))
+	fsInfo, err := blockstore.LoadFSInfo(backingDir, password, false)
+	if err != nil {
+		return err
+	}
+	roots, err := merge.PendingCommits(fsInfo, backingDir)
+	if err != nil {
+		return err
+	}
+
+	store := blockstore.NewChunkStore(fsInfo, backingDir)
+	result, err := store.CollectGarbage(blockstore.GCOptions{
+		DryRun:      *dryRun,
+		GracePeriod: *grace,
+		Roots:       roots,
+	})
+	if result != nil {
+		action, summary := "Removed", "removed"
+		if *dryRun {
+			action, summary = "Would remove", "to remove"
+		}
+		for _, name := range result.Removed {
+			fmt.Printf("%s %s\n", action, name)
+		}
+		fmt.Printf("%d reachable objects, %d files %s, %d kept in the "+
+			"grace period\n", result.Reachable, len(result.Removed), summary,
+			result.Kept)
+	}
+	return err
+}
+
+// Changes the password of a filesystem.
+func rekey(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	oldPassword, err := readPassword("old password: ")
+	if err != nil {
+		return err
+	}
+	newPassword, err := readPassword("new password: ")
+	if err != nil {
+		return err
+	}
+	migrated, err := blockstore.Rekey(blockstore.NewBackingDir(args[0]),
+		oldPassword, newPassword)
+	if migrated && err == nil {
+		fmt.Println("Warning: the filesystem's key was derived from the " +
+			"old password and is now its master key.  The old password " +
+			"can still decrypt its contents until they're copied to a new " +
+			"filesystem.")
+	}
+	return err
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = run(os.Args[2:])
+	case "pull":
+		err = pull(os.Args[2:])
+	case "push":
+		err = push(os.Args[2:])
+	case "log":
+		err = log(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "gc":
+		err = gc(os.Args[2:])
+	case "rekey":
+		err = rekey(os.Args[2:])
+	case "scratch":
+		err = scratch(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fatalf("%s", err)
+	}
+}
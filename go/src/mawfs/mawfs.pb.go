@@ -5,13 +5,41 @@
 Package mawfs is a generated protocol buffer package.
 
 It is generated from these files:
+
 	mawfs/mawfs.proto
 
 It has these top-level messages:
+
 	Entry
 	Node
+	CommitMetadata
 	Commit
 	Change
+	PublicParams
+	KDFParams
+	PrivateParams
+	RPCMessage
+	GetObjectRequest
+	GetObjectResponse
+	GetHeadRequest
+	GetHeadResponse
+	GetFileRequest
+	GetFileResponse
+	GetJournalBlockRequest
+	GetJournalBlockResponse
+	PullBranchRequest
+	PullBranchResponse
+	MergeRequest
+	MergeResponse
+	AddPeerRequest
+	InfoResponse
+	TraverseRequest
+	PeerConnectedRequest
+	GetCommitRequest
+	CommitAndDigest
+	CommitRequest
+	LoginRequest
+	LoginResponse
 */
 package mawfs
 
@@ -92,7 +120,9 @@ type Node struct {
 	Children []*Entry `protobuf:"bytes,3,rep,name=children" json:"children,omitempty"`
 	// See the MODE_* constants above.  'mode' should be present for all
 	// top-level file nodes and directory nodes.
-	Mode             *int32 `protobuf:"varint,5,opt,name=mode" json:"mode,omitempty"`
+	Mode *int32 `protobuf:"varint,5,opt,name=mode" json:"mode,omitempty"`
+	// Last modification time in seconds since the epoch.
+	Time             *int32 `protobuf:"varint,6,opt,name=time" json:"time,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -136,6 +166,43 @@ func (m *Node) GetMode() int32 {
 	return 0
 }
 
+func (m *Node) GetTime() int32 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+// User-provided metadata that is associated with a commit.
+type CommitMetadata struct {
+	// A user-provided commit comment.
+	Comment *string `protobuf:"bytes,1,opt,name=comment" json:"comment,omitempty"`
+	// A user-provided identifier of the committer of the change.  Should
+	// generally consist of a standard e-mail address, e.g.
+	// "John Doe" <jdoe@example.com>
+	Committer        *string `protobuf:"bytes,2,opt,name=committer" json:"committer,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *CommitMetadata) Reset()                    { *m = CommitMetadata{} }
+func (m *CommitMetadata) String() string            { return proto.CompactTextString(m) }
+func (*CommitMetadata) ProtoMessage()               {}
+func (*CommitMetadata) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *CommitMetadata) GetComment() string {
+	if m != nil && m.Comment != nil {
+		return *m.Comment
+	}
+	return ""
+}
+
+func (m *CommitMetadata) GetCommitter() string {
+	if m != nil && m.Committer != nil {
+		return *m.Committer
+	}
+	return ""
+}
+
 // A commit.  These objects track the history of an entire filesystem.
 type Commit struct {
 	// The digest of the "parent" commits.  There should generally be one
@@ -145,14 +212,26 @@ type Commit struct {
 	// one parent.
 	Parent [][]byte `protobuf:"bytes,1,rep,name=parent" json:"parent,omitempty"`
 	// The digest of the root of the filesystem at the point of the commit.
-	Root             []byte `protobuf:"bytes,2,opt,name=root" json:"root,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	Root []byte `protobuf:"bytes,2,opt,name=root" json:"root,omitempty"`
+	// The digest of a node containing the set of journal ids for the
+	// journal that preceded this commit.
+	JournalInfo []byte `protobuf:"bytes,3,opt,name=journalInfo" json:"journalInfo,omitempty"`
+	// The digest of a node containing the complete journal for this
+	// commit.  The implementation must not rely either on this field
+	// being present or the referenced journal being accessible.
+	Journal []byte `protobuf:"bytes,4,opt,name=journal" json:"journal,omitempty"`
+	// Commit time, in seconds since the epoch.
+	Timestamp *int32 `protobuf:"varint,5,opt,name=timestamp" json:"timestamp,omitempty"`
+	// User-provided commit metadata.  This is only present if the user
+	// provided it from a commit RPC.
+	Metadata         *CommitMetadata `protobuf:"bytes,6,opt,name=metadata" json:"metadata,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
 }
 
 func (m *Commit) Reset()                    { *m = Commit{} }
 func (m *Commit) String() string            { return proto.CompactTextString(m) }
 func (*Commit) ProtoMessage()               {}
-func (*Commit) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (*Commit) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 func (m *Commit) GetParent() [][]byte {
 	if m != nil {
@@ -168,6 +247,34 @@ func (m *Commit) GetRoot() []byte {
 	return nil
 }
 
+func (m *Commit) GetJournalInfo() []byte {
+	if m != nil {
+		return m.JournalInfo
+	}
+	return nil
+}
+
+func (m *Commit) GetJournal() []byte {
+	if m != nil {
+		return m.Journal
+	}
+	return nil
+}
+
+func (m *Commit) GetTimestamp() int32 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *Commit) GetMetadata() *CommitMetadata {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 // Change is like a lightweight Commit for purposes of storing changes in
 // the filesystem journal.
 type Change struct {
@@ -176,6 +283,10 @@ type Change struct {
 	// List of child indexes representing a path to the node to be
 	// modified.
 	Path []int32 `protobuf:"varint,10,rep,name=path" json:"path,omitempty"`
+	// Specified for CHANGE_REPLACE_CHILD to indicate the index of the
+	// child to replace (would be the last element of 'path', but it's
+	// just easier to work with as a separate attribute).
+	Index *int32 `protobuf:"varint,13,opt,name=index" json:"index,omitempty"`
 	// Child name.
 	Name *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
 	// Node to be added.
@@ -196,14 +307,23 @@ type Change struct {
 	// The commit that this change should be applied to.  Only the first
 	// change after a commit should have this field, all others should
 	// have 'lastChange' instead.
-	Commit           []byte `protobuf:"bytes,9,opt,name=commit" json:"commit,omitempty"`
+	Commit []byte `protobuf:"bytes,9,opt,name=commit" json:"commit,omitempty"`
+	// A random nonce value that is applied to a sequence of changes
+	// emitted by a peer during a single session, during which the
+	// journal may only be modified by the peer.
+	SessionId []byte `protobuf:"bytes,11,opt,name=sessionId" json:"sessionId,omitempty"`
+	// The node digest (this may be specified instead of "node" for cases
+	// where a committed node is being added).
+	Digest []byte `protobuf:"bytes,12,opt,name=digest" json:"digest,omitempty"`
+	// The last modification time of the node.
+	Time             *int32 `protobuf:"varint,14,opt,name=time" json:"time,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *Change) Reset()                    { *m = Change{} }
 func (m *Change) String() string            { return proto.CompactTextString(m) }
 func (*Change) ProtoMessage()               {}
-func (*Change) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*Change) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 func (m *Change) GetType() int32 {
 	if m != nil && m.Type != nil {
@@ -219,6 +339,13 @@ func (m *Change) GetPath() []int32 {
 	return nil
 }
 
+func (m *Change) GetIndex() int32 {
+	if m != nil && m.Index != nil {
+		return *m.Index
+	}
+	return 0
+}
+
 func (m *Change) GetName() string {
 	if m != nil && m.Name != nil {
 		return *m.Name
@@ -275,33 +402,882 @@ func (m *Change) GetCommit() []byte {
 	return nil
 }
 
+func (m *Change) GetSessionId() []byte {
+	if m != nil {
+		return m.SessionId
+	}
+	return nil
+}
+
+func (m *Change) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+func (m *Change) GetTime() int32 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+// These parameters are stored in plaintext at the head of the "params"
+// file, the only thing that we currently want here is the cipher.
+type PublicParams struct {
+	// The cipher is public so that we can distinguish between unknown
+	// cipher and incorrect password.  See the CIPHER_* constants in the
+	// blockstore package.
+	Cipher *int32 `protobuf:"varint,1,opt,name=cipher" json:"cipher,omitempty"`
+	// Parameters of the function used to derive the key from the password.
+	// If absent, the key is the SHA256 hash of the password.
+	Kdf              *KDFParams `protobuf:"bytes,2,opt,name=kdf" json:"kdf,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *PublicParams) Reset()                    { *m = PublicParams{} }
+func (m *PublicParams) String() string            { return proto.CompactTextString(m) }
+func (*PublicParams) ProtoMessage()               {}
+func (*PublicParams) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *PublicParams) GetCipher() int32 {
+	if m != nil && m.Cipher != nil {
+		return *m.Cipher
+	}
+	return 0
+}
+
+func (m *PublicParams) GetKdf() *KDFParams {
+	if m != nil {
+		return m.Kdf
+	}
+	return nil
+}
+
+// Key derivation function parameters.
+type KDFParams struct {
+	// The key derivation function, see the KDF_* constants in the
+	// blockstore package.
+	Type *int32 `protobuf:"varint,1,opt,name=type" json:"type,omitempty"`
+	// Random salt.
+	Salt []byte `protobuf:"bytes,2,opt,name=salt" json:"salt,omitempty"`
+	// scrypt cost parameters.  The CPU/memory cost is 2^logN.
+	LogN             *int32 `protobuf:"varint,3,opt,name=logN" json:"logN,omitempty"`
+	R                *int32 `protobuf:"varint,4,opt,name=r" json:"r,omitempty"`
+	P                *int32 `protobuf:"varint,5,opt,name=p" json:"p,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *KDFParams) Reset()                    { *m = KDFParams{} }
+func (m *KDFParams) String() string            { return proto.CompactTextString(m) }
+func (*KDFParams) ProtoMessage()               {}
+func (*KDFParams) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *KDFParams) GetType() int32 {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return 0
+}
+
+func (m *KDFParams) GetSalt() []byte {
+	if m != nil {
+		return m.Salt
+	}
+	return nil
+}
+
+func (m *KDFParams) GetLogN() int32 {
+	if m != nil && m.LogN != nil {
+		return *m.LogN
+	}
+	return 0
+}
+
+func (m *KDFParams) GetR() int32 {
+	if m != nil && m.R != nil {
+		return *m.R
+	}
+	return 0
+}
+
+func (m *KDFParams) GetP() int32 {
+	if m != nil && m.P != nil {
+		return *m.P
+	}
+	return 0
+}
+
+// Parameters stored in the encrypted part of the "params" file.
+type PrivateParams struct {
+	Version *int32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+	// The key used to encrypt all other objects.  This is encrypted with
+	// the key derived from the password so that the password can be
+	// changed without reencrypting everything.  If absent, the key
+	// derived from the password is used directly.
+	MasterKey        []byte `protobuf:"bytes,2,opt,name=masterKey" json:"masterKey,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *PrivateParams) Reset()                    { *m = PrivateParams{} }
+func (m *PrivateParams) String() string            { return proto.CompactTextString(m) }
+func (*PrivateParams) ProtoMessage()               {}
+func (*PrivateParams) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *PrivateParams) GetVersion() int32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *PrivateParams) GetMasterKey() []byte {
+	if m != nil {
+		return m.MasterKey
+	}
+	return nil
+}
+
+// The envelope for all RPC requests and responses.  On the wire, each
+// message is preceded by its size encoded as a varint.
+type RPCMessage struct {
+	// Message id, used to match responses to requests.  Requests with no id
+	// are asynchronous: they get no response.
+	Id *int32 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	// Method name.  This is absent for responses.
+	Method *string `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
+	// The serialized request message.
+	Request []byte `protobuf:"bytes,3,opt,name=request" json:"request,omitempty"`
+	// The serialized response message.
+	Response []byte `protobuf:"bytes,4,opt,name=response" json:"response,omitempty"`
+	// An error message, present if the request failed.
+	Error            *string `protobuf:"bytes,5,opt,name=error" json:"error,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *RPCMessage) Reset()                    { *m = RPCMessage{} }
+func (m *RPCMessage) String() string            { return proto.CompactTextString(m) }
+func (*RPCMessage) ProtoMessage()               {}
+func (*RPCMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *RPCMessage) GetId() int32 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *RPCMessage) GetMethod() string {
+	if m != nil && m.Method != nil {
+		return *m.Method
+	}
+	return ""
+}
+
+func (m *RPCMessage) GetRequest() []byte {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+func (m *RPCMessage) GetResponse() []byte {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+func (m *RPCMessage) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
+type GetObjectRequest struct {
+	Digest           []byte `protobuf:"bytes,1,opt,name=digest" json:"digest,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetObjectRequest) Reset()                    { *m = GetObjectRequest{} }
+func (m *GetObjectRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetObjectRequest) ProtoMessage()               {}
+func (*GetObjectRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *GetObjectRequest) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+type GetObjectResponse struct {
+	// The encrypted object, absent if the server doesn't have it.
+	Data             []byte `protobuf:"bytes,1,opt,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetObjectResponse) Reset()                    { *m = GetObjectResponse{} }
+func (m *GetObjectResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetObjectResponse) ProtoMessage()               {}
+func (*GetObjectResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *GetObjectResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type GetHeadRequest struct {
+	Branch           *string `protobuf:"bytes,1,opt,name=branch" json:"branch,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *GetHeadRequest) Reset()                    { *m = GetHeadRequest{} }
+func (m *GetHeadRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetHeadRequest) ProtoMessage()               {}
+func (*GetHeadRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *GetHeadRequest) GetBranch() string {
+	if m != nil && m.Branch != nil {
+		return *m.Branch
+	}
+	return ""
+}
+
+type GetHeadResponse struct {
+	// Absent if the branch doesn't exist.
+	Digest           []byte `protobuf:"bytes,1,opt,name=digest" json:"digest,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetHeadResponse) Reset()                    { *m = GetHeadResponse{} }
+func (m *GetHeadResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetHeadResponse) ProtoMessage()               {}
+func (*GetHeadResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *GetHeadResponse) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+type GetFileRequest struct {
+	Filename         *string `protobuf:"bytes,1,opt,name=filename" json:"filename,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *GetFileRequest) Reset()                    { *m = GetFileRequest{} }
+func (m *GetFileRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetFileRequest) ProtoMessage()               {}
+func (*GetFileRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *GetFileRequest) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+type GetFileResponse struct {
+	Data             []byte `protobuf:"bytes,1,opt,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetFileResponse) Reset()                    { *m = GetFileResponse{} }
+func (m *GetFileResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetFileResponse) ProtoMessage()               {}
+func (*GetFileResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *GetFileResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type GetJournalBlockRequest struct {
+	FirstBlockDigest []byte  `protobuf:"bytes,1,opt,name=firstBlockDigest" json:"firstBlockDigest,omitempty"`
+	Branch           *string `protobuf:"bytes,2,opt,name=branch" json:"branch,omitempty"`
+	Pos              *int32  `protobuf:"varint,3,opt,name=pos" json:"pos,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *GetJournalBlockRequest) Reset()                    { *m = GetJournalBlockRequest{} }
+func (m *GetJournalBlockRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetJournalBlockRequest) ProtoMessage()               {}
+func (*GetJournalBlockRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
+func (m *GetJournalBlockRequest) GetFirstBlockDigest() []byte {
+	if m != nil {
+		return m.FirstBlockDigest
+	}
+	return nil
+}
+
+func (m *GetJournalBlockRequest) GetBranch() string {
+	if m != nil && m.Branch != nil {
+		return *m.Branch
+	}
+	return ""
+}
+
+func (m *GetJournalBlockRequest) GetPos() int32 {
+	if m != nil && m.Pos != nil {
+		return *m.Pos
+	}
+	return 0
+}
+
+type GetJournalBlockResponse struct {
+	FirstBlockDigest []byte `protobuf:"bytes,1,opt,name=firstBlockDigest" json:"firstBlockDigest,omitempty"`
+	Contents         []byte `protobuf:"bytes,2,opt,name=contents" json:"contents,omitempty"`
+	Done             *bool  `protobuf:"varint,3,opt,name=done" json:"done,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetJournalBlockResponse) Reset()                    { *m = GetJournalBlockResponse{} }
+func (m *GetJournalBlockResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetJournalBlockResponse) ProtoMessage()               {}
+func (*GetJournalBlockResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
+
+func (m *GetJournalBlockResponse) GetFirstBlockDigest() []byte {
+	if m != nil {
+		return m.FirstBlockDigest
+	}
+	return nil
+}
+
+func (m *GetJournalBlockResponse) GetContents() []byte {
+	if m != nil {
+		return m.Contents
+	}
+	return nil
+}
+
+func (m *GetJournalBlockResponse) GetDone() bool {
+	if m != nil && m.Done != nil {
+		return *m.Done
+	}
+	return false
+}
+
+type PullBranchRequest struct {
+	Branch *string `protobuf:"bytes,1,opt,name=branch" json:"branch,omitempty"`
+	// The peer to pull from, absent to pull from any peer.
+	Peer *string `protobuf:"bytes,2,opt,name=peer" json:"peer,omitempty"`
+	// If true, pull from the peer that sent the request.
+	FromClient *bool `protobuf:"varint,3,opt,name=fromClient" json:"fromClient,omitempty"`
+	// For pushBranch, one of the TRAVERSE_* constants plus one, so that
+	// absent means TRAVERSE_NONE.
+	Traverse         *int32 `protobuf:"varint,4,opt,name=traverse" json:"traverse,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *PullBranchRequest) Reset()                    { *m = PullBranchRequest{} }
+func (m *PullBranchRequest) String() string            { return proto.CompactTextString(m) }
+func (*PullBranchRequest) ProtoMessage()               {}
+func (*PullBranchRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{17} }
+
+func (m *PullBranchRequest) GetBranch() string {
+	if m != nil && m.Branch != nil {
+		return *m.Branch
+	}
+	return ""
+}
+
+func (m *PullBranchRequest) GetPeer() string {
+	if m != nil && m.Peer != nil {
+		return *m.Peer
+	}
+	return ""
+}
+
+func (m *PullBranchRequest) GetFromClient() bool {
+	if m != nil && m.FromClient != nil {
+		return *m.FromClient
+	}
+	return false
+}
+
+func (m *PullBranchRequest) GetTraverse() int32 {
+	if m != nil && m.Traverse != nil {
+		return *m.Traverse
+	}
+	return 0
+}
+
+type PullBranchResponse struct {
+	// The name of the branch in the local repository.
+	LocalName        *string `protobuf:"bytes,1,opt,name=localName" json:"localName,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *PullBranchResponse) Reset()                    { *m = PullBranchResponse{} }
+func (m *PullBranchResponse) String() string            { return proto.CompactTextString(m) }
+func (*PullBranchResponse) ProtoMessage()               {}
+func (*PullBranchResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+
+func (m *PullBranchResponse) GetLocalName() string {
+	if m != nil && m.LocalName != nil {
+		return *m.LocalName
+	}
+	return ""
+}
+
+type MergeRequest struct {
+	Branch           *string `protobuf:"bytes,1,opt,name=branch" json:"branch,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *MergeRequest) Reset()                    { *m = MergeRequest{} }
+func (m *MergeRequest) String() string            { return proto.CompactTextString(m) }
+func (*MergeRequest) ProtoMessage()               {}
+func (*MergeRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{19} }
+
+func (m *MergeRequest) GetBranch() string {
+	if m != nil && m.Branch != nil {
+		return *m.Branch
+	}
+	return ""
+}
+
+type MergeResponse struct {
+	// The name of the branch the merge is being performed on, absent if the
+	// merge completed without conflicts.
+	MergeBranch *string `protobuf:"bytes,1,opt,name=mergeBranch" json:"mergeBranch,omitempty"`
+	// The alt-encoded digest of the merge commit.
+	Commit *string `protobuf:"bytes,2,opt,name=commit" json:"commit,omitempty"`
+	// Paths of conflicting files.
+	Conflict         []string `protobuf:"bytes,3,rep,name=conflict" json:"conflict,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *MergeResponse) Reset()                    { *m = MergeResponse{} }
+func (m *MergeResponse) String() string            { return proto.CompactTextString(m) }
+func (*MergeResponse) ProtoMessage()               {}
+func (*MergeResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{20} }
+
+func (m *MergeResponse) GetMergeBranch() string {
+	if m != nil && m.MergeBranch != nil {
+		return *m.MergeBranch
+	}
+	return ""
+}
+
+func (m *MergeResponse) GetCommit() string {
+	if m != nil && m.Commit != nil {
+		return *m.Commit
+	}
+	return ""
+}
+
+func (m *MergeResponse) GetConflict() []string {
+	if m != nil {
+		return m.Conflict
+	}
+	return nil
+}
+
+type AddPeerRequest struct {
+	PeerName         *string `protobuf:"bytes,1,opt,name=peerName" json:"peerName,omitempty"`
+	PeerAddr         *string `protobuf:"bytes,2,opt,name=peerAddr" json:"peerAddr,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *AddPeerRequest) Reset()                    { *m = AddPeerRequest{} }
+func (m *AddPeerRequest) String() string            { return proto.CompactTextString(m) }
+func (*AddPeerRequest) ProtoMessage()               {}
+func (*AddPeerRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{21} }
+
+func (m *AddPeerRequest) GetPeerName() string {
+	if m != nil && m.PeerName != nil {
+		return *m.PeerName
+	}
+	return ""
+}
+
+func (m *AddPeerRequest) GetPeerAddr() string {
+	if m != nil && m.PeerAddr != nil {
+		return *m.PeerAddr
+	}
+	return ""
+}
+
+type InfoResponse struct {
+	Mountpoint       *string `protobuf:"bytes,1,opt,name=mountpoint" json:"mountpoint,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *InfoResponse) Reset()                    { *m = InfoResponse{} }
+func (m *InfoResponse) String() string            { return proto.CompactTextString(m) }
+func (*InfoResponse) ProtoMessage()               {}
+func (*InfoResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{22} }
+
+func (m *InfoResponse) GetMountpoint() string {
+	if m != nil && m.Mountpoint != nil {
+		return *m.Mountpoint
+	}
+	return ""
+}
+
+func (m *InfoResponse) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+type TraverseRequest struct {
+	Branch           *string `protobuf:"bytes,1,opt,name=branch" json:"branch,omitempty"`
+	Algo             *int32  `protobuf:"varint,2,opt,name=algo" json:"algo,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TraverseRequest) Reset()                    { *m = TraverseRequest{} }
+func (m *TraverseRequest) String() string            { return proto.CompactTextString(m) }
+func (*TraverseRequest) ProtoMessage()               {}
+func (*TraverseRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{23} }
+
+func (m *TraverseRequest) GetBranch() string {
+	if m != nil && m.Branch != nil {
+		return *m.Branch
+	}
+	return ""
+}
+
+func (m *TraverseRequest) GetAlgo() int32 {
+	if m != nil && m.Algo != nil {
+		return *m.Algo
+	}
+	return 0
+}
+
+type PeerConnectedRequest struct {
+	PeerName         *string `protobuf:"bytes,1,opt,name=peerName" json:"peerName,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *PeerConnectedRequest) Reset()                    { *m = PeerConnectedRequest{} }
+func (m *PeerConnectedRequest) String() string            { return proto.CompactTextString(m) }
+func (*PeerConnectedRequest) ProtoMessage()               {}
+func (*PeerConnectedRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{24} }
+
+func (m *PeerConnectedRequest) GetPeerName() string {
+	if m != nil && m.PeerName != nil {
+		return *m.PeerName
+	}
+	return ""
+}
+
+type GetCommitRequest struct {
+	// Either an alt-encoded commit digest or a branch name.
+	CommitOrTag      *string `protobuf:"bytes,1,opt,name=commitOrTag" json:"commitOrTag,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *GetCommitRequest) Reset()                    { *m = GetCommitRequest{} }
+func (m *GetCommitRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetCommitRequest) ProtoMessage()               {}
+func (*GetCommitRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{25} }
+
+func (m *GetCommitRequest) GetCommitOrTag() string {
+	if m != nil && m.CommitOrTag != nil {
+		return *m.CommitOrTag
+	}
+	return ""
+}
+
+type CommitAndDigest struct {
+	Commit           *Commit `protobuf:"bytes,1,opt,name=commit" json:"commit,omitempty"`
+	Digest           []byte  `protobuf:"bytes,2,opt,name=digest" json:"digest,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *CommitAndDigest) Reset()                    { *m = CommitAndDigest{} }
+func (m *CommitAndDigest) String() string            { return proto.CompactTextString(m) }
+func (*CommitAndDigest) ProtoMessage()               {}
+func (*CommitAndDigest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{26} }
+
+func (m *CommitAndDigest) GetCommit() *Commit {
+	if m != nil {
+		return m.Commit
+	}
+	return nil
+}
+
+func (m *CommitAndDigest) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+type CommitRequest struct {
+	Metadata         *CommitMetadata `protobuf:"bytes,1,opt,name=metadata" json:"metadata,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
+}
+
+func (m *CommitRequest) Reset()                    { *m = CommitRequest{} }
+func (m *CommitRequest) String() string            { return proto.CompactTextString(m) }
+func (*CommitRequest) ProtoMessage()               {}
+func (*CommitRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{27} }
+
+func (m *CommitRequest) GetMetadata() *CommitMetadata {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+// Login request.  There are two kinds of login: peers exchange challenges
+// encrypted with the repository cipher and prove that they can decrypt
+// them, local clients send a nonce obtained from the .mawfs/otp file.
+type LoginRequest struct {
+	// A random challenge encrypted with the repository cipher.  Sent in the
+	// first phase of a peer login.
+	Challenge []byte `protobuf:"bytes,1,opt,name=challenge" json:"challenge,omitempty"`
+	// The response to the challenge in the LoginResponse, the SHA256 hash of
+	// the decrypted challenge encrypted with the repository cipher.  Sent in
+	// the second phase of a peer login.
+	Response []byte `protobuf:"bytes,2,opt,name=response" json:"response,omitempty"`
+	// A nonce from the .mawfs/otp file, for local client login.
+	Nonce            []byte `protobuf:"bytes,3,opt,name=nonce" json:"nonce,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *LoginRequest) Reset()                    { *m = LoginRequest{} }
+func (m *LoginRequest) String() string            { return proto.CompactTextString(m) }
+func (*LoginRequest) ProtoMessage()               {}
+func (*LoginRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{28} }
+
+func (m *LoginRequest) GetChallenge() []byte {
+	if m != nil {
+		return m.Challenge
+	}
+	return nil
+}
+
+func (m *LoginRequest) GetResponse() []byte {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+func (m *LoginRequest) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+type LoginResponse struct {
+	// The response to the challenge in the LoginRequest.
+	Response []byte `protobuf:"bytes,1,opt,name=response" json:"response,omitempty"`
+	// The server's challenge to the client.
+	Challenge []byte `protobuf:"bytes,2,opt,name=challenge" json:"challenge,omitempty"`
+	// Present if the login failed.
+	Error            *string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *LoginResponse) Reset()                    { *m = LoginResponse{} }
+func (m *LoginResponse) String() string            { return proto.CompactTextString(m) }
+func (*LoginResponse) ProtoMessage()               {}
+func (*LoginResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{29} }
+
+func (m *LoginResponse) GetResponse() []byte {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+func (m *LoginResponse) GetChallenge() []byte {
+	if m != nil {
+		return m.Challenge
+	}
+	return nil
+}
+
+func (m *LoginResponse) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
+// The state of a merge with conflicts that haven't been resolved yet.  This
+// is persisted in the "ALT" file in the backing store.
+type MergeState struct {
+	// The name of the branch that we're merging into.
+	TargetBranch *string `protobuf:"bytes,1,opt,name=targetBranch" json:"targetBranch,omitempty"`
+	// The name of the merge branch ("merge:<digest>") holding the merged tree.
+	MergeBranch *string `protobuf:"bytes,2,opt,name=mergeBranch" json:"mergeBranch,omitempty"`
+	// The name of the alternate branch, the one that we're merging.
+	AltBranch *string `protobuf:"bytes,3,opt,name=altBranch" json:"altBranch,omitempty"`
+	// The digest of the baseline commit of the target branch when the merge
+	// started.
+	TargetCommit []byte `protobuf:"bytes,4,opt,name=targetCommit" json:"targetCommit,omitempty"`
+	// The digest of the baseline commit of the alternate branch.
+	AltCommit []byte `protobuf:"bytes,5,opt,name=altCommit" json:"altCommit,omitempty"`
+	// The session ids of the journal of the alternate branch, which the
+	// merge commit includes.
+	AltSessionIds    [][]byte `protobuf:"bytes,6,rep,name=altSessionIds" json:"altSessionIds,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *MergeState) Reset()                    { *m = MergeState{} }
+func (m *MergeState) String() string            { return proto.CompactTextString(m) }
+func (*MergeState) ProtoMessage()               {}
+func (*MergeState) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{30} }
+
+func (m *MergeState) GetTargetBranch() string {
+	if m != nil && m.TargetBranch != nil {
+		return *m.TargetBranch
+	}
+	return ""
+}
+
+func (m *MergeState) GetMergeBranch() string {
+	if m != nil && m.MergeBranch != nil {
+		return *m.MergeBranch
+	}
+	return ""
+}
+
+func (m *MergeState) GetAltBranch() string {
+	if m != nil && m.AltBranch != nil {
+		return *m.AltBranch
+	}
+	return ""
+}
+
+func (m *MergeState) GetTargetCommit() []byte {
+	if m != nil {
+		return m.TargetCommit
+	}
+	return nil
+}
+
+func (m *MergeState) GetAltCommit() []byte {
+	if m != nil {
+		return m.AltCommit
+	}
+	return nil
+}
+
+func (m *MergeState) GetAltSessionIds() [][]byte {
+	if m != nil {
+		return m.AltSessionIds
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Entry)(nil), "Entry")
 	proto.RegisterType((*Node)(nil), "Node")
+	proto.RegisterType((*CommitMetadata)(nil), "CommitMetadata")
 	proto.RegisterType((*Commit)(nil), "Commit")
 	proto.RegisterType((*Change)(nil), "Change")
+	proto.RegisterType((*PublicParams)(nil), "PublicParams")
+	proto.RegisterType((*KDFParams)(nil), "KDFParams")
+	proto.RegisterType((*PrivateParams)(nil), "PrivateParams")
+	proto.RegisterType((*RPCMessage)(nil), "RPCMessage")
+	proto.RegisterType((*GetObjectRequest)(nil), "GetObjectRequest")
+	proto.RegisterType((*GetObjectResponse)(nil), "GetObjectResponse")
+	proto.RegisterType((*GetHeadRequest)(nil), "GetHeadRequest")
+	proto.RegisterType((*GetHeadResponse)(nil), "GetHeadResponse")
+	proto.RegisterType((*GetFileRequest)(nil), "GetFileRequest")
+	proto.RegisterType((*GetFileResponse)(nil), "GetFileResponse")
+	proto.RegisterType((*GetJournalBlockRequest)(nil), "GetJournalBlockRequest")
+	proto.RegisterType((*GetJournalBlockResponse)(nil), "GetJournalBlockResponse")
+	proto.RegisterType((*PullBranchRequest)(nil), "PullBranchRequest")
+	proto.RegisterType((*PullBranchResponse)(nil), "PullBranchResponse")
+	proto.RegisterType((*MergeRequest)(nil), "MergeRequest")
+	proto.RegisterType((*MergeResponse)(nil), "MergeResponse")
+	proto.RegisterType((*AddPeerRequest)(nil), "AddPeerRequest")
+	proto.RegisterType((*InfoResponse)(nil), "InfoResponse")
+	proto.RegisterType((*TraverseRequest)(nil), "TraverseRequest")
+	proto.RegisterType((*PeerConnectedRequest)(nil), "PeerConnectedRequest")
+	proto.RegisterType((*GetCommitRequest)(nil), "GetCommitRequest")
+	proto.RegisterType((*CommitAndDigest)(nil), "CommitAndDigest")
+	proto.RegisterType((*CommitRequest)(nil), "CommitRequest")
+	proto.RegisterType((*LoginRequest)(nil), "LoginRequest")
+	proto.RegisterType((*LoginResponse)(nil), "LoginResponse")
+	proto.RegisterType((*MergeState)(nil), "MergeState")
 }
 
 func init() { proto.RegisterFile("mawfs/mawfs.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 281 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x5c, 0x8f, 0x4d, 0x4e, 0xc3, 0x30,
-	0x10, 0x85, 0x95, 0xe6, 0xa7, 0xed, 0x24, 0xe2, 0xc7, 0xb0, 0xf0, 0x12, 0x65, 0x81, 0xba, 0x0a,
-	0x52, 0xaf, 0x80, 0x10, 0x3b, 0x36, 0x1c, 0x00, 0xac, 0x64, 0x68, 0x22, 0x6a, 0x3b, 0x8a, 0x07,
-	0x55, 0xe5, 0x42, 0x5c, 0x93, 0x19, 0x07, 0x55, 0xa2, 0x1b, 0x4b, 0xcf, 0xf3, 0xcd, 0x9b, 0xf7,
-	0xe0, 0xda, 0x9a, 0xc3, 0x47, 0x78, 0x88, 0x6f, 0x33, 0x4e, 0x9e, 0x7c, 0xfd, 0x0c, 0xf9, 0x93,
-	0xa3, 0xe9, 0xa8, 0x2a, 0xc8, 0x7a, 0x13, 0x7a, 0x9d, 0xdc, 0x25, 0x9b, 0x4a, 0x94, 0x33, 0x16,
-	0xf5, 0x82, 0xd5, 0x5a, 0xdd, 0x42, 0xe5, 0xa7, 0xdd, 0x5b, 0xdb, 0x63, 0xfb, 0x19, 0xbe, 0xac,
-	0x4e, 0xf9, 0x37, 0x17, 0x26, 0x0c, 0xdf, 0xa8, 0x33, 0x56, 0x59, 0xfd, 0x0e, 0xd9, 0x8b, 0xef,
-	0x50, 0x5d, 0xc1, 0xea, 0xc4, 0x25, 0x91, 0x93, 0x1f, 0xef, 0x08, 0x1d, 0x85, 0x3f, 0xbf, 0x7f,
-	0x9b, 0x4a, 0xcb, 0xc6, 0xb0, 0xef, 0x26, 0x74, 0xec, 0x9c, 0x6e, 0xca, 0x6d, 0xd1, 0x9c, 0x32,
-	0x59, 0xf6, 0xd4, 0xb9, 0xf8, 0xd4, 0xf7, 0x50, 0x3c, 0x7a, 0x6b, 0x07, 0x52, 0x17, 0x50, 0x8c,
-	0x86, 0x71, 0xe2, 0x0b, 0xe9, 0x9c, 0x76, 0xf2, 0x9e, 0xa2, 0x7b, 0x55, 0xff, 0x24, 0x0c, 0xf6,
-	0xc6, 0xed, 0x50, 0x06, 0x74, 0x1c, 0x91, 0xb1, 0xc5, 0x1c, 0x78, 0x34, 0xd4, 0x6b, 0xe0, 0xa5,
-	0xfc, 0xac, 0xe2, 0x0d, 0x2b, 0x39, 0x25, 0xd5, 0xca, 0x6d, 0xde, 0xc4, 0x2e, 0x7c, 0xc7, 0x61,
-	0x20, 0xec, 0x62, 0xd2, 0x4a, 0x95, 0x90, 0x8e, 0x3e, 0xc4, 0x38, 0x99, 0xec, 0x77, 0x86, 0x8c,
-	0x2e, 0xe2, 0xe8, 0x12, 0x96, 0x0e, 0x0f, 0xaf, 0xd2, 0x6a, 0x19, 0xc7, 0x0a, 0x60, 0x6f, 0x02,
-	0xcd, 0x41, 0xf4, 0x2a, 0x42, 0xec, 0xd7, 0xc6, 0x06, 0x7a, 0x2d, 0xfa, 0x37, 0x00, 0x00, 0xff,
-	0xff, 0x85, 0x71, 0xe4, 0xf2, 0x90, 0x01, 0x00, 0x00,
+	// 988 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x55, 0xcb, 0x6e, 0x23, 0x45,
+	0x14, 0x55, 0xfb, 0x15, 0xf7, 0x75, 0xdb, 0x8e, 0x3b, 0x03, 0xe9, 0x15, 0x38, 0xb5, 0x19, 0xaf,
+	0x3c, 0x28, 0x20, 0x21, 0xb1, 0x4b, 0x3c, 0x24, 0x0c, 0x21, 0x89, 0x35, 0x19, 0x09, 0x89, 0x0d,
+	0xaa, 0x74, 0x5f, 0xdb, 0x3d, 0xa9, 0xae, 0x32, 0x55, 0xe5, 0x19, 0xc2, 0x92, 0x25, 0x3f, 0xca,
+	0x6f, 0xa0, 0x7a, 0xd9, 0xed, 0xcc, 0x84, 0x4d, 0x94, 0x2e, 0x9f, 0x3a, 0xf7, 0xdc, 0xd7, 0x29,
+	0x18, 0x55, 0xf4, 0xe3, 0x42, 0xbd, 0xb2, 0x7f, 0xa7, 0x6b, 0x29, 0xb4, 0x20, 0x97, 0xd0, 0xfe,
+	0x91, 0x6b, 0xf9, 0x98, 0x26, 0xd0, 0x5a, 0x51, 0xb5, 0xca, 0xa2, 0x71, 0x34, 0x49, 0xcc, 0x17,
+	0xa7, 0x15, 0x66, 0x8d, 0x71, 0x34, 0x89, 0xd3, 0x17, 0x90, 0x08, 0xb9, 0xfc, 0x3d, 0x5f, 0x61,
+	0xfe, 0xa0, 0x36, 0x55, 0xd6, 0x1c, 0x47, 0x93, 0xb6, 0xc1, 0xa8, 0xf2, 0x2f, 0xcc, 0x5a, 0xe3,
+	0x68, 0xd2, 0x22, 0x1c, 0x5a, 0x37, 0xa2, 0xc0, 0xf4, 0x10, 0xba, 0x5b, 0x5c, 0x64, 0x71, 0xe6,
+	0x44, 0x70, 0x8d, 0x5c, 0x2b, 0xcf, 0xb7, 0x77, 0x33, 0xcd, 0xcc, 0x8d, 0x92, 0x15, 0x12, 0x79,
+	0xd6, 0x1c, 0x37, 0x27, 0xbd, 0xd3, 0xce, 0x74, 0xab, 0xa9, 0x12, 0x05, 0x66, 0xed, 0x10, 0x4f,
+	0x97, 0x15, 0x66, 0x1d, 0xf3, 0x45, 0xbe, 0x83, 0xc1, 0x4c, 0x54, 0x55, 0xa9, 0xaf, 0x51, 0xd3,
+	0x82, 0x6a, 0x9a, 0x0e, 0xe1, 0x20, 0x17, 0x55, 0x85, 0x5c, 0xdb, 0xc0, 0x71, 0x3a, 0x82, 0x38,
+	0xb7, 0x10, 0x8d, 0xd2, 0x45, 0x26, 0x7f, 0x47, 0xd0, 0x71, 0xd7, 0xd2, 0x01, 0x74, 0xd6, 0x54,
+	0x3a, 0x74, 0xd3, 0xa5, 0x2c, 0x85, 0xd0, 0x16, 0x98, 0xa4, 0x47, 0xd0, 0x7b, 0x2f, 0x36, 0x92,
+	0x53, 0xf6, 0x86, 0x2f, 0x84, 0xcd, 0x38, 0x31, 0x11, 0xfc, 0xa1, 0x95, 0x9e, 0x98, 0x08, 0x46,
+	0x92, 0xd2, 0xb4, 0x5a, 0x7b, 0x95, 0x27, 0xd0, 0xad, 0xbc, 0x22, 0xab, 0xb4, 0x77, 0x3a, 0x9c,
+	0xee, 0x0b, 0x25, 0xff, 0x1a, 0x11, 0x2b, 0xca, 0x97, 0x68, 0x73, 0x7a, 0x5c, 0x63, 0x16, 0x8d,
+	0x1b, 0x2e, 0xc3, 0x35, 0xd5, 0xab, 0x0c, 0xc6, 0xcd, 0x49, 0x3b, 0xed, 0x43, 0xbb, 0xe4, 0x05,
+	0xfe, 0x99, 0xf5, 0x43, 0xfa, 0xb5, 0x96, 0x1c, 0x41, 0x8b, 0x9b, 0xd2, 0x34, 0x6d, 0x88, 0xf6,
+	0xd4, 0xd6, 0x7e, 0x00, 0x1d, 0x8e, 0x4a, 0x63, 0xe1, 0xe5, 0xf5, 0xa0, 0xb9, 0x16, 0xca, 0x0a,
+	0x6b, 0x99, 0xfb, 0x5b, 0x51, 0x36, 0x15, 0x8e, 0x1f, 0xef, 0x4c, 0x17, 0x0e, 0xec, 0xcf, 0x29,
+	0x00, 0xa3, 0x4a, 0x3b, 0x5d, 0x59, 0xd7, 0x82, 0x06, 0xd0, 0x71, 0x05, 0xcc, 0xe2, 0x90, 0xae,
+	0x42, 0xa5, 0x4a, 0xc1, 0xdf, 0x14, 0x59, 0x2f, 0x40, 0x8a, 0x72, 0x89, 0x4a, 0x67, 0x49, 0x18,
+	0x1c, 0xdb, 0xa4, 0x81, 0x6d, 0xd2, 0xf7, 0x90, 0xcc, 0x37, 0xf7, 0xac, 0xcc, 0xe7, 0x54, 0xd2,
+	0x4a, 0x59, 0xc2, 0x72, 0xbd, 0x42, 0xe9, 0x47, 0xe3, 0x18, 0x9a, 0x0f, 0xc5, 0xc2, 0xa6, 0xd4,
+	0x3b, 0x85, 0xe9, 0xd5, 0xeb, 0x0b, 0x07, 0x24, 0x57, 0x10, 0x6f, 0x3f, 0x6a, 0x45, 0x0a, 0x63,
+	0x47, 0x59, 0xe8, 0x53, 0x02, 0x2d, 0x26, 0x96, 0x37, 0x7e, 0x24, 0x63, 0x88, 0x64, 0xd6, 0x0a,
+	0xff, 0xfa, 0x96, 0x90, 0x6f, 0xa1, 0x3f, 0x97, 0xe5, 0x07, 0xaa, 0xd1, 0x13, 0x0e, 0xe1, 0xe0,
+	0x03, 0x4a, 0x93, 0x87, 0xe7, 0x1c, 0x41, 0x5c, 0x51, 0xa5, 0x51, 0x5e, 0xe1, 0xa3, 0x23, 0x26,
+	0xbf, 0x01, 0xbc, 0x9d, 0xcf, 0xae, 0x51, 0x29, 0xba, 0xc4, 0x14, 0xa0, 0x51, 0x16, 0x1e, 0x3c,
+	0x80, 0x4e, 0x85, 0x7a, 0x25, 0x0a, 0xdf, 0x8a, 0x21, 0x1c, 0x48, 0xfc, 0x63, 0x63, 0x6a, 0xe0,
+	0xc6, 0xe4, 0x10, 0xba, 0x12, 0xd5, 0x5a, 0x70, 0x85, 0xbe, 0x11, 0x7d, 0x68, 0xa3, 0x94, 0x42,
+	0x5a, 0x41, 0x31, 0x21, 0x70, 0x78, 0x89, 0xfa, 0xf6, 0xfe, 0x3d, 0xe6, 0xfa, 0xad, 0xbb, 0x5a,
+	0x2b, 0xa4, 0xdd, 0x40, 0x72, 0x02, 0xa3, 0x1a, 0xc6, 0xb1, 0x6d, 0x7b, 0xe8, 0x20, 0x63, 0x18,
+	0x5c, 0xa2, 0xfe, 0x09, 0x69, 0x51, 0x23, 0xb9, 0x97, 0x94, 0xe7, 0x6e, 0x8d, 0x63, 0x72, 0x02,
+	0xc3, 0x2d, 0xc2, 0x53, 0x3c, 0x8d, 0x43, 0x2c, 0xc9, 0x45, 0xc9, 0x30, 0x90, 0x1c, 0x42, 0x77,
+	0x51, 0x32, 0xb4, 0xc3, 0xe6, 0x68, 0xbe, 0x86, 0xe1, 0x16, 0xf3, 0x59, 0x25, 0xb7, 0xf0, 0xe5,
+	0x25, 0xea, 0x9f, 0xdd, 0x6e, 0x9c, 0x33, 0x91, 0x3f, 0x04, 0xb2, 0x0c, 0x0e, 0x17, 0xa5, 0x54,
+	0xda, 0x1e, 0xbe, 0xae, 0x05, 0xae, 0x69, 0x75, 0x65, 0xf4, 0xc3, 0x6a, 0x1b, 0x49, 0xee, 0xe0,
+	0xf8, 0x13, 0x42, 0x1f, 0xf9, 0x79, 0xc6, 0xa7, 0x46, 0x63, 0xa7, 0xa3, 0x10, 0xdc, 0x6d, 0x49,
+	0x97, 0xfc, 0x0a, 0xa3, 0xf9, 0x86, 0xb1, 0x73, 0x1b, 0xf5, 0x99, 0x92, 0xd9, 0x1d, 0xc4, 0xe0,
+	0x17, 0x66, 0x2b, 0x16, 0x52, 0x54, 0x33, 0x56, 0x1a, 0xa3, 0xb0, 0x34, 0x26, 0x8c, 0x96, 0xd4,
+	0x0c, 0x90, 0x6b, 0x6f, 0x9b, 0xbc, 0x84, 0xb4, 0x4e, 0xec, 0x85, 0x8e, 0x20, 0x66, 0x22, 0xa7,
+	0xec, 0x66, 0x57, 0xc8, 0xaf, 0x20, 0xb9, 0x46, 0xb9, 0xc4, 0xe7, 0xfa, 0x75, 0x01, 0x7d, 0xff,
+	0xbb, 0xe7, 0x38, 0x82, 0x5e, 0x65, 0x0e, 0xce, 0xeb, 0x12, 0x77, 0x6b, 0xe9, 0x44, 0xba, 0xbc,
+	0x17, 0xac, 0xcc, 0xb5, 0x35, 0xd0, 0xd8, 0x98, 0xe3, 0x59, 0x51, 0xcc, 0x11, 0x65, 0xad, 0xa9,
+	0x26, 0xad, 0x9d, 0x96, 0x70, 0x72, 0x56, 0x14, 0xc1, 0x1c, 0xbf, 0x81, 0xc4, 0x98, 0xdd, 0x36,
+	0x78, 0x0a, 0x50, 0x89, 0x0d, 0xd7, 0x6b, 0x51, 0x6e, 0x3d, 0x75, 0xcf, 0x85, 0xc8, 0x2b, 0x18,
+	0xbe, 0xf3, 0xa5, 0xf8, 0x9f, 0x7a, 0x52, 0xb6, 0x14, 0xf6, 0x42, 0x9b, 0x4c, 0xe0, 0x85, 0x51,
+	0x35, 0x13, 0x9c, 0x63, 0xae, 0xb1, 0x78, 0x56, 0x1e, 0x79, 0x69, 0x77, 0xc4, 0x39, 0x67, 0x40,
+	0x1d, 0x41, 0xcf, 0x25, 0x7e, 0x2b, 0xdf, 0xd1, 0xa5, 0x07, 0xfe, 0x00, 0x43, 0x87, 0x3a, 0xe3,
+	0x85, 0x1b, 0x87, 0xf4, 0x78, 0x5b, 0xa0, 0xc8, 0x3a, 0xcb, 0xc1, 0x74, 0xe7, 0xf9, 0x7e, 0xf8,
+	0xdd, 0x92, 0x9f, 0x42, 0x7f, 0x3f, 0x42, 0xdd, 0xbd, 0xa3, 0xcf, 0xbb, 0xf7, 0x39, 0x24, 0xbf,
+	0x88, 0x65, 0xc9, 0xc3, 0x15, 0xf3, 0xca, 0xac, 0x28, 0x63, 0x68, 0x7c, 0x33, 0xfa, 0xc4, 0x00,
+	0x1a, 0xc1, 0x00, 0xb8, 0xe0, 0xb9, 0x9b, 0xc4, 0x84, 0xcc, 0xa0, 0xef, 0x39, 0x7c, 0xa9, 0xeb,
+	0x37, 0xa2, 0xe0, 0xb5, 0x3b, 0xda, 0xc6, 0xbe, 0x8b, 0x34, 0x6d, 0xe2, 0xff, 0x44, 0x00, 0x76,
+	0x5a, 0xee, 0x34, 0xd5, 0x68, 0x1e, 0x69, 0x4d, 0xe5, 0x12, 0xf5, 0xde, 0xac, 0x3c, 0x19, 0xa0,
+	0x46, 0x78, 0x18, 0x29, 0x0b, 0xb8, 0x66, 0x78, 0xe2, 0xdd, 0x6d, 0x97, 0xed, 0xee, 0x7d, 0xa3,
+	0x2c, 0x1c, 0xb5, 0xed, 0xd1, 0x17, 0xd0, 0xa7, 0x4c, 0xdf, 0x85, 0x67, 0x40, 0x65, 0x1d, 0xf3,
+	0x7a, 0xfe, 0x37, 0x00, 0xca, 0x15, 0xde, 0x67, 0x5b, 0x08, 0x00, 0x00,
 }
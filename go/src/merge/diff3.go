@@ -0,0 +1,301 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A line-based three-way merge of file contents, which does what
+// "diff3 -m" does for the mfs merge command without needing diffutils.
+
+package merge
+
+import (
+	"bytes"
+)
+
+// The labels shown on the conflict markers for each version of a file.
+type Labels struct {
+	Target, Org, Other string
+}
+
+// Splits 'data' into lines, each of which keeps its newline (the last line
+// may not have one).
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		lines = append(lines, string(data[:end]))
+		data = data[end:]
+	}
+	return lines
+}
+
+// Returns a longest common subsequence of 'a' and 'b' as a mapping from the
+// indexes of the lines in 'a' to the indexes of their matches in 'b', -1 for
+// lines that aren't matched.
+//
+// This is the linear space version of Myers' O(ND) algorithm: the middle of
+// an optimal path is found by searching forwards from the start and
+// backwards from the end at the same time, then the parts before and after
+// it are matched the same way.  Common prefixes and suffixes are matched
+// directly.  Only two vectors of O(N+M) are kept for each search, so the
+// memory doesn't depend on D.
+func matchLines(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+	matchRange(a, b, 0, 0, matches)
+	return matches
+}
+
+// Matches the lines of 'a' and 'b', which start at line 'offA' and 'offB'
+// of the inputs to matchLines(), recording them in 'matches'.
+func matchRange(a, b []string, offA, offB int, matches []int) {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		matches[offA] = offB
+		a, b = a[1:], b[1:]
+		offA++
+		offB++
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+		matches[offA+len(a)] = offB + len(b)
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+	x, y := middle(a, b)
+	matchRange(a[:x], b[:y], offA, offB, matches)
+	matchRange(a[x:], b[y:], offA+x, offB+y, matches)
+}
+
+// Returns a point (x, y) on an optimal path through the edit graph of 'a'
+// and 'b' that splits it into two smaller problems.  'a' and 'b' must be
+// non-empty and differ in their first and last lines.
+func middle(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+
+	// forward[offset+k] is the furthest x reached on diagonal k (x - y)
+	// from the start, backward[offset+k] is the furthest distance reached
+	// from the end on diagonal k of the reversed inputs.
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	// If the difference in lengths is odd, the paths meet on a forward
+	// step, otherwise on a backward one.
+	delta := n - m
+	front := delta%2 != 0
+
+	// Diagonals that have gone off the edge of the graph are skipped.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			if x > n {
+				fEnd += 2
+			} else if y > m {
+				fStart += 2
+			} else if front {
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 &&
+					x >= n-backward[j] {
+					return x, y
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			if x > n {
+				bEnd += 2
+			} else if y > m {
+				bStart += 2
+			} else if !front {
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 &&
+					forward[j] >= n-x {
+					return forward[j], forward[j] - (delta - k)
+				}
+			}
+		}
+	}
+
+	// Nothing in common.
+	return n, 0
+}
+
+// Returns true if the line slices are the same.
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Collects the merged output.
+type mergeWriter struct {
+	bytes.Buffer
+}
+
+func (w *mergeWriter) writeLines(lines []string) {
+	for _, line := range lines {
+		w.WriteString(line)
+	}
+}
+
+// Writes a conflict marker, making sure it starts on a line of its own.
+func (w *mergeWriter) writeMarker(marker, label string) {
+	if w.Len() > 0 && w.Bytes()[w.Len()-1] != '\n' {
+		w.WriteByte('\n')
+	}
+	w.WriteString(marker)
+	if label != "" {
+		w.WriteString(" " + label)
+	}
+	w.WriteByte('\n')
+}
+
+// Writes a chunk that was changed in both versions.
+func (w *mergeWriter) writeConflict(target, org, other []string,
+	labels Labels) {
+
+	w.writeMarker("<<<<<<<", labels.Target)
+	w.writeLines(target)
+	w.writeMarker("|||||||", labels.Org)
+	w.writeLines(org)
+	w.writeMarker("=======", "")
+	w.writeLines(other)
+	w.writeMarker(">>>>>>>", labels.Other)
+}
+
+// Merges the changes from 'org' to 'other' into 'target', line by line.
+// Returns the merged contents and true if there were conflicts, chunks that
+// were changed differently in 'target' and 'other'.  Conflicts are written
+// in the same form as "diff3 -m":
+//
+//	<<<<<<< labels.Target
+//	lines from target
+//	||||||| labels.Org
+//	lines from org
+//	=======
+//	lines from other
+//	>>>>>>> labels.Other
+func Diff3(target, org, other []byte, labels Labels) ([]byte, bool) {
+	targetLines := splitLines(target)
+	orgLines := splitLines(org)
+	otherLines := splitLines(other)
+	targetMatches := matchLines(orgLines, targetLines)
+	otherMatches := matchLines(orgLines, otherLines)
+
+	out := &mergeWriter{}
+	conflict := false
+	o, t, h := 0, 0, 0
+	for {
+		// Copy the lines that are unchanged in both versions.
+		for o < len(orgLines) && targetMatches[o] == t &&
+			otherMatches[o] == h {
+			out.WriteString(orgLines[o])
+			o++
+			t++
+			h++
+		}
+
+		// Find the next line that is unchanged in both, everything up to it
+		// is a changed chunk.
+		next := o
+		for next < len(orgLines) &&
+			(targetMatches[next] == -1 || otherMatches[next] == -1) {
+			next++
+		}
+		nextT, nextH := len(targetLines), len(otherLines)
+		if next < len(orgLines) {
+			nextT, nextH = targetMatches[next], otherMatches[next]
+		}
+		if next == o && nextT == t && nextH == h {
+			break
+		}
+
+		orgChunk := orgLines[o:next]
+		targetChunk := targetLines[t:nextT]
+		otherChunk := otherLines[h:nextH]
+		switch {
+		case sameLines(targetChunk, orgChunk):
+			out.writeLines(otherChunk)
+		case sameLines(otherChunk, orgChunk),
+			sameLines(targetChunk, otherChunk):
+			out.writeLines(targetChunk)
+		default:
+			out.writeConflict(targetChunk, orgChunk, otherChunk, labels)
+			conflict = true
+		}
+		o, t, h = next, nextT, nextH
+	}
+	return out.Bytes(), conflict
+}
+
+// The most lines a file can have for Diff3() to merge it.  Diffs take
+// O((N+M)D) time, so larger files are treated like binary ones.
+const maxDiff3Lines = 20000
+
+// Returns true if 'data' has too many lines for Diff3() to merge.
+func HasTooManyLines(data []byte) bool {
+	return bytes.Count(data, []byte("\n")) >= maxDiff3Lines
+}
+
+// Returns true if 'data' looks like binary data (it contains a null byte
+// in the first 8K, as diff and git check), which can't be merged by line.
+func IsBinary(data []byte) bool {
+	if len(data) > 8192 {
+		data = data[:8192]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
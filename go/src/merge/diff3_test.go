@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	blockstore "store"
+	"strings"
+	"testing"
+)
+
+// Joins 'lines' with newlines, adding one at the end.
+func text(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func diff3(target, org, other string) (string, bool) {
+	result, conflict := Diff3([]byte(target), []byte(org), []byte(other),
+		Labels{"target", "org", "other"})
+	return string(result), conflict
+}
+
+func checkMerge(t *testing.T, target, org, other, expected string) {
+	result, conflict := diff3(target, org, other)
+	blockstore.Assertf(t, !conflict && result == expected,
+		"merging %q %q %q: got %q (conflict %v), expected %q", target, org,
+		other, result, conflict, expected)
+}
+
+func TestDiff3(t *testing.T) {
+	org := text("a", "b", "c", "d", "e")
+	checkMerge(t, org, org, org, org)
+	checkMerge(t, text("a", "B", "c", "d", "e"), org,
+		text("a", "b", "c", "D", "e"), text("a", "B", "c", "D", "e"))
+	checkMerge(t, text("x", "a", "b", "c", "d", "e"), org,
+		text("a", "b", "c", "d", "e", "y"),
+		text("x", "a", "b", "c", "d", "e", "y"))
+	checkMerge(t, text("a", "d", "e"), org, text("a", "b", "c", "d", "E"),
+		text("a", "d", "E"))
+
+	// The same change on both sides isn't a conflict.
+	checkMerge(t, text("a", "B", "c"), org, text("a", "B", "c"),
+		text("a", "B", "c"))
+
+	// Nor is a change to one side of an empty file.
+	checkMerge(t, "", "", "new\n", "new\n")
+	checkMerge(t, "new\n", "", "", "new\n")
+}
+
+func TestDiff3Conflict(t *testing.T) {
+	org := text("a", "b", "c")
+	result, conflict := diff3(text("a", "T", "c", "d"), org,
+		text("a", "O", "c"))
+	blockstore.Assert(t, conflict)
+	expected := text("a", "<<<<<<< target", "T", "||||||| org", "b",
+		"=======", "O", ">>>>>>> other", "c", "d")
+	blockstore.Assertf(t, result == expected, "got %q", result)
+
+	// Files added on both sides conflict in their entirety, and missing
+	// newlines are added before markers.
+	result, conflict = diff3("target", "", "other")
+	blockstore.Assert(t, conflict)
+	expected = text("<<<<<<< target", "target", "||||||| org", "=======",
+		"other", ">>>>>>> other")
+	blockstore.Assertf(t, result == expected, "got %q", result)
+}
+
+func TestMatchLines(t *testing.T) {
+	a := splitLines([]byte(text("a", "b", "c", "a", "b", "b", "a")))
+	b := splitLines([]byte(text("c", "b", "a", "b", "a", "c")))
+	matches := matchLines(a, b)
+
+	// The LCS has 4 lines, and the matches must be increasing.
+	count, last := 0, -1
+	for i, match := range matches {
+		if match == -1 {
+			continue
+		}
+		blockstore.Assert(t, match > last && a[i] == b[match])
+		last = match
+		count++
+	}
+	blockstore.Assertf(t, count == 4, "got matches %v", matches)
+}
+
+// Returns the length of the longest common subsequence of 'a' and 'b'.
+func lcsLength(a, b []string) int {
+	lengths := make([]int, len(b)+1)
+	for i := range a {
+		diag := 0
+		for j := range b {
+			next := lengths[j+1]
+			if a[i] == b[j] {
+				lengths[j+1] = diag + 1
+			} else if lengths[j] > lengths[j+1] {
+				lengths[j+1] = lengths[j]
+			}
+			diag = next
+		}
+	}
+	return lengths[len(b)]
+}
+
+func TestMatchLinesRandom(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(20))
+		for i := range lines {
+			lines[i] = string('a' + rune(random.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 1000; i++ {
+		a, b := randomLines(), randomLines()
+		count, last := 0, -1
+		for i, match := range matchLines(a, b) {
+			if match == -1 {
+				continue
+			}
+			blockstore.Assert(t, match > last && a[i] == b[match])
+			last = match
+			count++
+		}
+		blockstore.Assertf(t, count == lcsLength(a, b),
+			"matched %d lines of %q and %q", count, a, b)
+	}
+}
+
+func TestMatchLinesLarge(t *testing.T) {
+	// Two completely rewritten files, with a line in common in the middle.
+	var a, b []string
+	for i := 0; i < 8000; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	a[4000], b[3000] = "same\n", "same\n"
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	matches := matchLines(a, b)
+	runtime.ReadMemStats(&after)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	blockstore.Assertf(t, allocated < 16<<20, "allocated %d bytes",
+		allocated)
+	for i, match := range matches {
+		blockstore.Assertf(t, match == -1 || (i == 4000 && match == 3000),
+			"line %d matches %d", i, match)
+	}
+	blockstore.Assert(t, matches[4000] == 3000)
+}
+
+func TestHasTooManyLines(t *testing.T) {
+	blockstore.Assert(t, !HasTooManyLines([]byte(text("a", "b"))))
+	blockstore.Assert(t, HasTooManyLines(bytes.Repeat([]byte("x\n"),
+		maxDiff3Lines)))
+}
+
+func TestIsBinary(t *testing.T) {
+	blockstore.Assert(t, !IsBinary([]byte("text\n")))
+	blockstore.Assert(t, IsBinary([]byte("bin\x00ary")))
+	blockstore.Assert(t, !IsBinary(nil))
+}
@@ -0,0 +1,524 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Three-way merging of branches, the Go equivalent of merge.crk.
+
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	blockstore "store"
+	"time"
+)
+
+// The outcome of merging a node.
+type Outcome interface {
+	// Applies the outcome to the node's parent.  'name' is the name the node
+	// is known by in the parent and 'parentConflicts' collects the
+	// conflicts in the parent.
+	apply(parent *blockstore.CachedNode, name string,
+		parentConflicts *Conflict) error
+}
+
+// Indicates a conflict.  A Conflict with no names means that the node
+// itself conflicts, otherwise it holds the names of the conflicting children
+// (a directory that conflicts only because some of its descendants do).
+type Conflict struct {
+	// Maps the names of conflicting children to the conflicts in their own
+	// children, nil if the child itself conflicts.
+	names map[string]*Conflict
+}
+
+// Adds the child 'name' as a conflict.
+func (c *Conflict) add(name string, child *Conflict) {
+	if c.names == nil {
+		c.names = make(map[string]*Conflict)
+	}
+	c.names[name] = child
+}
+
+func (c *Conflict) apply(parent *blockstore.CachedNode, name string,
+	parentConflicts *Conflict) error {
+
+	if len(c.names) > 0 {
+		parentConflicts.add(name, c)
+	} else {
+		parentConflicts.add(name, nil)
+	}
+	return nil
+}
+
+// Returns the slash-separated paths of all of the conflicting files and
+// directories relative to the node that the conflict is for, in sorted
+// order.
+func (c *Conflict) Paths() []string {
+	var names []string
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []string
+	for _, name := range names {
+		if child := c.names[name]; child != nil {
+			for _, path := range child.Paths() {
+				result = append(result, name+"/"+path)
+			}
+		} else {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// A mutation is when we can simply replace the node with a new one.
+type Mutation struct {
+	// The new node, nil if the node is to be deleted.
+	Replacement *blockstore.CachedNode
+}
+
+func (m *Mutation) apply(parent *blockstore.CachedNode, name string,
+	parentConflicts *Conflict) error {
+
+	now := int32(time.Now().Unix())
+	if m.Replacement == nil {
+		_, err := parent.DeleteChild(name, now)
+		return err
+	}
+	return parent.AddCopy(name, m.Replacement, now)
+}
+
+type unchanged struct{}
+
+func (unchanged) apply(parent *blockstore.CachedNode, name string,
+	parentConflicts *Conflict) error {
+
+	return nil
+}
+
+// Returned when the node doesn't need to change.
+var Unchanged Outcome = unchanged{}
+
+// Returns true if 'a' and 'b' are both nil or have the same contents.
+func equal(a, b *blockstore.CachedNode) (bool, error) {
+	if a == nil || b == nil {
+		return a == nil && b == nil, nil
+	}
+	return a.Equal(b)
+}
+
+// Returns the child 'name' of 'node', nil if 'node' is nil.
+func getChild(node *blockstore.CachedNode, name string) (
+	*blockstore.CachedNode, error) {
+
+	if node == nil {
+		return nil, nil
+	}
+	return node.GetChildByName(name)
+}
+
+// Returns the names of the children of 'node'.
+func childNames(node *blockstore.CachedNode) []string {
+	names := make([]string, node.GetChildCount())
+	for i := range names {
+		names[i], _ = node.GetChildName(i)
+	}
+	return names
+}
+
+// Merges trees.  If 'labels' is non-nil, files that were changed in both
+// trees are merged by line with Diff3(), otherwise they conflict.
+type treeMerger struct {
+	labels *Labels
+}
+
+// Does a three-way merge of 'other' into 'target'.  'org' is the node that
+// both were derived from.  Any of them may be nil if the node doesn't exist
+// in the corresponding tree.
+//
+// Changes in 'other' that don't conflict with those in 'target' are applied
+// to 'target' as we go, except for those to 'target' itself, which are
+// returned as a Mutation for the caller to apply to the parent.  Files that
+// were changed in both are conflicts, Merge() merges their contents.
+func Merge3(target, org, other *blockstore.CachedNode) (Outcome, error) {
+	return (&treeMerger{}).merge3("", target, org, other)
+}
+
+// Implements Merge3().  'path' is the path of the node relative to the root
+// of the merge, empty for the root itself.
+func (tm *treeMerger) merge3(path string,
+	target, org, other *blockstore.CachedNode) (Outcome, error) {
+
+	// If they're the same, we're done.
+	if same, err := equal(target, other); err != nil || same {
+		return Unchanged, err
+	}
+
+	// If the target is the same as the origin, we can accept the change in
+	// 'other'.
+	if same, err := equal(target, org); err != nil {
+		return nil, err
+	} else if same {
+		return &Mutation{other}, nil
+	}
+
+	// If 'other' is the same as the origin, we keep target's change.
+	if same, err := equal(other, org); err != nil || same {
+		return Unchanged, err
+	}
+
+	// From here on, the node has forked in two different directions from
+	// the origin.  Only directories can be merged.
+	if target == nil || !target.IsDir() || other == nil || !other.IsDir() {
+		return &Conflict{}, nil
+	}
+
+	// Merge all of the children in target.  Get the names first, applying
+	// outcomes can add and remove children.
+	conflicts := &Conflict{}
+	targetNames := make(map[string]bool)
+	for _, name := range childNames(target) {
+		targetNames[name] = true
+		child, err := target.GetChildByName(name)
+		if err != nil {
+			return nil, err
+		}
+		orgChild, err := getChild(org, name)
+		if err != nil {
+			return nil, err
+		}
+		otherChild, err := other.GetChildByName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// If the child was added in target, there's nothing to merge.
+		if orgChild == nil && otherChild == nil {
+			continue
+		}
+
+		if err := tm.mergeChild(target, path, name, child, orgChild,
+			otherChild, conflicts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Now merge the children in other that aren't in target.
+	for _, name := range childNames(other) {
+		if targetNames[name] {
+			continue
+		}
+		orgChild, err := getChild(org, name)
+		if err != nil {
+			return nil, err
+		}
+		otherChild, err := other.GetChildByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := tm.mergeChild(target, path, name, nil, orgChild,
+			otherChild, conflicts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any changes have already been applied to target, so unless there are
+	// conflicts nothing needs to be done to its ancestors.
+	if len(conflicts.names) > 0 {
+		return conflicts, nil
+	}
+	return Unchanged, nil
+}
+
+// Returns true if 'node' is a file.
+func isFile(node *blockstore.CachedNode) bool {
+	return node != nil && !node.IsDir()
+}
+
+// Merges the child 'name' of 'parent' (whose path is 'parentPath') and
+// applies the outcome.
+func (tm *treeMerger) mergeChild(parent *blockstore.CachedNode,
+	parentPath, name string, target, org, other *blockstore.CachedNode,
+	conflicts *Conflict) error {
+
+	path := name
+	if parentPath != "" {
+		path = parentPath + "/" + name
+	}
+	outcome, err := tm.merge3(path, target, org, other)
+	if err != nil {
+		return err
+	}
+
+	// Files that conflict get their contents merged.
+	if conflict, ok := outcome.(*Conflict); ok && tm.labels != nil &&
+		len(conflict.names) == 0 && isFile(target) && isFile(other) {
+		if !isFile(org) {
+			org = nil
+		}
+		if outcome, err = tm.mergeFile(parent, path, name, target, org,
+			other); err != nil {
+			return err
+		}
+	}
+	return outcome.apply(parent, name, conflicts)
+}
+
+// The suffix of the name that the other version of a binary file is kept
+// under when it can't be merged.
+const otherSuffix = ".merge-other"
+
+// Returns true if 'data' can be merged by Diff3().
+func canDiff3(data []byte) bool {
+	return !IsBinary(data) && !HasTooManyLines(data)
+}
+
+// Merges the contents of 'other' into the file 'target', the child 'name'
+// of 'parent'.  'org' is nil if the file didn't exist in the origin.
+//
+// Text files are merged with Diff3(), and the result, which may contain
+// conflict markers, replaces the contents of 'target'.  Binary files (and
+// text files with too many lines) can't be merged, so 'target' is left as it
+// is and a copy of 'other' is added next to it as name + ".merge-other".
+// Returns a Conflict unless the contents merged cleanly.
+func (tm *treeMerger) mergeFile(parent *blockstore.CachedNode, path,
+	name string, target, org, other *blockstore.CachedNode) (Outcome,
+	error) {
+
+	targetData, err := target.GetContents()
+	if err != nil {
+		return nil, err
+	}
+	otherData, err := other.GetContents()
+	if err != nil {
+		return nil, err
+	}
+	var orgData []byte
+	if org != nil {
+		if orgData, err = org.GetContents(); err != nil {
+			return nil, err
+		}
+	}
+
+	now := int32(time.Now().Unix())
+	if !canDiff3(targetData) || !canDiff3(orgData) || !canDiff3(otherData) {
+		otherName := name + otherSuffix
+		for i := 1; ; i++ {
+			if existing, err := parent.GetChildByName(otherName); err != nil {
+				return nil, err
+			} else if existing == nil {
+				break
+			}
+			otherName = fmt.Sprintf("%s%s.%d", name, otherSuffix, i)
+		}
+		return &Conflict{}, parent.AddCopy(otherName, other, now)
+	}
+
+	labels := Labels{tm.labels.Target + ":" + path,
+		tm.labels.Org + ":" + path,
+		tm.labels.Other + ":" + path,
+	}
+	merged, conflict := Diff3(targetData, orgData, otherData, labels)
+	if err := target.Write(0, merged, now); err != nil {
+		return nil, err
+	}
+	if err := target.Resize(uint64(len(merged)), now); err != nil {
+		return nil, err
+	}
+	if conflict {
+		return &Conflict{}, nil
+	}
+	return Unchanged, nil
+}
+
+// Replaces the children of 'root' with copies of the children of
+// 'replacement'.  This applies a Mutation to a root node, which has no
+// parent to apply it to.
+func replaceChildren(root, replacement *blockstore.CachedNode) error {
+	now := int32(time.Now().Unix())
+	for _, name := range childNames(root) {
+		child, err := replacement.GetChildByName(name)
+		if err != nil {
+			return err
+		}
+		if child == nil {
+			if _, err := root.DeleteChild(name, now); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range childNames(replacement) {
+		child, err := replacement.GetChildByName(name)
+		if err != nil {
+			return err
+		}
+		if err := root.AddCopy(name, child, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The result of merging one branch into another with Merge().
+type Merger struct {
+	// The branch that we're merging into.
+	TargetBranch string
+
+	// Set if the merge has conflicts, nil if the merge was committed.  The
+	// conflicts of a merge restored by LoadMerge() aren't known, it's empty.
+	Conflict *Conflict
+
+	// The name of the merge branch ("merge:<digest>") that holds the merged
+	// tree while there are conflicts to resolve, empty if there were none.
+	Branch string
+
+	// The digest of the merge commit, nil if there were conflicts.
+	Commit []byte
+
+	// The branch that we're merging, the "alternate" branch.
+	AltBranch string
+
+	target, org, other        *blockstore.Head
+	targetCommit, otherCommit []byte
+
+	// The session ids of the journal of the alternate branch, for a merge
+	// restored by LoadMerge() (otherwise they're taken from 'other').
+	otherSessionIds [][]byte
+
+	// Where the merge state is persisted, nil if it hasn't been saved.
+	fsInfo  *blockstore.FSInfo
+	backing blockstore.FileSys
+}
+
+// Returns the name of the merge branch for merging 'other' into 'target'.
+// The name is derived from the states of both branches (the exclusive or of
+// their branch digests), so it's unique to the merge.
+func mergeBranchName(target, other *blockstore.Head) string {
+	targetDigest := target.GetBranchDigest()
+	otherDigest := other.GetBranchDigest()
+	name := make([]byte, len(targetDigest))
+	for i := range name {
+		name[i] = targetDigest[i]
+		if i < len(otherDigest) {
+			name[i] ^= otherDigest[i]
+		}
+	}
+	return "merge:" + blockstore.AltEncode(name)
+}
+
+// Merges the branch of 'other' into the branch of 'target'.
+//
+// 'target' is switched to a new merge branch, which starts out as a copy of
+// the target branch, and changes from 'other' that don't conflict are
+// applied to its tree.  If there are no conflicts, the result is committed
+// on the target branch with the heads of both branches as parents, and the
+// merge branch is removed.  Otherwise, 'target' is left on the merge branch
+// and the conflicts are returned in the Merger, they must be resolved in
+// the tree of 'target'.
+//
+// Files that were changed in both branches are merged line by line.  Those
+// that still conflict are left with diff3-style conflict markers labeled
+// with the branch names, binary files keep the target's version and get the
+// other version in a ".merge-other" file next to them.
+func Merge(target, other *blockstore.Head) (*Merger, error) {
+	org, err := blockstore.FindCommonAncestor(target, other)
+	if err != nil {
+		return nil, err
+	}
+	m := &Merger{TargetBranch: target.GetBranch(),
+		AltBranch:    other.GetBranch(),
+		target:       target,
+		org:          org,
+		other:        other,
+		targetCommit: target.GetBaselineCommit(),
+		otherCommit:  other.GetBaselineCommit(),
+	}
+
+	m.Branch = mergeBranchName(target, other)
+	if err := target.Fork(m.Branch); err != nil {
+		return nil, err
+	}
+
+	targetRoot, err := target.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+	orgRoot, err := org.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+	otherRoot, err := other.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+	tm := &treeMerger{&Labels{m.TargetBranch, "org", m.AltBranch}}
+	outcome, err := tm.merge3("", targetRoot, orgRoot, otherRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	switch outcome := outcome.(type) {
+	case *Conflict:
+		m.Conflict = outcome
+		return m, nil
+	case *Mutation:
+		if err := replaceChildren(targetRoot, outcome.Replacement); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.commit(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Returns the session ids of the journal of the alternate branch.
+func (m *Merger) altSessionIds() [][]byte {
+	if m.other != nil {
+		return m.other.GetSessionIds()
+	}
+	return m.otherSessionIds
+}
+
+// Commits the merged tree on the target branch and removes the merge
+// branch.
+func (m *Merger) commit() error {
+	m.target.AddSessionIds(m.altSessionIds())
+	m.target.SetBranch(m.TargetBranch)
+
+	// It's only a merge commit if the branches have different commits,
+	// otherwise the merge just combines their journals.
+	var err error
+	if bytes.Equal(m.otherCommit, m.targetCommit) {
+		m.Commit, err = m.target.Commit(nil)
+	} else {
+		m.Commit, err = m.target.CommitMerge(m.otherCommit, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	store := m.target.GetStore()
+	if err := store.DeleteJournal(m.Branch); err != nil {
+		return err
+	}
+	if err := store.DeleteHead(m.Branch); err != nil {
+		return err
+	}
+	m.Branch = ""
+	return nil
+}
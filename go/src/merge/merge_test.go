@@ -0,0 +1,330 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merge
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"reflect"
+	blockstore "store"
+	"strings"
+	"testing"
+)
+
+type mergeTest struct {
+	t     *testing.T
+	store blockstore.NodeStore
+}
+
+// Creates a store with a "master" branch containing files "a", "b" and
+// "dir/x" and an "other" branch with the same commit.
+func newMergeTest(t *testing.T) *mergeTest {
+	return newMergeTestWithStore(t,
+		blockstore.NewMemStore(blockstore.NewFSInfo("pw")))
+}
+
+// Like newMergeTest(), but with an existing store.
+func newMergeTestWithStore(t *testing.T,
+	store blockstore.NodeStore) *mergeTest {
+
+	m := &mergeTest{t, store}
+	head := m.head("master")
+	m.write(head, "a", "a contents")
+	m.write(head, "b", "b contents")
+	m.write(head, "dir/x", "x contents")
+	digest := m.commit(head)
+	m.store.SetHead("other", digest)
+	return m
+}
+
+// Returns the head of 'branch', each in its own cache as it would be for
+// separate trees.
+func (m *mergeTest) head(branch string) *blockstore.Head {
+	head, err := blockstore.NewCache(m.store).GetHead(branch)
+	if err != nil {
+		m.t.Fatalf("GetHead(%s): %s", branch, err)
+	}
+	return head
+}
+
+// Returns the node at 'path', nil if there is none.
+func (m *mergeTest) lookup(head *blockstore.Head,
+	path string) *blockstore.CachedNode {
+
+	node, err := head.GetRoot()
+	if err != nil {
+		m.t.Fatalf("GetRoot: %s", err)
+	}
+	for _, name := range strings.Split(path, "/") {
+		if node, err = node.GetChildByName(name); err != nil {
+			m.t.Fatalf("GetChildByName(%s): %s", name, err)
+		} else if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Writes 'contents' to the file at 'path', creating it and its directory if
+// necessary.
+func (m *mergeTest) write(head *blockstore.Head, path, contents string) {
+	dir, err := head.GetRoot()
+	if err != nil {
+		m.t.Fatalf("GetRoot: %s", err)
+	}
+	names := strings.Split(path, "/")
+	for _, name := range names[:len(names)-1] {
+		child, _ := dir.GetChildByName(name)
+		if child == nil {
+			child, err = dir.AddChild(name,
+				&pb.Node{Mode: proto.Int32(blockstore.MODE_DIR)}, 0)
+			if err != nil {
+				m.t.Fatalf("AddChild(%s): %s", name, err)
+			}
+		}
+		dir = child
+	}
+	file, err := dir.AddChild(names[len(names)-1], &pb.Node{}, 0)
+	if err != nil {
+		m.t.Fatalf("AddChild(%s): %s", path, err)
+	}
+	if err := file.Write(0, []byte(contents), 0); err != nil {
+		m.t.Fatalf("Write(%s): %s", path, err)
+	}
+}
+
+func (m *mergeTest) remove(head *blockstore.Head, name string) {
+	root, _ := head.GetRoot()
+	if ok, err := root.DeleteChild(name, 0); !ok || err != nil {
+		m.t.Fatalf("DeleteChild(%s): %v, %v", name, ok, err)
+	}
+}
+
+func (m *mergeTest) commit(head *blockstore.Head) []byte {
+	digest, err := head.Commit(nil)
+	if err != nil {
+		m.t.Fatalf("Commit: %s", err)
+	}
+	return digest
+}
+
+// Returns the contents of the file at 'path' in the committed head of
+// 'branch', "" if there is no such file.
+func (m *mergeTest) contents(branch, path string) string {
+	node := m.lookup(m.head(branch), path)
+	if node == nil {
+		return ""
+	}
+	contents, err := node.GetContents()
+	if err != nil {
+		m.t.Fatalf("GetContents(%s): %s", path, err)
+	}
+	return string(contents)
+}
+
+func (m *mergeTest) merge(target, other *blockstore.Head) *Merger {
+	merger, err := Merge(target, other)
+	if err != nil {
+		m.t.Fatalf("Merge: %s", err)
+	}
+	return merger
+}
+
+func TestCleanMerge(t *testing.T) {
+	m := newMergeTest(t)
+	master := m.head("master")
+	m.write(master, "a", "new a")
+	masterCommit := m.commit(master)
+	other := m.head("other")
+	m.write(other, "c", "c contents")
+	m.write(other, "dir/x", "new x")
+	m.remove(other, "b")
+	otherCommit := m.commit(other)
+
+	merger := m.merge(master, other)
+	if merger.Conflict != nil {
+		t.Fatalf("Conflicts: %v", merger.Conflict.Paths())
+	}
+	blockstore.Assert(t, merger.Branch == "")
+	blockstore.Assert(t, master.GetBranch() == "master")
+
+	// The merge is committed with both heads as parents.
+	head, _ := m.store.GetHead("master")
+	blockstore.Assert(t, bytes.Equal(head, merger.Commit))
+	commit, _ := m.store.LoadCommit(head)
+	blockstore.Assert(t, len(commit.Parent) == 2 &&
+		bytes.Equal(commit.Parent[0], masterCommit) &&
+		bytes.Equal(commit.Parent[1], otherCommit))
+
+	blockstore.Assert(t, m.contents("master", "a") == "new a")
+	blockstore.Assert(t, m.lookup(m.head("master"), "b") == nil)
+	blockstore.Assert(t, m.contents("master", "c") == "c contents")
+	blockstore.Assert(t, m.contents("master", "dir/x") == "new x")
+
+	// The other branch is unchanged, and no journals are left behind.
+	head, _ = m.store.GetHead("other")
+	blockstore.Assert(t, bytes.Equal(head, otherCommit))
+	for _, branch := range []string{"master", "other"} {
+		iter, _ := m.store.MakeJournalIter(branch)
+		blockstore.Assert(t, !iter.IsValid())
+	}
+}
+
+func TestConflictingMerge(t *testing.T) {
+	m := newMergeTest(t)
+	master := m.head("master")
+	m.write(master, "a", "master a")
+	m.write(master, "dir/x", "master x")
+	masterCommit := m.commit(master)
+	other := m.head("other")
+	m.write(other, "a", "other a")
+	m.write(other, "dir/x", "other x")
+	m.write(other, "dir/y", "other y")
+	m.write(other, "c", "c contents")
+	m.commit(other)
+
+	merger := m.merge(master, other)
+	blockstore.Assert(t, merger.Commit == nil)
+	if merger.Conflict == nil {
+		t.Fatalf("No conflicts")
+	}
+	paths := merger.Conflict.Paths()
+	blockstore.Assertf(t, reflect.DeepEqual(paths, []string{"a", "dir/x"}),
+		"got conflicts %v", paths)
+
+	// The target is now on the merge branch, and the master branch is
+	// unchanged.
+	blockstore.Assert(t, strings.HasPrefix(merger.Branch, "merge:"))
+	blockstore.Assert(t, master.GetBranch() == merger.Branch)
+	blockstore.Assert(t, merger.TargetBranch == "master")
+	head, _ := m.store.GetHead("master")
+	blockstore.Assert(t, bytes.Equal(head, masterCommit))
+	blockstore.Assert(t, m.contents("master", "c") == "")
+
+	// Everything that didn't conflict has been merged into the merge
+	// branch, conflicting files have conflict markers.
+	blockstore.Assert(t, m.contents(merger.Branch, "c") == "c contents")
+	blockstore.Assert(t, m.contents(merger.Branch, "dir/y") == "other y")
+	contents := m.contents(merger.Branch, "a")
+	blockstore.Assertf(t, contents == "<<<<<<< master:a\nmaster a\n"+
+		"||||||| org:a\na contents\n=======\nother a\n>>>>>>> other:a\n",
+		"got %q", contents)
+	contents = m.contents(merger.Branch, "dir/x")
+	blockstore.Assertf(t, strings.HasPrefix(contents,
+		"<<<<<<< master:dir/x\nmaster x\n"), "got %q", contents)
+}
+
+func TestMergeFileContents(t *testing.T) {
+	m := newMergeTest(t)
+	master := m.head("master")
+	m.write(master, "a", "first\nsecond\nthird\n")
+	m.write(master, "b", "b\x00contents")
+	long := strings.Repeat("line\n", maxDiff3Lines)
+	m.write(master, "c", long)
+	m.store.SetHead("other", m.commit(master))
+
+	// Change different lines of "a" on each branch, "b" is binary and "c"
+	// is too long to merge.
+	master = m.head("master")
+	m.write(master, "a", "first\nsecond\nthird\nmaster\n")
+	m.write(master, "b", "b\x00master")
+	m.write(master, "c", long+"master\n")
+	m.commit(master)
+	other := m.head("other")
+	m.write(other, "a", "other\nfirst\nsecond\nthird\n")
+	m.write(other, "b", "b\x00other")
+	m.write(other, "c", "other\n"+long)
+	m.commit(other)
+
+	merger := m.merge(master, other)
+	if merger.Conflict == nil {
+		t.Fatalf("No conflicts")
+	}
+	paths := merger.Conflict.Paths()
+	blockstore.Assertf(t, reflect.DeepEqual(paths, []string{"b", "c"}),
+		"got conflicts %v", paths)
+	blockstore.Assert(t, m.contents(merger.Branch, "a") ==
+		"other\nfirst\nsecond\nthird\nmaster\n")
+
+	// The binary file keeps both versions.
+	blockstore.Assert(t, m.contents(merger.Branch, "b") == "b\x00master")
+	blockstore.Assert(t,
+		m.contents(merger.Branch, "b.merge-other") == "b\x00other")
+
+	// So does a file with too many lines to merge.
+	blockstore.Assert(t, m.contents(merger.Branch, "c") == long+"master\n")
+	blockstore.Assert(t,
+		m.contents(merger.Branch, "c.merge-other") == "other\n"+long)
+}
+
+func TestMergeJournals(t *testing.T) {
+	m := newMergeTest(t)
+	master := m.head("master")
+	m.write(master, "m", "master file")
+	other := m.head("other")
+	m.write(other, "o", "other file")
+	m.write(other, "dir/x", "new x")
+
+	merger := m.merge(master, other)
+	blockstore.Assert(t, merger.Conflict == nil)
+
+	// The branches had the same commit, so this isn't a merge commit.
+	commit, _ := m.store.LoadCommit(merger.Commit)
+	blockstore.Assert(t, len(commit.Parent) == 1)
+	blockstore.Assert(t, m.contents("master", "m") == "master file")
+	blockstore.Assert(t, m.contents("master", "o") == "other file")
+	blockstore.Assert(t, m.contents("master", "dir/x") == "new x")
+	blockstore.Assert(t, m.contents("master", "a") == "a contents")
+}
+
+func TestMergeUnchangedTarget(t *testing.T) {
+	m := newMergeTest(t)
+	other := m.head("other")
+	m.write(other, "c", "c contents")
+	m.remove(other, "a")
+	m.commit(other)
+
+	merger := m.merge(m.head("master"), other)
+	blockstore.Assert(t, merger.Conflict == nil && merger.Commit != nil)
+	blockstore.Assert(t, m.contents("master", "c") == "c contents")
+	blockstore.Assert(t, m.lookup(m.head("master"), "a") == nil)
+	blockstore.Assert(t, m.contents("master", "b") == "b contents")
+}
+
+func TestMerge3(t *testing.T) {
+	m := newMergeTest(t)
+	master := m.head("master")
+	a := m.lookup(master, "a")
+	b := m.lookup(master, "b")
+	dir := m.lookup(master, "dir")
+
+	outcome, err := Merge3(a, a, a)
+	blockstore.Assert(t, err == nil && outcome == Unchanged)
+	outcome, _ = Merge3(a, a, b)
+	mutation, ok := outcome.(*Mutation)
+	blockstore.Assert(t, ok && mutation.Replacement == b)
+	outcome, _ = Merge3(a, a, nil)
+	mutation, ok = outcome.(*Mutation)
+	blockstore.Assert(t, ok && mutation.Replacement == nil)
+	outcome, _ = Merge3(b, a, a)
+	blockstore.Assert(t, outcome == Unchanged)
+	outcome, _ = Merge3(nil, a, b)
+	conflict, ok := outcome.(*Conflict)
+	blockstore.Assert(t, ok && len(conflict.Paths()) == 0)
+	outcome, _ = Merge3(dir, a, b)
+	_, ok = outcome.(*Conflict)
+	blockstore.Assert(t, ok)
+}
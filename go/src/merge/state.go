@@ -0,0 +1,206 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Persistence of pending merges, the merges that had conflicts and are
+// waiting to be resolved or cancelled ("mfs resolve" and
+// "mfs cancel_merge").
+
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	pb "mawfs"
+	blockstore "store"
+)
+
+// The file in the backing store that holds the encrypted MergeState of the
+// pending merge.  It only exists while there is one.
+const altFile = "ALT"
+
+// Returns the state of the merge, which is what gets persisted.
+func (m *Merger) State() *pb.MergeState {
+	return &pb.MergeState{
+		TargetBranch:  proto.String(m.TargetBranch),
+		MergeBranch:   proto.String(m.Branch),
+		AltBranch:     proto.String(m.AltBranch),
+		TargetCommit:  m.targetCommit,
+		AltCommit:     m.otherCommit,
+		AltSessionIds: m.altSessionIds(),
+	}
+}
+
+// Saves the state of a merge with conflicts to the backing store, so that it
+// can be resolved or cancelled after a restart.  There can be only one
+// pending merge, this replaces any existing one.
+func (m *Merger) Save(fsInfo *blockstore.FSInfo,
+	backing blockstore.FileSys) error {
+
+	if m.Branch == "" {
+		return errors.New("The merge is not pending, there's nothing to save.")
+	}
+	serialized, err := proto.Marshal(m.State())
+	if err != nil {
+		return err
+	}
+	ciphertext, err := fsInfo.Encrypt(serialized)
+	if err != nil {
+		return err
+	}
+	if err := blockstore.WriteFileAtomically(backing, altFile,
+		ciphertext); err != nil {
+		return err
+	}
+	m.fsInfo = fsInfo
+	m.backing = backing
+	return nil
+}
+
+// Loads the pending merge from the backing store.  Returns nil if there is
+// none.
+//
+// The merged tree is in the head of the merge branch (Merger.Branch), which
+// must be passed to Resolve() or Cancel() to finish the merge.
+func LoadMerge(fsInfo *blockstore.FSInfo, backing blockstore.FileSys) (
+	*Merger, error) {
+
+	if !backing.Exists(altFile) {
+		return nil, nil
+	}
+	src, err := backing.Open(altFile)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	ciphertext, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := fsInfo.Decrypt(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	state := &pb.MergeState{}
+	if err := proto.Unmarshal(serialized, state); err != nil {
+		return nil, err
+	}
+	return &Merger{TargetBranch: state.GetTargetBranch(),
+		Conflict:        &Conflict{},
+		Branch:          state.GetMergeBranch(),
+		AltBranch:       state.GetAltBranch(),
+		targetCommit:    state.TargetCommit,
+		otherCommit:     state.AltCommit,
+		otherSessionIds: state.AltSessionIds,
+		fsInfo:          fsInfo,
+		backing:         backing,
+	}, nil
+}
+
+// Returns the commits that the pending merge in the backing store refers to,
+// nil if there is no pending merge.  Garbage collection must keep these (see
+// blockstore.GCOptions.Roots).
+func PendingCommits(fsInfo *blockstore.FSInfo,
+	backing blockstore.FileSys) ([][]byte, error) {
+
+	m, err := LoadMerge(fsInfo, backing)
+	if m == nil || err != nil {
+		return nil, err
+	}
+	var commits [][]byte
+	for _, commit := range [][]byte{m.targetCommit, m.otherCommit} {
+		if commit != nil {
+			commits = append(commits, commit)
+		}
+	}
+	return commits, nil
+}
+
+// Removes the persisted state, if there is any.
+func (m *Merger) clear() error {
+	if m.backing == nil || !m.backing.Exists(altFile) {
+		return nil
+	}
+	return m.backing.Remove(altFile)
+}
+
+// Checks that 'head' is the head of the merge branch of the pending merge.
+func (m *Merger) checkHead(head *blockstore.Head) error {
+	if m.Branch == "" {
+		return errors.New("No merge operation is pending.")
+	}
+	if head.GetBranch() != m.Branch {
+		return fmt.Errorf("Head is on branch %s, not the merge branch %s",
+			head.GetBranch(), m.Branch)
+	}
+	return nil
+}
+
+// Completes a merge once its conflicts have been fixed in 'head', the head
+// of the merge branch.  The merged tree is committed on the target branch
+// with the commits of both branches as parents, and the merge branch and
+// the persisted state are removed.  'head' is left on the target branch.
+//
+// This fails if the target branch has been committed to since the merge
+// started.
+func (m *Merger) Resolve(head *blockstore.Head) error {
+	if err := m.checkHead(head); err != nil {
+		return err
+	}
+	digest, err := head.GetStore().GetHead(m.TargetBranch)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, m.targetCommit) {
+		return fmt.Errorf("Branch %s has changed since the merge started",
+			m.TargetBranch)
+	}
+
+	// Load the tree before commit() moves the head off of the merge branch,
+	// it's replayed from the merge branch's journal.
+	if _, err := head.GetRoot(); err != nil {
+		return err
+	}
+	m.target = head
+	if err := m.commit(); err != nil {
+		return err
+	}
+	m.Conflict = nil
+	return m.clear()
+}
+
+// Abandons the merge, removing the merge branch and the persisted state.
+// 'head' is the head of the merge branch, which should no longer be used.
+// Returns a new head for the target branch, which is as it was before the
+// merge.
+func (m *Merger) Cancel(head *blockstore.Head) (*blockstore.Head, error) {
+	if err := m.checkHead(head); err != nil {
+		return nil, err
+	}
+	store := head.GetStore()
+	if err := store.DeleteJournal(m.Branch); err != nil {
+		return nil, err
+	}
+	if err := store.DeleteHead(m.Branch); err != nil {
+		return nil, err
+	}
+	m.Branch = ""
+	m.Conflict = nil
+	if err := m.clear(); err != nil {
+		return nil, err
+	}
+	return head.GetCache().GetHead(m.TargetBranch)
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merge
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	blockstore "store"
+	"testing"
+)
+
+type stateTest struct {
+	*mergeTest
+	fsInfo       *blockstore.FSInfo
+	backing      *blockstore.FakeFileSys
+	masterCommit []byte
+	otherCommit  []byte
+
+	// The session ids of the journal of "other" when it was merged.
+	otherSessionIds [][]byte
+}
+
+// Creates a merge of "other" into "master" with a conflict in "a" and saves
+// it.  "other" has an uncommitted change to "d".
+func newStateTest(t *testing.T) (*stateTest, *Merger) {
+	fsInfo := blockstore.NewFSInfo("pw")
+	backing := blockstore.NewFakeFileSys()
+	s := &stateTest{mergeTest: newMergeTestWithStore(t,
+		blockstore.NewChunkStore(fsInfo, backing)),
+		fsInfo:  fsInfo,
+		backing: backing,
+	}
+	master := s.head("master")
+	s.write(master, "a", "master a")
+	s.masterCommit = s.commit(master)
+	other := s.head("other")
+	s.write(other, "a", "other a")
+	s.write(other, "c", "c contents")
+	s.otherCommit = s.commit(other)
+	s.write(other, "d", "d contents")
+	s.otherSessionIds = other.GetSessionIds()
+	blockstore.Assert(t, len(s.otherSessionIds) == 1)
+
+	merger := s.merge(master, other)
+	blockstore.Assert(t, merger.Conflict != nil)
+	if err := merger.Save(fsInfo, backing); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	return s, merger
+}
+
+// Loads the pending merge as if after a restart.
+func (s *stateTest) load() *Merger {
+	merger, err := LoadMerge(s.fsInfo, s.backing)
+	if err != nil {
+		s.t.Fatalf("LoadMerge: %s", err)
+	}
+	return merger
+}
+
+func TestLoadMerge(t *testing.T) {
+	s, merger := newStateTest(t)
+	loaded := s.load()
+	if loaded == nil {
+		t.Fatalf("No pending merge")
+	}
+	blockstore.Assert(t, loaded.TargetBranch == "master")
+	blockstore.Assert(t, loaded.AltBranch == "other")
+	blockstore.Assert(t, loaded.Branch == merger.Branch)
+	blockstore.Assert(t, bytes.Equal(loaded.targetCommit, s.masterCommit))
+	blockstore.Assert(t, bytes.Equal(loaded.otherCommit, s.otherCommit))
+	blockstore.Assert(t, reflect.DeepEqual(loaded.otherSessionIds,
+		s.otherSessionIds))
+
+	// The state is encrypted.
+	src, _ := s.backing.Open(altFile)
+	contents, _ := ioutil.ReadAll(src)
+	blockstore.Assert(t, !bytes.Contains(contents, []byte("master")))
+
+	commits, err := PendingCommits(s.fsInfo, s.backing)
+	blockstore.Assert(t, err == nil && len(commits) == 2 &&
+		bytes.Equal(commits[0], s.masterCommit) &&
+		bytes.Equal(commits[1], s.otherCommit))
+
+	// Nothing to load when there's no pending merge.
+	s.backing.Remove(altFile)
+	blockstore.Assert(t, s.load() == nil)
+	commits, err = PendingCommits(s.fsInfo, s.backing)
+	blockstore.Assert(t, err == nil && commits == nil)
+}
+
+func TestResolve(t *testing.T) {
+	s, merger := newStateTest(t)
+	merged := s.head(merger.Branch)
+	s.write(merged, "a", "resolved a")
+
+	// After a restart, with the head of the merge branch from a new cache.
+	merger = s.load()
+	head := s.head(merger.Branch)
+	if err := merger.Resolve(head); err != nil {
+		t.Fatalf("Resolve: %s", err)
+	}
+	blockstore.Assert(t, head.GetBranch() == "master")
+	blockstore.Assert(t, s.load() == nil)
+
+	digest, _ := s.store.GetHead("master")
+	blockstore.Assert(t, bytes.Equal(digest, merger.Commit))
+	commit, _ := s.store.LoadCommit(digest)
+	blockstore.Assert(t, len(commit.Parent) == 2 &&
+		bytes.Equal(commit.Parent[0], s.masterCommit) &&
+		bytes.Equal(commit.Parent[1], s.otherCommit))
+	blockstore.Assert(t, s.contents("master", "a") == "resolved a")
+	blockstore.Assert(t, s.contents("master", "c") == "c contents")
+	blockstore.Assert(t, s.contents("master", "d") == "d contents")
+
+	// The commit includes the journal of "other".
+	sessionIds, err := blockstore.LoadJournalInfo(s.store,
+		commit.JournalInfo)
+	blockstore.Assertf(t, err == nil && sessionIds[string(
+		s.otherSessionIds[0])], "session ids %v, %v", sessionIds, err)
+
+	// The merge branch is gone.
+	_, err = s.store.GetHead(merged.GetBranch())
+	_, unknown := err.(blockstore.UnknownName)
+	blockstore.Assert(t, unknown)
+}
+
+func TestResolveChangedTarget(t *testing.T) {
+	s, merger := newStateTest(t)
+	master := s.head("master")
+	s.write(master, "b", "new b")
+	s.commit(master)
+
+	merger = s.load()
+	err := merger.Resolve(s.head(merger.Branch))
+	blockstore.Assertf(t, err != nil, "Resolve succeeded")
+	blockstore.Assert(t, s.load() != nil)
+
+	// Only the head of the merge branch can be resolved.
+	blockstore.Assert(t, merger.Resolve(s.head("master")) != nil)
+}
+
+func TestCancel(t *testing.T) {
+	s, merger := newStateTest(t)
+	mergeBranch := merger.Branch
+
+	merger = s.load()
+	head, err := merger.Cancel(s.head(mergeBranch))
+	if err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	blockstore.Assert(t, s.load() == nil)
+	blockstore.Assert(t, head.GetBranch() == "master")
+	blockstore.Assert(t, bytes.Equal(head.GetBaselineCommit(),
+		s.masterCommit))
+	blockstore.Assert(t, s.contents("master", "a") == "master a")
+	blockstore.Assert(t, s.contents("master", "c") == "")
+	_, err = s.store.GetHead(mergeBranch)
+	_, unknown := err.(blockstore.UnknownName)
+	blockstore.Assert(t, unknown)
+
+	_, err = merger.Cancel(head)
+	blockstore.Assert(t, err != nil)
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"net"
+	blockstore "store"
+	"strconv"
+)
+
+// Returned from GetJournal() if the remote journal changed while we were
+// reading it.
+var ErrJournalChanged = blockstore.ErrJournalChanged
+
+// Manages a single connection to a peer.  Does not reconnect, once the
+// connection is lost all calls return ErrPeerDisconnected.
+//
+// Implements blockstore.RawChunkReader and blockstore.RemoteReader, so a
+// proxy can be used as the remote reader of a ReadThroughStore.
+type PeerProxy struct {
+	c *conn
+}
+
+func checkPeerProxyIfaces() {
+	var _ blockstore.RawChunkReader = &PeerProxy{}
+	var _ blockstore.RemoteReader = &PeerProxy{}
+}
+
+// Creates a proxy that communicates over 'rwc'.  The proxy serves no methods
+// to the remote end until ServeReader() is called.
+func NewPeerProxy(rwc net.Conn) *PeerProxy {
+	c := newConn(rwc, newMethodMap())
+	go c.serve()
+	return &PeerProxy{c}
+}
+
+// Serves the raw contents of 'reader' to the remote end, so that it can pull
+// branches from us.  This is required for PushBranch().  The methods can only
+// be called once the remote end has proven it has our key, which is the case
+// after Login() or if the proxy was created with DialSecure().
+func (p *PeerProxy) ServeReader(reader blockstore.RawChunkReader) {
+	rawChunkServer{reader}.register(p.c.methods)
+}
+
+// Connects to the peer at 'addr' ("host" or "host:port") over TCP.  If there
+// is no port, DEFAULT_PORT is used.
+func Dial(addr string) (*PeerProxy, error) {
+	rwc, err := net.Dial("tcp", addPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerProxy(rwc), nil
+}
+
+// Adds DEFAULT_PORT to 'addr' if it doesn't specify a port.
+func addPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, strconv.Itoa(DEFAULT_PORT))
+	}
+	return addr
+}
+
+// Closes the connection.
+func (p *PeerProxy) Close() error {
+	return p.c.close()
+}
+
+// Invokes a remote method and unmarshals the result into 'resp' (which may be
+// nil if the method has no meaningful result).
+func (p *PeerProxy) invoke(method string, req, resp proto.Message) error {
+	data, err := p.c.call(method, req)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		return proto.Unmarshal(data, resp)
+	}
+	return nil
+}
+
+// Returns the (encrypted) object with the specified digest, nil if the peer
+// doesn't have it.
+func (p *PeerProxy) GetObject(digest []byte) ([]byte, error) {
+	resp := &pb.GetObjectResponse{}
+	err := p.invoke("getObject", &pb.GetObjectRequest{Digest: digest}, resp)
+	return resp.Data, err
+}
+
+// Implements blockstore.RawChunkReader.
+func (p *PeerProxy) ReadRawChunk(digest []byte) ([]byte, error) {
+	return p.GetObject(digest)
+}
+
+// Implements blockstore.RemoteReader.
+func (p *PeerProxy) GetContents(digest []byte) ([]byte, error) {
+	return p.GetObject(digest)
+}
+
+// Returns the digest of the head commit of 'branch', nil if the peer doesn't
+// have the branch.
+func (p *PeerProxy) GetHead(branch string) ([]byte, error) {
+	resp := &pb.GetHeadResponse{}
+	err := p.invoke("getHead",
+		&pb.GetHeadRequest{Branch: proto.String(branch)}, resp)
+	return resp.Digest, err
+}
+
+// Returns the contents of a file from the peer's backing store.
+func (p *PeerProxy) GetFile(name string) ([]byte, error) {
+	resp := &pb.GetFileResponse{}
+	err := p.invoke("getFile",
+		&pb.GetFileRequest{Filename: proto.String(name)}, resp)
+	return resp.Data, err
+}
+
+// Gets the next journal block from the peer.  See
+// blockstore.RawChunkReader.
+func (p *PeerProxy) GetJournalBlock(firstBlockDigest []byte, branch string,
+	pos int) (*blockstore.JournalBlock, error) {
+
+	req := &pb.GetJournalBlockRequest{FirstBlockDigest: firstBlockDigest,
+		Branch: proto.String(branch),
+		Pos:    proto.Int32(int32(pos)),
+	}
+	resp := &pb.GetJournalBlockResponse{}
+	if err := p.invoke("getJournalBlock", req, resp); err != nil {
+		return nil, err
+	}
+	return &blockstore.JournalBlock{FirstBlockDigest: resp.FirstBlockDigest,
+		Contents: resp.Contents,
+		Done:     resp.GetDone(),
+	}, nil
+}
+
+// Reads the entire journal for 'branch' from the peer, one block at a time.
+// Returns nil if there is no journal, ErrJournalChanged if the journal
+// changed while we were reading it.
+func (p *PeerProxy) GetJournal(branch string) ([]byte, error) {
+	return blockstore.ReadJournal(p, branch)
+}
+
+// Returns the digest and commit named by 'commitOrTag', which is either an
+// alt-encoded commit digest or a branch name.
+func (p *PeerProxy) GetCommit(commitOrTag string) ([]byte, *pb.Commit,
+	error) {
+
+	resp := &pb.CommitAndDigest{}
+	err := p.invoke("getCommit",
+		&pb.GetCommitRequest{CommitOrTag: proto.String(commitOrTag)}, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Digest, resp.Commit, nil
+}
+
+// Commits the peer's current branch.  'metadata' may be nil.
+func (p *PeerProxy) Commit(metadata *pb.CommitMetadata) error {
+	return p.invoke("commit", &pb.CommitRequest{Metadata: metadata}, nil)
+}
+
+// Tells the peer that we are also a peer, named 'name'.  The name is used
+// for the tracking branches of branches that we push.
+func (p *PeerProxy) PeerConnected(name string) error {
+	return p.invoke("peerConnected",
+		&pb.PeerConnectedRequest{PeerName: proto.String(name)}, nil)
+}
+
+// Asks the peer to pull 'branch' from us.  Returns the name the peer stored
+// the branch under, which is "<name>:<branch>" if the branches have
+// diverged (<name> being the name we gave to PeerConnected()).
+func (p *PeerProxy) PullBranchFromMe(branch string) (string, error) {
+	resp := &pb.PullBranchResponse{}
+	err := p.invoke("pullBranch", &pb.PullBranchRequest{
+		Branch:     proto.String(branch),
+		FromClient: proto.Bool(true),
+	}, resp)
+	return resp.GetLocalName(), err
+}
+
+// Asks the peer to traverse every commit and node of its branch 'branch'
+// with the algorithm 'algo' (TRAVERSE_FULL or TRAVERSE_DELTA), pulling
+// anything it doesn't have from us.
+func (p *PeerProxy) Traverse(branch string, algo int) error {
+	return p.invoke("traverse", &pb.TraverseRequest{
+		Branch: proto.String(branch),
+		Algo:   proto.Int32(int32(algo)),
+	}, nil)
+}
+
+// Pushes 'branch' to the peer: the peer pulls the branch from us and then,
+// unless 'traverse' is TRAVERSE_NONE, traverses it to pull everything
+// reachable from it.  Returns the name the peer stored the branch under.
+//
+// ServeReader() and PeerConnected() must have been called first.
+func (p *PeerProxy) PushBranch(branch string, traverse int) (string,
+	error) {
+
+	localName, err := p.PullBranchFromMe(branch)
+	if err != nil {
+		return "", err
+	}
+	if traverse != TRAVERSE_NONE {
+		if err := p.Traverse(localName, traverse); err != nil {
+			return "", err
+		}
+	}
+	return localName, nil
+}
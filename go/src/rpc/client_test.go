@@ -0,0 +1,403 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	blockstore "store"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Connects to the server at 'addr' and logs in with the key in 'fsInfo'.
+func dialProxy(t *testing.T, addr string,
+	fsInfo *blockstore.FSInfo) *PeerProxy {
+
+	proxy, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	if err := proxy.Login(fsInfo); err != nil {
+		t.Fatalf("Login: %s", err)
+	}
+	return proxy
+}
+
+func TestPeerProxy(t *testing.T) {
+	backing := blockstore.NewFakeFileSys()
+	fsInfo, _ := blockstore.LoadFSInfo(backing, "password", true)
+	store := blockstore.NewChunkStore(fsInfo, backing)
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	commit := &pb.Commit{Timestamp: proto.Int32(100)}
+	digest, _ := store.StoreCommit(commit)
+	store.SetHead("master", digest)
+
+	data, err := proxy.GetObject(digest)
+	blockstore.Assertf(t, err == nil, "GetObject: %s", err)
+	expected, _ := store.GetRawChunkReader().ReadRawChunk(digest)
+	blockstore.Assert(t, bytes.Equal(data, expected))
+	data, err = proxy.GetObject([]byte("missing"))
+	blockstore.Assert(t, data == nil && err == nil)
+
+	head, err := proxy.GetHead("master")
+	blockstore.Assert(t, err == nil && bytes.Equal(head, digest))
+	head, err = proxy.GetHead("unknown")
+	blockstore.Assert(t, err == nil && head == nil)
+
+	params, err := proxy.GetFile("params")
+	blockstore.Assert(t, err == nil && len(params) > 0)
+	_, err = proxy.GetFile("missing")
+	_, isRemote := err.(*RemoteError)
+	blockstore.Assertf(t, isRemote, "got error %v", err)
+
+	commitDigest, loaded, err := proxy.GetCommit("master")
+	blockstore.Assertf(t, err == nil, "GetCommit: %s", err)
+	blockstore.Assert(t, bytes.Equal(commitDigest, digest))
+	blockstore.Assert(t, proto.Equal(loaded, commit))
+
+	committer := &fakeCommitter{}
+	server.SetCommitter(committer)
+	metadata := &pb.CommitMetadata{Committer: proto.String("me")}
+	blockstore.Assert(t, proxy.Commit(metadata) == nil)
+	blockstore.Assert(t, proto.Equal(committer.metadata, metadata))
+}
+
+func TestPeerProxyJournal(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	journal, err := proxy.GetJournal("master")
+	blockstore.Assert(t, err == nil && journal == nil)
+
+	for i := 0; i < 2000; i++ {
+		store.WriteToJournal("master", &pb.Change{Type: proto.Int32(1),
+			Name: proto.String(strings.Repeat("name", 25)),
+		})
+	}
+	journal, err = proxy.GetJournal("master")
+	blockstore.Assertf(t, err == nil, "GetJournal: %s", err)
+	blockstore.Assert(t, len(journal) > 2*blockstore.BlockSize)
+
+	// Reading it a block at a time across a change to the journal should
+	// tell us it changed.
+	block, _ := proxy.GetJournalBlock(nil, "master", 0)
+	blockstore.Assert(t, !block.Done)
+	store.DeleteJournal("master")
+	for i := 0; i < 2000; i++ {
+		store.WriteToJournal("master", &pb.Change{Type: proto.Int32(2),
+			Name: proto.String(strings.Repeat("name", 25)),
+		})
+	}
+	block, err = proxy.GetJournalBlock(block.FirstBlockDigest, "master",
+		blockstore.BlockSize)
+	blockstore.Assert(t, err == nil && block.Contents == nil && !block.Done)
+}
+
+func TestPeerProxyConcurrentCalls(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	var digests [][]byte
+	for i := 0; i < 20; i++ {
+		digest, _ := store.StoreNode(&pb.Node{Size: proto.Uint64(uint64(i))})
+		digests = append(digests, digest)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, len(digests))
+	for i, digest := range digests {
+		wg.Add(1)
+		go func(i int, digest []byte) {
+			defer wg.Done()
+			results[i], _ = proxy.GetObject(digest)
+		}(i, digest)
+	}
+	wg.Wait()
+
+	reader := store.GetRawChunkReader()
+	for i, digest := range digests {
+		expected, _ := reader.ReadRawChunk(digest)
+		blockstore.Assertf(t, bytes.Equal(results[i], expected),
+			"wrong result for call %d", i)
+	}
+}
+
+func TestPeerProxyDisconnect(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+	_, err := proxy.GetHead("master")
+	blockstore.Assert(t, err == nil)
+
+	server.Close()
+	_, err = proxy.GetHead("master")
+	blockstore.Assert(t, err != nil)
+	_, err = proxy.GetHead("master")
+	blockstore.Assertf(t, err == ErrPeerDisconnected, "got error %v", err)
+}
+
+func TestReadThroughPeer(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	remote := blockstore.NewMemStore(fsInfo)
+	head, _ := blockstore.NewCache(remote).GetHead("master")
+	root, _ := head.GetRoot()
+	file, _ := root.AddChild("file", &pb.Node{}, 100)
+	file.Write(0, []byte("remote data"), 100)
+	head.Commit(nil)
+	_, addr := startServer(t, fsInfo, remote, remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	// Replicate the head and let the cache load everything else on demand.
+	local := blockstore.NewChunkStore(fsInfo, blockstore.NewFakeFileSys())
+	digest, _ := proxy.GetHead("master")
+	local.SetHead("master", digest)
+	store := blockstore.NewReadThroughStore(local, fsInfo, proxy)
+	head, err := blockstore.NewCache(store).GetHead("master")
+	if err != nil {
+		t.Fatalf("GetHead: %s", err)
+	}
+	root, err = head.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	file, _ = root.GetChildByName("file")
+	blockstore.Assert(t, file != nil)
+	contents, err := file.GetContents()
+	blockstore.Assertf(t, err == nil && string(contents) == "remote data",
+		"got contents %q, %v", contents, err)
+
+	// Everything should now be available locally.
+	proxy.Close()
+	head, _ = blockstore.NewCache(local).GetHead("master")
+	root, err = head.GetRoot()
+	blockstore.Assertf(t, err == nil, "GetRoot: %s", err)
+}
+
+func TestPullFromPeer(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	remote := blockstore.NewMemStore(fsInfo)
+	head, _ := blockstore.NewCache(remote).GetHead("master")
+	root, _ := head.GetRoot()
+	root.AddChild("committed", &pb.Node{}, 100)
+	digest, _ := head.Commit(nil)
+	root.AddChild("journaled", &pb.Node{}, 100)
+	_, addr := startServer(t, fsInfo, remote, remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	local := blockstore.NewChunkStore(fsInfo, blockstore.NewFakeFileSys())
+	name, err := blockstore.PullBranch(local, fsInfo, "peer", proxy,
+		"master")
+	blockstore.Assertf(t, err == nil, "PullBranch: %s", err)
+	blockstore.Assert(t, name == "master")
+	localDigest, _ := local.GetHead("master")
+	blockstore.Assert(t, bytes.Equal(localDigest, digest))
+
+	// The pulled commit should now be usable without the peer.
+	proxy.Close()
+	head, _ = blockstore.NewCache(local).GetHead("master")
+	root, err = head.GetRoot()
+	blockstore.Assertf(t, err == nil, "GetRoot: %s", err)
+	child, _ := root.GetChildByName("journaled")
+	blockstore.Assert(t, child != nil)
+}
+
+func TestPushBranch(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	local := blockstore.NewChunkStore(fsInfo, blockstore.NewFakeFileSys())
+	head, _ := blockstore.NewCache(local).GetHead("master")
+	root, _ := head.GetRoot()
+	root.AddChild("first", &pb.Node{}, 100)
+	first, _ := head.Commit(nil)
+	root.AddChild("second", &pb.Node{}, 100)
+	second, _ := head.Commit(nil)
+
+	remote := blockstore.NewChunkStore(fsInfo, blockstore.NewFakeFileSys())
+	_, addr := startServer(t, fsInfo, remote, remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+
+	// The peer can't pull from us until we serve our store and tell it who
+	// we are.
+	_, err := proxy.PushBranch("master", TRAVERSE_FULL)
+	blockstore.Assertf(t, err != nil, "pushed without a peer name")
+	blockstore.Assert(t, proxy.PeerConnected("laptop") == nil)
+	_, err = proxy.PushBranch("master", TRAVERSE_FULL)
+	blockstore.Assertf(t, err != nil, "pushed without serving the store")
+	proxy.ServeReader(local.GetRawChunkReader())
+
+	name, err := proxy.PushBranch("master", TRAVERSE_FULL)
+	blockstore.Assertf(t, err == nil, "PushBranch: %s", err)
+	blockstore.Assert(t, name == "master")
+	digest, _ := remote.GetHead("master")
+	blockstore.Assert(t, bytes.Equal(digest, second))
+	traversed := remote.GetTraversed()
+	blockstore.Assert(t, !traversed.Has(second))
+
+	// The whole history should now be on the peer.
+	blockstore.Assert(t,
+		blockstore.TraverseCommit(remote, second, nil) == nil)
+	_, err = remote.LoadCommit(first)
+	blockstore.Assert(t, err == nil)
+
+	// A delta traversal records what it has traversed.
+	root.AddChild("third", &pb.Node{}, 100)
+	third, _ := head.Commit(nil)
+	_, err = proxy.PushBranch("master", TRAVERSE_DELTA)
+	blockstore.Assertf(t, err == nil, "PushBranch: %s", err)
+	blockstore.Assert(t, traversed.Has(third) && traversed.Has(first))
+
+	err = proxy.Traverse("master", 100)
+	blockstore.Assertf(t, err != nil &&
+		strings.Contains(err.Error(), "Unknown traversal type"),
+		"got error %v", err)
+	err = proxy.Traverse("unknown", TRAVERSE_FULL)
+	blockstore.Assertf(t, err != nil &&
+		strings.Contains(err.Error(), "does not exist"),
+		"got error %v", err)
+}
+
+func TestPushHostileNames(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	local := blockstore.NewMemStore(fsInfo)
+	head, _ := blockstore.NewCache(local).GetHead("master")
+	head.Commit(nil)
+
+	backing := blockstore.NewFakeFileSys()
+	remote := blockstore.NewChunkStore(fsInfo, backing)
+	_, addr := startServer(t, fsInfo, remote, remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+	proxy.ServeReader(local.GetRawChunkReader())
+
+	// Names that would escape "refs" and "journals" or clobber the root
+	// node ref.
+	hostile := []string{"../../x", "x/y", "..", "x\x00", "root"}
+	for _, name := range hostile {
+		blockstore.Assertf(t, proxy.PeerConnected(name) != nil,
+			"accepted peer name %q", name)
+	}
+	blockstore.Assert(t, proxy.PeerConnected("laptop") == nil)
+	for _, name := range hostile {
+		_, err := proxy.PushBranch(name, TRAVERSE_FULL)
+		blockstore.Assertf(t, err != nil &&
+			strings.Contains(err.Error(), "Invalid branch name"),
+			"pushed branch %q: %v", name, err)
+		err = proxy.Traverse(name, TRAVERSE_FULL)
+		blockstore.Assertf(t, err != nil &&
+			strings.Contains(err.Error(), "Invalid branch name"),
+			"traversed branch %q: %v", name, err)
+	}
+	blockstore.Assert(t, !backing.Exists("x") && !backing.Exists("refs/x"))
+}
+
+// A Committer for a live head, like fusefs.FS.
+type headCommitter struct {
+	mu   sync.Mutex
+	head *blockstore.Head
+}
+
+func (c *headCommitter) Commit(metadata *pb.CommitMetadata) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.head.Commit(metadata)
+	return err
+}
+
+func (c *headCommitter) GetBranch() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head.GetBranch()
+}
+
+func TestPushToServedBranch(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	local := blockstore.NewMemStore(fsInfo)
+	head, _ := blockstore.NewCache(local).GetHead("master")
+	root, _ := head.GetRoot()
+	root.AddChild("base", &pb.Node{}, 100)
+	head.Commit(nil)
+
+	remote := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, remote,
+		remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+	proxy.ServeReader(local.GetRawChunkReader())
+	proxy.PeerConnected("laptop")
+	name, err := proxy.PushBranch("master", TRAVERSE_NONE)
+	blockstore.Assert(t, err == nil && name == "master")
+
+	// Serve master from a live head.
+	served, _ := blockstore.NewCache(remote).GetHead("master")
+	servedRoot, err := served.GetRoot()
+	blockstore.Assertf(t, err == nil, "GetRoot: %s", err)
+	committer := &headCommitter{head: served}
+	server.SetCommitter(committer)
+
+	// A push that could be fast-forwarded goes to the tracking branch.
+	root.AddChild("pushed", &pb.Node{}, 100)
+	pushed, _ := head.Commit(nil)
+	name, err = proxy.PushBranch("master", TRAVERSE_NONE)
+	blockstore.Assertf(t, err == nil, "PushBranch: %s", err)
+	blockstore.Assert(t, name == "laptop:master")
+	digest, _ := remote.GetHead("laptop:master")
+	blockstore.Assert(t, bytes.Equal(digest, pushed))
+
+	// The live head carries on from its own baseline.
+	committer.mu.Lock()
+	servedRoot.AddChild("live", &pb.Node{}, 100)
+	committer.mu.Unlock()
+	blockstore.Assert(t, committer.Commit(nil) == nil)
+	head, _ = blockstore.NewCache(remote).GetHead("master")
+	root, err = head.GetRoot()
+	blockstore.Assertf(t, err == nil, "GetRoot: %s", err)
+	child, _ := root.GetChildByName("live")
+	blockstore.Assert(t, child != nil)
+	head, _ = blockstore.NewCache(remote).GetHead("laptop:master")
+	root, _ = head.GetRoot()
+	child, _ = root.GetChildByName("pushed")
+	blockstore.Assert(t, child != nil)
+}
+
+func TestPushBranchWithoutHistory(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	local := blockstore.NewMemStore(fsInfo)
+	head, _ := blockstore.NewCache(local).GetHead("master")
+	root, _ := head.GetRoot()
+	root.AddChild("first", &pb.Node{}, 100)
+	first, _ := head.Commit(nil)
+	root.AddChild("second", &pb.Node{}, 100)
+	head.Commit(nil)
+
+	remote := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, remote, remote.GetRawChunkReader())
+	proxy := dialProxy(t, addr, fsInfo)
+	proxy.ServeReader(local.GetRawChunkReader())
+	proxy.PeerConnected("laptop")
+
+	// Without a traversal, only what the head needs gets pushed.
+	_, err := proxy.PushBranch("master", TRAVERSE_NONE)
+	blockstore.Assertf(t, err == nil, "PushBranch: %s", err)
+	_, err = remote.LoadCommit(first)
+	blockstore.Assert(t, err != nil)
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Peer login, the equivalent of the login method in rpc.crk.
+//
+// Peers log in with a challenge/response exchange that proves that both ends
+// have the repository key:
+//
+//  1. The client sends a random challenge encrypted with the repository
+//     cipher.
+//  2. The server decrypts it and returns the SHA256 hash of the challenge
+//     (encrypted) along with a challenge of its own.
+//  3. The client verifies the hash and returns the (encrypted) hash of the
+//     server's challenge, which the server verifies.
+//
+// The server refuses to answer the challenges that it has issued, otherwise
+// a client could get the answer to one by sending it back on another
+// connection.
+//
+// Local clients log in with a nonce obtained from the .mawfs/otp file
+// instead.
+
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	blockstore "store"
+)
+
+// The size of a login challenge in bytes.
+const challengeSize = 32
+
+// Returned from the login functions if the login was rejected.
+type LoginError struct {
+	Message string
+}
+
+func (err *LoginError) Error() string {
+	return "Login failed: " + err.Message
+}
+
+func hash(data []byte) []byte {
+	digest := sha256.Sum256(data)
+	return digest[:]
+}
+
+// Creates a random challenge.  Returns the challenge, its encrypted form and
+// the hash that we expect in response.
+func newChallenge(fsInfo *blockstore.FSInfo) ([]byte, []byte, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, nil, err
+	}
+	encrypted, err := fsInfo.Encrypt(challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encrypted, hash(challenge), nil
+}
+
+// Decrypts 'challenge' and returns the encrypted hash of it, which is the
+// response to the challenge, and the hash itself.  Returns nil and no error
+// if the challenge can't be decrypted.
+func answerChallenge(fsInfo *blockstore.FSInfo, challenge []byte) ([]byte,
+	[]byte, error) {
+
+	plaintext, err := fsInfo.Decrypt(challenge)
+	if err != nil || len(plaintext) == 0 {
+		return nil, nil, nil
+	}
+	digest := hash(plaintext)
+	response, err := fsInfo.Encrypt(digest)
+	return response, digest, err
+}
+
+// Returns true if 'response' is the encrypted form of 'expected'.
+func checkResponse(fsInfo *blockstore.FSInfo, response,
+	expected []byte) bool {
+
+	plaintext, err := fsInfo.Decrypt(response)
+	return err == nil && subtle.ConstantTimeCompare(plaintext, expected) == 1
+}
+
+// Records 'expected', the response to a challenge sent on the connection of
+// 'ctx', in place of the connection's previous challenge.  ctx.mu must be
+// held.
+func (s *Server) issueChallenge(ctx *Context, expected []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, string(ctx.expectedResponse))
+	s.challenges[string(expected)] = true
+	ctx.expectedResponse = expected
+}
+
+// Forgets the challenge sent on the connection of 'ctx', once it's been
+// answered or the connection is closed.  ctx.mu must be held.
+func (s *Server) retireChallenge(ctx *Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, string(ctx.expectedResponse))
+	ctx.expectedResponse = nil
+}
+
+// Returns true if 'expected' is the response to a challenge that we sent.
+func (s *Server) issuedChallenge(expected []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.challenges[string(expected)]
+}
+
+// Returns a LoginResponse with an error.
+func loginError(message string) *pb.LoginResponse {
+	return &pb.LoginResponse{Error: proto.String(message)}
+}
+
+func (s *Server) login(ctx *Context, request []byte) (proto.Message, error) {
+	req := &pb.LoginRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	switch {
+	case req.Challenge != nil:
+		response, digest, err := answerChallenge(s.fsInfo, req.Challenge)
+		if err != nil {
+			return nil, err
+		} else if response == nil {
+			return loginError("Invalid challenge password"), nil
+		}
+
+		// Answering one of our own challenges would let a client without
+		// the key log in by reflecting it from another connection.
+		if s.issuedChallenge(digest) {
+			return loginError("Invalid challenge password"), nil
+		}
+		challenge, expected, err := newChallenge(s.fsInfo)
+		if err != nil {
+			return nil, err
+		}
+		s.issueChallenge(ctx, expected)
+		return &pb.LoginResponse{Response: response, Challenge: challenge},
+			nil
+
+	case req.Response != nil:
+		// Only one attempt is allowed per challenge.
+		expected := ctx.expectedResponse
+		s.retireChallenge(ctx)
+		if expected == nil {
+			return loginError("Response received before challenge!"), nil
+		} else if !checkResponse(s.fsInfo, req.Response, expected) {
+			return loginError("Incorrect login response."), nil
+		}
+
+	case req.Nonce != nil:
+		if !s.nonces.Redeem(req.Nonce) {
+			return loginError("Invalid nonce."), nil
+		}
+
+	default:
+		return loginError("Invalid login request."), nil
+	}
+
+	ctx.authenticated = true
+	return &pb.LoginResponse{}, nil
+}
+
+// Sends a login request, returns the response or a LoginError if the server
+// rejected the login.
+func (p *PeerProxy) sendLogin(req *pb.LoginRequest) (*pb.LoginResponse,
+	error) {
+
+	resp := &pb.LoginResponse{}
+	if err := p.invoke("login", req, resp); err != nil {
+		return nil, err
+	} else if resp.Error != nil {
+		return nil, &LoginError{resp.GetError()}
+	}
+	return resp, nil
+}
+
+// Logs in to the peer with a challenge/response exchange.  This verifies
+// that the peer also has the key in 'fsInfo'.
+func (p *PeerProxy) Login(fsInfo *blockstore.FSInfo) error {
+	challenge, expected, err := newChallenge(fsInfo)
+	if err != nil {
+		return err
+	}
+	resp, err := p.sendLogin(&pb.LoginRequest{Challenge: challenge})
+	if err != nil {
+		return err
+	}
+	if !checkResponse(fsInfo, resp.Response, expected) {
+		return &LoginError{"Invalid response received from peer."}
+	}
+
+	response, _, err := answerChallenge(fsInfo, resp.Challenge)
+	if err != nil {
+		return err
+	} else if response == nil {
+		return &LoginError{"Invalid challenge received from peer."}
+	}
+	if _, err := p.sendLogin(&pb.LoginRequest{Response: response}); err != nil {
+		return err
+	}
+
+	// The peer has proven that it has our key, it can call our methods.
+	p.c.ctx.setAuthenticated()
+	return nil
+}
+
+// Logs in to the peer with a nonce obtained from its .mawfs/otp file.
+func (p *PeerProxy) LoginWithNonce(nonce []byte) error {
+	_, err := p.sendLogin(&pb.LoginRequest{Nonce: nonce})
+	return err
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	blockstore "store"
+	"testing"
+)
+
+// Dials 'addr' without logging in.
+func dialNoLogin(t *testing.T, addr string) *PeerProxy {
+	proxy, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	return proxy
+}
+
+// Verifies that 'err' is a LoginError with 'message'.
+func expectLoginError(t *testing.T, err error, message string) {
+	t.Helper()
+	if loginErr, ok := err.(*LoginError); !ok || loginErr.Message != message {
+		t.Errorf("expected login error %q, got %v", message, err)
+	}
+}
+
+// Verifies that the proxy can't call methods that require a login.
+func expectAccessDenied(t *testing.T, proxy *PeerProxy) {
+	t.Helper()
+	_, err := proxy.GetHead("master")
+	if err == nil || err.Error() != "Access denied, auth required." {
+		t.Errorf("expected access denied, got %v", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+
+	proxy := dialNoLogin(t, addr)
+	expectAccessDenied(t, proxy)
+	blockstore.Assert(t, proxy.Login(fsInfo) == nil)
+	_, err := proxy.GetHead("master")
+	blockstore.Assertf(t, err == nil, "GetHead: %s", err)
+
+	// Logging in on one connection doesn't authenticate the others.
+	expectAccessDenied(t, dialNoLogin(t, addr))
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	proxy := dialNoLogin(t, addr)
+	err := proxy.Login(blockstore.NewFSInfo("wrong"))
+	expectLoginError(t, err, "Invalid challenge password")
+	expectAccessDenied(t, proxy)
+
+	// A server that can't answer the challenge must not be able to
+	// convince the client that it has the key.
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	wrongInfo := blockstore.NewFSInfo("wrong")
+	server.HandleNoAuth("login", func(ctx *Context, request []byte) (
+		proto.Message, error) {
+
+		response, _ := wrongInfo.Encrypt(make([]byte, 32))
+		challenge, _, _ := newChallenge(fsInfo)
+		return &pb.LoginResponse{Response: response, Challenge: challenge},
+			nil
+	})
+	err = dialNoLogin(t, addr).Login(fsInfo)
+	expectLoginError(t, err, "Invalid response received from peer.")
+}
+
+func TestLoginBadResponses(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+
+	login := func(req *pb.LoginRequest) *pb.LoginResponse {
+		resp := &pb.LoginResponse{}
+		if err := client.call("login", req, resp); err != nil {
+			t.Fatalf("login: %s", err)
+		}
+		return resp
+	}
+	expectDenied := func() {
+		t.Helper()
+		err := client.call("getHead", &pb.GetHeadRequest{}, nil)
+		if err == nil || err.Error() != "Access denied, auth required." {
+			t.Errorf("expected access denied, got %v", err)
+		}
+	}
+
+	resp := login(&pb.LoginRequest{})
+	blockstore.Assert(t, resp.GetError() == "Invalid login request.")
+	response, _ := fsInfo.Encrypt(make([]byte, 32))
+	resp = login(&pb.LoginRequest{Response: response})
+	blockstore.Assert(t, resp.GetError() == "Response received before "+
+		"challenge!")
+
+	// Truncated challenge.
+	challenge, expected, _ := newChallenge(fsInfo)
+	resp = login(&pb.LoginRequest{Challenge: challenge[:len(challenge)-1]})
+	blockstore.Assert(t, resp.GetError() == "Invalid challenge password")
+	expectDenied()
+
+	// Truncated response.
+	resp = login(&pb.LoginRequest{Challenge: challenge})
+	blockstore.Assert(t, resp.Error == nil)
+	blockstore.Assert(t, checkResponse(fsInfo, resp.Response, expected))
+	response, _, _ = answerChallenge(fsInfo, resp.Challenge)
+	resp = login(&pb.LoginRequest{Response: response[:len(response)-1]})
+	blockstore.Assert(t, resp.GetError() == "Incorrect login response.")
+	expectDenied()
+
+	// Only one response is allowed per challenge.
+	resp = login(&pb.LoginRequest{Response: response})
+	blockstore.Assert(t, resp.GetError() == "Response received before "+
+		"challenge!")
+	expectDenied()
+
+	// A response to a different challenge.
+	resp = login(&pb.LoginRequest{Challenge: challenge})
+	blockstore.Assert(t, resp.Error == nil)
+	resp = login(&pb.LoginRequest{Response: response})
+	blockstore.Assert(t, resp.GetError() == "Incorrect login response.")
+	expectDenied()
+
+	// A truncated LoginRequest.
+	data, _ := proto.Marshal(&pb.LoginRequest{Challenge: challenge})
+	client.lastId++
+	client.send(&pb.RPCMessage{Id: proto.Int32(client.lastId),
+		Method:  proto.String("login"),
+		Request: data[:len(data)-10],
+	})
+	reply := client.read()
+	blockstore.Assert(t, reply.GetId() == client.lastId && reply.Error != nil)
+	expectDenied()
+}
+
+func TestLoginReflection(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, store,
+		store.GetRawChunkReader())
+	login := func(client *rawClient, req *pb.LoginRequest) *pb.LoginResponse {
+		resp := &pb.LoginResponse{}
+		if err := client.call("login", req, resp); err != nil {
+			t.Fatalf("login: %s", err)
+		}
+		return resp
+	}
+
+	// The attacker doesn't have the key, but has a challenge from a
+	// legitimate client (a recorded one would do too) to get the server to
+	// send a challenge on its connection.
+	attacker := dial(t, addr)
+	challenge, _, _ := newChallenge(fsInfo)
+	resp := login(attacker, &pb.LoginRequest{Challenge: challenge})
+	blockstore.Assert(t, resp.Error == nil)
+
+	// The server must not answer its own challenge on another connection.
+	other := dial(t, addr)
+	reflected := login(other, &pb.LoginRequest{Challenge: resp.Challenge})
+	blockstore.Assertf(t, reflected.GetError() ==
+		"Invalid challenge password" && reflected.Response == nil,
+		"got %v", reflected)
+	err := attacker.call("getHead", &pb.GetHeadRequest{}, nil)
+	blockstore.Assert(t, err != nil)
+
+	// Nor on the same connection.
+	resp = login(attacker, &pb.LoginRequest{Challenge: challenge})
+	reflected = login(attacker, &pb.LoginRequest{Challenge: resp.Challenge})
+	blockstore.Assert(t, reflected.GetError() == "Invalid challenge password")
+
+	// Challenges are forgotten once they're answered.
+	proxy := dialNoLogin(t, addr)
+	blockstore.Assert(t, proxy.Login(fsInfo) == nil)
+	server.mu.Lock()
+	outstanding := len(server.challenges)
+	server.mu.Unlock()
+	blockstore.Assertf(t, outstanding == 1, "%d challenges", outstanding)
+}
+
+func TestTruncatedMessage(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+
+	challenge, _, _ := newChallenge(fsInfo)
+	data, _ := proto.Marshal(&pb.LoginRequest{Challenge: challenge})
+	buf := &bytes.Buffer{}
+	writeMessage(buf, &pb.RPCMessage{Id: proto.Int32(1),
+		Method:  proto.String("login"),
+		Request: data,
+	})
+
+	// The server must drop the connection without responding.
+	client.conn.Write(buf.Bytes()[:buf.Len()-1])
+	client.conn.(interface{ CloseWrite() error }).CloseWrite()
+	_, err := readMessage(client.src)
+	blockstore.Assert(t, err != nil)
+}
+
+func TestNonceLogin(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+
+	proxy := dialNoLogin(t, addr)
+	nonce, err := server.GetNonceManager().Get()
+	blockstore.Assert(t, err == nil && len(nonce) == NONCE_SIZE)
+	expectLoginError(t, proxy.LoginWithNonce(nonce[:NONCE_SIZE-1]),
+		"Invalid nonce.")
+	expectAccessDenied(t, proxy)
+	blockstore.Assert(t, proxy.LoginWithNonce(nonce) == nil)
+	_, err = proxy.GetHead("master")
+	blockstore.Assert(t, err == nil)
+
+	// Nonces can't be replayed.
+	proxy = dialNoLogin(t, addr)
+	expectLoginError(t, proxy.LoginWithNonce(nonce), "Invalid nonce.")
+	expectAccessDenied(t, proxy)
+}
+
+func TestNonceManager(t *testing.T) {
+	nonces := NewNonceManager()
+	first, _ := nonces.Get()
+	second, _ := nonces.Get()
+	blockstore.Assert(t, !bytes.Equal(first, second))
+	blockstore.Assert(t, nonces.Redeem(second))
+	blockstore.Assert(t, !nonces.Redeem(second))
+
+	// Only the most recent nonces are kept.
+	for i := 0; i < MAX_NONCES; i++ {
+		nonces.Get()
+	}
+	blockstore.Assert(t, !nonces.Redeem(first))
+	last, _ := nonces.Get()
+	blockstore.Assert(t, nonces.Redeem(last))
+}
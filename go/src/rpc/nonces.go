@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"sync"
+)
+
+// The size of a nonce in bytes.
+const NONCE_SIZE = 32
+
+// The maximum number of outstanding nonces.  When this is exceeded, the
+// oldest one is discarded.
+const MAX_NONCES = 12
+
+// Manages the one-time nonces that local clients use to log in.  A client
+// with access to the mounted filesystem obtains a nonce (by reading
+// .mawfs/otp) and sends it in a LoginRequest.  Each nonce can only be
+// redeemed once.
+type NonceManager struct {
+	mu     sync.Mutex
+	nonces [][]byte
+}
+
+func NewNonceManager() *NonceManager {
+	return &NonceManager{}
+}
+
+// Creates and returns a new nonce.
+func (m *NonceManager) Get() ([]byte, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.nonces) >= MAX_NONCES {
+		m.nonces = m.nonces[1:]
+	}
+	m.nonces = append(m.nonces, nonce)
+	return append([]byte(nil), nonce...), nil
+}
+
+// Returns true if 'nonce' is outstanding and removes it so that it can't be
+// used again.
+func (m *NonceManager) Redeem(nonce []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, cur := range m.nonces {
+		if subtle.ConstantTimeCompare(cur, nonce) == 1 {
+			m.nonces = append(m.nonces[:i:i], m.nonces[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the outstanding nonce that begins with 'prefix', removes it and
+// returns the remainder of it.  Returns nil if there is no such nonce.  This
+// is used for the local PSK identities, where the first half of the nonce is
+// the identity and the second half is the key.
+func (m *NonceManager) RedeemPrefix(prefix []byte) []byte {
+	if len(prefix) == 0 || len(prefix) >= NONCE_SIZE {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, cur := range m.nonces {
+		if subtle.ConstantTimeCompare(cur[:len(prefix)], prefix) == 1 {
+			m.nonces = append(m.nonces[:i:i], m.nonces[i+1:]...)
+			return cur[len(prefix):]
+		}
+	}
+	return nil
+}
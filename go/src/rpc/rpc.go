@@ -0,0 +1,404 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The peer RPC protocol, the Go equivalent of rpc.crk.
+//
+// Every message on the wire is a serialized RPCMessage preceded by its size
+// encoded as a varint.  Either end of a connection can send requests, a
+// message with a method is a request and a message without one is the
+// response to the request with the same id.
+//
+// The server implements the methods that peers use to sync (login, the raw
+// chunk methods, getCommit, peerConnected, pullBranch, traverse and, when
+// serving a mounted branch, commit).  The administrative methods of rpc.crk
+// (merge, resolve, cancelMerge, addPeer, getInfo, pushBranch and
+// getMountpoint) aren't implemented, calls to them get a "not supported"
+// error.
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"log"
+	pb "mawfs"
+	"net"
+	"sync"
+)
+
+// The default port for the RPC service.
+const DEFAULT_PORT = 9119
+
+// Traversal algorithms for the traverse and pushBranch methods.
+const (
+	TRAVERSE_NONE  = -1
+	TRAVERSE_FULL  = 0
+	TRAVERSE_DELTA = 1
+)
+
+// The largest message we'll accept.  This keeps a broken or hostile peer from
+// making us allocate arbitrarily large buffers.
+const maxMessageSize = 64 * 1024 * 1024
+
+// Reads the next message from 'src'.  Returns io.EOF if the stream ends
+// cleanly before the message.
+func readMessage(src *bufio.Reader) (*pb.RPCMessage, error) {
+	size, err := binary.ReadUvarint(src)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("RPC message of %d bytes is too large", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(src, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	msg := &pb.RPCMessage{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Writes 'msg' to 'dst' with its size prefix.
+func writeMessage(dst io.Writer, msg *pb.RPCMessage) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := proto.NewBuffer(nil)
+	if err := buf.EncodeRawBytes(data); err != nil {
+		return err
+	}
+	_, err = dst.Write(buf.Bytes())
+	return err
+}
+
+// Returned from calls on a connection that has been closed.
+var ErrPeerDisconnected = errors.New("Peer disconnected")
+
+// An error returned by the remote end of a connection.
+type RemoteError struct {
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	return err.Message
+}
+
+// Per-connection state, passed to method handlers.
+type Context struct {
+	// The address of the remote end of the connection.
+	RemoteAddr net.Addr
+
+	// The connection itself, so handlers can call back to the remote end.
+	conn *conn
+
+	// Guards the login state and peer name below.
+	mu sync.Mutex
+
+	// Set once the remote end has logged in.
+	authenticated bool
+
+	// The response we expect to the challenge we sent during login, nil if
+	// we haven't sent one.
+	expectedResponse []byte
+
+	// The name of the peer at the remote end, empty if the connection isn't
+	// from a peer or the peerConnected method hasn't been called yet.
+	peerName string
+}
+
+// Returns true if the remote end of the connection has logged in.
+func (ctx *Context) Authenticated() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.authenticated
+}
+
+func (ctx *Context) setAuthenticated() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.authenticated = true
+}
+
+// Returns the name the remote peer gave in peerConnected, empty if it hasn't
+// given one.
+func (ctx *Context) PeerName() string {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.peerName
+}
+
+func (ctx *Context) setPeerName(name string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.peerName = name
+}
+
+// Returns a proxy for calling methods on the remote end of the connection.
+// This only works if the remote end serves methods, as a PeerProxy does
+// after ServeReader().
+func (ctx *Context) Peer() *PeerProxy {
+	return &PeerProxy{ctx.conn}
+}
+
+// Processes the serialized request for a method, returns the response (which
+// may be nil).
+type Handler func(ctx *Context, request []byte) (proto.Message, error)
+
+// A connection to a peer or client.
+type conn struct {
+	rwc net.Conn
+	ctx *Context
+
+	// The methods we serve over the connection.
+	methods *methodMap
+
+	// Serializes writes to the connection.
+	writeMu sync.Mutex
+
+	// Guards everything below.
+	mu sync.Mutex
+
+	// The id of the last request we sent.
+	lastId int32
+
+	// Channels waiting for the responses to our requests, keyed by request
+	// id.
+	waiters map[int32]chan *pb.RPCMessage
+
+	// Set when the connection has terminated.
+	closed bool
+}
+
+func newConn(rwc net.Conn, methods *methodMap) *conn {
+	c := &conn{rwc: rwc,
+		ctx:     &Context{RemoteAddr: rwc.RemoteAddr()},
+		methods: methods,
+		waiters: make(map[int32]chan *pb.RPCMessage),
+	}
+	c.ctx.conn = c
+	return c
+}
+
+func (c *conn) write(msg *pb.RPCMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeMessage(c.rwc, msg)
+}
+
+// Sends a response to request 'id'.
+func (c *conn) writeResponse(id int32, response proto.Message) error {
+	reply := &pb.RPCMessage{Id: proto.Int32(id)}
+	if response != nil {
+		data, err := proto.Marshal(response)
+		if err != nil {
+			return err
+		}
+
+		// An empty response must still be present.
+		if data == nil {
+			data = []byte{}
+		}
+		reply.Response = data
+	}
+	return c.write(reply)
+}
+
+// Sends an error response to request 'id'.
+func (c *conn) writeError(id int32, errorMessage string) error {
+	return c.write(&pb.RPCMessage{Id: proto.Int32(id),
+		Error: proto.String(errorMessage),
+	})
+}
+
+// Calls 'handler' with 'request', turning a panic into an error so that a
+// bad request can't take down the whole process.
+func (c *conn) callHandler(handler Handler, request []byte) (
+	response proto.Message, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handler panicked on request from %s: %v",
+				c.ctx.RemoteAddr, r)
+			response, err = nil, fmt.Errorf("Internal error: %v", r)
+		}
+	}()
+	return handler(c.ctx, request)
+}
+
+// Calls the handler for request 'msg' and sends back the result.
+func (c *conn) processRequest(msg *pb.RPCMessage) {
+	var response proto.Message
+	var err error
+	if handler, noauth := c.methods.get(msg.GetMethod()); handler == nil {
+		err = fmt.Errorf("Method %q not found", msg.GetMethod())
+	} else if !noauth && !c.ctx.Authenticated() {
+		err = errors.New("Access denied, auth required.")
+	} else {
+		response, err = c.callHandler(handler, msg.Request)
+	}
+
+	// Messages with no id are asynchronous, they get no response.
+	if msg.GetId() == 0 {
+		return
+	}
+
+	if err != nil {
+		err = c.writeError(msg.GetId(), err.Error())
+	} else {
+		err = c.writeResponse(msg.GetId(), response)
+	}
+	if err != nil {
+		log.Printf("Error writing response to %s: %s", c.ctx.RemoteAddr, err)
+	}
+}
+
+// Sends a request for 'method' and waits for the response.  Returns the
+// serialized response, a RemoteError if the remote end returned an error.
+func (c *conn) call(method string, request proto.Message) ([]byte, error) {
+	msg := &pb.RPCMessage{Method: proto.String(method)}
+	if request != nil {
+		data, err := proto.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		msg.Request = data
+	}
+
+	waiter := make(chan *pb.RPCMessage, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrPeerDisconnected
+	}
+	c.lastId++
+	id := c.lastId
+	c.waiters[id] = waiter
+	c.mu.Unlock()
+
+	msg.Id = proto.Int32(id)
+	if err := c.write(msg); err != nil {
+		c.mu.Lock()
+		delete(c.waiters, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	reply, ok := <-waiter
+	if !ok {
+		return nil, ErrPeerDisconnected
+	}
+	if reply.Error != nil {
+		return nil, &RemoteError{reply.GetError()}
+	}
+	return reply.Response, nil
+}
+
+// Delivers a response to the caller waiting for it.
+func (c *conn) processResponse(msg *pb.RPCMessage) {
+	c.mu.Lock()
+	waiter, ok := c.waiters[msg.GetId()]
+	delete(c.waiters, msg.GetId())
+	c.mu.Unlock()
+	if !ok {
+		log.Printf("No request found for response id %d from %s",
+			msg.GetId(), c.ctx.RemoteAddr)
+		return
+	}
+	waiter <- msg
+}
+
+// Marks the connection as closed and releases everyone waiting for a
+// response.
+func (c *conn) terminate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, waiter := range c.waiters {
+		close(waiter)
+		delete(c.waiters, id)
+	}
+}
+
+// Reads and processes messages until the connection is closed.  Requests are
+// processed concurrently, so a slow request doesn't hold up the others.
+func (c *conn) serve() {
+	defer c.terminate()
+	defer c.rwc.Close()
+	src := bufio.NewReader(c.rwc)
+	for {
+		msg, err := readMessage(src)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from %s: %s", c.ctx.RemoteAddr,
+					err)
+			}
+			return
+		}
+
+		if msg.Method == nil {
+			c.processResponse(msg)
+		} else {
+			go c.processRequest(msg)
+		}
+	}
+}
+
+func (c *conn) close() error {
+	return c.rwc.Close()
+}
+
+type method struct {
+	handler Handler
+
+	// True if the method can be called before the remote end has logged in.
+	noauth bool
+}
+
+// A thread-safe mapping from method name to handler.
+type methodMap struct {
+	mu      sync.Mutex
+	methods map[string]method
+}
+
+func newMethodMap() *methodMap {
+	return &methodMap{methods: make(map[string]method)}
+}
+
+// Returns the handler for method 'name' (nil if there isn't one) and whether
+// it can be called without logging in.
+func (m *methodMap) get(name string) (Handler, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meth := m.methods[name]
+	return meth.handler, meth.noauth
+}
+
+func (m *methodMap) set(name string, handler Handler, noauth bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.methods[name] = method{handler, noauth}
+}
@@ -0,0 +1,338 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Encrypted, mutually authenticated connections keyed from the repository
+// secret, the equivalent of ssl.crk.
+//
+// ssl.crk uses TLS-PSK, which the Go TLS library doesn't support.  Instead,
+// both ends perform a TLS 1.3 handshake with an ephemeral self-signed server
+// certificate (which is not verified) and then prove to each other that they
+// know the pre-shared key by exchanging HMACs of the TLS session's exported
+// keying material.  The exported keying material is different on each side
+// of a man in the middle, so a peer that doesn't know the key can neither
+// impersonate an end nor relay the connection.
+//
+// The identities and keys are the same as in ssl.crk:
+//   - for peers, the identity is 'P' + an encrypted random id and the key is
+//     the encrypted SHA256 hash of the id.  This relies on the cipher being
+//     deterministic, which AES-SIV is.
+//   - for local users, the identity is 'L' + the first half of a nonce
+//     obtained from .mawfs/otp and the key is the second half.
+//
+// After the handshake, the identity is sent as a size-prefixed string, then
+// the client's HMAC and then the server's HMAC, which the server only sends
+// if it accepted the client's.  A connection that completes the handshake is
+// logged in.
+
+package rpc
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"math/big"
+	"net"
+	blockstore "store"
+	"time"
+)
+
+// The time allowed for the handshake.
+const handshakeTimeout = 30 * time.Second
+
+// The largest identity we'll accept.
+const maxIdentitySize = 1024
+
+// The label for the keying material exported from the TLS session.
+const exporterLabel = "EXPORTER-mawfs-psk"
+
+// Returned by the handshake if the other end doesn't know the key.
+var ErrBadKey = errors.New("Peer failed to prove knowledge of the key")
+
+// Returns the identity and key for connecting to peers with the key in
+// 'fsInfo'.
+func peerIdentity(fsInfo *blockstore.FSInfo) ([]byte, []byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	encrypted, err := fsInfo.Encrypt(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	psk, err := fsInfo.Encrypt(hash(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]byte{'P'}, encrypted...), psk, nil
+}
+
+// Returns the identity and key for connecting to the local server with a
+// nonce obtained from .mawfs/otp.
+func localIdentity(nonce []byte) ([]byte, []byte, error) {
+	if len(nonce) != NONCE_SIZE {
+		return nil, nil, fmt.Errorf("Nonce must be %d bytes", NONCE_SIZE)
+	}
+	return append([]byte{'L'}, nonce[:NONCE_SIZE/2]...),
+		nonce[NONCE_SIZE/2:], nil
+}
+
+// Returns the key for the client 'identity', nil if the identity is invalid.
+func (s *Server) getPSK(identity []byte) ([]byte, error) {
+	if len(identity) == 0 {
+		return nil, nil
+	}
+	switch identity[0] {
+	case 'P':
+		id, err := s.fsInfo.Decrypt(identity[1:])
+		if err != nil || len(id) == 0 {
+			return nil, nil
+		}
+		return s.fsInfo.Encrypt(hash(id))
+	case 'L':
+		if len(identity) != NONCE_SIZE/2+1 {
+			return nil, nil
+		}
+		return s.nonces.RedeemPrefix(identity[1:]), nil
+	}
+	return nil, nil
+}
+
+// Returns the HMAC that proves that 'side' knows 'psk'.
+func computeMAC(tlsConn *tls.Conn, psk []byte, side string) ([]byte, error) {
+	state := tlsConn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(exporterLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte(side))
+	mac.Write(material)
+	return mac.Sum(nil), nil
+}
+
+// Writes a size-prefixed string.
+func writeString(dst io.Writer, data []byte) error {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeRawBytes(data)
+	_, err := dst.Write(buf.Bytes())
+	return err
+}
+
+// Reads a size-prefixed string of at most 'maxSize' bytes.
+func readString(src *bufio.Reader, maxSize uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(src)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("Handshake string of %d bytes is too large",
+			size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(src, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// A TLS connection that has completed the PSK handshake.  Reads go through
+// the reader that was used for the handshake.
+type secureConn struct {
+	*tls.Conn
+	src *bufio.Reader
+}
+
+func (c *secureConn) Read(data []byte) (int, error) {
+	return c.src.Read(data)
+}
+
+// Performs the client side of the handshake over 'rwc'.  On success, returns
+// the secure connection.  'rwc' is closed if the handshake fails.
+func clientHandshake(rwc net.Conn, identity, psk []byte) (net.Conn, error) {
+	// The server's certificate is self-signed and deliberately not
+	// verified, the server is authenticated by the key instead.
+	tlsConn := tls.Client(rwc, &tls.Config{InsecureSkipVerify: true,
+		MinVersion: tls.VersionTLS13,
+	})
+	conn, err := handshake(tlsConn, func(src *bufio.Reader) error {
+		if err := writeString(tlsConn, identity); err != nil {
+			return err
+		}
+		mac, err := computeMAC(tlsConn, psk, "client")
+		if err != nil {
+			return err
+		}
+		if err := writeString(tlsConn, mac); err != nil {
+			return err
+		}
+
+		expected, err := computeMAC(tlsConn, psk, "server")
+		if err != nil {
+			return err
+		}
+		serverMAC, err := readString(src, sha256.Size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			err == nil && !hmac.Equal(serverMAC, expected) {
+			return ErrBadKey
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Performs the server side of the handshake over 'rwc'.  On success, returns
+// the secure connection.  'rwc' is closed if the handshake fails.
+func (s *Server) serverHandshake(rwc net.Conn) (net.Conn, error) {
+	config, err := s.getTLSConfig()
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	tlsConn := tls.Server(rwc, config)
+	return handshake(tlsConn, func(src *bufio.Reader) error {
+		identity, err := readString(src, maxIdentitySize)
+		if err != nil {
+			return err
+		}
+		psk, err := s.getPSK(identity)
+		if err != nil {
+			return err
+		}
+		clientMAC, err := readString(src, sha256.Size)
+		if err != nil {
+			return err
+		}
+
+		// We still have to read the client's MAC for an invalid identity,
+		// but there's no way for it to be correct.
+		if psk == nil {
+			return ErrBadKey
+		}
+		expected, err := computeMAC(tlsConn, psk, "client")
+		if err != nil {
+			return err
+		} else if !hmac.Equal(clientMAC, expected) {
+			return ErrBadKey
+		}
+
+		mac, err := computeMAC(tlsConn, psk, "server")
+		if err != nil {
+			return err
+		}
+		return writeString(tlsConn, mac)
+	})
+}
+
+// Runs the TLS handshake and then 'exchange' (the key exchange) with a
+// timeout.
+func handshake(tlsConn *tls.Conn,
+	exchange func(src *bufio.Reader) error) (net.Conn, error) {
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tlsConn.Handshake()
+	src := bufio.NewReader(tlsConn)
+	if err == nil {
+		err = exchange(src)
+	}
+	if err == nil {
+		err = tlsConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return &secureConn{tlsConn, src}, nil
+}
+
+// Returns the server's TLS configuration, creating it (and the server's
+// ephemeral certificate) the first time.
+func (s *Server) getTLSConfig() (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsConfig != nil {
+		return s.tlsConfig, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().AddDate(10, 0, 0),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert},
+			PrivateKey: key,
+		}},
+		MinVersion: tls.VersionTLS13,
+	}
+	return s.tlsConfig, nil
+}
+
+// Connects to the peer at 'addr' over a secure connection keyed from
+// 'fsInfo'.  The returned proxy is already logged in.
+func DialSecure(addr string, fsInfo *blockstore.FSInfo) (*PeerProxy,
+	error) {
+
+	identity, psk, err := peerIdentity(fsInfo)
+	if err != nil {
+		return nil, err
+	}
+	return dialSecure(addr, identity, psk)
+}
+
+// Connects to the local server at 'addr' over a secure connection keyed from
+// a nonce obtained from .mawfs/otp.  The returned proxy is already logged in.
+func DialSecureWithNonce(addr string, nonce []byte) (*PeerProxy, error) {
+	identity, psk, err := localIdentity(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return dialSecure(addr, identity, psk)
+}
+
+func dialSecure(addr string, identity, psk []byte) (*PeerProxy, error) {
+	rwc, err := net.Dial("tcp", addPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := clientHandshake(rwc, identity, psk)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake verified that the server has the key, too.
+	proxy := NewPeerProxy(conn)
+	proxy.c.ctx.setAuthenticated()
+	return proxy, nil
+}
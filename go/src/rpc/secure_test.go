@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"net"
+	blockstore "store"
+	"sync"
+	"testing"
+)
+
+// Records everything read from the connections it accepts.
+type recordingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	data bytes.Buffer
+}
+
+type recordingConn struct {
+	net.Conn
+	listener *recordingListener
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{conn, l}, nil
+}
+
+func (l *recordingListener) received() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.data.Bytes()...)
+}
+
+func (c *recordingConn) Read(data []byte) (int, error) {
+	count, err := c.Conn.Read(data)
+	c.listener.mu.Lock()
+	c.listener.data.Write(data[:count])
+	c.listener.mu.Unlock()
+	return count, err
+}
+
+// Starts a secure server for 'store' on a loopback port.
+func startSecureServer(t *testing.T, fsInfo *blockstore.FSInfo,
+	store *blockstore.MemNodeStore) (*Server, *recordingListener) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	recorder := &recordingListener{Listener: listener}
+	server := NewServer(fsInfo, store, store.GetRawChunkReader())
+	go server.ServeSecure(recorder)
+	t.Cleanup(func() { server.Close() })
+	return server, recorder
+}
+
+func TestSecureConnection(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, listener := startSecureServer(t, fsInfo, store)
+	addr := listener.Addr().String()
+	digest, _ := store.StoreCommit(&pb.Commit{Timestamp: proto.Int32(100)})
+	store.SetHead("master", digest)
+
+	proxy, err := DialSecure(addr, fsInfo)
+	if err != nil {
+		t.Fatalf("DialSecure: %s", err)
+	}
+	defer proxy.Close()
+
+	// The handshake logs us in.
+	head, err := proxy.GetHead("master")
+	blockstore.Assertf(t, err == nil, "GetHead: %s", err)
+	blockstore.Assert(t, bytes.Equal(head, digest))
+
+	// Nothing we sent should be visible on the wire.
+	blockstore.Assert(t, !bytes.Contains(listener.received(),
+		[]byte("getHead")))
+	blockstore.Assert(t, !bytes.Contains(listener.received(),
+		[]byte("master")))
+}
+
+func TestSecureConnectionWrongKey(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, listener := startSecureServer(t, fsInfo, store)
+	addr := listener.Addr().String()
+
+	_, err := DialSecure(addr, blockstore.NewFSInfo("wrong"))
+	blockstore.Assertf(t, err == ErrBadKey, "got error %v", err)
+
+	// A client with the right key must reject a server with the wrong one.
+	wrongInfo := blockstore.NewFSInfo("wrong")
+	_, listener = startSecureServer(t, wrongInfo,
+		blockstore.NewMemStore(wrongInfo))
+	_, err = DialSecure(listener.Addr().String(), fsInfo)
+	blockstore.Assertf(t, err == ErrBadKey, "got error %v", err)
+
+	// Plaintext clients can't talk to a secure server.
+	_, listener = startSecureServer(t, fsInfo, store)
+	proxy := dialNoLogin(t, listener.Addr().String())
+	blockstore.Assert(t, proxy.Login(fsInfo) != nil)
+}
+
+func TestSecureConnectionWithNonce(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, listener := startSecureServer(t, fsInfo, store)
+	addr := listener.Addr().String()
+
+	nonce, _ := server.GetNonceManager().Get()
+	proxy, err := DialSecureWithNonce(addr, nonce)
+	if err != nil {
+		t.Fatalf("DialSecureWithNonce: %s", err)
+	}
+	defer proxy.Close()
+	_, err = proxy.GetHead("master")
+	blockstore.Assertf(t, err == nil, "GetHead: %s", err)
+
+	// The nonce can't be used again.
+	_, err = DialSecureWithNonce(addr, nonce)
+	blockstore.Assertf(t, err == ErrBadKey, "got error %v", err)
+
+	// The first half of the nonce is not enough.
+	nonce, _ = server.GetNonceManager().Get()
+	bad := append(append([]byte(nil), nonce[:NONCE_SIZE/2]...),
+		make([]byte, NONCE_SIZE/2)...)
+	_, err = DialSecureWithNonce(addr, bad)
+	blockstore.Assertf(t, err == ErrBadKey, "got error %v", err)
+	_, err = DialSecureWithNonce(addr, nonce)
+	blockstore.Assertf(t, err == ErrBadKey, "got error %v", err)
+}
@@ -0,0 +1,452 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"log"
+	pb "mawfs"
+	"net"
+	"os"
+	blockstore "store"
+	"sync"
+)
+
+// Commits the current state of the branch being served.  This is implemented
+// by fusefs.FS.
+type Committer interface {
+	Commit(metadata *pb.CommitMetadata) error
+
+	// Returns the branch that the head being served is on.
+	GetBranch() string
+}
+
+// Serves a store to peers and clients.
+type Server struct {
+	fsInfo  *blockstore.FSInfo
+	store   blockstore.NodeStore
+	methods *methodMap
+	nonces  *NonceManager
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+
+	// The committer for the branch being served, nil if there isn't one.
+	committer Committer
+
+	// The responses expected to the login challenges that we've sent and
+	// haven't had answered, see login().
+	challenges map[string]bool
+
+	// Created on the first secure connection.
+	tlsConfig *tls.Config
+}
+
+// Creates a new server.  'store' is used for the methods that operate on
+// objects and 'reader' for the ones that serve the raw contents of the
+// backing store, they would normally be views of the same store.  'fsInfo'
+// is the FSInfo of the store, peers log in by proving that they have the
+// same key.
+func NewServer(fsInfo *blockstore.FSInfo, store blockstore.NodeStore,
+	reader blockstore.RawChunkReader) *Server {
+
+	s := &Server{fsInfo: fsInfo,
+		store:      store,
+		methods:    newMethodMap(),
+		nonces:     NewNonceManager(),
+		listeners:  make(map[net.Listener]bool),
+		conns:      make(map[*conn]bool),
+		challenges: make(map[string]bool),
+	}
+	s.HandleNoAuth("login", s.login)
+	rawChunkServer{reader}.register(s.methods)
+	s.Handle("getCommit", s.getCommit)
+	s.Handle("peerConnected", s.peerConnected)
+	s.Handle("pullBranch", s.pullBranch)
+	s.Handle("traverse", s.traverse)
+	for _, method := range unsupportedMethods {
+		s.methods.set(method, notSupported(method),
+			method == "getMountpoint")
+	}
+	return s
+}
+
+// The rpc.crk methods that this server doesn't implement.  getMountpoint
+// can be called without logging in, as in rpc.crk.
+var unsupportedMethods = []string{"merge", "resolve", "cancelMerge",
+	"addPeer", "getInfo", "pushBranch", "getMountpoint",
+}
+
+// Returns a handler that fails every call to 'method', so that clients get a
+// clear error rather than "not found" for a method they expect to exist.
+func notSupported(method string) Handler {
+	return func(ctx *Context, request []byte) (proto.Message, error) {
+		return nil, fmt.Errorf("Method %q is not supported by this server",
+			method)
+	}
+}
+
+// Registers 'handler' as the handler for 'method', replacing any existing
+// handler.  The method can only be called by clients that have logged in.
+func (s *Server) Handle(method string, handler Handler) {
+	s.methods.set(method, handler, false)
+}
+
+// Like Handle(), but the method can be called without logging in.
+func (s *Server) HandleNoAuth(method string, handler Handler) {
+	s.methods.set(method, handler, true)
+}
+
+// Returns the server's nonce manager.  Nonces obtained from it can be used
+// once to log in.
+func (s *Server) GetNonceManager() *NonceManager {
+	return s.nonces
+}
+
+// Enables the "commit" method, which commits through 'committer'.  Pushes
+// to the branch that 'committer' is on are stored in tracking branches, see
+// pullBranch().
+func (s *Server) SetCommitter(committer Committer) {
+	s.mu.Lock()
+	s.committer = committer
+	s.mu.Unlock()
+	s.Handle("commit", func(ctx *Context, request []byte) (proto.Message,
+		error) {
+
+		req := &pb.CommitRequest{}
+		if err := proto.Unmarshal(request, req); err != nil {
+			return nil, err
+		}
+		return nil, committer.Commit(req.Metadata)
+	})
+}
+
+// Accepts connections on 'listener' and serves them until the listener is
+// closed.  Returns nil if the listener was closed by Close().  Clients must
+// log in before they can use the connection.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, false)
+}
+
+// Like Serve(), but connections are secured with the handshake in secure.go.
+// Clients that complete the handshake are logged in.
+func (s *Server) ServeSecure(listener net.Listener) error {
+	return s.serve(listener, true)
+}
+
+// Listens on the TCP address 'addr' and serves connections from it.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Listens on the TCP address 'addr' and serves secure connections from it.
+func (s *Server) ListenAndServeSecure(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeSecure(listener)
+}
+
+func (s *Server) serve(listener net.Listener, secure bool) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners[listener] = true
+	s.mu.Unlock()
+
+	for {
+		rwc, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, listener)
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		if !secure {
+			s.serveConn(rwc, false)
+			continue
+		}
+
+		// Do the handshake in the background so a slow client doesn't hold
+		// up the others.
+		go func() {
+			conn, err := s.serverHandshake(rwc)
+			if err != nil {
+				log.Printf("Handshake with %s failed: %s", rwc.RemoteAddr(),
+					err)
+				return
+			}
+			s.serveConn(conn, true)
+		}()
+	}
+}
+
+// Serves a single connection in the background.  'authenticated' is true if
+// the client has already logged in.
+func (s *Server) serveConn(rwc net.Conn, authenticated bool) {
+	c := newConn(rwc, s.methods)
+	c.ctx.authenticated = authenticated
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		rwc.Close()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	go func() {
+		c.serve()
+		c.ctx.mu.Lock()
+		s.retireChallenge(c.ctx)
+		c.ctx.mu.Unlock()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+}
+
+// Closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.conns {
+		c.close()
+	}
+	return nil
+}
+
+// --- Method implementations. ---
+
+// Serves the raw contents of a backing store.  These are the methods that a
+// peer needs to pull from us, so they are also served by a PeerProxy that is
+// pushing a branch.
+type rawChunkServer struct {
+	reader blockstore.RawChunkReader
+}
+
+func (r rawChunkServer) register(methods *methodMap) {
+	methods.set("getObject", r.getObject, false)
+	methods.set("getHead", r.getHead, false)
+	methods.set("getFile", r.getFile, false)
+	methods.set("getJournalBlock", r.getJournalBlock, false)
+}
+
+func (r rawChunkServer) getObject(ctx *Context, request []byte) (
+	proto.Message, error) {
+
+	req := &pb.GetObjectRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	data, err := r.reader.ReadRawChunk(req.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetObjectResponse{Data: data}, nil
+}
+
+func (r rawChunkServer) getHead(ctx *Context, request []byte) (
+	proto.Message, error) {
+
+	req := &pb.GetHeadRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	digest, err := r.reader.GetHead(req.GetBranch())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetHeadResponse{Digest: digest}, nil
+}
+
+func (r rawChunkServer) getFile(ctx *Context, request []byte) (
+	proto.Message, error) {
+
+	req := &pb.GetFileRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	data, err := r.reader.GetFile(req.GetFilename())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("File %q not found", req.GetFilename())
+	} else if err != nil {
+		return nil, err
+	}
+	return &pb.GetFileResponse{Data: data}, nil
+}
+
+func (r rawChunkServer) getJournalBlock(ctx *Context, request []byte) (
+	proto.Message, error) {
+
+	req := &pb.GetJournalBlockRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	if req.GetPos() < 0 {
+		return nil, fmt.Errorf("Invalid journal position %d", req.GetPos())
+	}
+	block, err := r.reader.GetJournalBlock(req.FirstBlockDigest,
+		req.GetBranch(), int(req.GetPos()))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetJournalBlockResponse{
+		FirstBlockDigest: block.FirstBlockDigest,
+		Contents:         block.Contents,
+		Done:             proto.Bool(block.Done),
+	}, nil
+}
+
+func (s *Server) getCommit(ctx *Context, request []byte) (proto.Message,
+	error) {
+
+	req := &pb.GetCommitRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	digest, commit, err := blockstore.LookUpCommit(s.store,
+		req.GetCommitOrTag())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CommitAndDigest{Commit: commit, Digest: digest}, nil
+}
+
+// Checks a branch or peer name from a peer.  These become file names in the
+// backing store (see blockstore.IsValidBranchName()), and "root" is reserved
+// for the root node ref in "refs".  'kind' describes the name in the error.
+func checkName(kind, name string) error {
+	if !blockstore.IsValidBranchName(name) || name == "root" {
+		return fmt.Errorf("Invalid %s name %q", kind, name)
+	}
+	return nil
+}
+
+func (s *Server) peerConnected(ctx *Context, request []byte) (proto.Message,
+	error) {
+
+	req := &pb.PeerConnectedRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	if req.GetPeerName() == "" {
+		return nil, errors.New("peerConnected requires a peer name")
+	}
+	if err := checkName("peer", req.GetPeerName()); err != nil {
+		return nil, err
+	}
+	ctx.setPeerName(req.GetPeerName())
+	return nil, nil
+}
+
+// Returns true if 'branch' is the branch being served through the
+// committer.
+func (s *Server) isServedBranch(branch string) bool {
+	s.mu.Lock()
+	committer := s.committer
+	s.mu.Unlock()
+	return committer != nil && committer.GetBranch() == branch
+}
+
+// Pulls a branch from the peer at the other end of the connection, this is
+// the first half of a push.  Pulling from other peers isn't supported, we
+// have no configured peers to pull from.
+//
+// The branch being served has a live head whose baseline and journal can't
+// be replaced under it, so a push to it is always stored in the tracking
+// branch "<peer>:<branch>" to be merged.
+func (s *Server) pullBranch(ctx *Context, request []byte) (proto.Message,
+	error) {
+
+	req := &pb.PullBranchRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	if !req.GetFromClient() {
+		return nil, errors.New("pullBranch is only supported with fromClient")
+	}
+	peerName := ctx.PeerName()
+	if peerName == "" {
+		return nil, errors.New("pullBranch with fromClient may only be " +
+			"called from another peer")
+	}
+	if err := checkName("branch", req.GetBranch()); err != nil {
+		return nil, err
+	}
+	pull := blockstore.PullBranch
+	if s.isServedBranch(req.GetBranch()) {
+		pull = blockstore.PullTrackingBranch
+	}
+	localName, err := pull(s.store, s.fsInfo, peerName, ctx.Peer(),
+		req.GetBranch())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PullBranchResponse{LocalName: proto.String(localName)}, nil
+}
+
+// Traverses every commit and node in a branch, loading anything we don't
+// have from the peer at the other end of the connection.  This is the second
+// half of a push.
+func (s *Server) traverse(ctx *Context, request []byte) (proto.Message,
+	error) {
+
+	req := &pb.TraverseRequest{}
+	if err := proto.Unmarshal(request, req); err != nil {
+		return nil, err
+	}
+	if err := checkName("branch", req.GetBranch()); err != nil {
+		return nil, err
+	}
+	head, err := s.store.GetHead(req.GetBranch())
+	if _, unknown := err.(blockstore.UnknownName); unknown {
+		return nil, fmt.Errorf("branch %s does not exist", req.GetBranch())
+	} else if err != nil {
+		return nil, err
+	}
+
+	var traversed blockstore.ChunkSet
+	switch req.GetAlgo() {
+	case TRAVERSE_FULL:
+	case TRAVERSE_DELTA:
+		traversed = s.store.GetTraversed()
+	default:
+		return nil, fmt.Errorf("Unknown traversal type %d", req.GetAlgo())
+	}
+
+	store := blockstore.NewReadThroughStore(s.store, s.fsInfo, ctx.Peer())
+	return nil, blockstore.TraverseCommit(store, head, traversed)
+}
@@ -0,0 +1,299 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"net"
+	blockstore "store"
+	"strings"
+	"testing"
+)
+
+// Starts a server for 'store' on a loopback port, returns the server and its
+// address.
+func startServer(t *testing.T, fsInfo *blockstore.FSInfo,
+	store blockstore.NodeStore,
+	reader blockstore.RawChunkReader) (*Server, string) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	server := NewServer(fsInfo, store, reader)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, listener.Addr().String()
+}
+
+// A minimal client that talks directly to the wire protocol.
+type rawClient struct {
+	t      *testing.T
+	conn   net.Conn
+	src    *bufio.Reader
+	lastId int32
+}
+
+func dial(t *testing.T, addr string) *rawClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn, src: bufio.NewReader(conn)}
+}
+
+func (c *rawClient) send(msg *pb.RPCMessage) {
+	if err := writeMessage(c.conn, msg); err != nil {
+		c.t.Fatalf("writeMessage: %s", err)
+	}
+}
+
+func (c *rawClient) read() *pb.RPCMessage {
+	msg, err := readMessage(c.src)
+	if err != nil {
+		c.t.Fatalf("readMessage: %s", err)
+	}
+	return msg
+}
+
+// Calls 'method' and unmarshals the result into 'resp'.  Returns the error
+// from the remote end.
+func (c *rawClient) call(method string, req, resp proto.Message) error {
+	c.lastId++
+	msg := &pb.RPCMessage{Id: proto.Int32(c.lastId),
+		Method: proto.String(method),
+	}
+	if req != nil {
+		msg.Request, _ = proto.Marshal(req)
+	}
+	c.send(msg)
+
+	reply := c.read()
+	if reply.GetId() != c.lastId {
+		c.t.Fatalf("got reply id %d, expected %d", reply.GetId(), c.lastId)
+	}
+	if reply.Error != nil {
+		return errors.New(reply.GetError())
+	}
+	if resp != nil {
+		if err := proto.Unmarshal(reply.Response, resp); err != nil {
+			c.t.Fatalf("Unmarshal: %s", err)
+		}
+	}
+	return nil
+}
+
+// Logs in as a peer with the key in 'fsInfo'.
+func (c *rawClient) login(fsInfo *blockstore.FSInfo) {
+	challenge, expected, _ := newChallenge(fsInfo)
+	resp := &pb.LoginResponse{}
+	err := c.call("login", &pb.LoginRequest{Challenge: challenge}, resp)
+	if err != nil || resp.Error != nil ||
+		!checkResponse(fsInfo, resp.Response, expected) {
+		c.t.Fatalf("login challenge failed: %v, %q", err, resp.GetError())
+	}
+
+	response, _, _ := answerChallenge(fsInfo, resp.Challenge)
+	resp = &pb.LoginResponse{}
+	err = c.call("login", &pb.LoginRequest{Response: response}, resp)
+	if err != nil || resp.Error != nil {
+		c.t.Fatalf("login response failed: %v, %q", err, resp.GetError())
+	}
+}
+
+func TestGetObjectAndHead(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+	client.login(fsInfo)
+
+	node := &pb.Node{Contents: proto.String("contents")}
+	digest, _ := store.StoreNode(node)
+	store.SetHead("master", digest)
+
+	objResp := &pb.GetObjectResponse{}
+	err := client.call("getObject", &pb.GetObjectRequest{Digest: digest},
+		objResp)
+	blockstore.Assertf(t, err == nil, "getObject: %s", err)
+	chunk, err := fsInfo.ReadChunk(bytes.NewBuffer(objResp.Data))
+	blockstore.Assert(t, err == nil)
+	loaded, _ := store.LoadNode(digest)
+	blockstore.Assert(t, proto.Equal(loaded, node) && chunk != nil)
+
+	objResp = &pb.GetObjectResponse{}
+	err = client.call("getObject",
+		&pb.GetObjectRequest{Digest: []byte("missing")}, objResp)
+	blockstore.Assert(t, err == nil && objResp.Data == nil)
+
+	headResp := &pb.GetHeadResponse{}
+	err = client.call("getHead",
+		&pb.GetHeadRequest{Branch: proto.String("master")}, headResp)
+	blockstore.Assert(t, err == nil && bytes.Equal(headResp.Digest, digest))
+	headResp = &pb.GetHeadResponse{}
+	err = client.call("getHead",
+		&pb.GetHeadRequest{Branch: proto.String("unknown")}, headResp)
+	blockstore.Assert(t, err == nil && headResp.Digest == nil)
+}
+
+func TestGetFileAndJournal(t *testing.T) {
+	backing := blockstore.NewFakeFileSys()
+	fsInfo, _ := blockstore.LoadFSInfo(backing, "password", true)
+	store := blockstore.NewChunkStore(fsInfo, backing)
+	_, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+	client.login(fsInfo)
+
+	fileResp := &pb.GetFileResponse{}
+	err := client.call("getFile",
+		&pb.GetFileRequest{Filename: proto.String("params")}, fileResp)
+	blockstore.Assert(t, err == nil && len(fileResp.Data) > 0)
+	err = client.call("getFile",
+		&pb.GetFileRequest{Filename: proto.String("missing")}, nil)
+	blockstore.Assertf(t, err != nil && err.Error() ==
+		`File "missing" not found`, "got error %v", err)
+
+	for i := 0; i < 2000; i++ {
+		store.WriteToJournal("master", &pb.Change{Type: proto.Int32(1),
+			Name: proto.String(strings.Repeat("name", 25)),
+		})
+	}
+	src, _ := backing.Open("journals/master")
+	expected := &bytes.Buffer{}
+	expected.ReadFrom(src)
+
+	var journal []byte
+	req := &pb.GetJournalBlockRequest{Branch: proto.String("master"),
+		Pos: proto.Int32(0),
+	}
+	for blocks := 1; ; blocks++ {
+		resp := &pb.GetJournalBlockResponse{}
+		err := client.call("getJournalBlock", req, resp)
+		blockstore.Assertf(t, err == nil, "getJournalBlock: %s", err)
+		journal = append(journal, resp.Contents...)
+		if resp.GetDone() {
+			blockstore.Assert(t, blocks > 1)
+			break
+		}
+		req.FirstBlockDigest = resp.FirstBlockDigest
+		req.Pos = proto.Int32(int32(len(journal)))
+	}
+	blockstore.Assert(t, bytes.Equal(journal, expected.Bytes()))
+
+	resp := &pb.GetJournalBlockResponse{}
+	err = client.call("getJournalBlock",
+		&pb.GetJournalBlockRequest{Branch: proto.String("other")}, resp)
+	blockstore.Assert(t, err == nil && resp.Contents == nil && resp.GetDone())
+}
+
+type fakeCommitter struct {
+	metadata *pb.CommitMetadata
+}
+
+func (c *fakeCommitter) Commit(metadata *pb.CommitMetadata) error {
+	c.metadata = metadata
+	return nil
+}
+
+func (c *fakeCommitter) GetBranch() string {
+	return ""
+}
+
+func TestCommits(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+	client.login(fsInfo)
+
+	commit := &pb.Commit{Timestamp: proto.Int32(100)}
+	digest, _ := store.StoreCommit(commit)
+	store.SetHead("master", digest)
+	resp := &pb.CommitAndDigest{}
+	err := client.call("getCommit",
+		&pb.GetCommitRequest{CommitOrTag: proto.String("master")}, resp)
+	blockstore.Assertf(t, err == nil, "getCommit: %s", err)
+	blockstore.Assert(t, bytes.Equal(resp.Digest, digest))
+	blockstore.Assert(t, proto.Equal(resp.Commit, commit))
+	err = client.call("getCommit",
+		&pb.GetCommitRequest{CommitOrTag: proto.String("unknown")}, resp)
+	blockstore.Assert(t, err != nil)
+
+	// "commit" isn't available until there's a committer.
+	metadata := &pb.CommitMetadata{Comment: proto.String("comment")}
+	err = client.call("commit", &pb.CommitRequest{Metadata: metadata}, nil)
+	blockstore.Assert(t, err != nil)
+	committer := &fakeCommitter{}
+	server.SetCommitter(committer)
+	err = client.call("commit", &pb.CommitRequest{Metadata: metadata}, nil)
+	blockstore.Assertf(t, err == nil, "commit: %s", err)
+	blockstore.Assert(t, proto.Equal(committer.metadata, metadata))
+}
+
+func TestUnknownAndAsyncMethods(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	server, addr := startServer(t, fsInfo, store, store.GetRawChunkReader())
+	client := dial(t, addr)
+	client.login(fsInfo)
+
+	err := client.call("bogus", nil, nil)
+	blockstore.Assertf(t, err != nil && err.Error() ==
+		`Method "bogus" not found`, "got error %v", err)
+
+	err = client.call("merge", nil, nil)
+	blockstore.Assertf(t, err != nil && err.Error() ==
+		`Method "merge" is not supported by this server`, "got error %v", err)
+
+	// A panicking handler gets an error response rather than killing the
+	// server.
+	server.Handle("panic", func(ctx *Context, request []byte) (
+		proto.Message, error) {
+		panic("boom")
+	})
+	err = client.call("panic", nil, nil)
+	blockstore.Assertf(t, err != nil && err.Error() == "Internal error: boom",
+		"got error %v", err)
+
+	// Asynchronous requests (with no id) get no response, so the next
+	// message we read must be the response to the synchronous call.
+	client.send(&pb.RPCMessage{Method: proto.String("bogus")})
+	err = client.call("getHead",
+		&pb.GetHeadRequest{Branch: proto.String("master")}, nil)
+	blockstore.Assert(t, err == nil)
+}
+
+func TestClose(t *testing.T) {
+	fsInfo := blockstore.NewFSInfo("password")
+	store := blockstore.NewMemStore(fsInfo)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := NewServer(fsInfo, store, store.GetRawChunkReader())
+	result := make(chan error)
+	go func() { result <- server.Serve(listener) }()
+	client := dial(t, listener.Addr().String())
+	client.login(fsInfo)
+	blockstore.Assert(t, client.call("getHead", &pb.GetHeadRequest{}, nil) ==
+		nil)
+
+	server.Close()
+	blockstore.Assert(t, <-result == nil)
+	_, err := readMessage(client.src)
+	blockstore.Assert(t, err != nil)
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Finding the common ancestor of two branches, the equivalent of
+// findCommonCommit() and findCommonAncestor() in util.crk.
+
+package blockstore
+
+import (
+	"bytes"
+	"errors"
+	"history"
+)
+
+// Returns the digest of a commit that is an ancestor of (or the same as)
+// both 'alpha' and 'beta'.  Returns nil if there is none, which means that
+// the commits are from different filesystems.  See
+// history.FindCommonCommit().
+func FindCommonCommit(store NodeStore, alpha, beta []byte) ([]byte, error) {
+	return history.FindCommonCommit(store, alpha, beta)
+}
+
+// Returns a read-only head for the tree that 'target' and 'other' (the
+// heads of two branches) are both derived from.  If the branches have the
+// same baseline commit, this is the baseline with the changes that are
+// common to both journals, otherwise it is the tree of their common commit.
+func FindCommonAncestor(target, other *Head) (*Head, error) {
+	if bytes.Equal(target.baselineCommit, other.baselineCommit) {
+		org := target.cache.GetCommitHead(target.baselineCommit)
+		root, err := org.GetRoot()
+		if err != nil {
+			return nil, err
+		}
+		a, err := target.store.MakeJournalIter(target.branch)
+		if err != nil {
+			return nil, err
+		}
+		b, err := other.store.MakeJournalIter(other.branch)
+		if err != nil {
+			return nil, err
+		}
+		if err := root.replayJournalUntilDivergence(a, b); err != nil {
+			return nil, err
+		}
+		return org, nil
+	}
+
+	common, err := FindCommonCommit(target.store, target.baselineCommit,
+		other.baselineCommit)
+	if err != nil {
+		return nil, err
+	} else if common == nil {
+		return nil, errors.New("Branches have no common ancestor")
+	}
+	return target.cache.GetCommitHead(common), nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"testing"
+)
+
+// Stores a commit with the given parents, returns its digest.
+func storeTestCommit(t *testing.T, store NodeStore, timestamp int32,
+	parents ...[]byte) []byte {
+
+	digest, err := store.StoreCommit(&pb.Commit{Parent: parents,
+		Timestamp: proto.Int32(timestamp),
+	})
+	if err != nil {
+		t.Fatalf("StoreCommit: %s", err)
+	}
+	return digest
+}
+
+func TestFindCommonCommit(t *testing.T) {
+	store := NewMemStore(NewFSInfo("password"))
+	root := storeTestCommit(t, store, 1)
+	base := storeTestCommit(t, store, 2, root)
+	a1 := storeTestCommit(t, store, 3, base)
+	a2 := storeTestCommit(t, store, 4, a1)
+	b1 := storeTestCommit(t, store, 5, base)
+	merged := storeTestCommit(t, store, 6, a2, b1)
+	b2 := storeTestCommit(t, store, 7, b1)
+
+	check := func(alpha, beta, expected []byte) {
+		t.Helper()
+		common, err := FindCommonCommit(store, alpha, beta)
+		Assertf(t, err == nil && bytes.Equal(common, expected),
+			"got %s, %v, expected %s", sig(common), err, sig(expected))
+	}
+	check(a2, b1, base)
+	check(b1, a2, base)
+	check(a2, a2, a2)
+	check(a1, a2, a1)
+	check(merged, b2, b1)
+	check(merged, a1, a1)
+
+	unrelated := storeTestCommit(t, store, 8)
+	check(a2, unrelated, nil)
+}
+
+func TestFindCommonAncestor(t *testing.T) {
+	p := newPullTest(t)
+	base := p.commit(p.addFile(p.local, "base"))
+	p.local.SetHead("other", base)
+
+	// Give both branches a common change, then diverge.
+	master := p.addFile(p.local, "shared")
+	iter, _ := p.local.MakeJournalIter("master")
+	shared, _ := readJournalIter(iter)
+	for _, entry := range shared {
+		p.local.WriteToJournal("other", &entry.change)
+	}
+	root, _ := master.GetRoot()
+	root.AddChild("master-only", &pb.Node{}, 0)
+	other, _ := NewCache(p.local).GetHead("other")
+	otherRoot, _ := other.GetRoot()
+	otherRoot.AddChild("other-only", &pb.Node{}, 0)
+
+	org, err := FindCommonAncestor(master, other)
+	if err != nil {
+		t.Fatalf("FindCommonAncestor: %s", err)
+	}
+	Assert(t, org.GetBranch() == "")
+	Assert(t, bytes.Equal(org.GetBaselineCommit(), base))
+	Assert(t, bytes.Equal(org.GetLastChange(), shared[1].digest))
+	orgRoot, _ := org.GetRoot()
+	for name, expected := range map[string]bool{"base": true, "shared": true,
+		"master-only": false, "other-only": false} {
+		child, _ := orgRoot.GetChildByName(name)
+		Assertf(t, (child != nil) == expected, "child %s", name)
+	}
+
+	// The common ancestor can't be changed.
+	_, err = orgRoot.AddChild("new", &pb.Node{}, 0)
+	Assert(t, err != nil)
+
+	// With different commits, the ancestor is the common commit.
+	masterCommit := p.commit(master)
+	p.commit(other)
+	org, err = FindCommonAncestor(master, other)
+	Assert(t, err == nil && bytes.Equal(org.GetBaselineCommit(), base))
+	master.Fork("fork")
+	forked, _ := NewCache(p.local).GetHead("fork")
+	Assert(t, bytes.Equal(forked.GetBaselineCommit(), masterCommit))
+}
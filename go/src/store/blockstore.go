@@ -19,12 +19,17 @@ package blockstore
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"github.com/golang/protobuf/proto"
 	"github.com/jacobsa/crypto/siv"
 	"io"
 	pb "mawfs"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 const BlockSize = 65536
@@ -53,6 +58,14 @@ type SivCipher struct {
 	key []byte
 }
 
+// Creates a new AES-SIV cipher.  'key' must be 32 bytes.
+func NewSivCipher(key []byte) (Cipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES-SIV key must be 32 bytes.")
+	}
+	return &SivCipher{key}, nil
+}
+
 func (cipher *SivCipher) Encrypt(plaintext []byte) ([]byte, error) {
 	return siv.Encrypt(nil, cipher.key, plaintext, nil)
 }
@@ -67,10 +80,16 @@ type FSInfo struct {
 
 // Cretaes a new FSInfo object from the given password.  The password can be
 // ordinary UIT8 text and of any length, the actual key will be generated from
-// its SHA256 sum.
+// its SHA256 sum.  This is the key derivation used by the Crack
+// implementation and is cheap to brute-force, use LoadFSInfo() to get the
+// cipher from a backing store's params file.
 func NewFSInfo(password string) *FSInfo {
-	key := sha256.Sum256([]byte(password))
-	return &FSInfo{&SivCipher{key[:]}}
+	return &FSInfo{&SivCipher{HashPassword(password)}}
+}
+
+// Creates a new FSInfo object that uses 'cipher'.
+func NewFSInfoFromCipher(cipher Cipher) *FSInfo {
+	return &FSInfo{cipher}
 }
 
 // Returns plaintext encrypted with the filesystem's cipher.
@@ -141,7 +160,8 @@ type NodeStore interface {
 	// storeNode() only it doesn't store the node, it just creates its digest.
 	MakeDigest(data []byte) ([]byte, error)
 
-	// Get the node at the given digest, nil if it's not currently stored.
+	// Get the node at the given digest, an error if it's not currently
+	// stored.
 	LoadNode(digest []byte) (*pb.Node, error)
 
 	// Stores a Commit, returns its digest.
@@ -167,6 +187,10 @@ type NodeStore interface {
 	// Sets the digest of the head commit for the branch.
 	SetHead(branch string, digest []byte) error
 
+	// Removes the head of a branch.  Removing a branch that doesn't exist
+	// is not an error.
+	DeleteHead(branch string) error
+
 	// Write a change to the journal for the branch.  Returns the digest of
 	// the change.
 	WriteToJournal(branch string, change *pb.Change) ([]byte, error)
@@ -180,6 +204,35 @@ type NodeStore interface {
 	//    ## Returns the size of the journal, or rather, the size of all of the
 	//    ## changes in it.
 	//    @abstract uint getJournalSize(String branch);
+
+	// Returns the set of chunks that are known to be completely traversed.
+	// A store may choose not to implement this, in which case it returns
+	// nil.
+	GetTraversed() ChunkSet
+}
+
+// Returns the digest and commit named by 'commitOrTag', which is either an
+// alt-encoded commit digest or a branch name.  Returns an UnknownName error if
+// it is neither.
+func LookUpCommit(store NodeStore, commitOrTag string) ([]byte, *pb.Commit,
+	error) {
+
+	if digest, err := altDecode(commitOrTag); err == nil {
+		if commit, err := store.LoadCommit(digest); err == nil {
+			return digest, commit, nil
+		}
+	}
+
+	// Assume it's a branch name.
+	digest, err := store.GetHead(commitOrTag)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := store.LoadCommit(digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return digest, commit, nil
 }
 
 // Wraps a file in an interface.
@@ -187,6 +240,9 @@ type File interface {
 	io.Closer
 	io.Reader
 	io.Writer
+
+	// Commits the contents of the file to stable storage.
+	Sync() error
 }
 
 // Wraps a filesystem in an interface to improve testability.
@@ -197,13 +253,37 @@ type FileSys interface {
 	Exists(name string) bool
 	Mkdir(name string) error
 	Remove(name string) error
+
+	// Renames 'oldName' to 'newName', replacing 'newName' if it exists.
+	// The rename must be atomic and durable once it returns.
+	Rename(oldName, newName string) error
+
+	// Returns the files and directories in the directory 'name' ("" for
+	// the top level) sorted by name.  Returns an error satisfying
+	// os.IsNotExist() if there is no such directory.
+	List(name string) ([]DirEntry, error)
 }
 
-// Implements File.
+// An entry in the listing of a directory.
+type DirEntry struct {
+	Name    string
+	IsDir   bool
+	ModTime time.Time
+}
+
+// Implements FileSys over a directory in the local filesystem.
 type BackingDir struct {
 	root string
 }
 
+// Creates a BackingDir rooted at 'root'.
+func NewBackingDir(root string) BackingDir {
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	return BackingDir{root}
+}
+
 func checkBackingDirIfaces() {
 	var _ FileSys = &BackingDir{}
 }
@@ -217,9 +297,9 @@ func (bd BackingDir) Open(name string) (File, error) {
 }
 
 func (bd BackingDir) Append(name string) (File, error) {
-	return os.OpenFile(name,
+	return os.OpenFile(bd.root+name,
 		os.O_WRONLY|os.O_APPEND|os.O_SYNC|os.O_CREATE,
-		0)
+		0600)
 }
 
 func (bd BackingDir) Exists(name string) bool {
@@ -233,54 +313,135 @@ func (bd BackingDir) Exists(name string) bool {
 }
 
 func (bd BackingDir) Mkdir(name string) error {
-	return os.Mkdir(name, 0700)
+	return os.Mkdir(bd.root+name, 0700)
 }
 
 func (bd BackingDir) Remove(name string) error {
-	return os.Remove(name)
+	return os.Remove(bd.root + name)
+}
+
+func (bd BackingDir) Rename(oldName, newName string) error {
+	if err := os.Rename(bd.root+oldName, bd.root+newName); err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename survives a crash.
+	return syncDir(filepath.Dir(bd.root + newName))
+}
+
+func (bd BackingDir) List(name string) ([]DirEntry, error) {
+	entries, err := os.ReadDir(bd.root + name)
+	if err != nil {
+		return nil, err
+	}
+	var result []DirEntry
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Removed since it was read.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, DirEntry{entry.Name(), entry.IsDir(),
+			info.ModTime()})
+	}
+	return result, nil
+}
+
+// Writes 'data' to the file 'name' atomically and durably.  The data is
+// written to a temporary file, which is synced and then renamed to 'name',
+// so after a crash 'name' has either its old contents or all of 'data'.
+func WriteFileAtomically(backing FileSys, name string, data []byte) error {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tempName := name + "." + altEncode(suffix) + tempSuffix
+	dst, err := backing.Create(tempName)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = backing.Rename(tempName, name)
+	}
+	if err != nil {
+		backing.Remove(tempName)
+	}
+	return err
 }
 
+// The suffix of the temporary files written by WriteFileAtomically().  Any
+// that exist after a crash can be removed.
+const tempSuffix = ".tmp"
+
 // NodeStore implementation that writes to a backing filesystem directory.
 type ChunkStore struct {
 	fsInfo  *FSInfo
 	backing FileSys
+
+	// Set by EnableQuarantine().
+	quarantine   bool
+	replacements RemoteReader
 }
 
 func NewChunkStore(fsInfo *FSInfo, backing FileSys) *ChunkStore {
-	return &ChunkStore{fsInfo, backing}
+	return &ChunkStore{fsInfo: fsInfo, backing: backing}
 }
 
-// Stores chunk data among the objects (filenames are the alt-encoded
-// digests), returns the digest.
-func (cs *ChunkStore) store(obj proto.Message) ([]byte, error) {
+// Stores 'obj' as an encrypted object in 'backing' (see layout.go for where),
+// returns the digest.
+func storeObject(fsInfo *FSInfo, backing FileSys, obj proto.Message) (
+	[]byte, error) {
+
 	rep, err := proto.Marshal(obj)
 	if err != nil {
 		return nil, err
 	}
 
 	buf := bytes.Buffer{}
-	digest, err := cs.fsInfo.WriteChunk(&buf, rep)
+	digest, err := fsInfo.WriteChunk(&buf, rep)
 	if err != nil {
 		return nil, err
 	}
 
-	dst, err := cs.backing.Create(altEncode(digest))
-	if err != nil {
+	if err := writeObject(backing, digest, buf.Bytes()); err != nil {
 		return nil, err
 	}
-
-	dst.Write(buf.Bytes())
 	return digest, nil
 }
 
+// Stores chunk data among the objects (filenames are the alt-encoded
+// digests), returns the digest.
+func (cs *ChunkStore) store(obj proto.Message) ([]byte, error) {
+	return storeObject(cs.fsInfo, cs.backing, obj)
+}
+
+// Loads the object with 'digest'.  Returns a *CorruptObject error if the
+// object file doesn't match its digest, an *UndecryptableObject error if it
+// does but can't be decrypted.  Only corrupt objects are quarantined.
 func (cs *ChunkStore) load(digest []byte) (*Chunk, error) {
-	src, err := cs.backing.Open(altEncode(digest))
-	if err != nil {
-		return nil, err
+	name := findObject(cs.backing, digest)
+	if name == "" {
+		return nil, &os.PathError{Op: "open", Path: objectName(digest),
+			Err: os.ErrNotExist}
 	}
-	defer src.Close()
-
-	return cs.fsInfo.ReadChunk(src)
+	raw, err := readObject(cs.backing, name, digest)
+	var chunk *Chunk
+	if err == nil {
+		chunk, err = cs.fsInfo.decryptObject(raw, digest, name)
+	}
+	if corrupt, ok := err.(*CorruptObject); ok && cs.quarantine {
+		return cs.quarantineObject(corrupt)
+	}
+	return chunk, err
 }
 
 func (cs *ChunkStore) StoreNode(node *pb.Node) ([]byte, error) {
@@ -328,25 +489,34 @@ func (cs *ChunkStore) LoadCommit(digest []byte) (*pb.Commit, error) {
 }
 
 func (cs *ChunkStore) LoadRootDigest() ([]byte, error) {
+	if !cs.backing.Exists("refs/root") {
+		return nil, nil
+	}
 	src, err := cs.backing.Open("refs/root")
 	if err != nil {
 		return nil, err
 	}
+	defer src.Close()
 
 	buf := bytes.Buffer{}
 	buf.ReadFrom(src)
 	return altDecode(buf.String())
 }
 
+// Creates the refs directory if it doesn't exist.
+func (cs *ChunkStore) makeRefsDir() error {
+	if !cs.backing.Exists("refs") {
+		return cs.backing.Mkdir("refs")
+	}
+	return nil
+}
+
 func (cs *ChunkStore) StoreRootDigest(digest []byte) error {
-	encoded := altEncode(digest)
-	dst, err := cs.backing.Create("refs/root")
-	if err != nil {
+	if err := cs.makeRefsDir(); err != nil {
 		return err
 	}
-
-	dst.Write([]byte(encoded))
-	return nil
+	return WriteFileAtomically(cs.backing, "refs/root",
+		[]byte(altEncode(digest)))
 }
 
 func (cs *ChunkStore) GetHead(branch string) ([]byte, error) {
@@ -357,20 +527,27 @@ func (cs *ChunkStore) GetHead(branch string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer src.Close()
 	buf := bytes.Buffer{}
 	buf.ReadFrom(src)
 	return altDecode(buf.String())
 }
 
 func (cs *ChunkStore) SetHead(branch string, digest []byte) error {
-	dst, err := cs.backing.Create("refs/" + branch)
-	if err != nil {
+	// Create the refs directory first.
+	if err := cs.makeRefsDir(); err != nil {
 		return err
 	}
 
-	_, err = dst.Write([]byte(altEncode(digest)))
-	dst.Close()
-	return err
+	return WriteFileAtomically(cs.backing, "refs/"+branch,
+		[]byte(altEncode(digest)))
+}
+
+func (cs *ChunkStore) DeleteHead(branch string) error {
+	if !cs.backing.Exists("refs/" + branch) {
+		return nil
+	}
+	return cs.backing.Remove("refs/" + branch)
 }
 
 func (cs *ChunkStore) WriteToJournal(branch string, change *pb.Change) (
@@ -405,19 +582,23 @@ func (cs *ChunkStore) WriteToJournal(branch string, change *pb.Change) (
 	if err != nil {
 		return nil, err
 	}
+	defer dst.Close()
 
 	_, err = dst.Write(envelope.Bytes())
 	return digest, err
 }
 
 func (cs *ChunkStore) DeleteJournal(branch string) error {
-	return cs.backing.Remove(branch)
+	if !cs.backing.Exists("journals/" + branch) {
+		return nil
+	}
+	return cs.backing.Remove("journals/" + branch)
 }
 
 // Implements JournalIter.
 type csJournalIter struct {
-	src    File
-	cs     *ChunkStore
+	src    io.Reader
+	fsInfo *FSInfo
 	change *ChangeEntry
 }
 
@@ -426,8 +607,10 @@ func (i *csJournalIter) readChange() (*ChangeEntry, error) {
 	// will also necessarily be shorter than the size + chunk, because every
 	// encrypted Change record has a 16 byte SIV header.
 	buf := bytes.NewBuffer(make([]byte, 8))
-	_, err := i.src.Read(buf.Bytes())
-	if err != nil {
+	_, err := io.ReadFull(i.src, buf.Bytes())
+	if err == io.ErrUnexpectedEOF {
+		return nil, &DecodingError{"Incomplete change record."}
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -444,7 +627,7 @@ func (i *csJournalIter) readChange() (*ChangeEntry, error) {
 	// Read in the rest of the protobuf.
 	remaining := size - (8 - uint64(n))
 	remainingBuf := make([]byte, remaining)
-	n, err = i.src.Read(remainingBuf)
+	n, err = io.ReadFull(i.src, remainingBuf)
 	if uint64(n) != remaining {
 		return nil, &DecodingError{"Incomplete change record."}
 	} else if err != nil {
@@ -453,7 +636,7 @@ func (i *csJournalIter) readChange() (*ChangeEntry, error) {
 	buf.Write(remainingBuf)
 
 	// Read a chunk out of it.
-	chunk, err := i.cs.fsInfo.ReadChunk(buf)
+	chunk, err := i.fsInfo.ReadChunk(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -472,8 +655,10 @@ func (cs *csJournalIter) IsValid() bool {
 	return cs.change != nil
 }
 
-func newCsJournalIter(src File, cs *ChunkStore) (*csJournalIter, error) {
-	result := csJournalIter{src: src, cs: cs}
+func newCsJournalIter(src io.Reader, fsInfo *FSInfo) (*csJournalIter,
+	error) {
+
+	result := csJournalIter{src: src, fsInfo: fsInfo}
 	var err error
 	result.change, err = result.readChange()
 	if err != nil && err != io.EOF {
@@ -501,14 +686,36 @@ func (i *csJournalIter) Elem() (*ChangeEntry, error) {
 func (cs *csJournalIter) Next() error {
 	var err error
 	cs.change, err = cs.readChange()
+	if err == io.EOF {
+		return nil
+	}
 	return err
 }
 
+// Implements JournalIter for a branch that has no journal.
+type nullJournalIter struct{}
+
+func (nullJournalIter) Elem() (*ChangeEntry, error) {
+	return nil, nil
+}
+
+func (nullJournalIter) Next() error {
+	return nil
+}
+
+func (nullJournalIter) IsValid() bool {
+	return false
+}
+
 func (cs *ChunkStore) MakeJournalIter(branch string) (JournalIter, error) {
+	if !cs.backing.Exists("journals/" + branch) {
+		return nullJournalIter{}, nil
+	}
+
 	src, err := cs.backing.Open("journals/" + branch)
 	if err != nil {
 		return nil, err
 	}
 
-	return newCsJournalIter(src, cs)
+	return newCsJournalIter(src, cs.fsInfo)
 }
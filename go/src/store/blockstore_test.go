@@ -17,9 +17,13 @@ package blockstore
 import (
 	"bytes"
 	"crypto/sha256"
+	"github.com/golang/protobuf/proto"
 	pb "mawfs"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewChunk(t *testing.T) {
@@ -162,8 +166,13 @@ func TestCommits(t *testing.T) {
 }
 
 func TestChunkStoreConformance(t *testing.T) {
-	var ns NodeStore = NewChunkStore(NewFSInfo("bad-password"), NewFakeFileSys())
-	ns.StoreCommit(&pb.Commit{Root: []byte("12345")})
+	NodeStoreConformance(t, func() NodeStore {
+		return NewChunkStore(NewFSInfo("bad-password"), NewFakeFileSys())
+	})
+	NodeStoreConformance(t, func() NodeStore {
+		return NewChunkStore(NewFSInfo("bad-password"),
+			NewBackingDir(t.TempDir()))
+	})
 }
 
 func TestStoreRetrieveRootDigest(t *testing.T) {
@@ -251,7 +260,7 @@ func TestJournal(t *testing.T) {
 		}
 
 		if !bytes.Equal(entry.digest, digests[i]) {
-			t.Error("digest %d doesn't match expected value")
+			t.Errorf("digest %d doesn't match expected value", i)
 			t.Fail()
 		}
 
@@ -283,3 +292,269 @@ func TestJournal(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// Serialized objects as written by the Crack implementation (fields are
+// emitted in declaration order, which is not always tag order).
+
+// Commit{parent: "par1", root: "root", journalInfo: "jinfo",
+// journal: "journal", timestamp: 1500000000,
+// metadata: {comment: "comment", committer: "me"}}
+var crackCommitFixture = []byte{
+	0x0a, 0x04, 'p', 'a', 'r', '1',
+	0x12, 0x04, 'r', 'o', 'o', 't',
+	0x1a, 0x05, 'j', 'i', 'n', 'f', 'o',
+	0x22, 0x07, 'j', 'o', 'u', 'r', 'n', 'a', 'l',
+	0x28, 0x80, 0xde, 0xa0, 0xcb, 0x05,
+	0x32, 0x0d,
+	0x0a, 0x07, 'c', 'o', 'm', 'm', 'e', 'n', 't',
+	0x12, 0x02, 'm', 'e',
+}
+
+// Node{checksum: 0, size: 70000,
+// children: [{hash: "hash", name: "file", size: 70000}], mode: 1,
+// time: 1500000000}
+var crackNodeFixture = []byte{
+	0x08, 0x00,
+	0x20, 0xf0, 0xa2, 0x04,
+	0x1a, 0x10,
+	0x0a, 0x04, 'h', 'a', 's', 'h',
+	0x12, 0x04, 'f', 'i', 'l', 'e',
+	0x20, 0xf0, 0xa2, 0x04,
+	0x28, 0x01,
+	0x30, 0x80, 0xde, 0xa0, 0xcb, 0x05,
+}
+
+// Change{type: CHANGE_REPLACE_CHILD, path: [1, 2], index: 3,
+// commit: "commit", sessionId: "session", digest: "digest",
+// time: 1500000000}
+var crackChangeFixture = []byte{
+	0x08, 0x05,
+	0x50, 0x01,
+	0x50, 0x02,
+	0x68, 0x03,
+	0x4a, 0x06, 'c', 'o', 'm', 'm', 'i', 't',
+	0x5a, 0x07, 's', 'e', 's', 's', 'i', 'o', 'n',
+	0x62, 0x06, 'd', 'i', 'g', 'e', 's', 't',
+	0x70, 0x80, 0xde, 0xa0, 0xcb, 0x05,
+}
+
+// Stores 'data' as an encrypted object in 'fs', the way a Crack instance
+// would, and returns its digest.
+func storeRawObject(t *testing.T, fsInfo *FSInfo, fs FileSys,
+	data []byte) []byte {
+
+	buf := bytes.Buffer{}
+	digest, err := fsInfo.WriteChunk(&buf, data)
+	if err != nil {
+		t.Fatalf("WriteChunk: %s", err)
+	}
+	dst, err := fs.Create(altEncode(digest))
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	dst.Write(buf.Bytes())
+	return digest
+}
+
+// Verifies that 'msg' retained all of its fields and survives a round-trip
+// through the Go encoder.
+func checkRoundTrip(t *testing.T, msg, empty proto.Message) {
+	rep, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if err := proto.Unmarshal(rep, empty); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if !proto.Equal(msg, empty) {
+		t.Errorf("Round trip changed the message: %v != %v", msg, empty)
+	}
+}
+
+func TestLoadCrackCommit(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(fsInfo, fs)
+	digest := storeRawObject(t, fsInfo, fs, crackCommitFixture)
+
+	commit, err := cs.LoadCommit(digest)
+	if err != nil {
+		t.Fatalf("LoadCommit: %s", err)
+	}
+	Assert(t, len(commit.XXX_unrecognized) == 0)
+	Assert(t, len(commit.Parent) == 1 && string(commit.Parent[0]) == "par1")
+	Assert(t, string(commit.GetRoot()) == "root")
+	Assert(t, string(commit.GetJournalInfo()) == "jinfo")
+	Assert(t, string(commit.GetJournal()) == "journal")
+	Assert(t, commit.GetTimestamp() == 1500000000)
+	Assert(t, commit.GetMetadata().GetComment() == "comment")
+	Assert(t, commit.GetMetadata().GetCommitter() == "me")
+
+	// All fields are in tag order, so we should get the same object back.
+	newDigest, err := cs.StoreCommit(commit)
+	if err != nil {
+		t.Fatalf("StoreCommit: %s", err)
+	}
+	Assert(t, bytes.Equal(newDigest, digest))
+	checkRoundTrip(t, commit, &pb.Commit{})
+}
+
+func TestLoadCrackNode(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(fsInfo, fs)
+	digest := storeRawObject(t, fsInfo, fs, crackNodeFixture)
+
+	node, err := cs.LoadNode(digest)
+	if err != nil {
+		t.Fatalf("LoadNode: %s", err)
+	}
+	Assert(t, len(node.XXX_unrecognized) == 0)
+	Assert(t, node.Checksum != nil && node.GetChecksum() == 0)
+	Assert(t, node.GetSize() == 70000)
+	Assert(t, node.GetMode() == MODE_DIR)
+	Assert(t, node.GetTime() == 1500000000)
+	Assert(t, len(node.Children) == 1)
+	child := node.Children[0]
+	Assert(t, len(child.XXX_unrecognized) == 0)
+	Assert(t, string(child.GetHash()) == "hash")
+	Assert(t, child.GetName() == "file")
+	Assert(t, child.GetSize() == 70000)
+	checkRoundTrip(t, node, &pb.Node{})
+}
+
+func TestReadCrackJournal(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(fsInfo, fs)
+
+	buf := bytes.Buffer{}
+	if _, err := fsInfo.WriteChunk(&buf, crackChangeFixture); err != nil {
+		t.Fatalf("WriteChunk: %s", err)
+	}
+	envelope := proto.Buffer{}
+	envelope.EncodeRawBytes(buf.Bytes())
+	fs.Mkdir("journals")
+	dst, _ := fs.Create("journals/master")
+	dst.Write(envelope.Bytes())
+
+	iter, err := cs.MakeJournalIter("master")
+	if err != nil {
+		t.Fatalf("MakeJournalIter: %s", err)
+	}
+	Assert(t, iter.IsValid())
+	entry, err := iter.Elem()
+	if err != nil {
+		t.Fatalf("Elem: %s", err)
+	}
+	change := &entry.change
+	Assert(t, len(change.XXX_unrecognized) == 0)
+	Assert(t, change.GetType() == CHANGE_REPLACE_CHILD)
+	Assert(t, reflect.DeepEqual(change.Path, []int32{1, 2}))
+	Assert(t, change.GetIndex() == 3)
+	Assert(t, string(change.GetCommit()) == "commit")
+	Assert(t, string(change.GetSessionId()) == "session")
+	Assert(t, string(change.GetDigest()) == "digest")
+	Assert(t, change.GetTime() == 1500000000)
+	checkRoundTrip(t, change, &pb.Change{})
+}
+
+func TestBackingDir(t *testing.T) {
+	root := t.TempDir()
+	cs := NewChunkStore(NewFSInfo("password"), NewBackingDir(root))
+
+	digest, err := cs.StoreNode(&pb.Node{Contents: proto.String("data")})
+	if err != nil {
+		t.Fatalf("StoreNode: %s", err)
+	}
+	node, err := cs.LoadNode(digest)
+	Assert(t, err == nil && node.GetContents() == "data")
+
+	Assert(t, cs.SetHead("master", digest) == nil)
+	head, err := cs.GetHead("master")
+	Assert(t, err == nil && bytes.Equal(head, digest))
+
+	_, err = cs.WriteToJournal("master",
+		&pb.Change{Type: proto.Int32(CHANGE_RESIZE)})
+	Assertf(t, err == nil, "WriteToJournal: %s", err)
+	iter, err := cs.MakeJournalIter("master")
+	Assert(t, err == nil && iter.IsValid())
+	Assert(t, cs.DeleteJournal("master") == nil)
+	iter, err = cs.MakeJournalIter("master")
+	Assert(t, err == nil && !iter.IsValid())
+
+	// Atomic writes don't leave their temporary files behind.
+	files, _ := filepath.Glob(filepath.Join(root, "*"+tempSuffix))
+	Assertf(t, len(files) == 0, "got temporary files %v", files)
+	files, _ = filepath.Glob(filepath.Join(root, "refs", "*"+tempSuffix))
+	Assertf(t, len(files) == 0, "got temporary files %v", files)
+
+	entries, err := NewBackingDir(root).List("")
+	Assertf(t, err == nil && len(entries) == 3, "List: %v, %v", entries,
+		err)
+	Assert(t, entries[0].Name == "journals" && entries[0].IsDir)
+	Assert(t, entries[1].Name == "objects" && entries[2].Name == "refs")
+	entries, err = NewBackingDir(root).List("refs")
+	Assert(t, err == nil && len(entries) == 1)
+	Assert(t, entries[0].Name == "master" && !entries[0].IsDir &&
+		time.Since(entries[0].ModTime) < time.Minute)
+	_, err = NewBackingDir(root).List("nothing")
+	Assert(t, os.IsNotExist(err))
+}
+
+// Checks that the "master" ref and the root digest in 'cs' are either
+// 'oldDigest' or 'newDigest' and refer to a node that can be loaded.
+// Returns the value of the ref.
+func checkRefs(t *testing.T, cs *ChunkStore, oldDigest,
+	newDigest []byte) []byte {
+
+	head, err := cs.GetHead("master")
+	Assertf(t, err == nil &&
+		(bytes.Equal(head, oldDigest) || bytes.Equal(head, newDigest)),
+		"got head %v, %v", head, err)
+	_, err = cs.LoadNode(head)
+	Assertf(t, err == nil, "LoadNode(head): %s", err)
+
+	root, err := cs.LoadRootDigest()
+	Assertf(t, err == nil &&
+		(bytes.Equal(root, oldDigest) || bytes.Equal(root, newDigest)),
+		"got root digest %v, %v", root, err)
+	_, err = cs.LoadNode(root)
+	Assertf(t, err == nil, "LoadNode(root): %s", err)
+	return head
+}
+
+func TestCrashDuringWrites(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+
+	// Crash after every possible number of operations while storing a node
+	// and updating the refs to it.
+	for n := 0; ; n++ {
+		fs := NewFaultyFileSys()
+		cs := NewChunkStore(fsInfo, fs)
+		oldDigest, err := cs.StoreNode(&pb.Node{Contents: proto.String("old")})
+		Assert(t, err == nil)
+		Assert(t, cs.SetHead("master", oldDigest) == nil)
+		Assert(t, cs.StoreRootDigest(oldDigest) == nil)
+
+		fs.FailAfter(n)
+		newDigest, err := cs.StoreNode(
+			&pb.Node{Contents: proto.String("new")})
+		if err == nil {
+			err = cs.SetHead("master", newDigest)
+		}
+		if err == nil {
+			err = cs.StoreRootDigest(newDigest)
+		}
+		Assertf(t, fs.Failed() == (err != nil), "got error %v", err)
+
+		head := checkRefs(t, NewChunkStore(fsInfo, fs.Crash()), oldDigest,
+			newDigest)
+		if !fs.Failed() {
+			// Everything was written before the crash.
+			Assert(t, bytes.Equal(head, newDigest))
+			Assert(t, n > 3)
+			break
+		}
+	}
+}
@@ -15,9 +15,14 @@
 package blockstore
 
 import (
-     "errors"
+	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	pb "mawfs"
+	"sort"
+	"time"
 	//"strings"  TODO: get latest go, use strings.Compare()
 )
 
@@ -32,12 +37,46 @@ const (
 	DefaultGcBottom       = 16 * Meg
 )
 
+// Change types (the values of Change.type).
+const (
+	// Add a child.  Contains "node" and "name" (add child is only applied to
+	// a directory).
+	CHANGE_ADD_CHILD = 1
+
+	// Delete a child (contains a name).
+	CHANGE_DELETE_CHILD = 2
+
+	// Write data to node contents.  Contains "pos" and "data".
+	CHANGE_WRITE = 3
+
+	// Resize node contents.  Contains "newSize".
+	CHANGE_RESIZE = 4
+
+	// Replace a child.  "path" is the path to the parent, "index" is the
+	// index of the child within the parent.
+	CHANGE_REPLACE_CHILD = 5
+
+	// Set an attribute.
+	CHANGE_SETATTR = 6
+)
+
 // Base class for cached objects.
 type Obj interface {
 	GetNext() Obj
 	SetNext(next Obj)
 	GetPrev() Obj
 	SetPrev(prev Obj)
+
+	// Returns true if the object can be safely released from the cache.
+	Disposable() bool
+
+	// Releases the object (and anything that depends on it) so it can be
+	// freed from memory.  Implementations must call Cache.releaseObj() for
+	// every object that they remove from the cache.
+	Release()
+
+	// Returns the resident size of the object.
+	GetRSize() int
 }
 
 type ObjImpl struct {
@@ -75,6 +114,13 @@ type Cache struct {
 	// oldest is the first.
 	newest, oldest Obj
 
+	// The total resident size of all objects in the list.
+	size int
+
+	// The next object to be considered during a garbage collection.  This
+	// is advanced if the object is released out from under the collector.
+	gcCursor Obj
+
 	//    @final void addChange(Change change) {
 	//        if (lastChange) {
 	//            change.lastChange = lastChange;
@@ -156,7 +202,6 @@ func (cache *Cache) LoadNode(digest []byte) (*pb.Node, error) {
 // Load a cached node.
 func (cache *Cache) makeCachedNode(parent *CachedNode, digest []byte) (
         *CachedNode, error) {
-    fmt.Print("Loading node: ", altEncode(digest))
     n, err := cache.LoadNode(digest)
     if err != nil {
         return nil, err
@@ -164,6 +209,9 @@ func (cache *Cache) makeCachedNode(parent *CachedNode, digest []byte) (
 
     result := NewCachedNode(cache, digest, n)
     result.parent = parent
+    if parent != nil {
+        result.head = parent.head
+    }
     return result, nil
 }
 
@@ -174,6 +222,7 @@ func NewCache(store NodeStore) *Cache {
 	}
 }
 
+// Adds a new object as the most recently used.
 func (c *Cache) addObj(obj Obj) {
 	if obj.GetNext() != nil || obj.GetPrev() != nil {
 		panic("Adding object that's already in the LRU chain.")
@@ -185,6 +234,67 @@ func (c *Cache) addObj(obj Obj) {
 		obj.SetPrev(c.newest)
 	}
 	c.newest = obj
+	c.size += obj.GetRSize()
+}
+
+// Removes the object from the LRU chain.
+func (c *Cache) unlink(obj Obj) {
+	if c.gcCursor == obj {
+		c.gcCursor = obj.GetNext()
+	}
+	if prev := obj.GetPrev(); prev != nil {
+		prev.SetNext(obj.GetNext())
+	} else {
+		c.oldest = obj.GetNext()
+	}
+	if next := obj.GetNext(); next != nil {
+		next.SetPrev(obj.GetPrev())
+	} else {
+		c.newest = obj.GetPrev()
+	}
+	obj.SetNext(nil)
+	obj.SetPrev(nil)
+}
+
+// Releases the object from the LRU chain.
+func (c *Cache) releaseObj(obj Obj) {
+	c.unlink(obj)
+	c.size -= obj.GetRSize()
+}
+
+// Brings an object to the end of the LRU chain (makes it the most recently
+// used).
+func (c *Cache) touch(obj Obj) {
+	if c.newest != obj {
+		c.unlink(obj)
+		c.size -= obj.GetRSize()
+		c.addObj(obj)
+	}
+}
+
+// Returns the total resident size of all objects in the cache.
+func (c *Cache) GetSize() int {
+	return c.size
+}
+
+// Runs garbage collection if the cache has grown past the GC threshold,
+// releasing disposable objects from least to most recently used until the
+// cache size is under the GC bottom.
+func (c *Cache) GarbageCollect() {
+	if c.size <= c.gcThreshold {
+		return
+	}
+
+	for cur := c.oldest; cur != nil && c.size > c.gcBottom; {
+		// Releasing an object can release objects after it, so let
+		// releaseObj() keep track of the next one.
+		c.gcCursor = cur.GetNext()
+		if cur.Disposable() {
+			cur.Release()
+		}
+		cur = c.gcCursor
+	}
+	c.gcCursor = nil
 }
 
 // Returns a Head object for the specified branch.
@@ -221,6 +331,12 @@ func (cache *Cache) GetHead(branch string) (*Head, error) {
     return NewHead(cache, branch, digest), nil
 }
 
+// Returns a Head for the tree of 'commit' that isn't on any branch.  The
+// tree is read-only, attempts to change it fail.
+func (cache *Cache) GetCommitHead(commit []byte) *Head {
+	return NewHead(cache, "", commit)
+}
+
 func boolToString(val bool) string {
     if val {
         return "true"
@@ -264,9 +380,26 @@ type Head struct {
 	// The name of the branch.  "master" is the default branch.
 	branch string
 
+	// The root node, nil until it is loaded by GetRoot().
+	root *CachedNode
+
 	maxContentSize int
 	maxChildren    int
 	maxJournalSize int
+
+	// The total size of all of the changes in the journal.  When this
+	// exceeds maxJournalSize, we commit.
+	journalSize int
+
+	// The id of the current session.  This is stored in every change that
+	// we write to the journal so that peers can tell whether a commit
+	// includes the changes in their copy of the journal.  Created when the
+	// first change is written.
+	sessionId []byte
+
+	// The ids of all of the sessions in the journal, these are stored in the
+	// journal info of the next commit.
+	sessionIds map[string]bool
 }
 
 // Creates a new Head object.
@@ -275,55 +408,269 @@ func NewHead(cache *Cache, branch string, baselineCommit []byte) *Head {
 	return &Head{cache, cache.store, baselineCommit,
 		nil,
 		branch,
+		nil,
 		DefaultMaxContentSize,
 		DefaultMaxChildren,
 		DefaultMaxJournalSize,
+		0,
+		nil,
+		make(map[string]bool),
+	}
+}
+
+// The size of a session id in bytes.
+const sessionIdSize = 8
+
+// Sets the id of the current session.  This is mainly useful for testing,
+// normally the session id is random.
+func (head *Head) SetSessionId(sessionId []byte) {
+	head.sessionId = sessionId
+}
+
+// Returns the name of the head's branch, empty if the head isn't on a
+// branch (see Cache.GetCommitHead()).
+func (head *Head) GetBranch() string {
+	return head.branch
+}
+
+// Moves the head to 'branch'.  Changes made after this are recorded in the
+// journal of the new branch and the next commit becomes its head.
+func (head *Head) SetBranch(branch string) {
+	head.branch = branch
+}
+
+// Returns the digest of the commit that the journal is relative to.
+func (head *Head) GetBaselineCommit() []byte {
+	return head.baselineCommit
+}
+
+// Returns the digest of the last change in the journal, nil if there is
+// none.
+func (head *Head) GetLastChange() []byte {
+	return head.lastChange
+}
+
+// Returns the digest of the last change if there is one, otherwise the
+// digest of the baseline commit.  This identifies the current state of the
+// branch.
+func (head *Head) GetBranchDigest() []byte {
+	if head.lastChange != nil {
+		return head.lastChange
+	}
+	return head.baselineCommit
+}
+
+// Returns the store that the head's branch is stored in.
+func (head *Head) GetStore() NodeStore {
+	return head.store
+}
+
+// Returns the cache that the head's nodes are loaded into.
+func (head *Head) GetCache() *Cache {
+	return head.cache
+}
+
+// Returns the session ids of the head's journal, in sorted order.  They're
+// only known once the journal has been replayed (see GetRoot()).
+func (head *Head) GetSessionIds() [][]byte {
+	ids := make([]string, 0, len(head.sessionIds))
+	for id := range head.sessionIds {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+	result := make([][]byte, len(ids))
+	for i, id := range ids {
+		result[i] = []byte(id)
+	}
+	return result
+}
+
+// Adds 'ids' to the session ids of the head's journal, so the next commit
+// records that it includes the changes from those sessions.  Used when
+// merging another branch (see GetSessionIds()).
+func (head *Head) AddSessionIds(ids [][]byte) {
+	for _, id := range ids {
+		head.sessionIds[string(id)] = true
+	}
+}
+
+// Moves the head to a new branch, 'branch', which starts from the same
+// commit with a copy of the journal.  The original branch is unchanged.
+func (head *Head) Fork(branch string) error {
+	if _, err := head.GetRoot(); err != nil {
+		return err
+	}
+	iter, err := head.store.MakeJournalIter(head.branch)
+	if err != nil {
+		return err
+	}
+	journal, err := readJournalIter(iter)
+	if err != nil {
+		return err
+	}
+
+	if err := head.store.SetHead(branch, head.baselineCommit); err != nil {
+		return err
+	}
+	if err := head.store.DeleteJournal(branch); err != nil {
+		return err
+	}
+	head.branch = branch
+	head.lastChange = nil
+	head.journalSize = 0
+	for _, entry := range journal {
+		if err := head.addChange(&entry.change); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (head *Head) addChange(change *pb.Change) error {
+	if head.branch == "" {
+		return errors.New("Can't change a tree that isn't on a branch.")
+	}
+	if head.sessionId == nil {
+		head.sessionId = make([]byte, sessionIdSize)
+		if _, err := rand.Read(head.sessionId); err != nil {
+			head.sessionId = nil
+			return err
+		}
+	}
+
 	if head.lastChange != nil {
 		change.LastChange = head.lastChange
 	} else {
 		change.Commit = head.baselineCommit
 	}
+	change.SessionId = head.sessionId
 	lastChange, err := head.store.WriteToJournal(head.branch, change)
-	if err != nil {
+	if err == nil {
 		head.lastChange = lastChange
+		head.journalSize += proto.Size(change)
+		head.sessionIds[string(head.sessionId)] = true
 	}
 	return err
 }
 
-// Returns the filesystem root at the branch head.
+// Returns true if the journal has grown large enough that we should commit.
+func (head *Head) shouldCommit() bool {
+	return head.journalSize >= head.maxJournalSize
+}
+
+// Commits all outstanding changes in the tree: stores all dirty nodes,
+// stores a new commit object, sets the branch head to it and clears the
+// journal.  'metadata' may be nil.  Returns the digest of the new commit.
+func (head *Head) Commit(metadata *pb.CommitMetadata) ([]byte, error) {
+	return head.commit(metadata, nil)
+}
+
+// Like Commit(), but the commit gets 'otherParent' as a second parent.  This
+// is how a merge of another branch is committed.
+func (head *Head) CommitMerge(otherParent []byte,
+	metadata *pb.CommitMetadata) ([]byte, error) {
+
+	return head.commit(metadata, otherParent)
+}
+
+func (head *Head) commit(metadata *pb.CommitMetadata, otherParent []byte) (
+	[]byte, error) {
+
+	root, err := head.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	rootDigest, err := root.commit()
+	if err != nil {
+		return nil, err
+	}
+
+	commit := &pb.Commit{Root: rootDigest,
+		Timestamp: proto.Int32(int32(time.Now().Unix())),
+		Metadata:  metadata,
+	}
+	if head.baselineCommit != nil {
+		commit.Parent = [][]byte{head.baselineCommit}
+	}
+	if otherParent != nil {
+		commit.Parent = append(commit.Parent, otherParent)
+	}
+	if len(head.sessionIds) > 0 {
+		commit.JournalInfo, err = storeJournalInfo(head.store,
+			head.sessionIds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	digest, err := head.store.StoreCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	if err := head.store.SetHead(head.branch, digest); err != nil {
+		return nil, err
+	}
+	if err := head.store.DeleteJournal(head.branch); err != nil {
+		return nil, err
+	}
+
+	head.baselineCommit = digest
+	head.lastChange = nil
+	head.journalSize = 0
+	head.sessionIds = make(map[string]bool)
+
+	// After a commit is the best time to collect garbage because there are
+	// no dirty nodes.
+	head.cache.GarbageCollect()
+	return digest, nil
+}
+
+// Returns the filesystem root at the branch head, replaying the journal
+// against it if there is one.
 // Note that the root node is not stored by the head.
 func (head *Head) GetRoot() (*CachedNode, error) {
+	if head.root != nil {
+		return head.root, nil
+	}
 
-    var root *CachedNode
-    if head.baselineCommit != nil {
-        commit, err := head.store.LoadCommit(head.baselineCommit)
-        if err != nil {
-            return nil, err
-        }
+	var root *CachedNode
+	if head.baselineCommit != nil {
+		commit, err := head.store.LoadCommit(head.baselineCommit)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err = head.cache.makeCachedNode(nil, commit.Root)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Nothing persisted, just create an empty root.
+		root = NewCachedNode(head.cache, nil, &pb.Node{})
+	}
+	root.head = head
 
-        root, err = head.cache.makeCachedNode(nil, commit.Root)
-        if err != nil {
-            return nil, err
-        }
-    } else {
-        // Nothing persisted, just create an empty root.
-        root = NewCachedNode(head.cache, nil, &pb.Node{})
-    }
+	// A head that isn't on a branch has no journal.
+	if head.branch != "" {
+		if err := root.replayJournal(); err != nil {
+			return nil, err
+		}
+	}
 
-    iter, _ := head.cache.store.MakeJournalIter(head.branch)
-    if iter != nil {
-        // TODO: this is where we would normally do a replay.
-        // root.replayJournal().
-        // in replayJournal, should also verify that the final change is the
-        // one that we expect.
-        panic("journal replay not implemented yet")
-    }
+	head.root = root
+	return root, nil
+}
 
-    return root, nil
+// Returned when the journal can not be applied to the tree, for example
+// because it was recorded against a different commit.
+//
+// Implements error.
+type JournalError struct {
+	msg string
+}
+
+func (err *JournalError) Error() string {
+	return err.msg
 }
 
 // Wrapper around Node to manage its presence in the cache.
@@ -335,8 +682,14 @@ func (head *Head) GetRoot() (*CachedNode, error) {
 //
 // Implements Obj.
 type CachedNode struct {
+    ObjImpl
 
     cache *Cache
+
+    // The head of the branch that the node belongs to.  Changes to the node
+    // are recorded in its journal.
+    head *Head
+
     digest []byte
     node *pb.Node
 
@@ -355,27 +708,167 @@ type CachedNode struct {
     // the cache).
     parent *CachedNode
 
-    // Children of the current node.
-    children childArray
+    // Children of the current node.  This is nil until the children are
+    // first accessed.
+    children *childArray
+
+    // True if the node is in the cache's LRU list.
+    cached bool
+
+    // The resident size of the node as last computed (not including its
+    // children).
+    rsize int
+
+    // The number of external references to the node.  A node with external
+    // references (or with descendants that have them) won't be garbage
+    // collected.
+    extRefs int
+}
+
+// Approximate memory overhead of a CachedNode and its entry in the parent,
+// excluding the Node itself.
+const nodeOverhead = 160
+
+// Returns the approximate resident size of the node, excluding children.
+func (node *CachedNode) computeRSize() int {
+    return nodeOverhead + len(node.digest) + proto.Size(node.node)
 }
 
 // Used to indicate that the node has been accessed.  Brings the node to the
 // back of the LRU list.
-func touched() {
-    // Currently does nothing.
+func (node *CachedNode) touch() {
+    if node.cached {
+        node.cache.touch(node)
+    }
+}
+
+// Recomputes the resident size of the node, updating the cache size.
+func (node *CachedNode) updateRSize() {
+    rsize := node.computeRSize()
+    if node.cached {
+        node.cache.size += rsize - node.rsize
+    }
+    node.rsize = rsize
+}
+
+// Adds the node to the cache's LRU list if it isn't already there.
+func (node *CachedNode) track() {
+    if node.cache != nil && !node.cached {
+        node.rsize = node.computeRSize()
+        node.cached = true
+        node.cache.addObj(node)
+    }
+}
+
+// Adds the node and all of its loaded descendants to the cache.
+func (node *CachedNode) trackTree() {
+    node.track()
+    if node.children != nil {
+        for _, entry := range node.children.cached {
+            if entry.node != nil {
+                entry.node.trackTree()
+            }
+        }
+    }
+}
+
+// Removes the node from the cache.  This doesn't affect the node's
+// children.
+func (node *CachedNode) forget() {
+    if node.cached {
+        node.cached = false
+        node.cache.releaseObj(node)
+    }
+}
+
+// Removes the node and all of its loaded descendants from the cache.
+func (node *CachedNode) forgetTree() {
+    if node.children != nil {
+        for _, entry := range node.children.cached {
+            if entry.node != nil {
+                entry.node.forgetTree()
+            }
+        }
+    }
+    node.forget()
+}
+
+// Returns true if the node or any of its loaded descendants have external
+// references.
+func (node *CachedNode) pinned() bool {
+    if node.extRefs > 0 {
+        return true
+    }
+    if node.children != nil {
+        for _, entry := range node.children.cached {
+            if entry.node != nil && entry.node.pinned() {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Implements Obj.  A node is disposable if it is clean (which implies that
+// all of its descendants are clean), isn't the root and nothing in its
+// subtree is externally referenced.
+func (node *CachedNode) Disposable() bool {
+    return !node.dirty && node.parent != nil && !node.pinned()
+}
+
+// Implements Obj.  Releases the node and all of its loaded descendants from
+// the cache and from its parent.  The parent entry retains the digest, so
+// the node will be reloaded from the store when it is next accessed.
+func (node *CachedNode) Release() {
+    if parent := node.parent; parent != nil {
+        if entry := parent.getEntryFor(node); entry != nil {
+            entry.node = nil
+        }
+    }
+    node.forgetTree()
+    node.parent = nil
+    node.children = nil
+}
+
+// Implements Obj.
+func (node *CachedNode) GetRSize() int {
+    return node.rsize
+}
+
+// Adds an external reference to the node.  Code that holds on to a node
+// across other cache operations (e.g. a file handle) should call this to
+// ensure that the node doesn't get released by the garbage collector.
+//
+// Returns the node itself.
+func (node *CachedNode) AddExtRef() *CachedNode {
+    node.extRefs++
+    return node
+}
+
+// Releases a reference obtained from AddExtRef().
+func (node *CachedNode) ReleaseExtRef() {
+    node.extRefs--
 }
 
 func (node *CachedNode) GetMode() int {
-    touched()
-    return node.GetMode()
+    node.touch()
+    return int(node.node.GetMode())
 }
 
+// Creates a new CachedNode.  'digest' should be nil for a new node, in which
+// case the node is dirty.
 func NewCachedNode(cache *Cache, digest []byte, node *pb.Node) *CachedNode {
-    return &CachedNode{cache: cache, digest: digest, node: node};
+    result := &CachedNode{cache: cache, digest: digest, node: node,
+                          dirty: digest == nil}
+    result.track()
+    return result
 }
 
 func (node *CachedNode) GetChild(index int) (*CachedNode, error) {
-    touched()
+    node.touch()
+    if !node.populateChildren(false) {
+        return nil, errors.New("Index out of range.")
+    }
     cachedEntry, err := node.children.getChildEntry(index)
     if err != nil {
         return nil, err
@@ -392,7 +885,8 @@ type cachedEntry struct {
 
 func newCachedEntry(entry *pb.Entry, node *CachedNode,
                     parent *CachedNode) *cachedEntry {
-    return &cachedEntry{entry: entry, cache: node.cache, parent: parent}
+    return &cachedEntry{entry: entry, cache: node.cache, node: node,
+                        parent: parent}
 }
 
 // Returns the entry's name or nil if it doesn't have a name.
@@ -409,11 +903,21 @@ func (e *cachedEntry) GetDigest() []byte {
 // Returns a cached node for the entry, loading it if necessary.
 func (e *cachedEntry) getNode() (*CachedNode, error) {
     if e.node == nil {
+        if e.GetDigest() == nil {
+            return nil, errors.New("No digest or node for entry.")
+        }
         node, err := e.cache.makeCachedNode(e.parent, e.GetDigest())
         if err != nil {
             return nil, err
         }
         e.node = node
+
+        // Loading is where the cache grows, so collect garbage here.  The
+        // new node (and hence all of its ancestors) are protected while we
+        // do so.
+        node.extRefs++
+        e.cache.GarbageCollect()
+        node.extRefs--
     }
     return e.node, nil
 }
@@ -438,13 +942,13 @@ func Compare(a, b string) int {
 }
 
 func (ca *childArray) findIndexHelper(name string, start, end int) (int, bool) {
-    if len(ca.cached) == 0 {
+    if len(ca.rep) == 0 {
         return 0, false
     }
 
     midpoint := (end - start) / 2 + start
     if midpoint == start {
-        comparison := Compare(name, *ca.cached[midpoint].GetName())
+        comparison := Compare(name, ca.rep[midpoint].GetName())
         switch {
             case comparison == 0:
                 return start, true
@@ -456,9 +960,9 @@ func (ca *childArray) findIndexHelper(name string, start, end int) (int, bool) {
     }
 
     switch {
-        case name == *ca.cached[midpoint].GetName():
+        case name == ca.rep[midpoint].GetName():
             return midpoint, true
-        case name < *ca.cached[midpoint].GetName():
+        case name < ca.rep[midpoint].GetName():
             return ca.findIndexHelper(name, start, midpoint)
         default:
             return ca.findIndexHelper(name, midpoint, end)
@@ -470,7 +974,7 @@ func (ca *childArray) findIndex(name string) (int, bool) {
 }
 
 func (ca *childArray) getChildEntry(index int) (*cachedEntry, error) {
-    if index > len(ca.cached) {
+    if index < 0 || index >= len(ca.cached) {
         return nil, errors.New("Index out of range.")
     }
 
@@ -482,3 +986,1097 @@ func (ca *childArray) append(entry *cachedEntry) {
     ca.cached = append(ca.cached, entry)
     ca.rep = append(ca.rep, entry.entry)
 }
+
+// Inserts a new entry at 'index'.
+func (ca *childArray) insert(index int, entry *cachedEntry) {
+	ca.cached = append(ca.cached, nil)
+	copy(ca.cached[index+1:], ca.cached[index:])
+	ca.cached[index] = entry
+	ca.rep = append(ca.rep, nil)
+	copy(ca.rep[index+1:], ca.rep[index:])
+	ca.rep[index] = entry.entry
+}
+
+// Removes the entry at 'index' and returns it.
+func (ca *childArray) remove(index int) *cachedEntry {
+	result := ca.cached[index]
+	ca.cached = append(ca.cached[:index], ca.cached[index+1:]...)
+	ca.rep = append(ca.rep[:index], ca.rep[index+1:]...)
+	return result
+}
+
+// Returns the digest alt-encoded, or "null" if the digest is empty.
+func sig(digest []byte) string {
+	if len(digest) == 0 {
+		return "null"
+	}
+	return altEncode(digest)
+}
+
+// Returns a new entry referencing 'child'.  The entry's parent is filled in
+// when it is added to a node.
+func newNodeEntry(child *CachedNode) *cachedEntry {
+	return &cachedEntry{entry: &pb.Entry{Size: proto.Uint64(child.GetSize())},
+		cache: child.cache,
+		node:  child,
+	}
+}
+
+// Allocates the children array to mirror the entries in the node.  If
+// 'createEmpty' is true, the array is created even if the node has no
+// children.  Returns true if the array exists at the end of the call.
+func (node *CachedNode) populateChildren(createEmpty bool) bool {
+	if node.children != nil {
+		return true
+	}
+	if len(node.node.Children) == 0 && !createEmpty {
+		return false
+	}
+
+	node.children = newChildArray(node.node.Children)
+	for i, entry := range node.node.Children {
+		node.children.cached[i] = &cachedEntry{entry: entry,
+			cache:  node.cache,
+			parent: node,
+		}
+	}
+	return true
+}
+
+// Replaces the children of the node with 'entries', reparenting them, and
+// recomputes the size of the node.
+func (node *CachedNode) setEntries(entries []*cachedEntry) {
+	children := newChildArray(make([]*pb.Entry, 0, len(entries)))
+	var size uint64
+	for _, entry := range entries {
+		entry.parent = node
+		if entry.node != nil {
+			entry.node.parent = node
+		}
+		children.append(entry)
+		size += entry.entry.GetSize()
+	}
+	node.children = children
+	node.node.Children = children.rep
+	node.node.Size = proto.Uint64(size)
+	node.dirty = true
+	node.digest = nil
+}
+
+// Returns the entry in the node that references 'child', nil if there is
+// none.
+func (node *CachedNode) getEntryFor(child *CachedNode) *cachedEntry {
+	if node.children == nil {
+		return nil
+	}
+	for _, entry := range node.children.cached {
+		if entry.node == child {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Returns true if the node is dirty (it hasn't been stored or has been
+// modified since it was loaded).
+func (node *CachedNode) IsDirty() bool {
+	return node.dirty
+}
+
+// Returns true if the node is a directory.
+func (node *CachedNode) IsDir() bool {
+	return node.node.GetMode()&MODE_DIR != 0
+}
+
+// Returns the total size of the contents of the node.
+func (node *CachedNode) GetSize() uint64 {
+	return node.node.GetSize()
+}
+
+// Returns the number of children of the node.
+func (node *CachedNode) GetChildCount() int {
+	return len(node.node.Children)
+}
+
+// Returns the name of the child at 'index'.
+func (node *CachedNode) GetChildName(index int) (string, error) {
+	if index < 0 || index >= len(node.node.Children) {
+		return "", errors.New("Index out of range.")
+	}
+	return node.node.Children[index].GetName(), nil
+}
+
+// Returns the child with the given name, nil if there is no such child.
+func (node *CachedNode) GetChildByName(name string) (*CachedNode, error) {
+	node.touch()
+	if !node.populateChildren(false) {
+		return nil, nil
+	}
+	index, found := node.children.findIndex(name)
+	if !found {
+		return nil, nil
+	}
+	return node.GetChild(index)
+}
+
+// Returns true if this is a content node (a leaf).
+func (node *CachedNode) isContentNode() bool {
+	return node.node.Contents != nil
+}
+
+// Marks the node and all of its ancestors as dirty, bringing the sizes in
+// the ancestor entries up to date.
+func (node *CachedNode) markDirty() {
+	node.updateRSize()
+	node.touch()
+	node.propagateDirty()
+}
+
+func (node *CachedNode) propagateDirty() {
+	node.dirty = true
+	node.digest = nil
+	if node.parent == nil {
+		return
+	}
+
+	if entry := node.parent.getEntryFor(node); entry != nil {
+		entry.entry.Hash = nil
+
+		// If the size has changed, change it in the parent.  (Differences
+		// are computed modulo 2^64, so this works for shrinking nodes, too)
+		if orgSize := entry.entry.GetSize(); orgSize != node.GetSize() {
+			entry.entry.Size = proto.Uint64(node.GetSize())
+			node.parent.node.Size =
+				proto.Uint64(node.parent.GetSize() + node.GetSize() - orgSize)
+		}
+	}
+	node.parent.propagateDirty()
+}
+
+// Adds 'child' under 'name', replacing any existing child of that name.
+// Does everything but record the change.
+func (node *CachedNode) addChild(name string, child *CachedNode) {
+	child.parent = node
+	child.head = node.head
+	child.trackTree()
+	entry := &cachedEntry{
+		entry: &pb.Entry{Name: proto.String(name),
+			Size: proto.Uint64(child.GetSize()),
+		},
+		cache:  node.cache,
+		node:   child,
+		parent: node,
+	}
+
+	node.populateChildren(true)
+	var orgSize uint64
+	if index, found := node.children.findIndex(name); found {
+		orgSize = node.children.rep[index].GetSize()
+		node.children.cached[index] = entry
+		node.children.rep[index] = entry.entry
+	} else {
+		node.children.insert(index, entry)
+	}
+	node.node.Children = node.children.rep
+	node.node.Size = proto.Uint64(node.GetSize() + child.GetSize() - orgSize)
+	node.markDirty()
+}
+
+// Deletes the named child.  Returns false if there is no such child.
+// Does everything but record the change.
+func (node *CachedNode) deleteChild(name string) bool {
+	if !node.populateChildren(false) {
+		return false
+	}
+	index, found := node.children.findIndex(name)
+	if !found {
+		return false
+	}
+
+	entry := node.children.remove(index)
+	node.node.Children = node.children.rep
+	node.node.Size = proto.Uint64(node.GetSize() - entry.entry.GetSize())
+	if entry.node != nil {
+		entry.node.parent = nil
+		entry.node.forgetTree()
+	}
+	node.markDirty()
+	return true
+}
+
+// Replaces the child at 'index' with 'child', keeping the name of the
+// existing entry.  Does everything but record the change.
+func (node *CachedNode) replaceChild(index int, child *CachedNode) error {
+	if !node.populateChildren(false) {
+		return errors.New("Index out of range.")
+	}
+	entry, err := node.children.getChildEntry(index)
+	if err != nil {
+		return err
+	}
+
+	if entry.node != nil {
+		entry.node.parent = nil
+		entry.node.forgetTree()
+	}
+	child.parent = node
+	child.head = node.head
+	child.trackTree()
+	entry.node = child
+	entry.entry.Hash = child.digest
+
+	orgSize := entry.entry.GetSize()
+	entry.entry.Size = proto.Uint64(child.GetSize())
+	node.node.Size = proto.Uint64(node.GetSize() + child.GetSize() - orgSize)
+	node.markDirty()
+	return nil
+}
+
+// Sets the modification time of the node if 'time' is non-nil.
+func (node *CachedNode) setTime(time *int32) {
+	if time != nil {
+		node.node.Time = proto.Int32(*time)
+		node.markDirty()
+	}
+}
+
+// Returns 'time' as a change field: nil if it is zero, in which case it is
+// ignored.
+func changeTime(time int32) *int32 {
+	if time == 0 {
+		return nil
+	}
+	return proto.Int32(time)
+}
+
+// Returns the index of 'child' in the node, -1 if it isn't a child.
+func (node *CachedNode) indexOf(child *CachedNode) int {
+	if node.children == nil {
+		return -1
+	}
+	for i, entry := range node.children.cached {
+		if entry.node == child {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the path of child indexes from the root to the node.
+func (node *CachedNode) getPath() []int32 {
+	if node.parent == nil {
+		return nil
+	}
+	return append(node.parent.getPath(), int32(node.parent.indexOf(node)))
+}
+
+// Fills in the path of the change and adds it to the journal of the head.
+func (node *CachedNode) recordChange(change *pb.Change) error {
+	if node.head == nil {
+		return errors.New("Node does not belong to a branch.")
+	}
+
+	// Changes to nodes that have been removed from the tree (for example,
+	// a file that was deleted while open) aren't recorded.
+	root := node
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root != node.head.root {
+		return nil
+	}
+
+	change.Path = node.getPath()
+	if err := node.head.addChange(change); err != nil {
+		return err
+	}
+	if node.head.shouldCommit() {
+		_, err := node.head.Commit(nil)
+		return err
+	}
+	return nil
+}
+
+// Stores the node and all of its dirty descendants, returns the digest of
+// the node.
+func (node *CachedNode) commit() ([]byte, error) {
+	// If our digest is up to date, we don't need to do anything.
+	if !node.dirty {
+		return node.digest, nil
+	}
+
+	if node.children != nil {
+		// Commit all loaded children and fill in their digests.  Children
+		// that aren't loaded can't be dirty.
+		for _, entry := range node.children.cached {
+			if entry.node != nil {
+				digest, err := entry.node.commit()
+				if err != nil {
+					return nil, err
+				}
+				entry.entry.Hash = digest
+			}
+			if entry.entry.Hash == nil {
+				return nil, fmt.Errorf("Invalid hash for %s",
+					entry.entry.GetName())
+			}
+		}
+	}
+
+	digest, err := node.cache.store.StoreNode(node.node)
+	if err != nil {
+		return nil, err
+	}
+	node.digest = digest
+	node.dirty = false
+	return digest, nil
+}
+
+// Records all of the loaded children of the node (and their loaded
+// descendants) in the journal.  This is needed when a node with dirty
+// descendants is added to the tree, since the ADD_CHILD change only carries
+// the node itself.
+func (node *CachedNode) deepRecord() error {
+	if !node.dirty || !node.populateChildren(false) {
+		return nil
+	}
+
+	for i, entry := range node.children.cached {
+		if entry.node == nil {
+			continue
+		}
+		entry.node.head = node.head
+		err := node.recordChange(&pb.Change{
+			Type:  proto.Int32(CHANGE_REPLACE_CHILD),
+			Index: proto.Int32(int32(i)),
+			Node:  entry.node.node,
+		})
+		if err != nil {
+			return err
+		}
+
+		// If recording the change caused a commit, the whole tree is clean.
+		if !node.dirty {
+			return nil
+		}
+	}
+
+	// This has to happen after the children themselves are recorded.
+	for _, entry := range node.children.cached {
+		if entry.node != nil {
+			if err := entry.node.deepRecord(); err != nil {
+				return err
+			}
+			if !node.dirty {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Adds a new child node under 'name', replacing any existing child of that
+// name, and returns the new CachedNode.  If 'time' is non-zero, it becomes
+// the modification time of the receiver.
+func (node *CachedNode) AddChild(name string, child *pb.Node, time int32) (
+	*CachedNode, error) {
+
+	result := NewCachedNode(node.cache, nil, child)
+	if err := node.AddCachedChild(name, result, time); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Adds an existing CachedNode under 'name'.  Use this for adding children
+// with loaded descendants (e.g. when moving a node).
+func (node *CachedNode) AddCachedChild(name string, child *CachedNode,
+	time int32) error {
+
+	node.touch()
+	if !node.IsDir() {
+		return errors.New("Can't add a child to a file.")
+	}
+
+	// If the child is dirty and has loaded children, we have to record
+	// each of them, too.
+	needsChildRecord := child.dirty && child.children != nil
+
+	node.addChild(name, child)
+	node.setTime(changeTime(time))
+	err := node.recordChange(&pb.Change{Type: proto.Int32(CHANGE_ADD_CHILD),
+		Name: proto.String(name),
+		Node: child.node,
+		Time: changeTime(time),
+	})
+	if err != nil || !needsChildRecord {
+		return err
+	}
+	return child.deepRecord()
+}
+
+// Returns a copy of the node for 'cache'.  Dirty descendants are copied,
+// too, clean ones are left to be loaded from the store by their digests.
+func (node *CachedNode) copy(cache *Cache) *CachedNode {
+	result := NewCachedNode(cache, node.digest,
+		proto.Clone(node.node).(*pb.Node))
+	if !node.dirty || node.children == nil {
+		return result
+	}
+
+	result.populateChildren(true)
+	for i, entry := range node.children.cached {
+		if entry.node == nil {
+			continue
+		}
+		if entry.node.dirty {
+			child := entry.node.copy(cache)
+			child.parent = result
+			result.children.cached[i].node = child
+		} else {
+			result.children.rep[i].Hash = entry.node.digest
+		}
+	}
+	return result
+}
+
+// Adds a copy of 'child' under 'name', replacing any existing child of that
+// name.  'child' may belong to another tree, for example when merging
+// another branch.
+func (node *CachedNode) AddCopy(name string, child *CachedNode,
+	time int32) error {
+
+	return node.AddCachedChild(name, child.copy(node.cache), time)
+}
+
+// Returns true if the node and 'other' have the same contents.  Nodes may be
+// from different trees, descendants are loaded as necessary to compare them.
+func (node *CachedNode) Equal(other *CachedNode) (bool, error) {
+	if !node.dirty && !other.dirty && bytes.Equal(node.digest, other.digest) {
+		return true, nil
+	}
+	if node.node.GetMode() != other.node.GetMode() ||
+		node.GetChildCount() != other.GetChildCount() ||
+		node.node.GetContents() != other.node.GetContents() {
+		return false, nil
+	}
+
+	for i := 0; i < node.GetChildCount(); i++ {
+		name, _ := node.GetChildName(i)
+		otherName, _ := other.GetChildName(i)
+		if name != otherName {
+			return false, nil
+		}
+		child, err := node.GetChild(i)
+		if err != nil {
+			return false, err
+		}
+		otherChild, err := other.GetChild(i)
+		if err != nil {
+			return false, err
+		}
+		if equal, err := child.Equal(otherChild); err != nil || !equal {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Deletes the named child.  Returns false if there is no such child.
+func (node *CachedNode) DeleteChild(name string, time int32) (bool, error) {
+	node.touch()
+	if !node.deleteChild(name) {
+		return false, nil
+	}
+	node.setTime(changeTime(time))
+	err := node.recordChange(&pb.Change{Type: proto.Int32(CHANGE_DELETE_CHILD),
+		Name: proto.String(name),
+		Time: changeTime(time),
+	})
+	return err == nil, err
+}
+
+// Moves the child 'name' to 'newName' in directory 'newParent' (which may
+// be the receiver), replacing any existing child of that name.
+func (node *CachedNode) Rename(name string, newParent *CachedNode,
+	newName string, time int32) error {
+
+	child, err := node.GetChildByName(name)
+	if err != nil {
+		return err
+	} else if child == nil {
+		return fmt.Errorf("No child named %s", name)
+	}
+
+	// Make sure we're not moving a directory into its own subtree.
+	for cur := newParent; cur != nil; cur = cur.parent {
+		if cur == child {
+			return errors.New("Can't move a directory into itself.")
+		}
+	}
+
+	if _, err := node.DeleteChild(name, time); err != nil {
+		return err
+	}
+	return newParent.AddCachedChild(newName, child, time)
+}
+
+// Writes 'data' to the file at 'pos', extending it if necessary.  If 'time'
+// is non-zero, it becomes the modification time of the file.
+func (node *CachedNode) Write(pos uint64, data []byte, time int32) error {
+	node.touch()
+	if err := node.write(pos, data); err != nil {
+		return err
+	}
+	node.setTime(changeTime(time))
+	return node.recordChange(&pb.Change{Type: proto.Int32(CHANGE_WRITE),
+		Pos:  proto.Uint64(pos),
+		Data: data,
+		Time: changeTime(time),
+	})
+}
+
+// Resizes the file to 'newSize', truncating it or padding it with zeroes.
+// If 'time' is non-zero, it becomes the modification time of the file.
+func (node *CachedNode) Resize(newSize uint64, time int32) error {
+	node.touch()
+	if err := node.resize(newSize); err != nil {
+		return err
+	}
+	node.setTime(changeTime(time))
+	return node.recordChange(&pb.Change{Type: proto.Int32(CHANGE_RESIZE),
+		NewSize: proto.Uint64(newSize),
+		Time:    changeTime(time),
+	})
+}
+
+// Sets the modification time of the node.  Unlike the other mutators, a
+// 'time' of zero is actually applied.
+func (node *CachedNode) SetTime(time int32) error {
+	if node.node.Time != nil && node.GetTime() == time {
+		return nil
+	}
+	node.setTime(&time)
+	return node.recordChange(&pb.Change{Type: proto.Int32(CHANGE_SETATTR),
+		Time: proto.Int32(time),
+	})
+}
+
+// Returns the modification time of the node.
+func (node *CachedNode) GetTime() int32 {
+	node.touch()
+	return node.node.GetTime()
+}
+
+// Reads the contents of the node starting at 'pos' into 'buf'.  Returns the
+// number of bytes read, which is only less than len(buf) if we've reached
+// the end of the contents.
+func (node *CachedNode) Read(pos uint64, buf []byte) (int, error) {
+	node.touch()
+	if pos >= node.GetSize() {
+		return 0, nil
+	}
+
+	if node.isContentNode() {
+		return copy(buf, node.node.GetContents()[pos:]), nil
+	}
+
+	if !node.populateChildren(false) {
+		return 0, nil
+	}
+	total := 0
+	for i, entry := range node.children.cached {
+		size := entry.entry.GetSize()
+		if pos >= size {
+			// Make the position relative to the start of the next child.
+			pos -= size
+			continue
+		}
+
+		child, err := node.GetChild(i)
+		if err != nil {
+			return total, err
+		}
+		n, err := child.Read(pos, buf[total:])
+		total += n
+		if err != nil || total == len(buf) {
+			return total, err
+		}
+		pos = 0
+	}
+	return total, nil
+}
+
+// Returns the complete contents of the node.
+func (node *CachedNode) GetContents() ([]byte, error) {
+	buf := make([]byte, node.GetSize())
+	n, err := node.Read(0, buf)
+	return buf[:n], err
+}
+
+// Splits file data into the contents of a sequence of leaf nodes at the
+// chunker boundaries, further splitting any chunk larger than
+// maxContentSize.
+func (head *Head) splitContents(data []byte) [][]byte {
+	var result [][]byte
+	for _, chunk := range splitChunks(data) {
+		for len(chunk) > head.maxContentSize {
+			result = append(result, chunk[:head.maxContentSize])
+			chunk = chunk[head.maxContentSize:]
+		}
+		result = append(result, chunk)
+	}
+	return result
+}
+
+// Returns a new content node.
+func (node *CachedNode) newContentNode(contents []byte) *CachedNode {
+	str := string(contents)
+	result := NewCachedNode(node.cache, nil,
+		&pb.Node{Contents: &str, Size: proto.Uint64(uint64(len(str)))})
+	result.head = node.head
+	return result
+}
+
+// Returns the start and end positions of the leaf node containing 'pos'.
+func (node *CachedNode) leafBounds(pos uint64) (uint64, uint64, error) {
+	if !node.populateChildren(false) {
+		return 0, node.GetSize(), nil
+	}
+
+	var base uint64
+	for i, entry := range node.children.cached {
+		size := entry.entry.GetSize()
+		if pos < base+size {
+			child, err := node.GetChild(i)
+			if err != nil {
+				return 0, 0, err
+			}
+			start, end, err := child.leafBounds(pos - base)
+			return base + start, base + end, err
+		}
+		base += size
+	}
+	return base, base, nil
+}
+
+// Returns the span of the existing contents that must be rewritten to write
+// the range from 'start' to 'end'.  The span begins at the start of the leaf
+// containing 'start' (or the last leaf, if 'start' is beyond the end of the
+// contents) and ends at the end of the leaf containing 'end'.
+func (node *CachedNode) rewriteSpan(start, end uint64) (uint64, uint64,
+	error) {
+
+	size := node.GetSize()
+	if size == 0 {
+		return 0, 0, nil
+	}
+	if start >= size {
+		start = size - 1
+	}
+
+	spanStart, spanEnd, err := node.leafBounds(start)
+	if err != nil || end <= spanEnd {
+		return spanStart, spanEnd, err
+	}
+
+	if end >= size {
+		return spanStart, size, nil
+	}
+	_, spanEnd, err = node.leafBounds(end - 1)
+	return spanStart, spanEnd, err
+}
+
+// Writes 'data' at 'pos', padding with zeroes if 'pos' is beyond the end of
+// the contents.  Does everything but record the change.
+// This must be applied to the top-level node of a file.
+func (node *CachedNode) write(pos uint64, data []byte) error {
+	if node.IsDir() {
+		return errors.New("Can't write to a directory.")
+	}
+
+	end := pos + uint64(len(data))
+	spanStart, spanEnd, err := node.rewriteSpan(pos, end)
+	if err != nil {
+		return err
+	}
+
+	bufEnd := spanEnd
+	if end > bufEnd {
+		bufEnd = end
+	}
+	buf := make([]byte, bufEnd-spanStart)
+	if _, err := node.Read(spanStart, buf[:spanEnd-spanStart]); err != nil {
+		return err
+	}
+	copy(buf[pos-spanStart:], data)
+
+	return node.replaceSpan(spanStart, spanEnd, buf)
+}
+
+// Truncates the contents to 'newSize' or pads them with zeroes if they are
+// smaller.  Does everything but record the change.
+// This must be applied to the top-level node of a file.
+func (node *CachedNode) resize(newSize uint64) error {
+	size := node.GetSize()
+	switch {
+	case newSize == size:
+		return nil
+	case newSize > size:
+		return node.write(newSize, nil)
+	case node.IsDir():
+		return errors.New("Can't resize a directory.")
+	}
+
+	spanStart, _, err := node.leafBounds(newSize)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, newSize-spanStart)
+	if _, err := node.Read(spanStart, buf); err != nil {
+		return err
+	}
+	return node.replaceSpan(spanStart, size, buf)
+}
+
+// Replaces the contents from 'start' to 'end' (which must be leaf
+// boundaries) with 'data'.
+func (node *CachedNode) replaceSpan(start, end uint64, data []byte) error {
+	var leaves []*cachedEntry
+	for _, contents := range node.head.splitContents(data) {
+		leaves = append(leaves, newNodeEntry(node.newContentNode(contents)))
+	}
+
+	var extra []*cachedEntry
+	if node.populateChildren(false) {
+		var err error
+		if extra, err = node.splice(start, end, leaves); err != nil {
+			return err
+		}
+	} else {
+		// A content node or an empty node, the span is the whole node.
+		node.node.Contents = nil
+		node.setEntries(leaves)
+		extra = node.split()
+	}
+
+	// Add tiers until the top-level node is back under the child limit.
+	for len(extra) > 0 {
+		extra = node.addTier(extra)
+	}
+
+	if err := node.collapse(); err != nil {
+		return err
+	}
+	node.markDirty()
+	return nil
+}
+
+// Replaces the leaves between 'start' and 'end' (relative to the node, and
+// always leaf boundaries) with 'leaves'.  Returns entries for the new
+// siblings that are created if the node has to be split.
+func (node *CachedNode) splice(start, end uint64,
+	leaves []*cachedEntry) ([]*cachedEntry, error) {
+
+	first, err := node.GetChild(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*cachedEntry
+	var base uint64
+	if first.isContentNode() {
+		// The children are leaves, replace the ones in the span.
+		for _, entry := range node.children.cached {
+			size := entry.entry.GetSize()
+			if base >= end && leaves != nil {
+				result = append(result, leaves...)
+				leaves = nil
+			}
+			if base >= start && base+size <= end {
+				if entry.node != nil {
+					entry.node.parent = nil
+					entry.node.forgetTree()
+				}
+			} else {
+				result = append(result, entry)
+			}
+			base += size
+		}
+		result = append(result, leaves...)
+	} else {
+		// Inner node, recurse into the children that overlap the span.  The
+		// new leaves all go into the first of them.
+		for i, entry := range node.children.cached {
+			size := entry.entry.GetSize()
+			if base < end && base+size > start {
+				child, err := node.GetChild(i)
+				if err != nil {
+					return nil, err
+				}
+				childStart, childEnd := start, end
+				if childStart < base {
+					childStart = base
+				}
+				if childEnd > base+size {
+					childEnd = base + size
+				}
+				extra, err := child.splice(childStart-base, childEnd-base,
+					leaves)
+				if err != nil {
+					return nil, err
+				}
+				leaves = nil
+
+				// Drop the child if it is now empty.
+				if child.GetChildCount() > 0 {
+					entry.entry.Hash = nil
+					entry.entry.Size = proto.Uint64(child.GetSize())
+					result = append(result, entry)
+				} else {
+					child.parent = nil
+					child.forgetTree()
+				}
+				result = append(result, extra...)
+			} else {
+				result = append(result, entry)
+			}
+			base += size
+		}
+	}
+
+	node.setEntries(result)
+	return node.split(), nil
+}
+
+// Splits the node if it has more than the maximum number of children.  The
+// node keeps the first maxChildren children and the rest are moved to new
+// nodes.  Returns entries for the new nodes.
+func (node *CachedNode) split() []*cachedEntry {
+	max := node.head.maxChildren
+	entries := node.children.cached
+	if len(entries) <= max {
+		return nil
+	}
+
+	var extra []*cachedEntry
+	for i := max; i < len(entries); i += max {
+		end := i + max
+		if end > len(entries) {
+			end = len(entries)
+		}
+		newNode := NewCachedNode(node.cache, nil, &pb.Node{})
+		newNode.head = node.head
+		newNode.setEntries(entries[i:end])
+		extra = append(extra, newNodeEntry(newNode))
+	}
+	node.setEntries(entries[:max])
+	return extra
+}
+
+// Moves all of the node's children into a new child node followed by
+// 'extra', making the tree one level deeper.  Returns entries for new
+// siblings if the node has to be split again.
+func (node *CachedNode) addTier(extra []*cachedEntry) []*cachedEntry {
+	firstChild := NewCachedNode(node.cache, nil, &pb.Node{})
+	firstChild.head = node.head
+	firstChild.setEntries(node.children.cached)
+	node.setEntries(append([]*cachedEntry{newNodeEntry(firstChild)},
+		extra...))
+	return node.split()
+}
+
+// Removes unnecessary tiers from the top-level node of a file: a node with a
+// single child takes over the child's children (or its contents, if the child
+// is a leaf) and a node with no children is reset to an empty node.
+func (node *CachedNode) collapse() error {
+	for node.children != nil && len(node.children.cached) == 1 {
+		child, err := node.GetChild(0)
+		if err != nil {
+			return err
+		}
+		child.parent = nil
+		child.forget()
+		if child.isContentNode() {
+			node.children = nil
+			node.node.Children = nil
+			node.node.Contents = child.node.Contents
+			node.node.Size = proto.Uint64(child.GetSize())
+			return nil
+		}
+		child.populateChildren(false)
+		node.setEntries(child.children.cached)
+	}
+
+	if node.children != nil && len(node.children.cached) == 0 {
+		node.children = nil
+		node.node.Children = nil
+		node.node.Size = proto.Uint64(0)
+	}
+	return nil
+}
+
+// Returns the descendant identified by a path of child indexes.
+func (node *CachedNode) lookup(path []int32) (*CachedNode, error) {
+	if len(path) == 0 {
+		return node, nil
+	}
+	child, err := node.GetChild(int(path[0]))
+	if err != nil {
+		return nil, err
+	}
+	return child.lookup(path[1:])
+}
+
+// Applies a change to the node.
+//
+// Note that this assumes that the Node object within 'change' can be taken
+// for use by a new CachedNode without cloning.
+func (node *CachedNode) applyChange(change *pb.Change) error {
+	switch change.GetType() {
+	case CHANGE_ADD_CHILD:
+		if change.Node == nil {
+			return &JournalError{"Add child change has no node."}
+		}
+		node.addChild(change.GetName(),
+			NewCachedNode(node.cache, nil, change.Node))
+	case CHANGE_REPLACE_CHILD:
+		var child *CachedNode
+		if change.Node != nil {
+			child = NewCachedNode(node.cache, nil, change.Node)
+		} else if change.Digest != nil {
+			pbNode, err := node.cache.LoadNode(change.Digest)
+			if err != nil {
+				return err
+			}
+			child = NewCachedNode(node.cache, change.Digest, pbNode)
+		} else {
+			return &JournalError{"Replace child change has no node or digest."}
+		}
+		return node.replaceChild(int(change.GetIndex()), child)
+	case CHANGE_DELETE_CHILD:
+		if !node.deleteChild(change.GetName()) {
+			return &JournalError{"replaying delete: can't delete child " +
+				change.GetName()}
+		}
+	case CHANGE_WRITE:
+		if err := node.write(change.GetPos(), change.Data); err != nil {
+			return err
+		}
+	case CHANGE_RESIZE:
+		if err := node.resize(change.GetNewSize()); err != nil {
+			return err
+		}
+	case CHANGE_SETATTR:
+	default:
+		return &JournalError{
+			fmt.Sprintf("Unrecognized change type %d", change.GetType()),
+		}
+	}
+	node.setTime(change.Time)
+	return nil
+}
+
+// Verifies that the change follows 'lastChange' (or the baseline commit, if
+// 'lastChange' is nil) and applies it to the tree.
+//
+// This should only be called on the root node.
+func (node *CachedNode) replayChange(entry *ChangeEntry,
+	lastChange []byte) error {
+
+	change := &entry.change
+	if lastChange == nil {
+		// First change after a commit.  Verify that the change has a commit
+		// hash that matches the last commit.
+		if change.Commit == nil {
+			return &JournalError{"First change in the journal does not " +
+				"have a commit field."}
+		}
+		if !bytes.Equal(change.Commit, node.head.baselineCommit) {
+			return &JournalError{fmt.Sprintf(
+				"First change in the journal is for commit %s and current "+
+					"commit is %s", sig(change.Commit),
+				sig(node.head.baselineCommit))}
+		}
+	} else if !bytes.Equal(change.LastChange, lastChange) {
+		return &JournalError{fmt.Sprintf(
+			"Change %s should be applied to %s.  Last change was %s.",
+			sig(entry.digest), sig(change.LastChange), sig(lastChange))}
+	}
+
+	target, err := node.lookup(change.Path)
+	if err != nil {
+		return err
+	}
+	if err := target.applyChange(change); err != nil {
+		return err
+	}
+	if change.SessionId != nil {
+		node.head.sessionIds[string(change.SessionId)] = true
+	}
+	return nil
+}
+
+// Replays the changes that are common to the journals 'a' and 'b', stopping
+// where they diverge, and records the last one in the head.  Should only be
+// used on the root node.
+func (node *CachedNode) replayJournalUntilDivergence(a, b JournalIter) error {
+	var lastChange []byte
+	for a.IsValid() && b.IsValid() {
+		aEntry, err := a.Elem()
+		if err != nil {
+			return err
+		}
+		bEntry, err := b.Elem()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(aEntry.digest, bEntry.digest) {
+			break
+		}
+		if err := node.replayChange(aEntry, lastChange); err != nil {
+			return err
+		}
+		lastChange = aEntry.digest
+		if err := a.Next(); err != nil {
+			return err
+		}
+		if err := b.Next(); err != nil {
+			return err
+		}
+	}
+	node.head.lastChange = lastChange
+	return nil
+}
+
+// Replays all journal entries against the node and records the last change
+// in the head.  Should only be used on the root node.
+func (node *CachedNode) replayJournal() error {
+	if node.parent != nil {
+		return errors.New("Replay journal only works against the root node.")
+	}
+
+	iter, err := node.head.store.MakeJournalIter(node.head.branch)
+	if err != nil {
+		return err
+	}
+
+	var lastChange []byte
+	for iter.IsValid() {
+		entry, err := iter.Elem()
+		if err != nil {
+			return err
+		}
+		if err := node.replayChange(entry, lastChange); err != nil {
+			return err
+		}
+		lastChange = entry.digest
+		node.head.journalSize += proto.Size(&entry.change)
+		if err := iter.Next(); err != nil {
+			return err
+		}
+	}
+
+	node.head.lastChange = lastChange
+	return nil
+}
@@ -15,7 +15,9 @@
 package blockstore
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	pb "mawfs"
 	"testing"
 )
@@ -33,6 +35,10 @@ type TestCacheObj struct {
 	val int
 }
 
+func (o *TestCacheObj) Disposable() bool { return true }
+func (o *TestCacheObj) Release()         {}
+func (o *TestCacheObj) GetRSize() int    { return 1 }
+
 func TestNewCache(t *testing.T) {
 	cache, store := newTestCache()
 	Assertf(t, cache.store == store, "cache.store == store")
@@ -147,3 +153,483 @@ if !(head != nil) { t.Errorf("Assertion failed: head != nil"); return; }
     Assert(t, err == nil)
     Assert(t, root != nil)
 }
+
+// Returns the number of children in every node of the subtree and verifies
+// that all leaves are at the same depth.  Returns the depth of the leaves.
+func checkTree(t *testing.T, node *CachedNode, maxChildren int) int {
+	if !node.populateChildren(false) {
+		return 1
+	}
+	Assertf(t, node.GetChildCount() <= maxChildren,
+		"node has %d children", node.GetChildCount())
+	var size uint64
+	depth := 0
+	for i := 0; i < node.GetChildCount(); i++ {
+		child, err := node.GetChild(i)
+		Assertf(t, err == nil, "GetChild: %s", err)
+		Assertf(t, child.parent == node, "child %d is not parented", i)
+		Assertf(t, node.node.Children[i].GetSize() == child.GetSize(),
+			"entry size %d != child size %d", node.node.Children[i].GetSize(),
+			child.GetSize())
+		size += child.GetSize()
+		childDepth := checkTree(t, child, maxChildren)
+		Assertf(t, depth == 0 || depth == childDepth, "unbalanced tree")
+		depth = childDepth
+	}
+	Assertf(t, size == node.GetSize(), "node size %d != total %d",
+		node.GetSize(), size)
+	return depth + 1
+}
+
+func TestWriteAndResize(t *testing.T) {
+	cache, _ := newTestCache()
+	head := NewHead(cache, "master", nil)
+	head.maxContentSize = 16
+	head.maxChildren = 4
+	node := NewCachedNode(cache, nil, &pb.Node{})
+	node.head = head
+
+	// Build up the expected contents alongside the node.
+	var expected []byte
+	write := func(pos int, data string) {
+		err := node.write(uint64(pos), []byte(data))
+		Assertf(t, err == nil, "write: %s", err)
+		for len(expected) < pos+len(data) {
+			expected = append(expected, 0)
+		}
+		copy(expected[pos:], data)
+	}
+	check := func() {
+		contents, err := node.GetContents()
+		Assertf(t, err == nil, "GetContents: %s", err)
+		Assertf(t, bytes.Equal(contents, expected), "got %q, expected %q",
+			contents, expected)
+		checkTree(t, node, head.maxChildren)
+	}
+
+	write(0, "small")
+	check()
+	Assert(t, node.isContentNode())
+
+	for i := 0; i < 100; i++ {
+		write(len(expected), fmt.Sprintf("line %d of the test data\n", i))
+	}
+	check()
+
+	write(100, "overwriting some data in the middle of the file")
+	write(len(expected)+40, "after a gap")
+	check()
+
+	err := node.resize(1000)
+	Assertf(t, err == nil, "resize: %s", err)
+	expected = expected[:1000]
+	check()
+
+	err = node.resize(10)
+	Assertf(t, err == nil, "resize: %s", err)
+	expected = expected[:10]
+	check()
+	Assert(t, node.isContentNode())
+
+	err = node.resize(0)
+	Assertf(t, err == nil, "resize: %s", err)
+	expected = expected[:0]
+	check()
+	Assert(t, node.GetSize() == 0)
+}
+
+func TestReplayJournal(t *testing.T) {
+	cache, store := newTestCache()
+	head, err := cache.GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+
+	var file, dir int32 = 0, MODE_DIR
+	add := func(path []int32, name string, mode int32) {
+		err := head.addChange(&pb.Change{Type: proto.Int32(CHANGE_ADD_CHILD),
+			Path: path,
+			Name: &name,
+			Node: &pb.Node{Mode: &mode},
+		})
+		Assertf(t, err == nil, "addChange: %s", err)
+	}
+	add(nil, "foo", file)
+	err = head.addChange(&pb.Change{Type: proto.Int32(CHANGE_WRITE),
+		Path: []int32{0},
+		Pos:  proto.Uint64(0),
+		Data: []byte("hello world"),
+	})
+	Assertf(t, err == nil, "addChange: %s", err)
+	add(nil, "bar", dir)
+	add([]int32{0}, "baz", file)
+	err = head.addChange(&pb.Change{Type: proto.Int32(CHANGE_WRITE),
+		Path: []int32{1},
+		Pos:  proto.Uint64(6),
+		Data: []byte("there"),
+	})
+	Assertf(t, err == nil, "addChange: %s", err)
+	err = head.addChange(&pb.Change{Type: proto.Int32(CHANGE_RESIZE),
+		Path:    []int32{1},
+		NewSize: proto.Uint64(8),
+	})
+	Assertf(t, err == nil, "addChange: %s", err)
+
+	// Reload the head in a new cache and verify that it matches.
+	newHead, err := NewCache(store).GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+	root, err := newHead.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	Assert(t, bytes.Equal(newHead.lastChange, head.lastChange))
+	Assert(t, root.IsDirty())
+	Assertf(t, root.GetChildCount() == 2, "root has %d children",
+		root.GetChildCount())
+	Assert(t, root.GetSize() == 8)
+
+	foo, err := root.GetChildByName("foo")
+	Assertf(t, err == nil && foo != nil, "GetChildByName(foo): %s", err)
+	contents, err := foo.GetContents()
+	Assertf(t, string(contents) == "hello th", "got contents %q", contents)
+
+	bar, err := root.GetChildByName("bar")
+	Assertf(t, err == nil && bar != nil, "GetChildByName(bar): %s", err)
+	Assert(t, bar.IsDir())
+	baz, err := bar.GetChildByName("baz")
+	Assert(t, err == nil && baz != nil)
+
+	// Delete a child and replay again.
+	err = head.addChange(&pb.Change{Type: proto.Int32(CHANGE_DELETE_CHILD),
+		Name: proto.String("bar"),
+	})
+	Assertf(t, err == nil, "addChange: %s", err)
+	newHead, _ = NewCache(store).GetHead("master")
+	root, err = newHead.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	Assert(t, root.GetChildCount() == 1)
+	bar, _ = root.GetChildByName("bar")
+	Assert(t, bar == nil)
+}
+
+func TestReplayWrongCommit(t *testing.T) {
+	cache, store := newTestCache()
+	_, err := cache.GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+
+	_, err = store.WriteToJournal("master",
+		&pb.Change{Type: proto.Int32(CHANGE_ADD_CHILD),
+			Name:   proto.String("foo"),
+			Node:   &pb.Node{},
+			Commit: []byte("some other commit"),
+		})
+	Assertf(t, err == nil, "WriteToJournal: %s", err)
+
+	head, _ := NewCache(store).GetHead("master")
+	_, err = head.GetRoot()
+	_, ok := err.(*JournalError)
+	Assertf(t, ok, "Expected JournalError, got %s", err)
+}
+
+func TestReplayBrokenChain(t *testing.T) {
+	cache, store := newTestCache()
+	head, err := cache.GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+
+	err = head.addChange(&pb.Change{Type: proto.Int32(CHANGE_ADD_CHILD),
+		Name: proto.String("foo"),
+		Node: &pb.Node{},
+	})
+	Assertf(t, err == nil, "addChange: %s", err)
+	_, err = store.WriteToJournal("master",
+		&pb.Change{Type: proto.Int32(CHANGE_DELETE_CHILD),
+			Name:       proto.String("foo"),
+			LastChange: []byte("bogus change"),
+		})
+	Assertf(t, err == nil, "WriteToJournal: %s", err)
+
+	head, _ = NewCache(store).GetHead("master")
+	_, err = head.GetRoot()
+	_, ok := err.(*JournalError)
+	Assertf(t, ok, "Expected JournalError, got %s", err)
+}
+
+func TestReplayReplaceChildAndSetAttr(t *testing.T) {
+	cache, store := newTestCache()
+	head, err := cache.GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+
+	digest, err := store.StoreNode(&pb.Node{Contents: proto.String("stored"),
+		Size: proto.Uint64(6),
+	})
+	Assertf(t, err == nil, "StoreNode: %s", err)
+
+	changes := []*pb.Change{
+		{Type: proto.Int32(CHANGE_ADD_CHILD),
+			Name: proto.String("foo"),
+			Node: &pb.Node{Contents: proto.String("x"), Size: proto.Uint64(1)},
+			Time: proto.Int32(100),
+		},
+		{Type: proto.Int32(CHANGE_REPLACE_CHILD),
+			Index:  proto.Int32(0),
+			Digest: digest,
+		},
+		{Type: proto.Int32(CHANGE_SETATTR),
+			Path: []int32{0},
+			Time: proto.Int32(200),
+		},
+	}
+	for _, change := range changes {
+		err := head.addChange(change)
+		Assertf(t, err == nil, "addChange: %s", err)
+	}
+
+	newHead, _ := NewCache(store).GetHead("master")
+	root, err := newHead.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	Assert(t, root.node.GetTime() == 100)
+	Assert(t, root.GetSize() == 6)
+	foo, err := root.GetChildByName("foo")
+	Assertf(t, err == nil && foo != nil, "GetChildByName(foo): %s", err)
+	contents, err := foo.GetContents()
+	Assertf(t, string(contents) == "stored", "got contents %q", contents)
+	Assert(t, foo.node.GetTime() == 200)
+}
+
+func TestMutationAPI(t *testing.T) {
+	cache, store := newTestCache()
+	head, err := cache.GetHead("master")
+	Assertf(t, err == nil, "GetHead: %s", err)
+	root, err := head.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+
+	dir, err := root.AddChild("dir", &pb.Node{Mode: proto.Int32(MODE_DIR)},
+		100)
+	Assertf(t, err == nil, "AddChild: %s", err)
+	sub, err := dir.AddChild("sub", &pb.Node{Mode: proto.Int32(MODE_DIR)}, 0)
+	Assertf(t, err == nil, "AddChild: %s", err)
+	file, err := sub.AddChild("file", &pb.Node{}, 0)
+	Assertf(t, err == nil, "AddChild: %s", err)
+	Assertf(t, file.Write(0, []byte("hello world"), 200) == nil, "Write")
+	Assertf(t, file.Resize(5, 0) == nil, "Resize")
+	Assertf(t, file.Write(5, []byte(", there"), 0) == nil, "Write")
+	_, err = root.AddChild("other", &pb.Node{}, 0)
+	Assertf(t, err == nil, "AddChild: %s", err)
+	Assertf(t, root.SetTime(300) == nil, "SetTime")
+
+	// Move a directory with loaded, dirty descendants.
+	Assertf(t, dir.Rename("sub", root, "moved", 400) == nil, "Rename")
+	Assert(t, root.Rename("moved", sub, "loop", 0) != nil)
+
+	deleted, err := root.DeleteChild("other", 0)
+	Assert(t, err == nil && deleted)
+	deleted, err = root.DeleteChild("other", 0)
+	Assert(t, err == nil && !deleted)
+	Assert(t, file.Write(0, []byte("x"), 0) == nil)
+	Assert(t, dir.Write(0, []byte("x"), 0) != nil)
+
+	check := func(root *CachedNode) {
+		Assert(t, root.IsDirty())
+		Assertf(t, root.GetChildCount() == 2, "root has %d children",
+			root.GetChildCount())
+		Assertf(t, root.GetTime() == 400, "root time is %d", root.GetTime())
+		dir, _ := root.GetChildByName("dir")
+		Assert(t, dir != nil && dir.GetChildCount() == 0)
+		Assertf(t, dir.GetTime() == 400, "dir time is %d", dir.GetTime())
+		moved, _ := root.GetChildByName("moved")
+		Assert(t, moved != nil && moved.IsDir())
+		file, _ := moved.GetChildByName("file")
+		Assert(t, file != nil)
+		contents, err := file.GetContents()
+		Assertf(t, err == nil && string(contents) == "xello, there",
+			"got contents %q", contents)
+		Assert(t, file.GetTime() == 200)
+	}
+	check(root)
+
+	// Verify that replaying the journal produces the same tree.
+	newHead, _ := NewCache(store).GetHead("master")
+	newRoot, err := newHead.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	check(newRoot)
+}
+
+func TestCommit(t *testing.T) {
+	cache, store := newTestCache()
+	head, _ := cache.GetHead("master")
+	root, err := head.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	orgCommit := head.baselineCommit
+
+	dir, _ := root.AddChild("dir", &pb.Node{Mode: proto.Int32(MODE_DIR)}, 0)
+	file, _ := dir.AddChild("file", &pb.Node{}, 0)
+	Assert(t, file.Write(0, []byte("file contents"), 0) == nil)
+
+	metadata := &pb.CommitMetadata{Comment: proto.String("first commit"),
+		Committer: proto.String("me"),
+	}
+	digest, err := head.Commit(metadata)
+	if err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+	Assert(t, !root.IsDirty() && !dir.IsDirty() && !file.IsDirty())
+	Assert(t, head.lastChange == nil)
+	Assert(t, bytes.Equal(head.baselineCommit, digest))
+
+	storedHead, err := store.GetHead("master")
+	Assert(t, err == nil && bytes.Equal(storedHead, digest))
+	commit, err := store.LoadCommit(digest)
+	if err != nil {
+		t.Fatalf("LoadCommit: %s", err)
+	}
+	Assert(t, bytes.Equal(commit.Root, root.digest))
+	Assert(t, len(commit.Parent) == 1 &&
+		bytes.Equal(commit.Parent[0], orgCommit))
+	Assert(t, commit.GetTimestamp() != 0)
+	Assert(t, proto.Equal(commit.Metadata, metadata))
+	iter, err := store.MakeJournalIter("master")
+	Assert(t, err == nil && !iter.IsValid())
+
+	// Make sure that the new commit loads.
+	newHead, _ := NewCache(store).GetHead("master")
+	newRoot, err := newHead.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	Assert(t, !newRoot.IsDirty())
+	dir, _ = newRoot.GetChildByName("dir")
+	Assert(t, dir != nil)
+	file, _ = dir.GetChildByName("file")
+	Assert(t, file != nil)
+	contents, _ := file.GetContents()
+	Assert(t, string(contents) == "file contents")
+
+	// Committing a modified tree only stores the new nodes.
+	Assert(t, file.Write(0, []byte("File"), 0) == nil)
+	newDigest, err := newHead.Commit(nil)
+	if err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+	commit, _ = store.LoadCommit(newDigest)
+	Assert(t, len(commit.Parent) == 1 && bytes.Equal(commit.Parent[0], digest))
+	Assert(t, commit.Metadata == nil)
+}
+
+func TestAutoCommit(t *testing.T) {
+	cache, store := newTestCache()
+	head, _ := cache.GetHead("master")
+	head.maxJournalSize = 100
+	orgCommit := head.baselineCommit
+	root, _ := head.GetRoot()
+
+	dir, _ := root.AddChild("dir", &pb.Node{Mode: proto.Int32(MODE_DIR)}, 0)
+	Assert(t, bytes.Equal(head.baselineCommit, orgCommit))
+	file, _ := dir.AddChild("file", &pb.Node{}, 0)
+	Assert(t, file.Write(0, make([]byte, 200), 0) == nil)
+	Assert(t, !bytes.Equal(head.baselineCommit, orgCommit))
+	Assert(t, !root.IsDirty())
+	Assert(t, head.journalSize == 0)
+
+	digest, _ := store.GetHead("master")
+	Assert(t, bytes.Equal(digest, head.baselineCommit))
+}
+
+func TestLruTouchAndRelease(t *testing.T) {
+	cache, _ := newTestCache()
+	objs := []*TestCacheObj{{val: 1}, {val: 2}, {val: 3}}
+	for _, obj := range objs {
+		cache.addObj(obj)
+	}
+	Assert(t, cache.GetSize() == 3)
+
+	cache.touch(objs[0])
+	Assert(t, cache.oldest == Obj(objs[1]) && cache.newest == Obj(objs[0]))
+	cache.releaseObj(objs[2])
+	Assert(t, cache.oldest.GetNext() == Obj(objs[0]))
+	Assert(t, cache.newest.GetPrev() == Obj(objs[1]))
+	Assert(t, cache.GetSize() == 2)
+}
+
+// Returns the number of loaded nodes in the subtree rooted at 'node'.
+func countLoaded(node *CachedNode) int {
+	count := 1
+	if node.children != nil {
+		for _, entry := range node.children.cached {
+			if entry.node != nil {
+				count += countLoaded(entry.node)
+			}
+		}
+	}
+	return count
+}
+
+func TestGarbageCollect(t *testing.T) {
+	cache, store := newTestCache()
+	head, _ := cache.GetHead("master")
+	root, _ := head.GetRoot()
+	for i := 0; i < 10; i++ {
+		dir, _ := root.AddChild(fmt.Sprintf("dir%d", i),
+			&pb.Node{Mode: proto.Int32(MODE_DIR)}, 0)
+		for j := 0; j < 10; j++ {
+			file, _ := dir.AddChild(fmt.Sprintf("file%d", j), &pb.Node{}, 0)
+			file.Write(0, make([]byte, 1000), 0)
+		}
+	}
+	if _, err := head.Commit(nil); err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+
+	// Walk the whole tree from a fresh cache with a small GC threshold.
+	cache = NewCache(store)
+	cache.gcThreshold = 20000
+	cache.gcBottom = 10000
+	head, _ = cache.GetHead("master")
+	root, _ = head.GetRoot()
+	maxSize := 0
+	for i := 0; i < root.GetChildCount(); i++ {
+		dir, err := root.GetChild(i)
+		Assertf(t, err == nil, "GetChild: %s", err)
+		for j := 0; j < dir.GetChildCount(); j++ {
+			file, err := dir.GetChild(j)
+			Assertf(t, err == nil, "GetChild: %s", err)
+			contents, err := file.GetContents()
+			Assert(t, err == nil && len(contents) == 1000)
+			if cache.GetSize() > maxSize {
+				maxSize = cache.GetSize()
+			}
+		}
+	}
+	Assertf(t, maxSize <= cache.gcThreshold+2000, "cache grew to %d", maxSize)
+	Assertf(t, countLoaded(root) < 111, "%d nodes loaded", countLoaded(root))
+
+	// Dirty nodes and externally referenced nodes aren't collected.
+	dir, _ := root.GetChildByName("dir3")
+	file, _ := dir.GetChildByName("file3")
+	Assert(t, file.Write(0, []byte("dirty"), 0) == nil)
+	dir, _ = root.GetChildByName("dir5")
+	pinned, _ := dir.GetChildByName("file5")
+	pinned.AddExtRef()
+	for i := 0; i < root.GetChildCount(); i++ {
+		dir, _ := root.GetChild(i)
+		for j := 0; j < dir.GetChildCount(); j++ {
+			dir.GetChild(j)
+		}
+	}
+	dir, _ = root.GetChildByName("dir3")
+	newFile, _ := dir.GetChildByName("file3")
+	Assert(t, newFile == file)
+	contents, _ := newFile.GetContents()
+	Assert(t, string(contents[:5]) == "dirty")
+	dir, _ = root.GetChildByName("dir5")
+	newPinned, _ := dir.GetChildByName("file5")
+	Assert(t, newPinned == pinned)
+	pinned.ReleaseExtRef()
+}
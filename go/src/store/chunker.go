@@ -0,0 +1,267 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Content-defined chunking of file data.  This is a port of chunker.crk and
+// must produce exactly the same chunk boundaries, otherwise files written by
+// the two implementations won't dedupe against one another.
+
+package blockstore
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+)
+
+const (
+	// A prime constant that's around 8K.
+	rabinQ = 7919
+
+	// Default size of the fingerprinting window.
+	DefaultWindowSize = 32
+
+	MaxChunkSize = 16384
+	MinChunkSize = 2048
+)
+
+// Computes a Rabin fingerprint over a sliding window of the data.
+//
+// Note that the arithmetic is done in 32 bit unsigned integers and wraps
+// exactly the way the Crack version does.  Don't "fix" it.
+type rabinFingerprinter struct {
+	// A ring-buffer containing the window that we're hashing.  'pos' is the
+	// index of the oldest byte in the ring-buffer.
+	data [DefaultWindowSize]byte
+	pos  int
+
+	// The accumulator containing the Rabin fingerprint of the window mod q.
+	accum uint32
+}
+
+// Clears the window and resets the position to zero.  Note that this
+// doesn't reset the accumulator.
+func (fp *rabinFingerprinter) reset() {
+	fp.data = [DefaultWindowSize]byte{}
+	fp.pos = 0
+}
+
+// Calculates the oldest term of the polynomial from the byte.
+func (fp *rabinFingerprinter) calcOldest(b byte) uint32 {
+	oldest := uint32(b)
+	for i := 0; i < len(fp.data)-1; i++ {
+		oldest = (oldest << 8) % rabinQ
+	}
+	return oldest
+}
+
+// Adds a single byte to the window and returns true if the fingerprint
+// matches.
+func (fp *rabinFingerprinter) addByte(b byte) bool {
+	// Subtract the oldest*256^size.
+	oldest := fp.calcOldest(fp.data[fp.pos])
+	fp.accum = (((fp.accum - oldest) << 8) + uint32(b)) % rabinQ
+
+	// Store the byte in the ring buffer.
+	fp.data[fp.pos] = b
+	fp.pos++
+	if fp.pos >= len(fp.data) {
+		fp.pos = 0
+	}
+
+	return fp.accum == 0
+}
+
+// Adds the data to the window.  Returns the index of the end of the chunk if
+// a chunk boundary is discovered, otherwise returns -1.
+func (fp *rabinFingerprinter) add(data []byte) int {
+	for i, b := range data {
+		if fp.addByte(b) {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Breaks the data written to it into chunks, passing each complete chunk to
+// 'emit'.  Chunks passed to 'emit' are owned by the callee.
+type rabinSplitter struct {
+	buffer []byte
+	fp     rabinFingerprinter
+	emit   func(chunk []byte) error
+}
+
+func (s *rabinSplitter) writeChunk(size int) error {
+	chunk := make([]byte, size)
+	copy(chunk, s.buffer)
+	s.buffer = append(s.buffer[:0], s.buffer[size:]...)
+	s.fp.reset()
+	return s.emit(chunk)
+}
+
+// Implements io.Writer.
+func (s *rabinSplitter) Write(data []byte) (int, error) {
+	orgSize := len(s.buffer)
+	s.buffer = append(s.buffer, data...)
+
+	// This keeps track of the remaining data as we extract chunks.
+	remaining := data
+
+	// Loop through the contents of the buffer until we can't create any more
+	// chunks.
+	for len(remaining) > 0 {
+		if i := s.fp.add(remaining); i >= 0 {
+			// We found the fingerprint.  If the new chunk is greater than
+			// the minimum chunk size, cut it off here.  Otherwise we're now
+			// based off of the last fingerprint.
+			if orgSize+i >= MinChunkSize {
+				if err := s.writeChunk(orgSize + i); err != nil {
+					return 0, err
+				}
+				orgSize = 0
+			} else {
+				orgSize += i
+			}
+			remaining = remaining[i:]
+		} else if len(s.buffer) >= MaxChunkSize {
+			// If we're bigger than the max size, cut it off at the chunk
+			// size.
+			if err := s.writeChunk(MaxChunkSize); err != nil {
+				return 0, err
+			}
+			remaining = remaining[MaxChunkSize-orgSize:]
+			orgSize = 0
+		} else {
+			// No more chunks in this buffer.
+			break
+		}
+	}
+	return len(data), nil
+}
+
+// Emits whatever remains in the buffer as the final chunk.
+func (s *rabinSplitter) Flush() error {
+	if len(s.buffer) > 0 {
+		return s.writeChunk(len(s.buffer))
+	}
+	return nil
+}
+
+// Splits 'data' at the same boundaries that a Chunker would.
+func splitChunks(data []byte) [][]byte {
+	var result [][]byte
+	splitter := rabinSplitter{emit: func(chunk []byte) error {
+		result = append(result, chunk)
+		return nil
+	}}
+	splitter.Write(data)
+	splitter.Flush()
+	return result
+}
+
+// Chunker is an io.Writer that breaks a file into content-defined chunks,
+// stores each chunk as a content node and builds the tree of nodes for the
+// file.  Call Finish() after the last write to get the top-level node.
+type Chunker struct {
+	fsInfo      *FSInfo
+	backing     FileSys
+	splitter    rabinSplitter
+	entries     []*pb.Entry
+	maxChildren int
+}
+
+// Creates a new chunker that stores chunks in 'backing'.
+func NewChunker(fsInfo *FSInfo, backing FileSys) *Chunker {
+	c := &Chunker{fsInfo: fsInfo, backing: backing,
+		maxChildren: DefaultMaxChildren}
+	c.splitter.emit = c.storeChunk
+	return c
+}
+
+func (c *Chunker) storeChunk(chunk []byte) error {
+	digest, err := storeObject(c.fsInfo, c.backing,
+		&pb.Node{Contents: proto.String(string(chunk)),
+			Size: proto.Uint64(uint64(len(chunk))),
+		})
+	if err != nil {
+		return err
+	}
+	c.entries = append(c.entries, &pb.Entry{Hash: digest,
+		Size: proto.Uint64(uint64(len(chunk))),
+	})
+	return nil
+}
+
+// Implements io.Writer.
+func (c *Chunker) Write(data []byte) (int, error) {
+	return c.splitter.Write(data)
+}
+
+// Returns the total size of all of the entries.
+func entriesSize(entries []*pb.Entry) uint64 {
+	var size uint64
+	for _, entry := range entries {
+		size += entry.GetSize()
+	}
+	return size
+}
+
+// Flushes the last chunk and returns the top-level node of the file.  The
+// top-level node is not stored, so the caller can fill in the mode and add
+// it to a directory.
+//
+// If the file consists of a single chunk, its contents are stored directly
+// in the top-level node.  Otherwise, the chunks are stored and grouped
+// under intermediate nodes of no more than DefaultMaxChildren children.
+func (c *Chunker) Finish() (*pb.Node, error) {
+	if len(c.entries) == 0 {
+		// Zero or one chunk, just return a content node.
+		contents := string(c.splitter.buffer)
+		c.splitter.buffer = nil
+		return &pb.Node{Contents: &contents,
+			Size: proto.Uint64(uint64(len(contents))),
+		}, nil
+	}
+
+	if err := c.splitter.Flush(); err != nil {
+		return nil, err
+	}
+	entries := c.entries
+	c.entries = nil
+
+	for len(entries) > c.maxChildren {
+		var tier []*pb.Entry
+		for len(entries) > 0 {
+			count := c.maxChildren
+			if count > len(entries) {
+				count = len(entries)
+			}
+			size := entriesSize(entries[:count])
+			digest, err := storeObject(c.fsInfo, c.backing,
+				&pb.Node{Children: entries[:count],
+					Size: proto.Uint64(size),
+				})
+			if err != nil {
+				return nil, err
+			}
+			tier = append(tier, &pb.Entry{Hash: digest,
+				Size: proto.Uint64(size),
+			})
+			entries = entries[count:]
+		}
+		entries = tier
+	}
+
+	return &pb.Node{Children: entries,
+		Size: proto.Uint64(entriesSize(entries)),
+	}, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"reflect"
+	"testing"
+)
+
+// Generates 'size' bytes of data from a simple LCG so that the same data can
+// be produced from the Crack tests.
+func makeTestData(size int) []byte {
+	result := make([]byte, size)
+	var x uint32 = 1
+	for i := range result {
+		x = x*1103515245 + 12345
+		result[i] = byte(x >> 16)
+	}
+	return result
+}
+
+// Chunk sizes expected from the Crack RabinChunker for makeTestData(200000).
+var singleWriteSizes = []int{2457, 11636, 7540, 4689, 3993, 8932, 11815,
+	11888, 8347, 11712, 12679, 9176, 2646, 12242, 6008, 15278, 11701, 21095,
+	8438, 6689, 11039,
+}
+
+// Chunk sizes expected from the Crack RabinChunker for makeTestData(200000)
+// written 1000 bytes at a time.
+var streamedSizes = []int{2457, 11636, 7540, 4689, 3993, 8932, 11815,
+	11888, 8347, 11712, 12679, 9176, 2646, 12242, 6008, 15278, 11701, 16384,
+	5121, 2052, 4951, 6862, 11891,
+}
+
+func chunkSizes(data []byte, writeSize int) ([]int, []byte) {
+	var sizes []int
+	var joined []byte
+	splitter := rabinSplitter{emit: func(chunk []byte) error {
+		sizes = append(sizes, len(chunk))
+		joined = append(joined, chunk...)
+		return nil
+	}}
+	for len(data) > 0 {
+		size := writeSize
+		if size > len(data) {
+			size = len(data)
+		}
+		splitter.Write(data[:size])
+		data = data[size:]
+	}
+	splitter.Flush()
+	return sizes, joined
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	data := makeTestData(200000)
+
+	sizes, joined := chunkSizes(data, len(data))
+	Assert(t, bytes.Equal(joined, data))
+	Assertf(t, reflect.DeepEqual(sizes, singleWriteSizes),
+		"got sizes %v", sizes)
+
+	sizes, joined = chunkSizes(data, 1000)
+	Assert(t, bytes.Equal(joined, data))
+	Assertf(t, reflect.DeepEqual(sizes, streamedSizes), "got sizes %v", sizes)
+}
+
+func TestChunkBoundariesAreLocal(t *testing.T) {
+	data := makeTestData(200000)
+	orgChunks := splitChunks(data)
+
+	// Insert some data in the middle and verify that only the chunks around
+	// the insertion changed.
+	modified := append(append(append([]byte{}, data[:100000]...),
+		[]byte("inserted data")...), data[100000:]...)
+	newChunks := splitChunks(modified)
+
+	orgSet := map[string]bool{}
+	for _, chunk := range orgChunks {
+		orgSet[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range newChunks {
+		if !orgSet[string(chunk)] {
+			changed++
+		}
+	}
+	Assertf(t, changed <= 2, "%d chunks changed", changed)
+}
+
+func TestChunker(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(fsInfo, fs)
+	data := makeTestData(200000)
+
+	chunker := NewChunker(fsInfo, fs)
+	chunker.maxChildren = 4
+	for i := 0; i < len(data); i += 1000 {
+		chunker.Write(data[i : i+1000])
+	}
+	top, err := chunker.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %s", err)
+	}
+	Assert(t, top.GetSize() == uint64(len(data)))
+
+	// Walk the tree, verify the sizes and collect the contents.
+	var contents []byte
+	var leaves []int
+	var walk func(node *pb.Node, depth int) uint64
+	walk = func(node *pb.Node, depth int) uint64 {
+		if node.Contents != nil {
+			contents = append(contents, node.GetContents()...)
+			leaves = append(leaves, depth)
+			return uint64(len(node.GetContents()))
+		}
+		Assert(t, len(node.Children) <= 4)
+		var total uint64
+		for _, entry := range node.Children {
+			child, err := cs.LoadNode(entry.Hash)
+			if err != nil {
+				t.Fatalf("LoadNode: %s", err)
+			}
+			size := walk(child, depth+1)
+			Assert(t, entry.GetSize() == size)
+			total += size
+		}
+		Assert(t, node.GetSize() == total)
+		return total
+	}
+	walk(top, 0)
+	Assert(t, bytes.Equal(contents, data))
+	Assert(t, len(leaves) == len(streamedSizes))
+	for _, depth := range leaves {
+		Assert(t, depth == leaves[0])
+	}
+
+	// Writing the same file again should produce the same tree.
+	chunker = NewChunker(fsInfo, fs)
+	chunker.maxChildren = 4
+	for i := 0; i < len(data); i += 1000 {
+		chunker.Write(data[i : i+1000])
+	}
+	newTop, err := chunker.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %s", err)
+	}
+	Assert(t, proto.Equal(top, newTop))
+}
+
+func TestChunkerSmallFile(t *testing.T) {
+	chunker := NewChunker(NewFSInfo("password"), NewFakeFileSys())
+	chunker.Write([]byte("small file"))
+	top, err := chunker.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %s", err)
+	}
+	Assert(t, top.GetContents() == "small file")
+	Assert(t, top.GetSize() == 10)
+	Assert(t, len(top.Children) == 0)
+}
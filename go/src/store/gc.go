@@ -0,0 +1,220 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Garbage collection of the objects in a backing store that can no longer
+// be reached from any branch.
+
+package blockstore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options for ChunkStore.CollectGarbage().
+type GCOptions struct {
+	// If true, nothing is removed, the result is what would have been.
+	DryRun bool
+
+	// Files modified less than this long ago are never removed.  Objects
+	// are written before the refs and journals that make them reachable,
+	// so this must be longer than any writer could take to get from one to
+	// the other.
+	GracePeriod time.Duration
+
+	// Commits to keep in addition to those reachable from the branches,
+	// such as those of a pending merge (see merge.PendingCommits()).
+	Roots [][]byte
+}
+
+// The outcome of ChunkStore.CollectGarbage().
+type GCResult struct {
+	// The number of objects that are reachable.
+	Reachable int
+
+	// The files that were removed (or would have been, for a dry run).
+	Removed []string
+
+	// The number of unreachable files that were kept because they're in
+	// the grace period.
+	Kept int
+}
+
+// Marks everything reachable from the branches, their journals, the root
+// node ref and 'roots'.  Returns the set of the digests of the reachable
+// objects.
+func (cs *ChunkStore) markReachable(roots [][]byte) (map[string]bool,
+	error) {
+
+	branches, err := ListBranches(cs.backing)
+	if err != nil {
+		return nil, err
+	}
+	t := newTraverser(cs, nil)
+	for _, branch := range branches {
+		head, err := cs.GetHead(branch)
+		if _, unknown := err.(UnknownName); err != nil && !unknown {
+			return nil, err
+		} else if err == nil {
+			roots = append(roots, head)
+		}
+
+		// Changes refer to their baseline commit and to the nodes that
+		// they add.
+		journal, err := cs.MakeJournalIter(branch)
+		if err != nil {
+			return nil, err
+		}
+		changes, err := readJournalIter(journal)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range changes {
+			change := &entry.change
+			if change.Commit != nil {
+				roots = append(roots, change.Commit)
+			}
+			if change.Digest != nil {
+				if err := t.node(change.Digest); err != nil {
+					return nil, err
+				}
+			}
+			for _, child := range change.GetNode().GetChildren() {
+				if err := t.node(child.Hash); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// The root node ref (see ChunkStore.StoreRootDigest()).
+	if root, err := cs.LoadRootDigest(); err != nil {
+		return nil, err
+	} else if root != nil {
+		if err := t.node(root); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, digest := range roots {
+		if err := t.commit(digest); err != nil {
+			return nil, err
+		}
+	}
+	return t.visited, nil
+}
+
+// Returns 'name' in the directory 'dir' ("" for the top level).
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Removes the garbage from the directories of a store.
+type sweeper struct {
+	cs        *ChunkStore
+	opts      GCOptions
+	reachable map[string]bool
+	result    *GCResult
+}
+
+// Removes 'name' if it was last modified before the grace period.
+func (s *sweeper) remove(name string, entry DirEntry) error {
+	if time.Since(entry.ModTime) < s.opts.GracePeriod {
+		s.result.Kept++
+		return nil
+	}
+	s.result.Removed = append(s.result.Removed, name)
+	if s.opts.DryRun {
+		return nil
+	}
+	return s.cs.backing.Remove(name)
+}
+
+// Removes the unreachable objects and temporary files in 'dir'.  If
+// 'objects' is false, only temporary files are removed.
+func (s *sweeper) sweep(dir string, objects bool) error {
+	entries, err := s.cs.backing.List(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		name := joinPath(dir, entry.Name)
+		var err error
+		if strings.HasSuffix(entry.Name, tempSuffix) {
+			err = s.remove(name, entry)
+		} else if digest := flatObjectDigest(entry.Name); digest != nil &&
+			objects && !s.reachable[string(digest)] {
+			err = s.remove(name, entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes every object in the store that isn't reachable from a branch
+// (including its history and journal), the root node ref or 'opts.Roots',
+// in both the fan-out and the flat layout.  Temporary files left by
+// interrupted atomic writes are removed too, as are the "traversed" markers
+// of unreachable objects.  The quarantine directory is left alone.
+//
+// Nothing is removed if any reachable object can't be loaded: run Verify()
+// to find out what's wrong.
+//
+// Other processes can go on writing to the store while this runs, as long
+// as they write their refs and journals within opts.GracePeriod of the
+// objects they refer to.
+func (cs *ChunkStore) CollectGarbage(opts GCOptions) (*GCResult, error) {
+	reachable, err := cs.markReachable(opts.Roots)
+	if err != nil {
+		return nil, fmt.Errorf("Not collecting garbage: %s", err)
+	}
+	result := &GCResult{Reachable: len(reachable)}
+	s := &sweeper{cs, opts, reachable, result}
+
+	// Remove the traversed markers first, so a marker can't outlive its
+	// object and make a later traversal skip fetching it.
+	if err := s.sweep(traversedDir, true); err != nil {
+		return result, err
+	}
+
+	if err := s.sweep("", true); err != nil {
+		return result, err
+	}
+	dirs, err := cs.backing.List(objectsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir {
+			continue
+		}
+		if err := s.sweep(joinPath(objectsDir, dir.Name),
+			true); err != nil {
+			return result, err
+		}
+	}
+	return result, s.sweep("refs", false)
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type gcTest struct {
+	t  *testing.T
+	fs *FakeFileSys
+	cs *ChunkStore
+}
+
+// Creates a store with a "master" branch with two commits and a journal.
+func newGCTest(t *testing.T) *gcTest {
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(NewFSInfo("pw"), fs)
+	writeVerifyTestTree(t, cs, "master")
+	return &gcTest{t, fs, cs}
+}
+
+// Makes every file in the store look like it was written two hours ago.
+func (g *gcTest) age() {
+	for name := range g.fs.contents {
+		g.fs.SetModTime(name, time.Now().Add(-2*time.Hour))
+	}
+}
+
+func (g *gcTest) collect(opts GCOptions) *GCResult {
+	opts.GracePeriod = time.Hour
+	result, err := g.cs.CollectGarbage(opts)
+	if err != nil {
+		g.t.Fatalf("CollectGarbage: %s", err)
+	}
+	sort.Strings(result.Removed)
+	return result
+}
+
+// Checks that everything on "master" is intact.
+func (g *gcTest) verify() {
+	report := Verify(g.cs, []string{"master"})
+	Assertf(g.t, report.OK(), "got problems %v", problemKinds(report))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	g := newGCTest(t)
+	g.age()
+	result := g.collect(GCOptions{})
+	Assertf(t, len(result.Removed) == 0 && result.Kept == 0,
+		"removed %v", result.Removed)
+	Assert(t, result.Reachable > 10)
+
+	// Everything on a deleted branch is garbage, except what it shares with
+	// master.
+	writeVerifyTestTree(t, g.cs, "other")
+	g.cs.DeleteHead("other")
+	g.cs.DeleteJournal("other")
+	stray := storeTestNode(t, g.cs, "stray")
+	g.age()
+
+	result = g.collect(GCOptions{DryRun: true})
+	removed := result.Removed
+	Assertf(t, len(removed) > 2, "removed %v", removed)
+	found := false
+	for _, name := range removed {
+		Assert(t, g.fs.Exists(name))
+		found = found || name == objectName(stray)
+	}
+	Assert(t, found)
+
+	result = g.collect(GCOptions{})
+	Assert(t, reflect.DeepEqual(result.Removed, removed))
+	Assert(t, !g.fs.Exists(objectName(stray)))
+	for _, name := range removed {
+		Assert(t, !g.fs.Exists(name))
+	}
+	g.verify()
+	Assert(t, len(g.collect(GCOptions{}).Removed) == 0)
+}
+
+func TestCollectGarbageGracePeriod(t *testing.T) {
+	g := newGCTest(t)
+	g.age()
+	stray := storeTestNode(t, g.cs, "stray")
+	g.fs.Create("refs/master.x" + tempSuffix)
+
+	result := g.collect(GCOptions{})
+	Assert(t, len(result.Removed) == 0 && result.Kept == 2)
+	Assert(t, g.fs.Exists(objectName(stray)))
+
+	g.age()
+	result = g.collect(GCOptions{})
+	Assertf(t, reflect.DeepEqual(result.Removed, []string{
+		objectName(stray), "refs/master.x" + tempSuffix}), "removed %v",
+		result.Removed)
+}
+
+func TestCollectGarbageRoots(t *testing.T) {
+	g := newGCTest(t)
+
+	// Nodes referenced by the journal.
+	head, _ := g.cs.GetHead("master")
+	changed := storeTestNode(t, g.cs, "changed")
+	child := storeTestNode(t, g.cs, "child")
+	g.cs.WriteToJournal("master", &pb.Change{
+		Type:   proto.Int32(CHANGE_REPLACE_CHILD),
+		Commit: head,
+		Digest: changed,
+	})
+	g.cs.WriteToJournal("master", &pb.Change{
+		Type: proto.Int32(CHANGE_ADD_CHILD),
+		Node: &pb.Node{Children: []*pb.Entry{{Hash: child}}},
+	})
+
+	// A node that's only referenced by refs/root.
+	rootNode := storeTestNode(t, g.cs, "root node")
+	g.cs.StoreRootDigest(rootNode)
+
+	// A commit that's only reachable from the roots.
+	root := storeTestNode(t, g.cs, "root")
+	commit, _ := g.cs.StoreCommit(&pb.Commit{Root: root})
+	g.age()
+
+	result := g.collect(GCOptions{Roots: [][]byte{commit}})
+	Assertf(t, len(result.Removed) == 0, "removed %v", result.Removed)
+	result = g.collect(GCOptions{})
+	Assert(t, reflect.DeepEqual(result.Removed, []string{objectName(root),
+		objectName(commit)}) || reflect.DeepEqual(result.Removed,
+		[]string{objectName(commit), objectName(root)}))
+	Assert(t, g.fs.Exists(objectName(changed)))
+	Assert(t, g.fs.Exists(objectName(child)))
+	Assert(t, g.fs.Exists(objectName(rootNode)))
+}
+
+func TestCollectGarbageLayouts(t *testing.T) {
+	g := newGCTest(t)
+	head, _ := g.cs.GetHead("master")
+	Assert(t, TraverseCommit(g.cs, head, g.cs.GetTraversed()) == nil)
+
+	// An unreachable object in the flat layout with a traversed marker, a
+	// reachable one in the flat layout and a quarantined one.
+	stray := storeTestNode(t, g.cs, "stray")
+	g.cs.GetTraversed().Add(stray)
+	g.fs.Rename(objectName(stray), altEncode(stray))
+	g.fs.Rename(objectName(head), altEncode(head))
+	g.fs.Mkdir(quarantineDir)
+	g.fs.Create(quarantineDir + "/" + altEncode(stray))
+	g.age()
+
+	result := g.collect(GCOptions{})
+	Assertf(t, reflect.DeepEqual(result.Removed, []string{altEncode(stray),
+		traversedDir + "/" + altEncode(stray)}), "removed %v",
+		result.Removed)
+	Assert(t, g.cs.GetTraversed().Has(head))
+	Assert(t, g.fs.Exists(quarantineDir+"/"+altEncode(stray)))
+	g.verify()
+}
+
+func TestCollectGarbageMissingObject(t *testing.T) {
+	g := newGCTest(t)
+	stray := storeTestNode(t, g.cs, "stray")
+	head, _ := g.cs.GetHead("master")
+	commit, _ := g.cs.LoadCommit(head)
+	g.fs.Remove(objectName(commit.Root))
+	g.age()
+
+	_, err := g.cs.CollectGarbage(GCOptions{})
+	Assert(t, err != nil)
+	Assert(t, g.fs.Exists(objectName(stray)))
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The layout of the object files in the backing store.
+//
+// Objects are stored in a fan-out layout, under a directory named for the
+// first byte of the digest in hex: objects/<hex byte>/<alt-encoded digest>.
+// (The alt-encoded prefix can't be used, it can be "..".)  Older
+// repositories store them directly in the root of the backing store under
+// their alt-encoded digest, objects are looked up there if they aren't in
+// the fan-out layout.  MigrateToFanOut() converts a repository.
+
+package blockstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const objectsDir = "objects"
+
+// Returns the directory that the object with 'digest' is stored in.
+func objectDir(digest []byte) string {
+	return fmt.Sprintf("%s/%02x", objectsDir, digest[0])
+}
+
+// Returns the name of the file the object with 'digest' is stored in.
+func objectName(digest []byte) string {
+	return objectDir(digest) + "/" + altEncode(digest)
+}
+
+// Returns the name of the file for the object with 'digest', which is in
+// the flat layout if it's there and not in the fan-out layout.  Returns ""
+// if the object doesn't exist.
+func findObject(backing FileSys, digest []byte) string {
+	if name := objectName(digest); backing.Exists(name) {
+		return name
+	} else if name := altEncode(digest); backing.Exists(name) {
+		return name
+	}
+	return ""
+}
+
+// Creates the directory for the object with 'digest' if it doesn't exist.
+func makeObjectDir(backing FileSys, digest []byte) error {
+	for _, dir := range []string{objectsDir, objectDir(digest)} {
+		if !backing.Exists(dir) {
+			if err := backing.Mkdir(dir); err != nil &&
+				!backing.Exists(dir) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes the encrypted object 'data' with 'digest'.
+func writeObject(backing FileSys, digest, data []byte) error {
+	if err := makeObjectDir(backing, digest); err != nil {
+		return err
+	}
+	return WriteFileAtomically(backing, objectName(digest), data)
+}
+
+// Returns the digest of the object stored in the flat layout as 'name', nil
+// if 'name' isn't the name of an object.
+func flatObjectDigest(name string) []byte {
+	digest, err := altDecode(name)
+	if err != nil || len(digest) != sha256.Size ||
+		altEncode(digest) != name {
+		return nil
+	}
+	return digest
+}
+
+// Moves all of the objects in the backing directory 'root' from the flat
+// layout to the fan-out layout.  Returns the number of objects moved.
+//
+// This is safe to interrupt: every object is in one layout or the other
+// and the migration can simply be run again.  Other processes must not be
+// using the repository while it runs.
+func MigrateToFanOut(root string) (int, error) {
+	backing := NewBackingDir(root)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rename without syncing the directories for every object, they're
+	// synced at the end.
+	dirs := map[string]bool{root: true}
+	count := 0
+	for _, entry := range entries {
+		digest := flatObjectDigest(entry.Name())
+		if digest == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		if err := makeObjectDir(backing, digest); err != nil {
+			return count, err
+		}
+		dir := filepath.Join(root, objectDir(digest))
+		if err := os.Rename(filepath.Join(root, entry.Name()),
+			filepath.Join(dir, entry.Name())); err != nil {
+			return count, err
+		}
+		dirs[dir] = true
+		count++
+	}
+
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Syncs the directory 'name', which makes changes to its entries durable.
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Stores a node with 'contents', returns its digest.
+func storeTestNode(t *testing.T, cs *ChunkStore, contents string) []byte {
+	digest, err := cs.StoreNode(&pb.Node{Contents: proto.String(contents)})
+	if err != nil {
+		t.Fatalf("StoreNode: %s", err)
+	}
+	return digest
+}
+
+// Returns true if the node 'digest' in 'cs' has 'contents'.
+func hasTestNode(cs *ChunkStore, digest []byte, contents string) bool {
+	node, err := cs.LoadNode(digest)
+	return err == nil && node.GetContents() == contents
+}
+
+func TestFanOutLayout(t *testing.T) {
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(NewFSInfo("password"), fs)
+	digest := storeTestNode(t, cs, "data")
+
+	name := objectName(digest)
+	Assertf(t, name == fmt.Sprintf("objects/%02x/%s", digest[0],
+		altEncode(digest)), "got name %s", name)
+	Assert(t, fs.Exists(name))
+	Assert(t, !fs.Exists(altEncode(digest)))
+	Assert(t, hasTestNode(cs, digest, "data"))
+
+	// Objects in the flat layout can still be read.
+	Assert(t, fs.Rename(name, altEncode(digest)) == nil)
+	Assert(t, hasTestNode(cs, digest, "data"))
+	raw, err := cs.GetRawChunkReader().ReadRawChunk(digest)
+	Assert(t, err == nil && raw != nil)
+
+	_, err = cs.LoadNode([]byte("missing"))
+	Assert(t, os.IsNotExist(err))
+}
+
+func TestMigrateToFanOut(t *testing.T) {
+	root := t.TempDir()
+	cs := NewChunkStore(NewFSInfo("password"), NewBackingDir(root))
+	var digests [][]byte
+	for i := 0; i < 10; i++ {
+		digest := storeTestNode(t, cs, fmt.Sprint("node ", i))
+		digests = append(digests, digest)
+
+		// Move it to where an older version would have put it.
+		Assert(t, os.Rename(filepath.Join(root, objectName(digest)),
+			filepath.Join(root, altEncode(digest))) == nil)
+	}
+	Assert(t, cs.SetHead("master", digests[0]) == nil)
+	Assert(t, os.WriteFile(filepath.Join(root, "notes"), nil, 0600) == nil)
+
+	count, err := MigrateToFanOut(root)
+	Assertf(t, err == nil && count == 10, "got %d, %v", count, err)
+	for i, digest := range digests {
+		Assert(t, hasTestNode(cs, digest, fmt.Sprint("node ", i)))
+		_, err := os.Stat(filepath.Join(root, objectName(digest)))
+		Assert(t, err == nil)
+		_, err = os.Stat(filepath.Join(root, altEncode(digest)))
+		Assert(t, os.IsNotExist(err))
+	}
+
+	// Everything else is left as it was.
+	head, err := cs.GetHead("master")
+	Assert(t, err == nil && bytes.Equal(head, digests[0]))
+	_, err = os.Stat(filepath.Join(root, "notes"))
+	Assert(t, err == nil)
+
+	count, err = MigrateToFanOut(root)
+	Assert(t, err == nil && count == 0)
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A NodeStore implemented in memory.  This is mainly useful for testing and
+// for scratch filesystems, it's the equivalent of memstore.crk.
+
+package blockstore
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	pb "mawfs"
+	"sync"
+)
+
+// Implements NodeStore entirely in memory.
+//
+// Objects are stored unencrypted, but their digests are computed from the
+// encrypted form exactly as they are for ChunkStore so that the same objects
+// have the same digests in both.
+type MemNodeStore struct {
+	mu       sync.Mutex
+	fsInfo   *FSInfo
+	objs     map[string][]byte
+	journals map[string][]*ChangeEntry
+	branches map[string][]byte
+	root     []byte
+}
+
+// Creates a new, empty MemNodeStore.  'fsInfo' is used to compute digests.
+func NewMemStore(fsInfo *FSInfo) *MemNodeStore {
+	return &MemNodeStore{fsInfo: fsInfo,
+		objs:     make(map[string][]byte),
+		journals: make(map[string][]*ChangeEntry),
+		branches: make(map[string][]byte),
+	}
+}
+
+func checkMemNodeStoreIfaces() {
+	var _ NodeStore = &MemNodeStore{}
+}
+
+// Returns a copy of 'data', so that callers can't modify our copy.
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+func (ms *MemNodeStore) MakeDigest(data []byte) ([]byte, error) {
+	return ms.fsInfo.WriteChunk(ioutil.Discard, data)
+}
+
+func (ms *MemNodeStore) store(obj proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := ms.MakeDigest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.objs[string(digest)] = data
+	return digest, nil
+}
+
+func (ms *MemNodeStore) load(digest []byte, obj proto.Message) error {
+	ms.mu.Lock()
+	data, ok := ms.objs[string(digest)]
+	ms.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Object %s not found", altEncode(digest))
+	}
+	return proto.Unmarshal(data, obj)
+}
+
+func (ms *MemNodeStore) StoreNode(node *pb.Node) ([]byte, error) {
+	return ms.store(node)
+}
+
+func (ms *MemNodeStore) LoadNode(digest []byte) (*pb.Node, error) {
+	node := &pb.Node{}
+	if err := ms.load(digest, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (ms *MemNodeStore) StoreCommit(commit *pb.Commit) ([]byte, error) {
+	return ms.store(commit)
+}
+
+func (ms *MemNodeStore) LoadCommit(digest []byte) (*pb.Commit, error) {
+	commit := &pb.Commit{}
+	if err := ms.load(digest, commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+func (ms *MemNodeStore) LoadRootDigest() ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyBytes(ms.root), nil
+}
+
+func (ms *MemNodeStore) StoreRootDigest(digest []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.root = copyBytes(digest)
+	return nil
+}
+
+func (ms *MemNodeStore) GetHead(branch string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	digest, ok := ms.branches[branch]
+	if !ok {
+		return nil, UnknownName{"Unknown name: " + branch}
+	}
+	return copyBytes(digest), nil
+}
+
+func (ms *MemNodeStore) SetHead(branch string, digest []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.branches[branch] = copyBytes(digest)
+	return nil
+}
+
+func (ms *MemNodeStore) DeleteHead(branch string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.branches, branch)
+	return nil
+}
+
+func (ms *MemNodeStore) WriteToJournal(branch string, change *pb.Change) (
+	[]byte, error) {
+
+	// Store a copy of the change so the caller can't modify it.
+	data, err := proto.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ChangeEntry{}
+	if err := proto.Unmarshal(data, &entry.change); err != nil {
+		return nil, err
+	}
+	if entry.digest, err = ms.MakeDigest(data); err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.journals[branch] = append(ms.journals[branch], entry)
+	return copyBytes(entry.digest), nil
+}
+
+func (ms *MemNodeStore) DeleteJournal(branch string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.journals, branch)
+	return nil
+}
+
+// Implements JournalIter.  Iterates over a snapshot of the journal, so
+// changes written after the iterator is created aren't visible to it.
+type memJournalIter struct {
+	changes []*ChangeEntry
+}
+
+func (i *memJournalIter) Elem() (*ChangeEntry, error) {
+	if len(i.changes) == 0 {
+		return nil, nil
+	}
+
+	// Return a copy, the cache modifies the changes it replays.
+	entry := &ChangeEntry{digest: copyBytes(i.changes[0].digest)}
+	proto.Merge(&entry.change, &i.changes[0].change)
+	return entry, nil
+}
+
+func (i *memJournalIter) Next() error {
+	if len(i.changes) > 0 {
+		i.changes = i.changes[1:]
+	}
+	return nil
+}
+
+func (i *memJournalIter) IsValid() bool {
+	return len(i.changes) > 0
+}
+
+func (ms *MemNodeStore) MakeJournalIter(branch string) (JournalIter, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	journal := ms.journals[branch]
+	return &memJournalIter{journal[:len(journal):len(journal)]}, nil
+}
+
+// The traversed set isn't worth keeping for a store that doesn't outlive the
+// process, so this always returns nil.
+func (ms *MemNodeStore) GetTraversed() ChunkSet {
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"testing"
+)
+
+func TestMemNodeStoreConformance(t *testing.T) {
+	NodeStoreConformance(t, func() NodeStore {
+		return NewMemStore(NewFSInfo("bad-password"))
+	})
+}
+
+func TestMemNodeStoreDigestsMatchChunkStore(t *testing.T) {
+	fsInfo := NewFSInfo("bad-password")
+	ms := NewMemStore(fsInfo)
+	cs := NewChunkStore(fsInfo, NewFakeFileSys())
+	node := &pb.Node{Contents: proto.String("contents")}
+	memDigest, _ := ms.StoreNode(node)
+	csDigest, _ := cs.StoreNode(node)
+	Assert(t, bytes.Equal(memDigest, csDigest))
+
+	change := &pb.Change{Type: proto.Int32(1)}
+	memDigest, _ = ms.WriteToJournal("master", change)
+	csDigest, _ = cs.WriteToJournal("master", change)
+	Assert(t, bytes.Equal(memDigest, csDigest))
+}
+
+func TestMemNodeStoreCache(t *testing.T) {
+	store := NewMemStore(NewFSInfo("bad-password"))
+	head, err := NewCache(store).GetHead("master")
+	if err != nil {
+		t.Fatalf("GetHead: %s", err)
+	}
+	root, _ := head.GetRoot()
+	file, err := root.AddChild("file", &pb.Node{}, 100)
+	Assertf(t, err == nil, "AddChild: %s", err)
+	Assert(t, file.Write(0, []byte("contents"), 100) == nil)
+
+	// Replay the journal in a new cache.
+	head, _ = NewCache(store).GetHead("master")
+	root, err = head.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	file, _ = root.GetChildByName("file")
+	Assert(t, file != nil)
+	contents, err := file.GetContents()
+	Assertf(t, err == nil && string(contents) == "contents",
+		"got contents %q", contents)
+
+	// Commit and reload.
+	_, err = head.Commit(nil)
+	Assertf(t, err == nil, "Commit: %s", err)
+	Assert(t, len(readJournal(t, store, "master")) == 0)
+	head, _ = NewCache(store).GetHead("master")
+	root, _ = head.GetRoot()
+	file, _ = root.GetChildByName("file")
+	Assert(t, file != nil)
+}
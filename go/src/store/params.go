@@ -0,0 +1,532 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tools for dealing with the params file, this is a port of params.crk.
+//
+// A params file consists of:
+//   -  A protobuf string containing a plaintext PublicParams protobuf.
+//   -  Another protobuf string containing an encrypted parcel of:
+//      -  a variable-length random header,
+//      -  an 8 byte magic value of ASCII "MAWFS1.0",
+//      -  a PrivateParams protobuf (also as a protobuf string),
+//      -  a variable-length random tail.
+// The encrypted parcel is encrypted with the cipher specified in the
+// PublicParams and the key derived from the user's password.
+//
+// The variable length parts consist of a single byte length followed by 0 to
+// 255 bytes of random data.
+//
+// Repositories created by the Crack implementation derive the key with a
+// single SHA256 hash of the password and use it to encrypt everything.  New
+// repositories derive the key from the password with scrypt (the parameters
+// of which are stored in the PublicParams) and use it only to encrypt a
+// random master key stored in the PrivateParams.  Everything else is
+// encrypted with the master key, so the password can be changed by
+// rewriting the params file.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	pb "mawfs"
+)
+
+const (
+	PARAMS_MAGIC_NUMBER = "MAWFS1.0"
+	DEFAULT_VERSION     = 1
+)
+
+// Cipher identifiers stored in PublicParams.
+const (
+	CIPHER_AES256 = 1
+	CIPHER_AESSIV = 2
+)
+
+// Key derivation functions stored in KDFParams.  KDF_SHA256 is the Crack
+// key derivation, which is also what you get if there are no KDFParams.
+const (
+	KDF_SHA256 = 0
+	KDF_SCRYPT = 1
+)
+
+// Default scrypt parameters for new repositories.  These are the values
+// recommended for interactive logins, at 32MB of memory.
+var (
+	DefaultScryptLogN int32 = 15
+	DefaultScryptR    int32 = 8
+	DefaultScryptP    int32 = 1
+)
+
+const (
+	keySize  = 32
+	saltSize = 16
+
+	// Don't let a params file make us allocate more than 32GB or do an
+	// unreasonable amount of work.  scrypt allocates 128*r*N bytes, plus
+	// 128*r*p bytes, and its running time is proportional to N*r*p.
+	maxScryptLogN   = 24
+	maxScryptRP     = 1 << 10
+	maxScryptMemory = 32 << 30
+)
+
+// Name of the params file in the backing directory.
+const paramsFileName = "params"
+
+// Returned when the params file can't be decrypted with the key.
+var ErrInvalidPassword = errors.New("Invalid password")
+
+// A CipherFactory creates a cipher from a key.
+type CipherFactory func(key []byte) (Cipher, error)
+
+// Registered ciphers.  CIPHER_AES256 (the original cipher used by the Crack
+// implementation, which shouldn't be used for new filesystems) isn't
+// supported by default.
+var cipherFactories = map[int32]CipherFactory{
+	CIPHER_AESSIV: NewSivCipher,
+}
+
+// Registers a factory for the cipher identified by 'id' in the params file,
+// replacing any existing factory for that id.
+func RegisterCipher(id int32, factory CipherFactory) {
+	cipherFactories[id] = factory
+}
+
+// Returns a new cipher of type 'id' created from 'key'.
+func makeCipher(id int32, key []byte) (Cipher, error) {
+	factory, ok := cipherFactories[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher type %d", id)
+	}
+	return factory(key)
+}
+
+// Converts a password to a key in the same way as the Crack implementation,
+// which is a SHA256 hash of the password.
+func HashPassword(password string) []byte {
+	key := sha256.Sum256([]byte(password))
+	return key[:]
+}
+
+// Derives the key from a password using the parameters in 'kdf'.  'kdf' may
+// be nil, in which case we use HashPassword().
+func deriveKey(kdf *pb.KDFParams, password string) ([]byte, error) {
+	switch kdf.GetType() {
+	case KDF_SHA256:
+		return HashPassword(password), nil
+	case KDF_SCRYPT:
+		// These come from the unauthenticated public params, so they have
+		// to be checked before scrypt sees them.
+		logN, r, p := kdf.GetLogN(), int64(kdf.GetR()), int64(kdf.GetP())
+		if logN < 1 || logN > maxScryptLogN {
+			return nil, fmt.Errorf("Invalid scrypt cost 2^%d", logN)
+		}
+		if r < 1 || p < 1 || r*p > maxScryptRP {
+			return nil, fmt.Errorf("Invalid scrypt parameters r=%d, p=%d", r,
+				p)
+		}
+		if 128*r<<uint(logN) > maxScryptMemory {
+			return nil, fmt.Errorf("scrypt parameters r=%d, N=2^%d need "+
+				"too much memory", r, logN)
+		}
+		return scrypt.Key([]byte(password), kdf.GetSalt(), 1<<uint(logN),
+			int(r), int(p), keySize)
+	default:
+		return nil, fmt.Errorf("Unknown key derivation function %d",
+			kdf.GetType())
+	}
+}
+
+// Returns new scrypt parameters with the default costs and a random salt.
+func newScryptParams(random io.Reader) (*pb.KDFParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+	return &pb.KDFParams{Type: proto.Int32(KDF_SCRYPT),
+		Salt: salt,
+		LogN: proto.Int32(DefaultScryptLogN),
+		R:    proto.Int32(DefaultScryptR),
+		P:    proto.Int32(DefaultScryptP),
+	}, nil
+}
+
+// Bundles the params and cipher determined from the params file.
+type ParamInfo struct {
+	// The cipher used to encrypt everything other than the params file.
+	Cipher       Cipher
+	PublicParams *pb.PublicParams
+	Params       *pb.PrivateParams
+
+	// The cipher created from the password, used to encrypt the private
+	// params.  If nil, 'Cipher' is used.
+	wrapCipher Cipher
+}
+
+// Writes 'data' to 'buf' as a protobuf string (a varint length followed by
+// the data).
+func writeString(buf *bytes.Buffer, data []byte) {
+	buf.Write(proto.EncodeVarint(uint64(len(data))))
+	buf.Write(data)
+}
+
+// Reads a protobuf string from the beginning of 'data'.  Returns the string
+// and the remaining data.
+func readString(data []byte) ([]byte, []byte, error) {
+	size, n := proto.DecodeVarint(data)
+	if n == 0 || uint64(len(data)-n) < size {
+		return nil, nil, errors.New("Params file is corrupt.")
+	}
+	return data[n : n+int(size)], data[n+int(size):], nil
+}
+
+// Reads the params from 'src' using 'password'.  Returns ErrInvalidPassword
+// if the password doesn't decrypt the file, and some other error if the file
+// is corrupt or the cipher is unknown.
+func ReadParams(src io.Reader, password string) (*ParamInfo, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the PublicParams and get the cipher type.
+	publicParamsData, data, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	publicParams := &pb.PublicParams{}
+	if err := proto.Unmarshal(publicParamsData, publicParams); err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(publicParams.GetKdf(), password)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := makeCipher(publicParams.GetCipher(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try decrypting the rest.
+	ciphertext, _, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := cipher.Decrypt(ciphertext)
+	if err != nil || len(plaintext) == 0 {
+		return nil, ErrInvalidPassword
+	}
+
+	// Need a magic number, at least one byte for the params proto and one
+	// byte for the end padding.
+	size := int(plaintext[0])
+	if size+10 > len(plaintext) {
+		return nil, ErrInvalidPassword
+	}
+	if string(plaintext[size+1:size+9]) != PARAMS_MAGIC_NUMBER {
+		return nil, ErrInvalidPassword
+	}
+
+	// Read the PrivateParams, we can ignore the rest of the padding.
+	paramsData, _, err := readString(plaintext[size+9:])
+	if err != nil {
+		return nil, err
+	}
+	params := &pb.PrivateParams{}
+	if err := proto.Unmarshal(paramsData, params); err != nil {
+		return nil, err
+	}
+
+	result := &ParamInfo{Cipher: cipher, PublicParams: publicParams,
+		Params: params,
+	}
+	if params.MasterKey != nil {
+		result.wrapCipher = cipher
+		result.Cipher, err = makeCipher(publicParams.GetCipher(),
+			params.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns the default parameters for new filesystems, with a random master
+// key encrypted with a key derived from 'password'.  'random' is a source of
+// entropy, this should normally be crypto/rand.Reader.
+func DefaultParams(password string, random io.Reader) (*ParamInfo, error) {
+	params := &ParamInfo{
+		PublicParams: &pb.PublicParams{Cipher: proto.Int32(CIPHER_AESSIV)},
+		Params: &pb.PrivateParams{Version: proto.Int32(DEFAULT_VERSION),
+			MasterKey: make([]byte, keySize),
+		},
+	}
+	if _, err := io.ReadFull(random, params.Params.MasterKey); err != nil {
+		return nil, err
+	}
+	var err error
+	if params.Cipher, err = NewSivCipher(params.Params.MasterKey); err != nil {
+		return nil, err
+	}
+	if err := params.Rekey(password, random); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Returns the parameters of a repository created before there was a params
+// file, which is encrypted directly with the SHA256 hash of the password.
+func legacyParams(password string) (*ParamInfo, error) {
+	cipher, err := NewSivCipher(HashPassword(password))
+	if err != nil {
+		return nil, err
+	}
+	return &ParamInfo{Cipher: cipher,
+		PublicParams: &pb.PublicParams{Cipher: proto.Int32(CIPHER_AESSIV)},
+		Params:       &pb.PrivateParams{Version: proto.Int32(DEFAULT_VERSION)},
+	}, nil
+}
+
+// Changes the password used to encrypt the private params to 'password',
+// generating a new salt from 'random'.  This only changes the params, call
+// WriteTo() to store them.
+//
+// If the params have no master key (because the key was derived directly
+// from the password) the existing key becomes the master key and the
+// params are upgraded to use scrypt.  Note that the Crack implementation
+// can't open repositories once this has been done, and that the master key
+// is still the hash of the old password: anyone who knows the old password
+// can go on decrypting the objects without the params file.  Only
+// reencrypting everything with a new master key would revoke it.
+func (p *ParamInfo) Rekey(password string, random io.Reader) error {
+	if p.Params.MasterKey == nil {
+		sivCipher, ok := p.Cipher.(*SivCipher)
+		if !ok {
+			return errors.New("Can only add a master key for AES-SIV.")
+		}
+		p.Params.MasterKey = sivCipher.key
+	}
+
+	kdf, err := newScryptParams(random)
+	if err != nil {
+		return err
+	}
+	key, err := deriveKey(kdf, password)
+	if err != nil {
+		return err
+	}
+	wrapCipher, err := makeCipher(p.PublicParams.GetCipher(), key)
+	if err != nil {
+		return err
+	}
+	p.PublicParams.Kdf = kdf
+	p.wrapCipher = wrapCipher
+	return nil
+}
+
+// Writes a length byte followed by that many bytes of random data from
+// 'random'.
+func writePadding(buf *bytes.Buffer, random io.Reader) error {
+	size := []byte{0}
+	if _, err := io.ReadFull(random, size); err != nil {
+		return err
+	}
+	buf.Write(size)
+	_, err := io.CopyN(buf, random, int64(size[0]))
+	return err
+}
+
+// Writes the params to 'dst'.  'random' is a source of entropy used to
+// generate the padding, this should normally be crypto/rand.Reader.
+func (p *ParamInfo) WriteTo(dst io.Writer, random io.Reader) error {
+	publicParamsData, err := proto.Marshal(p.PublicParams)
+	if err != nil {
+		return err
+	}
+	paramsData, err := proto.Marshal(p.Params)
+	if err != nil {
+		return err
+	}
+
+	// Create the encrypted part.
+	parcel := &bytes.Buffer{}
+	if err := writePadding(parcel, random); err != nil {
+		return err
+	}
+	parcel.WriteString(PARAMS_MAGIC_NUMBER)
+	writeString(parcel, paramsData)
+	if err := writePadding(parcel, random); err != nil {
+		return err
+	}
+	wrapCipher := p.wrapCipher
+	if wrapCipher == nil {
+		wrapCipher = p.Cipher
+	}
+	ciphertext, err := wrapCipher.Encrypt(parcel.Bytes())
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	writeString(buf, publicParamsData)
+	writeString(buf, ciphertext)
+	_, err = dst.Write(buf.Bytes())
+	return err
+}
+
+// Writes the params file to 'backing'.
+func writeParams(backing FileSys, params *ParamInfo) error {
+	buf := &bytes.Buffer{}
+	if err := params.WriteTo(buf, rand.Reader); err != nil {
+		return err
+	}
+
+	// Replace the file atomically, a torn params file would make the
+	// repository unreadable.
+	return WriteFileAtomically(backing, paramsFileName, buf.Bytes())
+}
+
+// Returns true if 'backing' contains a repository created before there was a
+// params file.
+func isLegacyStore(backing FileSys) bool {
+	return !backing.Exists(paramsFileName) &&
+		(backing.Exists("refs") || backing.Exists("journals"))
+}
+
+// Returns ErrInvalidPassword if the legacy params can't decrypt anything in
+// 'backing'.  Without a params file, this is the only way we have to check
+// the password, so every branch head and journal is tried until one of them
+// can be decrypted.  Returns an error if there's nothing to try, we don't
+// want to write params for a password that we haven't verified.
+func checkLegacyPassword(backing FileSys, params *ParamInfo) error {
+	cs := NewChunkStore(NewFSInfoFromCipher(params.Cipher), backing)
+	branches, err := ListBranches(backing)
+	if err != nil {
+		return err
+	}
+	tried := false
+	for _, branch := range branches {
+		if digest, err := cs.GetHead(branch); err == nil {
+			tried = true
+			if _, err := cs.LoadCommit(digest); err == nil {
+				return nil
+			}
+		}
+
+		// The journal iterator decrypts the first change when it's created.
+		// An empty journal doesn't tell us anything.
+		if iter, err := cs.MakeJournalIter(branch); err != nil {
+			tried = true
+		} else if iter.IsValid() {
+			return nil
+		}
+	}
+	if digest, err := cs.LoadRootDigest(); err == nil && digest != nil {
+		tried = true
+		if _, err := cs.LoadNode(digest); err == nil {
+			return nil
+		}
+	}
+	if tried {
+		return ErrInvalidPassword
+	}
+	return errors.New("Can't verify the password, the repository has no " +
+		"commits or journal entries.")
+}
+
+// Returns the legacy params for 'backing', verifying the password.
+func loadLegacyParams(backing FileSys, password string) (*ParamInfo, error) {
+	params, err := legacyParams(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLegacyPassword(backing, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Reads the params file from 'backing'.
+func loadParams(backing FileSys, password string) (*ParamInfo, error) {
+	src, err := backing.Open(paramsFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return ReadParams(src, password)
+}
+
+// Returns the FSInfo for the filesystem in 'backing', reading the cipher
+// from its params file.  If there is no params file and 'maybeCreate' is
+// true, writes a params file: with the default parameters for a new
+// repository, or with parameters matching the original password hashing
+// for a repository that predates the params file.
+func LoadFSInfo(backing FileSys, password string,
+	maybeCreate bool) (*FSInfo, error) {
+
+	var params *ParamInfo
+	var err error
+	if backing.Exists(paramsFileName) {
+		params, err = loadParams(backing, password)
+	} else if !maybeCreate {
+		return nil, errors.New("Backing store has no params file.")
+	} else if isLegacyStore(backing) {
+		if params, err = loadLegacyParams(backing, password); err == nil {
+			err = writeParams(backing, params)
+		}
+	} else {
+		if params, err = DefaultParams(password, rand.Reader); err == nil {
+			err = writeParams(backing, params)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewFSInfoFromCipher(params.Cipher), nil
+}
+
+// Changes the password of the repository in 'backing' from 'oldPassword' to
+// 'newPassword'.  This only rewrites the params file, none of the other
+// objects need to be reencrypted.  Repositories whose key is derived
+// directly from the password (including those without a params file) are
+// migrated to a master key with a key derived from the password using
+// scrypt.
+//
+// Returns true if the repository was migrated this way.  The master key is
+// then the key derived from 'oldPassword', so 'oldPassword' can still
+// decrypt the objects (see ParamInfo.Rekey()).
+func Rekey(backing FileSys, oldPassword, newPassword string) (bool, error) {
+	var params *ParamInfo
+	var err error
+	if isLegacyStore(backing) {
+		params, err = loadLegacyParams(backing, oldPassword)
+	} else {
+		params, err = loadParams(backing, oldPassword)
+	}
+	if err != nil {
+		return false, err
+	}
+	migrated := params.Params.MasterKey == nil
+	if err := params.Rekey(newPassword, rand.Reader); err != nil {
+		return false, err
+	}
+	return migrated, writeParams(backing, params)
+}
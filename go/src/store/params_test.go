@@ -0,0 +1,304 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"testing"
+)
+
+// A cipher that doesn't encrypt, so we can check the layout of the params
+// file.
+type plainCipher struct{}
+
+func (plainCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
+
+func (plainCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	return ciphertext, nil
+}
+
+const testCipherId = 100
+
+func init() {
+	// Keep scrypt cheap for the tests.
+	DefaultScryptLogN = 4
+
+	RegisterCipher(testCipherId, func(key []byte) (Cipher, error) {
+		return plainCipher{}, nil
+	})
+}
+
+func TestParamsLayout(t *testing.T) {
+	params := &ParamInfo{Cipher: plainCipher{},
+		PublicParams: &pb.PublicParams{Cipher: proto.Int32(testCipherId)},
+		Params:       &pb.PrivateParams{Version: proto.Int32(DEFAULT_VERSION)},
+	}
+	buf := &bytes.Buffer{}
+	padding := bytes.NewReader([]byte{2, 'a', 'b', 1, 'z'})
+	Assert(t, params.WriteTo(buf, padding) == nil)
+
+	expected := "\x02\x08\x64" + // PublicParams{cipher: 100}
+		"\x10" + // Length of the encrypted parcel.
+		"\x02ab" + // Start padding.
+		"MAWFS1.0" +
+		"\x02\x08\x01" + // PrivateParams{version: 1}
+		"\x01z" // End padding.
+	Assertf(t, buf.String() == expected, "got %q", buf.String())
+
+	read, err := ReadParams(bytes.NewReader(buf.Bytes()), "")
+	Assertf(t, err == nil, "ReadParams: %s", err)
+	Assert(t, read.PublicParams.GetCipher() == testCipherId)
+	Assert(t, read.Params.GetVersion() == DEFAULT_VERSION)
+}
+
+func TestParamsRoundTrip(t *testing.T) {
+	params, err := DefaultParams("password", rand.Reader)
+	Assert(t, err == nil)
+	buf := &bytes.Buffer{}
+	Assert(t, params.WriteTo(buf, rand.Reader) == nil)
+
+	read, err := ReadParams(bytes.NewReader(buf.Bytes()), "password")
+	Assertf(t, err == nil, "ReadParams: %s", err)
+	Assert(t, read.PublicParams.GetCipher() == CIPHER_AESSIV)
+	kdf := read.PublicParams.GetKdf()
+	Assert(t, kdf.GetType() == KDF_SCRYPT && len(kdf.GetSalt()) == saltSize)
+	Assert(t, kdf.GetLogN() == DefaultScryptLogN)
+	Assert(t, len(read.Params.GetMasterKey()) == keySize)
+	Assert(t, read.Params.GetVersion() == DEFAULT_VERSION)
+
+	// Verify that the cipher is equivalent to the one we wrote with.
+	ciphertext, _ := params.Cipher.Encrypt([]byte("test data"))
+	plaintext, err := read.Cipher.Decrypt(ciphertext)
+	Assert(t, err == nil && string(plaintext) == "test data")
+
+	_, err = ReadParams(bytes.NewReader(buf.Bytes()), "bad")
+	Assert(t, err == ErrInvalidPassword)
+
+	// The master key should be independent of the password.
+	other, _ := DefaultParams("password", rand.Reader)
+	Assert(t, !bytes.Equal(other.Params.MasterKey, params.Params.MasterKey))
+	Assert(t, !bytes.Equal(other.PublicParams.Kdf.Salt,
+		params.PublicParams.Kdf.Salt))
+}
+
+func TestParamsUnknownCipher(t *testing.T) {
+	params, _ := DefaultParams("password", rand.Reader)
+	params.PublicParams.Cipher = proto.Int32(12345)
+	buf := &bytes.Buffer{}
+	Assert(t, params.WriteTo(buf, rand.Reader) == nil)
+	_, err := ReadParams(bytes.NewReader(buf.Bytes()), "password")
+	Assert(t, err != nil && err != ErrInvalidPassword)
+
+	_, err = ReadParams(bytes.NewReader([]byte("\x05ab")), "")
+	Assert(t, err != nil && err != ErrInvalidPassword)
+}
+
+func TestLoadFSInfo(t *testing.T) {
+	fs := NewFakeFileSys()
+	_, err := LoadFSInfo(fs, "password", false)
+	Assert(t, err != nil)
+
+	fsInfo, err := LoadFSInfo(fs, "password", true)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+	Assert(t, fs.Exists("params"))
+	ciphertext, _ := fsInfo.Encrypt([]byte("test data"))
+
+	// Reload and verify that we get the same cipher, and that it isn't the
+	// one NewFSInfo() derives directly from the password.
+	fsInfo, err = LoadFSInfo(fs, "password", false)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+	plaintext, err := fsInfo.Decrypt(ciphertext)
+	Assert(t, err == nil && string(plaintext) == "test data")
+	_, err = NewFSInfo("password").Decrypt(ciphertext)
+	Assert(t, err != nil)
+
+	_, err = LoadFSInfo(fs, "wrong", false)
+	Assert(t, err == ErrInvalidPassword)
+}
+
+func TestRekey(t *testing.T) {
+	fs := NewFakeFileSys()
+	fsInfo, err := LoadFSInfo(fs, "old", true)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+	ciphertext, _ := fsInfo.Encrypt([]byte("test data"))
+	orgParams, _ := loadParams(fs, "old")
+
+	_, err = Rekey(fs, "wrong", "new")
+	Assert(t, err == ErrInvalidPassword)
+	migrated, err := Rekey(fs, "old", "new")
+	Assertf(t, err == nil, "Rekey: %s", err)
+	Assert(t, !migrated)
+
+	_, err = LoadFSInfo(fs, "old", false)
+	Assert(t, err == ErrInvalidPassword)
+	fsInfo, err = LoadFSInfo(fs, "new", false)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+	plaintext, err := fsInfo.Decrypt(ciphertext)
+	Assert(t, err == nil && string(plaintext) == "test data")
+
+	newParams, _ := loadParams(fs, "new")
+	Assert(t, bytes.Equal(newParams.Params.MasterKey,
+		orgParams.Params.MasterKey))
+	Assert(t, !bytes.Equal(newParams.PublicParams.Kdf.Salt,
+		orgParams.PublicParams.Kdf.Salt))
+}
+
+// Creates a repository the way it was done before there was a params file,
+// returns the digest of its head commit.
+func makeLegacyStore(t *testing.T, fs FileSys, password string) []byte {
+	cs := NewChunkStore(NewFSInfo(password), fs)
+	digest, err := cs.StoreCommit(&pb.Commit{Timestamp: proto.Int32(100)})
+	Assertf(t, err == nil, "StoreCommit: %s", err)
+	Assert(t, cs.SetHead("master", digest) == nil)
+	return digest
+}
+
+func TestLegacyStore(t *testing.T) {
+	fs := NewFakeFileSys()
+	digest := makeLegacyStore(t, fs, "password")
+
+	_, err := LoadFSInfo(fs, "wrong", true)
+	Assert(t, err == ErrInvalidPassword)
+	Assert(t, !fs.Exists("params"))
+
+	// Loading it should write params that are compatible with the old key
+	// derivation.
+	fsInfo, err := LoadFSInfo(fs, "password", true)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+	commit, err := NewChunkStore(fsInfo, fs).LoadCommit(digest)
+	Assert(t, err == nil && commit.GetTimestamp() == 100)
+	params, _ := loadParams(fs, "password")
+	Assert(t, params.PublicParams.Kdf == nil)
+	Assert(t, params.Params.MasterKey == nil)
+}
+
+func TestLegacyStoreWithoutMaster(t *testing.T) {
+	// A repository with only another branch.
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(NewFSInfo("password"), fs)
+	digest, _ := cs.StoreCommit(&pb.Commit{Timestamp: proto.Int32(100)})
+	cs.SetHead("other", digest)
+	_, err := LoadFSInfo(fs, "wrong", true)
+	Assert(t, err == ErrInvalidPassword)
+	_, err = Rekey(fs, "wrong", "new")
+	Assert(t, err == ErrInvalidPassword)
+	Assert(t, !fs.Exists("params"))
+	_, err = LoadFSInfo(fs, "password", true)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+
+	// A repository with only a journal.
+	fs = NewFakeFileSys()
+	cs = NewChunkStore(NewFSInfo("password"), fs)
+	cs.WriteToJournal("master", &pb.Change{Type: proto.Int32(
+		CHANGE_SETATTR)})
+	_, err = LoadFSInfo(fs, "wrong", true)
+	Assert(t, err == ErrInvalidPassword)
+	Assert(t, !fs.Exists("params"))
+	_, err = LoadFSInfo(fs, "password", true)
+	Assertf(t, err == nil, "LoadFSInfo: %s", err)
+
+	// Nothing that could verify the password.
+	fs = NewFakeFileSys()
+	fs.Mkdir("refs")
+	_, err = LoadFSInfo(fs, "password", true)
+	Assert(t, err != nil && err != ErrInvalidPassword)
+	_, err = Rekey(fs, "password", "new")
+	Assert(t, err != nil)
+	Assert(t, !fs.Exists("params"))
+}
+
+func TestLegacyStoreMigration(t *testing.T) {
+	for _, writeParams := range []bool{false, true} {
+		fs := NewFakeFileSys()
+		digest := makeLegacyStore(t, fs, "password")
+		if writeParams {
+			LoadFSInfo(fs, "password", true)
+		}
+
+		_, err := Rekey(fs, "wrong", "new")
+		Assert(t, err == ErrInvalidPassword)
+		migrated, err := Rekey(fs, "password", "new")
+		Assertf(t, err == nil, "Rekey: %s", err)
+		Assert(t, migrated)
+
+		_, err = LoadFSInfo(fs, "password", false)
+		Assert(t, err == ErrInvalidPassword)
+		fsInfo, err := LoadFSInfo(fs, "new", false)
+		Assertf(t, err == nil, "LoadFSInfo: %s", err)
+		commit, err := NewChunkStore(fsInfo, fs).LoadCommit(digest)
+		Assert(t, err == nil && commit.GetTimestamp() == 100)
+
+		params, _ := loadParams(fs, "new")
+		Assert(t, params.PublicParams.GetKdf().GetType() == KDF_SCRYPT)
+		Assert(t, bytes.Equal(params.Params.MasterKey,
+			HashPassword("password")))
+
+		// The old password still works without the params file.
+		_, err = NewChunkStore(NewFSInfo("password"), fs).LoadCommit(digest)
+		Assert(t, err == nil)
+
+		// Only the first rekey migrates.
+		migrated, err = Rekey(fs, "new", "newer")
+		Assert(t, err == nil && !migrated)
+	}
+}
+
+func TestScryptKey(t *testing.T) {
+	// Test vector from the scrypt paper.
+	kdf := &pb.KDFParams{Type: proto.Int32(KDF_SCRYPT),
+		Salt: []byte("NaCl"),
+		LogN: proto.Int32(10),
+		R:    proto.Int32(8),
+		P:    proto.Int32(16),
+	}
+	key, err := deriveKey(kdf, "password")
+	Assert(t, err == nil)
+	Assertf(t, hex.EncodeToString(key) ==
+		"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162",
+		"got key %x", key)
+
+	kdf.LogN = proto.Int32(100)
+	_, err = deriveKey(kdf, "password")
+	Assert(t, err != nil)
+}
+
+func TestReadParamsBadScrypt(t *testing.T) {
+	for _, kdf := range []*pb.KDFParams{
+		{LogN: proto.Int32(0), R: proto.Int32(8), P: proto.Int32(1)},
+		{LogN: proto.Int32(4), R: proto.Int32(0), P: proto.Int32(1)},
+		{LogN: proto.Int32(4), R: proto.Int32(8), P: proto.Int32(0)},
+		{LogN: proto.Int32(4), R: proto.Int32(-1), P: proto.Int32(-1)},
+		{LogN: proto.Int32(4), R: proto.Int32(1 << 30), P: proto.Int32(1)},
+		{LogN: proto.Int32(4), R: proto.Int32(1), P: proto.Int32(1 << 30)},
+		{LogN: proto.Int32(24), R: proto.Int32(1024), P: proto.Int32(1)},
+	} {
+		kdf.Type = proto.Int32(KDF_SCRYPT)
+		params := &ParamInfo{Cipher: plainCipher{},
+			PublicParams: &pb.PublicParams{Cipher: proto.Int32(testCipherId),
+				Kdf: kdf},
+			Params: &pb.PrivateParams{Version: proto.Int32(DEFAULT_VERSION)},
+		}
+		buf := &bytes.Buffer{}
+		Assert(t, params.WriteTo(buf, rand.Reader) == nil)
+		_, err := ReadParams(buf, "password")
+		Assertf(t, err != nil, "no error for %v", kdf)
+	}
+}
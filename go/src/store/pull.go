@@ -0,0 +1,426 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pulling branches from peers, the equivalent of __pullBranch() in
+// flows.crk.  See the sync algorithm in doc/notes.txt.
+
+package blockstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"history"
+	pb "mawfs"
+	"sort"
+)
+
+// Returned from ReadJournal() if the journal changed while we were reading
+// it.
+var ErrJournalChanged = errors.New("Remote journal has changed")
+
+// Reads the entire journal for 'branch' from 'reader', one block at a time.
+// Returns nil if there is no journal, ErrJournalChanged if the journal
+// changed while we were reading it.
+func ReadJournal(reader RawChunkReader, branch string) ([]byte, error) {
+	var journal, firstBlockDigest []byte
+	for {
+		block, err := reader.GetJournalBlock(firstBlockDigest, branch,
+			len(journal))
+		if err != nil {
+			return nil, err
+		}
+		if block.Contents == nil && !block.Done {
+			return nil, ErrJournalChanged
+		}
+		journal = append(journal, block.Contents...)
+		firstBlockDigest = block.FirstBlockDigest
+		if block.Done {
+			return journal, nil
+		}
+	}
+}
+
+// Decodes the changes in a raw journal in the format of the ChunkStore
+// journal files (and of the journal blocks served to peers).
+func decodeJournal(fsInfo *FSInfo, journal []byte) ([]*ChangeEntry, error) {
+	iter, err := newCsJournalIter(bytes.NewBuffer(journal), fsInfo)
+	if err != nil {
+		return nil, err
+	}
+	return readJournalIter(iter)
+}
+
+// Returns all of the entries in 'iter'.
+func readJournalIter(iter JournalIter) ([]*ChangeEntry, error) {
+	var entries []*ChangeEntry
+	for iter.IsValid() {
+		entry, err := iter.Elem()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Stores the journal info for a commit, the set of the ids of the sessions
+// in the journal that preceded it.  This is a node whose contents are the
+// serialized session ids.  Returns the digest of the node.
+func storeJournalInfo(store NodeStore, sessionIds map[string]bool) ([]byte,
+	error) {
+
+	// Sort the ids so the digest doesn't depend on the map order.
+	ids := make([]string, 0, len(sessionIds))
+	for id := range sessionIds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := proto.NewBuffer(nil)
+	for _, id := range ids {
+		if err := buf.EncodeStringBytes(id); err != nil {
+			return nil, err
+		}
+	}
+	return store.StoreNode(&pb.Node{Contents: proto.String(
+		string(buf.Bytes()))})
+}
+
+// Loads the set of session ids from the journal info node 'digest'.
+func LoadJournalInfo(store NodeStore, digest []byte) (map[string]bool,
+	error) {
+
+	node, err := store.LoadNode(digest)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool)
+	buf := proto.NewBuffer([]byte(node.GetContents()))
+	for len(buf.Unread()) > 0 {
+		id, err := buf.DecodeStringBytes()
+		if err != nil {
+			return nil, err
+		}
+		result[id] = true
+	}
+	return result, nil
+}
+
+// Returns true if the commit 'digest' derives from 'ancestor'.
+func derivesFrom(store NodeStore, digest, ancestor []byte) (bool, error) {
+	return history.IsAncestor(store, ancestor, digest)
+}
+
+// If 'later' derives from 'cur', returns the commit that derives directly
+// from 'cur'.  This may be 'later' itself or one of its ancestors.  Returns
+// nil if 'later' doesn't derive from 'cur'.
+func getFollowingCommit(store NodeStore, cur, later []byte) (*pb.Commit,
+	error) {
+
+	visited := make(map[string]bool)
+	pending := [][]byte{later}
+	for len(pending) > 0 {
+		digest := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[string(digest)] {
+			continue
+		}
+		visited[string(digest)] = true
+
+		commit, err := store.LoadCommit(digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.Parent {
+			if bytes.Equal(parent, cur) {
+				return commit, nil
+			}
+			pending = append(pending, parent)
+		}
+	}
+	return nil, nil
+}
+
+// Returns true if the commit 'head' includes all of the changes in
+// 'otherHead' and the journal 'otherJournal'.  This verifies that 'head'
+// derives from 'otherHead' and that all of the sessions in 'otherJournal'
+// are recorded in the commit following 'otherHead' on the path to 'head'.
+func subsumes(store NodeStore, head, otherHead []byte,
+	otherJournal []*ChangeEntry) (bool, error) {
+
+	following, err := getFollowingCommit(store, otherHead, head)
+	if err != nil || following == nil {
+		return false, err
+	}
+	if len(otherJournal) == 0 {
+		return true, nil
+	} else if following.JournalInfo == nil {
+		return false, nil
+	}
+
+	sessionIds, err := LoadJournalInfo(store, following.JournalInfo)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range otherJournal {
+		if !sessionIds[string(entry.change.SessionId)] {
+			// There are changes in the journal that aren't in the commit.
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Adapts a RawChunkReader to the RemoteReader interface.
+type rawChunkRemote struct {
+	RawChunkReader
+}
+
+func (r rawChunkRemote) GetContents(digest []byte) ([]byte, error) {
+	return r.ReadRawChunk(digest)
+}
+
+// Pulls 'branch' from 'remote', which is normally an rpc.PeerProxy for the
+// peer named 'peer'.
+//
+// If the remote branch includes everything in the local branch (its commit
+// derives from the local commit and its journal either extends the local
+// journal or the changes in the local journal are all recorded in the
+// remote commit), the local branch is fast-forwarded to the remote one.  If
+// the local branch includes everything in the remote branch, nothing is
+// changed.  Otherwise the branches have diverged, and the remote branch is
+// stored in the tracking branch "<peer>:<branch>".
+//
+// Returns the name of the branch that the remote state was stored in, which
+// is 'branch' unless a tracking branch was created.  The tree of the new
+// head is fetched from the remote and stored locally.
+func PullBranch(store NodeStore, fsInfo *FSInfo, peer string,
+	remote RawChunkReader, branch string) (string, error) {
+
+	return pullBranch(store, fsInfo, peer, remote, branch, false)
+}
+
+// Like PullBranch(), but the remote branch is always stored in the tracking
+// branch "<peer>:<branch>", the local branch is left alone.  This is for
+// branches that a live Head is on: pulling into them would change the
+// baseline and journal out from under it.
+func PullTrackingBranch(store NodeStore, fsInfo *FSInfo, peer string,
+	remote RawChunkReader, branch string) (string, error) {
+
+	return pullBranch(store, fsInfo, peer, remote, branch, true)
+}
+
+// Implements PullBranch() and PullTrackingBranch().
+func pullBranch(store NodeStore, fsInfo *FSInfo, peer string,
+	remote RawChunkReader, branch string, tracking bool) (string, error) {
+
+	localHead, err := store.GetHead(branch)
+	if err != nil && !isUnknownName(err) {
+		return "", err
+	}
+
+	remoteHead, err := remote.GetHead(branch)
+	if err != nil {
+		return "", err
+	} else if remoteHead == nil {
+		return "", fmt.Errorf("Peer %s does not have branch %s", peer,
+			branch)
+	}
+	rawJournal, err := ReadJournal(remote, branch)
+	if err != nil {
+		return "", err
+	}
+	remoteJournal, err := decodeJournal(fsInfo, rawJournal)
+	if err != nil {
+		return "", err
+	}
+
+	// The journal applies to its baseline commit, which may be newer than
+	// the head we got if the remote committed in between.
+	if len(remoteJournal) > 0 {
+		remoteHead = remoteJournal[0].change.Commit
+		if remoteHead == nil {
+			return "", &JournalError{"First change in the remote " +
+				"journal does not have a commit field."}
+		}
+	}
+
+	// Load commits through the remote so we can look at its history.
+	store = NewReadThroughStore(store, fsInfo, rawChunkRemote{remote})
+	p := &puller{store, branch, peer + ":" + branch}
+	if tracking {
+		return p.install(p.tracking, remoteHead, remoteJournal)
+	}
+
+	localJournal, err := store.MakeJournalIter(branch)
+	if err != nil {
+		return "", err
+	}
+	localEntries, err := readJournalIter(localJournal)
+	if err != nil {
+		return "", err
+	}
+
+	if localHead == nil {
+		return p.install(branch, remoteHead, remoteJournal)
+	}
+	if len(remoteJournal) == 0 {
+		return p.pullCommit(localHead, localEntries, remoteHead)
+	}
+	return p.pullJournal(localHead, localEntries, remoteHead, remoteJournal)
+}
+
+// State for PullBranch().
+type puller struct {
+	store NodeStore
+
+	// The branch being pulled and its tracking branch.
+	branch, tracking string
+}
+
+// Pulls a remote branch that has no journal.
+func (p *puller) pullCommit(localHead []byte, localJournal []*ChangeEntry,
+	remoteHead []byte) (string, error) {
+
+	// If our commit is derived from the remote commit, we're done.
+	if ok, err := derivesFrom(p.store, localHead, remoteHead); err != nil {
+		return "", err
+	} else if ok {
+		return p.branch, nil
+	}
+
+	// Fast-forward if the remote commit includes the local commit and
+	// journal.
+	ok, err := subsumes(p.store, remoteHead, localHead, localJournal)
+	if err != nil {
+		return "", err
+	} else if ok {
+		return p.install(p.branch, remoteHead, nil)
+	}
+	return p.install(p.tracking, remoteHead, nil)
+}
+
+// Pulls a remote branch with a journal.
+func (p *puller) pullJournal(localHead []byte, localJournal []*ChangeEntry,
+	remoteHead []byte, remoteJournal []*ChangeEntry) (string, error) {
+
+	if !bytes.Equal(remoteHead, localHead) {
+		// The remote journal can only be accepted if its commit includes
+		// everything we have.
+		if ok, err := subsumes(p.store, remoteHead, localHead,
+			localJournal); err != nil {
+			return "", err
+		} else if ok {
+			return p.install(p.branch, remoteHead, remoteJournal)
+		}
+
+		// If we include everything that the remote has, there's nothing to
+		// do.
+		if ok, err := subsumes(p.store, localHead, remoteHead,
+			remoteJournal); err != nil {
+			return "", err
+		} else if ok {
+			return p.branch, nil
+		}
+		return p.install(p.tracking, remoteHead, remoteJournal)
+	}
+
+	// The journals apply to the same commit.  Compare them until they
+	// diverge or one ends.
+	i := 0
+	for i < len(localJournal) && i < len(remoteJournal) &&
+		bytes.Equal(localJournal[i].digest, remoteJournal[i].digest) {
+		i++
+	}
+	switch {
+	case i == len(remoteJournal):
+		// The journals are the same or ours extends the remote one.
+		return p.branch, nil
+	case i == len(localJournal):
+		// The remote journal extends ours.
+		return p.install(p.branch, remoteHead, remoteJournal)
+	default:
+		return p.install(p.tracking, remoteHead, remoteJournal)
+	}
+}
+
+// Loads the tree of commit 'head' and the nodes referenced by 'journal' so
+// that they get fetched from the remote and stored locally.  After this, the
+// branch can be used without the remote.
+func (p *puller) fetchTree(head []byte, journal []*ChangeEntry) error {
+	commit, err := p.store.LoadCommit(head)
+	if err != nil {
+		return err
+	}
+	pending := [][]byte{commit.Root}
+	if commit.JournalInfo != nil {
+		pending = append(pending, commit.JournalInfo)
+	}
+	for _, entry := range journal {
+		if entry.change.Digest != nil {
+			pending = append(pending, entry.change.Digest)
+		}
+	}
+
+	visited := make(map[string]bool)
+	for len(pending) > 0 {
+		digest := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[string(digest)] {
+			continue
+		}
+		visited[string(digest)] = true
+
+		node, err := p.store.LoadNode(digest)
+		if err != nil {
+			return err
+		}
+		for _, child := range node.Children {
+			pending = append(pending, child.Hash)
+		}
+	}
+	return nil
+}
+
+// Stores 'head' and 'journal' as the state of branch 'name', replacing any
+// existing journal.  Returns 'name'.
+func (p *puller) install(name string, head []byte,
+	journal []*ChangeEntry) (string, error) {
+
+	if err := p.fetchTree(head, journal); err != nil {
+		return "", err
+	}
+	if err := p.store.DeleteJournal(name); err != nil {
+		return "", err
+	}
+	for _, entry := range journal {
+		digest, err := p.store.WriteToJournal(name, &entry.change)
+		if err != nil {
+			return "", err
+		}
+
+		// The changes are chained together by their digests, so the copy
+		// must be identical.
+		if !bytes.Equal(digest, entry.digest) {
+			return "", &JournalError{fmt.Sprintf("Change %s has digest "+
+				"%s when copied", sig(entry.digest), sig(digest))}
+		}
+	}
+	return name, p.store.SetHead(name, head)
+}
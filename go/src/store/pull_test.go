@@ -0,0 +1,265 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	pb "mawfs"
+	"testing"
+)
+
+// A local ChunkStore and a remote MemNodeStore sharing a key.
+type pullTest struct {
+	t      *testing.T
+	fsInfo *FSInfo
+	local  *ChunkStore
+	remote *MemNodeStore
+}
+
+func newPullTest(t *testing.T) *pullTest {
+	fsInfo := NewFSInfo("password")
+	return &pullTest{t, fsInfo, NewChunkStore(fsInfo, NewFakeFileSys()),
+		NewMemStore(fsInfo),
+	}
+}
+
+// Returns a view of the local store that can load the objects that only
+// the remote has.
+func (p *pullTest) localView() NodeStore {
+	return NewReadThroughStore(p.local, p.fsInfo,
+		rawChunkRemote{p.remote.GetRawChunkReader()})
+}
+
+// Adds the file 'name' to the "master" branch of 'store', returns the head
+// so the caller can commit it.  This writes two changes to the journal.
+func (p *pullTest) addFile(store NodeStore, name string) *Head {
+	head, err := NewCache(store).GetHead("master")
+	if err != nil {
+		p.t.Fatalf("GetHead: %s", err)
+	}
+	root, err := head.GetRoot()
+	if err != nil {
+		p.t.Fatalf("GetRoot: %s", err)
+	}
+	file, err := root.AddChild(name, &pb.Node{}, 100)
+	if err != nil {
+		p.t.Fatalf("AddChild: %s", err)
+	}
+	file.Write(0, []byte(name), 100)
+	return head
+}
+
+func (p *pullTest) commit(head *Head) []byte {
+	digest, err := head.Commit(nil)
+	if err != nil {
+		p.t.Fatalf("Commit: %s", err)
+	}
+	return digest
+}
+
+// Returns true if 'branch' of the local store has the file 'name'.
+func (p *pullTest) hasFile(branch, name string) bool {
+	head, err := NewCache(p.localView()).GetHead(branch)
+	if err != nil {
+		p.t.Fatalf("GetHead: %s", err)
+	}
+	root, err := head.GetRoot()
+	if err != nil {
+		p.t.Fatalf("GetRoot: %s", err)
+	}
+	file, err := root.GetChildByName(name)
+	return err == nil && file != nil
+}
+
+// Pulls "master" from the remote to the local store.
+func (p *pullTest) pull() string {
+	name, err := PullBranch(p.local, p.fsInfo, "peer",
+		p.remote.GetRawChunkReader(), "master")
+	if err != nil {
+		p.t.Fatalf("PullBranch: %s", err)
+	}
+	return name
+}
+
+func (p *pullTest) localHead(branch string) []byte {
+	digest, _ := p.local.GetHead(branch)
+	return digest
+}
+
+func (p *pullTest) localJournalSize(branch string) int {
+	return len(readJournal(p.t, p.local, branch))
+}
+
+func TestPullNewBranch(t *testing.T) {
+	p := newPullTest(t)
+	_, err := PullBranch(p.local, p.fsInfo, "peer",
+		p.remote.GetRawChunkReader(), "master")
+	Assert(t, err != nil)
+
+	head := p.addFile(p.remote, "committed")
+	digest := p.commit(head)
+	p.addFile(p.remote, "journaled")
+
+	Assert(t, p.pull() == "master")
+	Assert(t, bytes.Equal(p.localHead("master"), digest))
+	Assert(t, p.localJournalSize("master") == 2)
+	Assert(t, p.hasFile("master", "committed"))
+	Assert(t, p.hasFile("master", "journaled"))
+}
+
+func TestPullFastForward(t *testing.T) {
+	p := newPullTest(t)
+	p.commit(p.addFile(p.remote, "first"))
+	Assert(t, p.pull() == "master")
+
+	second := p.commit(p.addFile(p.remote, "second"))
+	Assert(t, p.pull() == "master")
+	Assert(t, bytes.Equal(p.localHead("master"), second))
+	Assert(t, p.hasFile("master", "second"))
+
+	// If the local branch is ahead of the remote one, nothing changes.
+	third := p.commit(p.addFile(p.localView(), "third"))
+	Assert(t, p.pull() == "master")
+	Assert(t, bytes.Equal(p.localHead("master"), third))
+}
+
+func TestPullTrackingBranch(t *testing.T) {
+	p := newPullTest(t)
+	first := p.commit(p.addFile(p.remote, "first"))
+	Assert(t, p.pull() == "master")
+
+	// Even a fast-forward leaves the local branch alone.
+	second := p.commit(p.addFile(p.remote, "second"))
+	p.addFile(p.remote, "journaled")
+	name, err := PullTrackingBranch(p.local, p.fsInfo, "peer",
+		p.remote.GetRawChunkReader(), "master")
+	Assertf(t, err == nil, "PullTrackingBranch: %s", err)
+	Assert(t, name == "peer:master")
+	Assert(t, bytes.Equal(p.localHead("master"), first))
+	Assert(t, p.localJournalSize("master") == 0)
+	Assert(t, bytes.Equal(p.localHead("peer:master"), second))
+	Assert(t, p.hasFile("peer:master", "journaled"))
+}
+
+func TestPullDivergentCommits(t *testing.T) {
+	p := newPullTest(t)
+	p.commit(p.addFile(p.remote, "first"))
+	p.pull()
+
+	localDigest := p.commit(p.addFile(p.localView(), "local"))
+	remoteDigest := p.commit(p.addFile(p.remote, "remote"))
+	Assert(t, p.pull() == "peer:master")
+	Assert(t, bytes.Equal(p.localHead("master"), localDigest))
+	Assert(t, bytes.Equal(p.localHead("peer:master"), remoteDigest))
+	Assert(t, p.hasFile("peer:master", "remote"))
+	Assert(t, !p.hasFile("peer:master", "local"))
+}
+
+func TestPullSubsumesJournal(t *testing.T) {
+	p := newPullTest(t)
+	p.commit(p.addFile(p.remote, "first"))
+	p.pull()
+
+	// Make a change locally and let the remote pick it up and commit it.
+	p.addFile(p.localView(), "local")
+	name, err := PullBranch(p.remote, p.fsInfo, "local",
+		p.local.GetRawChunkReader(), "master")
+	Assert(t, err == nil && name == "master")
+	head := p.addFile(p.remote, "remote")
+	digest := p.commit(head)
+
+	// The remote commit includes our journal, so we can fast-forward.
+	Assert(t, p.pull() == "master")
+	Assert(t, bytes.Equal(p.localHead("master"), digest))
+	Assert(t, p.localJournalSize("master") == 0)
+	Assert(t, p.hasFile("master", "local"))
+	Assert(t, p.hasFile("master", "remote"))
+}
+
+func TestPullDoesNotSubsumeJournal(t *testing.T) {
+	p := newPullTest(t)
+	first := p.commit(p.addFile(p.remote, "first"))
+	p.pull()
+
+	// The remote commit doesn't include our change.
+	p.addFile(p.localView(), "local")
+	digest := p.commit(p.addFile(p.remote, "remote"))
+	Assert(t, p.pull() == "peer:master")
+	Assert(t, bytes.Equal(p.localHead("master"), first))
+	Assert(t, p.localJournalSize("master") == 2)
+	Assert(t, bytes.Equal(p.localHead("peer:master"), digest))
+}
+
+func TestPullJournals(t *testing.T) {
+	p := newPullTest(t)
+	first := p.commit(p.addFile(p.remote, "first"))
+	p.pull()
+
+	// A remote journal that extends ours (which is empty) replaces it.
+	p.addFile(p.remote, "remote1")
+	Assert(t, p.pull() == "master")
+	Assert(t, p.localJournalSize("master") == 2)
+	p.addFile(p.remote, "remote2")
+	Assert(t, p.pull() == "master")
+	Assert(t, p.localJournalSize("master") == 4)
+	Assert(t, p.hasFile("master", "remote2"))
+
+	// Pulling the same journal again changes nothing.
+	Assert(t, p.pull() == "master")
+	Assert(t, p.localJournalSize("master") == 4)
+
+	// If ours extends the remote one, we keep ours.
+	p.addFile(p.localView(), "local")
+	Assert(t, p.pull() == "master")
+	Assert(t, p.localJournalSize("master") == 6)
+
+	// If they diverge, we get a tracking branch.
+	p.addFile(p.remote, "remote3")
+	Assert(t, p.pull() == "peer:master")
+	Assert(t, p.localJournalSize("master") == 6)
+	Assert(t, p.localJournalSize("peer:master") == 6)
+	Assert(t, bytes.Equal(p.localHead("peer:master"), first))
+	Assert(t, p.hasFile("peer:master", "remote3"))
+	Assert(t, !p.hasFile("peer:master", "local"))
+}
+
+func TestJournalInfo(t *testing.T) {
+	store := NewMemStore(NewFSInfo("password"))
+	head, _ := NewCache(store).GetHead("master")
+	head.SetSessionId([]byte("session1"))
+	root, _ := head.GetRoot()
+	root.AddChild("file", &pb.Node{}, 100)
+	digest, _ := head.Commit(nil)
+	commit, _ := store.LoadCommit(digest)
+	ids, err := LoadJournalInfo(store, commit.JournalInfo)
+	Assert(t, err == nil && len(ids) == 1 && ids["session1"])
+
+	// Session ids in a replayed journal are also recorded.
+	root.AddChild("other", &pb.Node{}, 100)
+	head, _ = NewCache(store).GetHead("master")
+	head.SetSessionId([]byte("session2"))
+	root, _ = head.GetRoot()
+	root.AddChild("another", &pb.Node{}, 100)
+	digest, _ = head.Commit(nil)
+	commit, _ = store.LoadCommit(digest)
+	ids, err = LoadJournalInfo(store, commit.JournalInfo)
+	Assert(t, err == nil && len(ids) == 2 && ids["session1"] &&
+		ids["session2"])
+
+	// Commits with no changes have no journal info.
+	digest, _ = head.Commit(nil)
+	commit, _ = store.LoadCommit(digest)
+	Assert(t, commit.JournalInfo == nil)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Detection and quarantine of corrupt object files.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+)
+
+// Returned when the contents of an object file don't match its digest.
+type CorruptObject struct {
+	// The digest of the object and the name of its file in the backing
+	// store.
+	Digest []byte
+	Path   string
+
+	// The name the file was moved to if it was quarantined, empty if it
+	// wasn't.
+	Quarantine string
+
+	// What's wrong with it.
+	Err error
+}
+
+func (err *CorruptObject) Error() string {
+	msg := fmt.Sprintf("Corrupt object %s in %s: %s", altEncode(err.Digest),
+		err.Path, err.Err)
+	if err.Quarantine != "" {
+		msg += ", moved to " + err.Quarantine
+	}
+	return msg
+}
+
+func (err *CorruptObject) Unwrap() error {
+	return err.Err
+}
+
+// Returned when the contents of an object file match its digest but can't
+// be decrypted.  The file is intact, so the key or the cipher must be wrong.
+type UndecryptableObject struct {
+	Digest []byte
+	Path   string
+	Err    error
+}
+
+func (err *UndecryptableObject) Error() string {
+	return fmt.Sprintf("Can't decrypt object %s in %s (wrong key or "+
+		"cipher?): %s", altEncode(err.Digest), err.Path, err.Err)
+}
+
+func (err *UndecryptableObject) Unwrap() error {
+	return err.Err
+}
+
+// The directory that corrupt objects are moved to.
+const quarantineDir = "quarantine"
+
+// Reads the object file 'name' and checks that its contents have 'digest'.
+// Returns the raw (encrypted) contents.
+func readObject(backing FileSys, name string, digest []byte) ([]byte,
+	error) {
+
+	src, err := backing.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if actual := sha256.Sum256(raw); !bytes.Equal(actual[:], digest) {
+		return nil, &CorruptObject{Digest: digest, Path: name,
+			Err: fmt.Errorf("contents have digest %s",
+				altEncode(actual[:]))}
+	}
+	return raw, nil
+}
+
+// Decrypts the raw contents of the object 'digest' stored in 'name'.
+func (f *FSInfo) decryptObject(raw, digest []byte, name string) (*Chunk,
+	error) {
+
+	plaintext, err := f.Decrypt(raw)
+	if err != nil {
+		return nil, &UndecryptableObject{Digest: digest, Path: name,
+			Err: err}
+	}
+	return &Chunk{contents: plaintext, digest: digest}, nil
+}
+
+// Makes the ChunkStore quarantine corrupt objects when it loads them: the
+// object file is moved to the "quarantine" directory so it can be examined
+// and isn't loaded again.  If 'remote' isn't nil, a replacement is then
+// requested from it (normally a peer), and if it has a good copy, that's
+// stored and returned in place of the corrupt one.
+func (cs *ChunkStore) EnableQuarantine(remote RemoteReader) {
+	cs.quarantine = true
+	cs.replacements = remote
+}
+
+// Moves the corrupt object described by 'corrupt' to the quarantine
+// directory, then tries to get a replacement.  Returns the replacement, or
+// 'corrupt' if there is none.
+func (cs *ChunkStore) quarantineObject(corrupt *CorruptObject) (*Chunk,
+	error) {
+
+	if !cs.backing.Exists(quarantineDir) {
+		if err := cs.backing.Mkdir(quarantineDir); err != nil {
+			return nil, err
+		}
+	}
+	dst := quarantineDir + "/" + altEncode(corrupt.Digest)
+	for i := 1; cs.backing.Exists(dst); i++ {
+		dst = fmt.Sprintf("%s/%s.%d", quarantineDir,
+			altEncode(corrupt.Digest), i)
+	}
+	if err := cs.backing.Rename(corrupt.Path, dst); err != nil {
+		return nil, err
+	}
+	corrupt.Quarantine = dst
+
+	if cs.replacements == nil {
+		return nil, corrupt
+	}
+	raw, err := cs.replacements.GetContents(corrupt.Digest)
+	if err != nil || raw == nil {
+		return nil, corrupt
+	}
+	if actual := sha256.Sum256(raw); !bytes.Equal(actual[:],
+		corrupt.Digest) {
+		return nil, corrupt
+	}
+	chunk, err := cs.fsInfo.decryptObject(raw, corrupt.Digest,
+		objectName(corrupt.Digest))
+	if err != nil {
+		return nil, corrupt
+	}
+	if err := writeObject(cs.backing, corrupt.Digest, raw); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// Replaces the contents of the file 'name'.
+func overwrite(fs FileSys, name string, contents []byte) {
+	dst, _ := fs.Create(name)
+	dst.Write(contents)
+	dst.Close()
+}
+
+// Returns the contents of the file 'name'.
+func readFile(fs FileSys, name string) []byte {
+	src, err := fs.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer src.Close()
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(src)
+	return buf.Bytes()
+}
+
+// Loads 'digest' from 'cs' and returns the CorruptObject error, nil if it
+// loads or fails some other way.
+func loadCorrupt(cs *ChunkStore, digest []byte) *CorruptObject {
+	_, err := cs.LoadNode(digest)
+	var corrupt *CorruptObject
+	if errors.As(err, &corrupt) {
+		return corrupt
+	}
+	return nil
+}
+
+func TestCorruptObject(t *testing.T) {
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(NewFSInfo("password"), fs)
+	digest := storeTestNode(t, cs, "data")
+	other := storeTestNode(t, cs, "other data")
+	name := objectName(digest)
+
+	// A swapped object file.
+	good := readFile(fs, name)
+	overwrite(fs, name, readFile(fs, objectName(other)))
+	corrupt := loadCorrupt(cs, digest)
+	if corrupt == nil {
+		t.Fatalf("Swapped object not detected")
+	}
+	Assert(t, bytes.Equal(corrupt.Digest, digest) && corrupt.Path == name)
+	Assert(t, corrupt.Quarantine == "")
+	_, err := cs.GetRawChunkReader().ReadRawChunk(digest)
+	Assert(t, errors.As(err, &corrupt))
+
+	// A flipped bit.
+	bad := append([]byte(nil), good...)
+	bad[len(bad)/2] ^= 1
+	overwrite(fs, name, bad)
+	Assert(t, loadCorrupt(cs, digest) != nil)
+
+	// Contents that match the digest but can't be decrypted aren't corrupt.
+	garbage := []byte("not encrypted")
+	garbageDigest := sha256.Sum256(garbage)
+	overwrite(fs, objectName(garbageDigest[:]), garbage)
+	Assert(t, loadCorrupt(cs, garbageDigest[:]) == nil)
+	_, err = cs.LoadNode(garbageDigest[:])
+	var undecryptable *UndecryptableObject
+	Assertf(t, errors.As(err, &undecryptable),
+		"Undecryptable object not detected: %v", err)
+
+	overwrite(fs, name, good)
+	Assert(t, hasTestNode(cs, digest, "data"))
+}
+
+func TestQuarantine(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(fsInfo, fs)
+	digest := storeTestNode(t, cs, "data")
+	name := objectName(digest)
+	good := readFile(fs, name)
+	bad := append([]byte(nil), good...)
+	bad[0] ^= 1
+	overwrite(fs, name, bad)
+
+	// Without a peer, the object is just moved aside.
+	cs.EnableQuarantine(nil)
+	corrupt := loadCorrupt(cs, digest)
+	if corrupt == nil {
+		t.Fatalf("Corrupt object not detected")
+	}
+	Assert(t, corrupt.Quarantine == quarantineDir+"/"+altEncode(digest))
+	Assert(t, bytes.Equal(readFile(fs, corrupt.Quarantine), bad))
+	Assert(t, !fs.Exists(name))
+
+	// With a peer, the object is replaced with the peer's copy.
+	peer := NewChunkStore(fsInfo, NewFakeFileSys())
+	Assert(t, bytes.Equal(storeTestNode(t, peer, "data"), digest))
+	overwrite(fs, name, bad)
+	cs.EnableQuarantine(rawChunkRemote{peer.GetRawChunkReader()})
+	Assert(t, hasTestNode(cs, digest, "data"))
+	Assert(t, bytes.Equal(readFile(fs, name), good))
+	Assert(t, fs.Exists(quarantineDir+"/"+altEncode(digest)+".1"))
+
+	// An object that can't be decrypted with the key is left in place.
+	wrongKey := NewChunkStore(NewFSInfo("wrong"), fs)
+	wrongKey.EnableQuarantine(nil)
+	_, err := wrongKey.LoadNode(digest)
+	var undecryptable *UndecryptableObject
+	Assert(t, errors.As(err, &undecryptable))
+	Assert(t, bytes.Equal(readFile(fs, name), good))
+	Assert(t, !fs.Exists(quarantineDir+"/"+altEncode(digest)+".2"))
+
+	// If the peer doesn't have it, it's still corrupt.
+	other := storeTestNode(t, cs, "other")
+	overwrite(fs, objectName(other), bad)
+	corrupt = loadCorrupt(cs, other)
+	Assert(t, corrupt != nil && corrupt.Quarantine != "")
+}
@@ -0,0 +1,273 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Access to the raw (encrypted) contents of a store, this is what gets served
+// to peers.  The equivalent of rawchunk.crk.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A block of a journal file, returned from GetJournalBlock().
+type JournalBlock struct {
+	// Digest of the first block of the journal file.  This will be nil if:
+	// -   No journal file exists.  In this case, 'Contents' will be nil and
+	//     'Done' will be true.
+	// -   The journal file is no larger than a block.  In this case,
+	//     'Contents' will be the entire journal file and 'Done' will be
+	//     true.
+	// -   The journal file has a different first block digest than that
+	//     requested by the caller.  In this case, 'Contents' will be nil and
+	//     'Done' will be false.
+	FirstBlockDigest []byte
+
+	// Contents of the requested block of the journal file.
+	Contents []byte
+
+	// True if 'Contents' is the last block of the journal or there is no
+	// journal.
+	Done bool
+}
+
+// An object that can read raw chunks.
+type RawChunkReader interface {
+	// Returns the raw (encrypted) chunk for 'digest'.  Returns nil and no
+	// error if the chunk isn't present.
+	//
+	// Implementations aren't required to verify that the digest matches the
+	// data, that is the responsibility of the final consumer.
+	ReadRawChunk(digest []byte) ([]byte, error)
+
+	// Returns the digest of the head of 'branch', nil and no error if the
+	// branch doesn't exist.
+	GetHead(branch string) ([]byte, error)
+
+	// Returns the block of the journal for 'branch' starting at 'pos'.
+	// 'firstBlockDigest' should be nil for the first block, and the
+	// FirstBlockDigest from the last JournalBlock for all subsequent ones.
+	GetJournalBlock(firstBlockDigest []byte, branch string, pos int) (
+		*JournalBlock, error)
+
+	// Returns the contents of a (small) file in the backing store, this was
+	// created for reading the params file.  Returns an error satisfying
+	// os.IsNotExist() if the file doesn't exist.
+	GetFile(name string) ([]byte, error)
+}
+
+// Extracts the requested journal block from the full contents of a journal
+// file.
+func makeJournalBlock(journal, firstBlockDigest []byte, pos int) *JournalBlock {
+	// If the journal is no larger than a block, just give back the whole
+	// thing.
+	if len(journal) <= BlockSize {
+		if pos == 0 {
+			return &JournalBlock{Contents: journal, Done: true}
+		}
+
+		// The caller is requesting a block from beyond the end of the
+		// journal.
+		return &JournalBlock{Done: true}
+	}
+
+	// Verify that the first block is the one the caller started with.
+	digest := sha256.Sum256(journal[:BlockSize])
+	if firstBlockDigest != nil && !bytes.Equal(firstBlockDigest, digest[:]) {
+		return &JournalBlock{}
+	}
+
+	if pos >= len(journal) {
+		return &JournalBlock{FirstBlockDigest: digest[:], Done: true}
+	}
+	end := pos + BlockSize
+	if end > len(journal) {
+		end = len(journal)
+	}
+	return &JournalBlock{FirstBlockDigest: digest[:],
+		Contents: journal[pos:end],
+		Done:     end == len(journal),
+	}
+}
+
+// Returns true if 'name' is a relative path that can't refer to anything
+// outside of the backing store.  Names come from peers, so we can't trust
+// them.
+func isLocalName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") ||
+		strings.Contains(name, "\x00") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if 'name' is a valid branch name.  A branch is stored in
+// files of that name in the "refs" and "journals" directories, so the name
+// must be a single path element.  Branch names can come from peers, so we
+// can't trust them.
+func IsValidBranchName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00")
+}
+
+// Implements RawChunkReader over a backing FileSys.
+type FSRawChunkReader struct {
+	backing FileSys
+}
+
+func NewFSRawChunkReader(backing FileSys) *FSRawChunkReader {
+	return &FSRawChunkReader{backing}
+}
+
+func checkFSRawChunkReaderIfaces() {
+	var _ RawChunkReader = &FSRawChunkReader{}
+}
+
+// Returns the RawChunkReader for the store.
+func (cs *ChunkStore) GetRawChunkReader() RawChunkReader {
+	return NewFSRawChunkReader(cs.backing)
+}
+
+// Reads the entire contents of 'name' from the backing store.  This opens
+// the file rather than checking FileSys.Exists() first, BackingDir.Exists()
+// panics on paths it can't stat and the names come from peers.
+func (r *FSRawChunkReader) readAll(name string) ([]byte, error) {
+	src, err := r.backing.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return ioutil.ReadAll(src)
+}
+
+func (r *FSRawChunkReader) ReadRawChunk(digest []byte) ([]byte, error) {
+	name := findObject(r.backing, digest)
+	if name == "" {
+		return nil, nil
+	}
+	return readObject(r.backing, name, digest)
+}
+
+func (r *FSRawChunkReader) GetHead(branch string) ([]byte, error) {
+	if !IsValidBranchName(branch) {
+		return nil, fmt.Errorf("Invalid branch name %q", branch)
+	}
+	data, err := r.readAll("refs/" + branch)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return altDecode(string(data))
+}
+
+func (r *FSRawChunkReader) GetJournalBlock(firstBlockDigest []byte,
+	branch string, pos int) (*JournalBlock, error) {
+
+	if !IsValidBranchName(branch) {
+		return nil, fmt.Errorf("Invalid branch name %q", branch)
+	}
+	journal, err := r.readAll("journals/" + branch)
+	if os.IsNotExist(err) {
+		return &JournalBlock{Done: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return makeJournalBlock(journal, firstBlockDigest, pos), nil
+}
+
+func (r *FSRawChunkReader) GetFile(name string) ([]byte, error) {
+	if !isLocalName(name) {
+		return nil, fmt.Errorf("Invalid file name %q", name)
+	}
+	return r.readAll(name)
+}
+
+// Implements RawChunkReader for a MemNodeStore.  Objects and journals are
+// encrypted on the way out so that they look exactly like they would in a
+// ChunkStore.
+type memRawChunkReader struct {
+	ms *MemNodeStore
+}
+
+// Returns the RawChunkReader for the store.
+func (ms *MemNodeStore) GetRawChunkReader() RawChunkReader {
+	return memRawChunkReader{ms}
+}
+
+func (r memRawChunkReader) ReadRawChunk(digest []byte) ([]byte, error) {
+	r.ms.mu.Lock()
+	data, ok := r.ms.objs[string(digest)]
+	r.ms.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := r.ms.fsInfo.WriteChunk(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r memRawChunkReader) GetHead(branch string) ([]byte, error) {
+	digest, err := r.ms.GetHead(branch)
+	if isUnknownName(err) {
+		return nil, nil
+	}
+	return digest, err
+}
+
+func (r memRawChunkReader) GetJournalBlock(firstBlockDigest []byte,
+	branch string, pos int) (*JournalBlock, error) {
+
+	r.ms.mu.Lock()
+	changes, ok := r.ms.journals[branch]
+	r.ms.mu.Unlock()
+	if !ok {
+		return &JournalBlock{Done: true}, nil
+	}
+
+	// Reconstruct the journal file in the format written by ChunkStore.
+	journal := proto.NewBuffer(nil)
+	for _, entry := range changes {
+		data, err := proto.Marshal(&entry.change)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		if _, err := r.ms.fsInfo.WriteChunk(buf, data); err != nil {
+			return nil, err
+		}
+		if err := journal.EncodeRawBytes(buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return makeJournalBlock(journal.Bytes(), firstBlockDigest, pos), nil
+}
+
+func (r memRawChunkReader) GetFile(name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Reads the entire journal for 'branch' through GetJournalBlock().
+func readJournalBlocks(t *testing.T, reader RawChunkReader,
+	branch string) []byte {
+
+	var result []byte
+	var firstBlockDigest []byte
+	for {
+		block, err := reader.GetJournalBlock(firstBlockDigest, branch,
+			len(result))
+		if err != nil {
+			t.Fatalf("GetJournalBlock: %s", err)
+		}
+		result = append(result, block.Contents...)
+		firstBlockDigest = block.FirstBlockDigest
+		if block.Done {
+			return result
+		}
+		Assertf(t, len(block.Contents) > 0, "empty block before the end")
+	}
+}
+
+func TestMakeJournalBlock(t *testing.T) {
+	small := []byte("small journal")
+	block := makeJournalBlock(small, nil, 0)
+	Assert(t, block.FirstBlockDigest == nil && block.Done)
+	Assert(t, bytes.Equal(block.Contents, small))
+	block = makeJournalBlock(small, nil, len(small))
+	Assert(t, block.Contents == nil && block.Done)
+
+	large := bytes.Repeat([]byte("0123456789"), BlockSize/4)
+	digest := sha256.Sum256(large[:BlockSize])
+	block = makeJournalBlock(large, nil, 0)
+	Assert(t, bytes.Equal(block.FirstBlockDigest, digest[:]))
+	Assert(t, bytes.Equal(block.Contents, large[:BlockSize]) && !block.Done)
+	block = makeJournalBlock(large, digest[:], 2*BlockSize)
+	Assert(t, bytes.Equal(block.Contents, large[2*BlockSize:]) && block.Done)
+
+	// A different first block means the journal has changed.
+	block = makeJournalBlock(large, []byte("bogus"), BlockSize)
+	Assert(t, block.FirstBlockDigest == nil && block.Contents == nil)
+	Assert(t, !block.Done)
+}
+
+func TestFSRawChunkReader(t *testing.T) {
+	fs := NewFakeFileSys()
+	fsInfo := NewFSInfo("password")
+	cs := NewChunkStore(fsInfo, fs)
+	reader := cs.GetRawChunkReader()
+
+	digest, _ := cs.StoreNode(&pb.Node{Contents: proto.String("contents")})
+	raw, err := reader.ReadRawChunk(digest)
+	Assert(t, err == nil && raw != nil)
+	chunk, err := fsInfo.ReadChunk(bytes.NewBuffer(raw))
+	Assert(t, err == nil && bytes.Equal(chunk.digest, digest))
+	raw, err = reader.ReadRawChunk([]byte("missing"))
+	Assert(t, raw == nil && err == nil)
+
+	head, err := reader.GetHead("master")
+	Assert(t, head == nil && err == nil)
+	cs.SetHead("master", digest)
+	head, err = reader.GetHead("master")
+	Assert(t, err == nil && bytes.Equal(head, digest))
+
+	block, err := reader.GetJournalBlock(nil, "master", 0)
+	Assert(t, err == nil && block.Contents == nil && block.Done)
+	for i := 0; i < 2000; i++ {
+		cs.WriteToJournal("master", &pb.Change{Type: proto.Int32(1),
+			Name: proto.String(strings.Repeat("name", 25)),
+		})
+	}
+	journal, _ := fs.Open("journals/master")
+	expected := &bytes.Buffer{}
+	expected.ReadFrom(journal)
+	Assert(t, expected.Len() > 2*BlockSize)
+	Assert(t, bytes.Equal(readJournalBlocks(t, reader, "master"),
+		expected.Bytes()))
+
+	_, err = reader.GetFile("params")
+	Assert(t, os.IsNotExist(err))
+	dst, _ := fs.Create("params")
+	dst.Write([]byte("params data"))
+	data, err := reader.GetFile("params")
+	Assert(t, err == nil && string(data) == "params data")
+
+	// Names that could escape the backing directory are rejected.
+	_, err = reader.GetFile("../params")
+	Assert(t, err != nil && !os.IsNotExist(err))
+	_, err = reader.GetHead("../../params")
+	Assert(t, err != nil)
+	_, err = reader.GetJournalBlock(nil, "/etc/passwd", 0)
+	Assert(t, err != nil)
+	for _, name := range []string{"", ".", "..", "x/y", "x\x00"} {
+		_, err = reader.GetHead(name)
+		Assertf(t, err != nil, "no error for %q", name)
+		_, err = reader.GetJournalBlock(nil, name, 0)
+		Assertf(t, err != nil, "no error for %q", name)
+	}
+	_, err = reader.GetFile("params\x00")
+	Assert(t, err != nil && !os.IsNotExist(err))
+}
+
+func TestFSRawChunkReaderBadPaths(t *testing.T) {
+	// Paths that a real directory can't stat shouldn't panic.
+	backing := NewBackingDir(t.TempDir())
+	cs := NewChunkStore(NewFSInfo("password"), backing)
+	digest, _ := cs.StoreNode(&pb.Node{})
+	cs.SetHead("x", digest)
+	reader := cs.GetRawChunkReader()
+	_, err := reader.GetHead("x/y")
+	Assert(t, err != nil)
+	_, err = reader.GetFile("refs/x/y")
+	Assert(t, err != nil)
+	_, err = reader.GetFile("refs\x00")
+	Assert(t, err != nil)
+}
+
+func TestMemRawChunkReaderMatchesChunkStore(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	cs := NewChunkStore(fsInfo, NewFakeFileSys())
+	ms := NewMemStore(fsInfo)
+	for _, store := range []NodeStore{cs, ms} {
+		digest, _ := store.StoreNode(&pb.Node{Contents: proto.String("data")})
+		store.SetHead("master", digest)
+		for i := 0; i < 10; i++ {
+			store.WriteToJournal("master", &pb.Change{Type: proto.Int32(1)})
+		}
+	}
+
+	csReader, msReader := cs.GetRawChunkReader(), ms.GetRawChunkReader()
+	digest, _ := ms.GetHead("master")
+	csHead, _ := csReader.GetHead("master")
+	msHead, _ := msReader.GetHead("master")
+	Assert(t, bytes.Equal(csHead, msHead))
+	csRaw, _ := csReader.ReadRawChunk(digest)
+	msRaw, _ := msReader.ReadRawChunk(digest)
+	Assert(t, msRaw != nil && bytes.Equal(csRaw, msRaw))
+	Assert(t, bytes.Equal(readJournalBlocks(t, csReader, "master"),
+		readJournalBlocks(t, msReader, "master")))
+
+	head, err := msReader.GetHead("unknown")
+	Assert(t, head == nil && err == nil)
+	_, err = msReader.GetFile("params")
+	Assert(t, os.IsNotExist(err))
+}
+
+func TestLookUpCommit(t *testing.T) {
+	store := NewMemStore(NewFSInfo("password"))
+	commit := &pb.Commit{Timestamp: proto.Int32(100)}
+	digest, _ := store.StoreCommit(commit)
+	store.SetHead("master", digest)
+
+	for _, name := range []string{"master", altEncode(digest)} {
+		found, loaded, err := LookUpCommit(store, name)
+		Assertf(t, err == nil, "LookUpCommit(%s): %s", name, err)
+		Assert(t, bytes.Equal(found, digest) && proto.Equal(loaded, commit))
+	}
+	_, _, err := LookUpCommit(store, "unknown")
+	Assert(t, isUnknownName(err))
+}
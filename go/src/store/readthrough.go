@@ -0,0 +1,137 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+)
+
+// Interface for obtaining objects from remote sources (normally peers).
+type RemoteReader interface {
+	// Returns the raw (encrypted) contents of the object with the digest,
+	// nil and no error if the object isn't available.
+	GetContents(digest []byte) ([]byte, error)
+}
+
+// Implemented by the stores that can keep objects obtained from a
+// RemoteReader, so they don't have to be fetched again.
+type chunkCacher interface {
+	// Stores 'chunk', whose encrypted form is 'raw'.
+	cacheChunk(chunk *Chunk, raw []byte) error
+}
+
+func (cs *ChunkStore) cacheChunk(chunk *Chunk, raw []byte) error {
+	return writeObject(cs.backing, chunk.digest, raw)
+}
+
+func (ms *MemNodeStore) cacheChunk(chunk *Chunk, raw []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.objs[string(chunk.digest)] = copyBytes(chunk.contents)
+	return nil
+}
+
+// A NodeStore that loads the objects that aren't in the local store from a
+// RemoteReader.  Objects obtained remotely are verified and stored locally.
+// This is the equivalent of a Crack NodeStore with a remote reader set by
+// setRemoteReader().
+//
+// Everything other than loading nodes and commits goes straight to the local
+// store.
+type ReadThroughStore struct {
+	NodeStore
+	fsInfo *FSInfo
+	remote RemoteReader
+}
+
+// Creates a ReadThroughStore over 'local'.  'fsInfo' must be the FSInfo of
+// the local store.
+func NewReadThroughStore(local NodeStore, fsInfo *FSInfo,
+	remote RemoteReader) *ReadThroughStore {
+
+	return &ReadThroughStore{local, fsInfo, remote}
+}
+
+func checkReadThroughStoreIfaces() {
+	var _ NodeStore = &ReadThroughStore{}
+}
+
+// Fetches the chunk for 'digest' from the remote reader and stores it
+// locally.  'localErr' is the error from the local store, it's returned if
+// the remote doesn't have the chunk either.
+func (rs *ReadThroughStore) fetch(digest []byte, localErr error) (*Chunk,
+	error) {
+
+	raw, err := rs.remote.GetContents(digest)
+	if err != nil {
+		return nil, err
+	} else if raw == nil {
+		return nil, localErr
+	}
+
+	chunk, err := rs.fsInfo.ReadChunk(bytes.NewBuffer(raw))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(chunk.digest, digest) {
+		return nil, fmt.Errorf("Chunk %s data integrity failure, actual "+
+			"data digest is %s", altEncode(digest),
+			altEncode(chunk.digest))
+	}
+
+	if cacher, ok := rs.NodeStore.(chunkCacher); ok {
+		if err := cacher.cacheChunk(chunk, raw); err != nil {
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+func (rs *ReadThroughStore) LoadNode(digest []byte) (*pb.Node, error) {
+	node, err := rs.NodeStore.LoadNode(digest)
+	if err == nil {
+		return node, nil
+	}
+
+	chunk, err := rs.fetch(digest, err)
+	if err != nil {
+		return nil, err
+	}
+	node = &pb.Node{}
+	if err := proto.Unmarshal(chunk.contents, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (rs *ReadThroughStore) LoadCommit(digest []byte) (*pb.Commit, error) {
+	commit, err := rs.NodeStore.LoadCommit(digest)
+	if err == nil {
+		return commit, nil
+	}
+
+	chunk, err := rs.fetch(digest, err)
+	if err != nil {
+		return nil, err
+	}
+	commit = &pb.Commit{}
+	if err := proto.Unmarshal(chunk.contents, commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
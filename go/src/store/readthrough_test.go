@@ -0,0 +1,117 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"testing"
+)
+
+// Implements RemoteReader over a RawChunkReader, counts the fetches.
+type fakeRemote struct {
+	reader  RawChunkReader
+	fetches int
+}
+
+func (r *fakeRemote) GetContents(digest []byte) ([]byte, error) {
+	r.fetches++
+	return r.reader.ReadRawChunk(digest)
+}
+
+func TestReadThroughStore(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	remoteStore := NewMemStore(fsInfo)
+	remote := &fakeRemote{reader: remoteStore.GetRawChunkReader()}
+	node := &pb.Node{Contents: proto.String("contents")}
+	nodeDigest, _ := remoteStore.StoreNode(node)
+	commit := &pb.Commit{Root: nodeDigest}
+	commitDigest, _ := remoteStore.StoreCommit(commit)
+
+	for _, local := range []NodeStore{NewMemStore(fsInfo),
+		NewChunkStore(fsInfo, NewFakeFileSys())} {
+
+		remote.fetches = 0
+		store := NewReadThroughStore(local, fsInfo, remote)
+		loadedCommit, err := store.LoadCommit(commitDigest)
+		Assertf(t, err == nil, "LoadCommit: %s", err)
+		Assert(t, proto.Equal(loadedCommit, commit))
+		loadedNode, err := store.LoadNode(nodeDigest)
+		Assertf(t, err == nil, "LoadNode: %s", err)
+		Assert(t, proto.Equal(loadedNode, node))
+		Assert(t, remote.fetches == 2)
+
+		// The objects should now be stored locally.
+		loadedNode, err = local.LoadNode(nodeDigest)
+		Assert(t, err == nil && proto.Equal(loadedNode, node))
+		store.LoadNode(nodeDigest)
+		Assert(t, remote.fetches == 2)
+
+		_, err = store.LoadNode([]byte("missing"))
+		Assert(t, err != nil)
+	}
+}
+
+// Returns the same contents for every digest.
+type badRemote struct {
+	contents []byte
+}
+
+func (r badRemote) GetContents(digest []byte) ([]byte, error) {
+	return r.contents, nil
+}
+
+func TestReadThroughStoreVerifiesDigests(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	buf := &bytes.Buffer{}
+	data, _ := proto.Marshal(&pb.Node{Contents: proto.String("bad")})
+	fsInfo.WriteChunk(buf, data)
+
+	local := NewMemStore(fsInfo)
+	store := NewReadThroughStore(local, fsInfo, badRemote{buf.Bytes()})
+	digest, _ := NewMemStore(fsInfo).StoreNode(&pb.Node{})
+	_, err := store.LoadNode(digest)
+	Assert(t, err != nil)
+	_, err = local.LoadNode(digest)
+	Assert(t, err != nil)
+}
+
+func TestReadThroughStoreCache(t *testing.T) {
+	fsInfo := NewFSInfo("password")
+	remoteStore := NewMemStore(fsInfo)
+	head, _ := NewCache(remoteStore).GetHead("master")
+	root, _ := head.GetRoot()
+	file, _ := root.AddChild("file", &pb.Node{}, 100)
+	file.Write(0, []byte("remote data"), 100)
+	digest, err := head.Commit(nil)
+	Assertf(t, err == nil, "Commit: %s", err)
+
+	// Load the tree through a cache on an empty local store.
+	local := NewMemStore(fsInfo)
+	local.SetHead("master", digest)
+	store := NewReadThroughStore(local, fsInfo,
+		&fakeRemote{reader: remoteStore.GetRawChunkReader()})
+	head, _ = NewCache(store).GetHead("master")
+	root, err = head.GetRoot()
+	if err != nil {
+		t.Fatalf("GetRoot: %s", err)
+	}
+	file, _ = root.GetChildByName("file")
+	Assert(t, file != nil)
+	contents, err := file.GetContents()
+	Assertf(t, err == nil && string(contents) == "remote data",
+		"got contents %q, %v", contents, err)
+}
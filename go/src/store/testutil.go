@@ -16,7 +16,14 @@ package blockstore
 
 import (
 	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Implements File.
@@ -28,46 +35,306 @@ func (*bufferFile) Close() error {
 	return nil
 }
 
+func (*bufferFile) Sync() error {
+	return nil
+}
+
 // Implements FileSys.
 type FakeFileSys struct {
 	contents map[string]*bufferFile
+	dirs     map[string]bool
+	modTimes map[string]time.Time
 }
 
 func NewFakeFileSys() *FakeFileSys {
-	return &FakeFileSys{make(map[string]*bufferFile)}
+	return &FakeFileSys{make(map[string]*bufferFile), make(map[string]bool),
+		make(map[string]time.Time)}
 }
 
 func (fs *FakeFileSys) Create(name string) (File, error) {
 	result := &bufferFile{}
 	fs.contents[name] = result
+	fs.modTimes[name] = time.Now()
 	return result, nil
 }
 
+// Returns a reader over a snapshot of the file contents (so reading from it
+// doesn't consume the file).
 func (fs *FakeFileSys) Open(name string) (File, error) {
-	return fs.contents[name], nil
+	file, ok := fs.contents[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	result := &bufferFile{}
+	result.Write(file.Bytes())
+	return result, nil
 }
 
 func (fs *FakeFileSys) Exists(name string) bool {
 	_, ok := fs.contents[name]
-	return ok
+	return ok || fs.dirs[name]
 }
 
 func (fs *FakeFileSys) Append(name string) (File, error) {
 	if _, exists := fs.contents[name]; !exists {
 		fs.contents[name] = &bufferFile{}
 	}
+	fs.modTimes[name] = time.Now()
 	return fs.contents[name], nil
 }
 
 func (fs *FakeFileSys) Mkdir(name string) error {
+	fs.dirs[name] = true
 	return nil
 }
 
 func (fs *FakeFileSys) Remove(name string) error {
-	delete(fs.contents, "journals/"+name)
+	delete(fs.contents, name)
+	delete(fs.modTimes, name)
+	return nil
+}
+
+func (fs *FakeFileSys) Rename(oldName, newName string) error {
+	file, ok := fs.contents[oldName]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	delete(fs.contents, oldName)
+	fs.contents[newName] = file
+	fs.modTimes[newName] = fs.modTimes[oldName]
+	delete(fs.modTimes, oldName)
+	return nil
+}
+
+func (fs *FakeFileSys) List(name string) ([]DirEntry, error) {
+	var files []string
+	for file := range fs.contents {
+		files = append(files, file)
+	}
+	entries := listDir(name, files, fs.dirs)
+	if entries == nil && name != "" && !fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	for i := range entries {
+		entries[i].ModTime = fs.modTimes[joinPath(name, entries[i].Name)]
+	}
+	return entries, nil
+}
+
+// Sets the modification time of the file 'name'.
+func (fs *FakeFileSys) SetModTime(name string, modTime time.Time) {
+	fs.modTimes[name] = modTime
+}
+
+// Returns the entries of the directory 'dir' of a fake filesystem with
+// 'files' and 'dirs', sorted by name and without modification times.
+func listDir(dir string, files []string, dirs map[string]bool) []DirEntry {
+	prefix := joinPath(dir, "")
+	var entries []DirEntry
+	add := func(name string, isDir bool) {
+		if !strings.HasPrefix(name, prefix) {
+			return
+		}
+		name = name[len(prefix):]
+		if name != "" && !strings.Contains(name, "/") {
+			entries = append(entries, DirEntry{Name: name, IsDir: isDir})
+		}
+	}
+	for _, name := range files {
+		add(name, false)
+	}
+	for name := range dirs {
+		add(name, true)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Returned by the operations of a FaultyFileSys after its fault has been
+// triggered.
+var ErrInjectedFault = errors.New("Injected fault")
+
+// Implements FileSys, simulating a filesystem that can crash.
+//
+// Data written to a file only survives a crash once the file has been synced
+// (or if it was opened with Append(), which writes synchronously), creating
+// a file truncates it immediately, and renames, removals and new directories
+// survive as soon as they return.  Crash() returns the state that survives.
+//
+// After FailAfter(n), the operation after the next n operations that change
+// the filesystem, and every operation after it, fail with ErrInjectedFault,
+// as if the system crashed at that point.
+type FaultyFileSys struct {
+	// The current contents of the files and what would survive a crash.
+	live, durable map[string][]byte
+	dirs          map[string]bool
+
+	// The number of operations left before the fault, -1 for no fault.
+	countdown int
+
+	// Set once an operation has failed.
+	failed bool
+}
+
+func NewFaultyFileSys() *FaultyFileSys {
+	return &FaultyFileSys{make(map[string][]byte), make(map[string][]byte),
+		make(map[string]bool), -1, false}
+}
+
+// Makes the operation after the next 'n' operations fail, along with all
+// operations after it.
+func (fs *FaultyFileSys) FailAfter(n int) {
+	fs.countdown = n
+}
+
+// Returns true if the fault has been triggered.
+func (fs *FaultyFileSys) Failed() bool {
+	return fs.failed
+}
+
+// Counts an operation that changes the filesystem, returns
+// ErrInjectedFault if it should fail.
+func (fs *FaultyFileSys) fault() error {
+	if fs.countdown == 0 {
+		fs.failed = true
+		return ErrInjectedFault
+	} else if fs.countdown > 0 {
+		fs.countdown--
+	}
 	return nil
 }
 
+// Returns a new filesystem with only what survives a crash at this point.
+func (fs *FaultyFileSys) Crash() *FaultyFileSys {
+	result := NewFaultyFileSys()
+	for name, contents := range fs.durable {
+		result.live[name] = copyBytes(contents)
+		result.durable[name] = copyBytes(contents)
+	}
+	for name := range fs.dirs {
+		result.dirs[name] = true
+	}
+	return result
+}
+
+// A file open for writing in a FaultyFileSys.
+type faultyFile struct {
+	fs   *FaultyFileSys
+	name string
+
+	// True if writes are synchronous.
+	sync bool
+}
+
+func (f *faultyFile) Read(data []byte) (int, error) {
+	return 0, errors.New("File is not open for reading")
+}
+
+func (f *faultyFile) Write(data []byte) (int, error) {
+	if err := f.fs.fault(); err != nil {
+		return 0, err
+	}
+	f.fs.live[f.name] = append(f.fs.live[f.name], data...)
+	if f.sync {
+		f.fs.durable[f.name] = copyBytes(f.fs.live[f.name])
+	}
+	return len(data), nil
+}
+
+func (f *faultyFile) Sync() error {
+	if err := f.fs.fault(); err != nil {
+		return err
+	}
+	f.fs.durable[f.name] = copyBytes(f.fs.live[f.name])
+	return nil
+}
+
+func (f *faultyFile) Close() error {
+	return nil
+}
+
+func (fs *FaultyFileSys) Create(name string) (File, error) {
+	if err := fs.fault(); err != nil {
+		return nil, err
+	}
+	fs.live[name] = []byte{}
+	fs.durable[name] = []byte{}
+	return &faultyFile{fs, name, false}, nil
+}
+
+func (fs *FaultyFileSys) Open(name string) (File, error) {
+	contents, ok := fs.live[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	result := &bufferFile{}
+	result.Write(contents)
+	return result, nil
+}
+
+func (fs *FaultyFileSys) Append(name string) (File, error) {
+	if err := fs.fault(); err != nil {
+		return nil, err
+	}
+	if _, exists := fs.live[name]; !exists {
+		fs.live[name] = []byte{}
+		fs.durable[name] = []byte{}
+	}
+	return &faultyFile{fs, name, true}, nil
+}
+
+func (fs *FaultyFileSys) Exists(name string) bool {
+	_, ok := fs.live[name]
+	return ok || fs.dirs[name]
+}
+
+func (fs *FaultyFileSys) Mkdir(name string) error {
+	if err := fs.fault(); err != nil {
+		return err
+	}
+	fs.dirs[name] = true
+	return nil
+}
+
+func (fs *FaultyFileSys) Remove(name string) error {
+	if err := fs.fault(); err != nil {
+		return err
+	}
+	delete(fs.live, name)
+	delete(fs.durable, name)
+	return nil
+}
+
+func (fs *FaultyFileSys) Rename(oldName, newName string) error {
+	if err := fs.fault(); err != nil {
+		return err
+	}
+	contents, ok := fs.live[oldName]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	fs.live[newName] = contents
+	fs.durable[newName] = fs.durable[oldName]
+	delete(fs.live, oldName)
+	delete(fs.durable, oldName)
+	return nil
+}
+
+// The entries have no modification times.
+func (fs *FaultyFileSys) List(name string) ([]DirEntry, error) {
+	var files []string
+	for file := range fs.live {
+		files = append(files, file)
+	}
+	entries := listDir(name, files, fs.dirs)
+	if entries == nil && name != "" && !fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return entries, nil
+}
+
 func Assertf(t *testing.T, cond bool, message string, v ...interface{}) {
 	if !cond {
 		t.Errorf(message, v...)
@@ -79,3 +346,139 @@ func Assert(t *testing.T, cond bool) {
         t.Fail();
     }
 }
+
+// Reads all of the changes in the journal for 'branch'.
+func readJournal(t *testing.T, ns NodeStore, branch string) []*ChangeEntry {
+	iter, err := ns.MakeJournalIter(branch)
+	if err != nil {
+		t.Fatalf("MakeJournalIter(%s): %s", branch, err)
+	}
+	var result []*ChangeEntry
+	for iter.IsValid() {
+		entry, err := iter.Elem()
+		if err != nil {
+			t.Fatalf("Elem: %s", err)
+		}
+		result = append(result, entry)
+		if err := iter.Next(); err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+	}
+	entry, err := iter.Elem()
+	Assertf(t, entry == nil && err == nil,
+		"Elem() returned %v, %v at the end of the journal", entry, err)
+	return result
+}
+
+// Verifies that a NodeStore implementation satisfies the NodeStore
+// contract.  'newStore' must return a new, empty store.
+func NodeStoreConformance(t *testing.T, newStore func() NodeStore) {
+	ns := newStore()
+
+	// Nodes.
+	node := &pb.Node{Contents: proto.String("contents"),
+		Size: proto.Uint64(8),
+	}
+	digest, err := ns.StoreNode(node)
+	if err != nil {
+		t.Fatalf("StoreNode: %s", err)
+	}
+	data, _ := proto.Marshal(node)
+	madeDigest, err := ns.MakeDigest(data)
+	Assertf(t, err == nil && bytes.Equal(madeDigest, digest),
+		"MakeDigest doesn't match the StoreNode digest")
+	loaded, err := ns.LoadNode(digest)
+	Assertf(t, err == nil && proto.Equal(loaded, node),
+		"LoadNode returned %v, %v", loaded, err)
+	loaded.Contents = proto.String("changed")
+	loaded, _ = ns.LoadNode(digest)
+	Assertf(t, loaded.GetContents() == "contents",
+		"modifying a loaded node changed the stored node")
+	other, _ := ns.StoreNode(&pb.Node{Contents: proto.String("other")})
+	Assert(t, !bytes.Equal(other, digest))
+	loaded, err = ns.LoadNode([]byte("no such node"))
+	Assertf(t, err != nil && loaded == nil, "loaded a nonexistent node")
+
+	// Commits.
+	commit := &pb.Commit{Parent: [][]byte{[]byte("parent")},
+		Root:      digest,
+		Timestamp: proto.Int32(1234),
+	}
+	commitDigest, err := ns.StoreCommit(commit)
+	if err != nil {
+		t.Fatalf("StoreCommit: %s", err)
+	}
+	loadedCommit, err := ns.LoadCommit(commitDigest)
+	Assertf(t, err == nil && proto.Equal(loadedCommit, commit),
+		"LoadCommit returned %v, %v", loadedCommit, err)
+	loadedCommit, err = ns.LoadCommit([]byte("no such commit"))
+	Assertf(t, err != nil && loadedCommit == nil,
+		"loaded a nonexistent commit")
+
+	// Root digest.
+	root, err := ns.LoadRootDigest()
+	Assertf(t, err == nil && root == nil,
+		"LoadRootDigest on an empty store returned %v, %v", root, err)
+	Assert(t, ns.StoreRootDigest(digest) == nil)
+	root, err = ns.LoadRootDigest()
+	Assertf(t, err == nil && bytes.Equal(root, digest),
+		"LoadRootDigest returned %v, %v", root, err)
+
+	// Branch heads.
+	head, err := ns.GetHead("master")
+	Assertf(t, isUnknownName(err) && head == nil,
+		"GetHead on an unknown branch returned %v, %v", head, err)
+	Assert(t, ns.SetHead("master", commitDigest) == nil)
+	Assert(t, ns.SetHead("other", digest) == nil)
+	head, err = ns.GetHead("master")
+	Assertf(t, err == nil && bytes.Equal(head, commitDigest),
+		"GetHead returned %v, %v", head, err)
+	Assert(t, ns.SetHead("master", other) == nil)
+	head, _ = ns.GetHead("master")
+	Assert(t, bytes.Equal(head, other))
+	head, _ = ns.GetHead("other")
+	Assert(t, bytes.Equal(head, digest))
+	Assert(t, ns.DeleteHead("other") == nil)
+	_, err = ns.GetHead("other")
+	Assert(t, isUnknownName(err))
+	Assert(t, ns.DeleteHead("other") == nil)
+	Assert(t, ns.SetHead("other", digest) == nil)
+
+	// Journals.
+	Assert(t, len(readJournal(t, ns, "master")) == 0)
+	var digests [][]byte
+	for i := int32(1); i <= 3; i++ {
+		change := &pb.Change{Type: proto.Int32(i)}
+		changeDigest, err := ns.WriteToJournal("master", change)
+		if err != nil {
+			t.Fatalf("WriteToJournal: %s", err)
+		}
+		digests = append(digests, changeDigest)
+	}
+	_, err = ns.WriteToJournal("other", &pb.Change{Type: proto.Int32(10)})
+	Assert(t, err == nil)
+
+	entries := readJournal(t, ns, "master")
+	Assertf(t, len(entries) == 3, "got %d journal entries", len(entries))
+	for i, entry := range entries {
+		Assertf(t, entry.change.GetType() == int32(i+1),
+			"change %d has type %d", i, entry.change.GetType())
+		Assertf(t, bytes.Equal(entry.digest, digests[i]),
+			"change %d has the wrong digest", i)
+	}
+	data, _ = proto.Marshal(&entries[0].change)
+	madeDigest, _ = ns.MakeDigest(data)
+	Assert(t, bytes.Equal(madeDigest, digests[0]))
+
+	Assert(t, ns.DeleteJournal("master") == nil)
+	Assert(t, len(readJournal(t, ns, "master")) == 0)
+	entries = readJournal(t, ns, "other")
+	Assert(t, len(entries) == 1 && entries[0].change.GetType() == 10)
+	Assert(t, ns.DeleteJournal("no-such-branch") == nil)
+
+	// A new journal after deletion starts from scratch.
+	_, err = ns.WriteToJournal("master", &pb.Change{Type: proto.Int32(4)})
+	Assert(t, err == nil)
+	entries = readJournal(t, ns, "master")
+	Assert(t, len(entries) == 1 && entries[0].change.GetType() == 4)
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Traversal of commits and node trees, the equivalent of traverseCommit()
+// and traverseNode() in util.crk.
+
+package blockstore
+
+import (
+	"fmt"
+)
+
+// A set of chunk digests.
+type ChunkSet interface {
+	Has(digest []byte) bool
+	Add(digest []byte) error
+}
+
+// Implements ChunkSet as a directory of empty files named for the
+// alt-encoded digests.  This is the set of chunks that have been completely
+// traversed, see ChunkStore.GetTraversed().
+type traversedChunkDB struct {
+	backing FileSys
+}
+
+const traversedDir = "traversed"
+
+func (db traversedChunkDB) Has(digest []byte) bool {
+	return db.backing.Exists(traversedDir + "/" + altEncode(digest))
+}
+
+func (db traversedChunkDB) Add(digest []byte) error {
+	if !db.backing.Exists(traversedDir) {
+		if err := db.backing.Mkdir(traversedDir); err != nil {
+			return err
+		}
+	}
+	dst, err := db.backing.Create(traversedDir + "/" + altEncode(digest))
+	if err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// Returns the set of chunks that are known to be completely traversed, which
+// is persisted in the "traversed" directory of the backing store.
+func (cs *ChunkStore) GetTraversed() ChunkSet {
+	return traversedChunkDB{cs.backing}
+}
+
+// Returned from a traversal when a node or commit can't be loaded.
+type NodeNotFound struct {
+	s   string
+	err error
+}
+
+func (err NodeNotFound) Error() string {
+	return err.s
+}
+
+// Returns the error from the store.
+func (err NodeNotFound) Unwrap() error {
+	return err.err
+}
+
+// Walks the tree of nodes and the commit history from a commit.  Every node
+// and commit is visited at most once per traversal.
+type traverser struct {
+	store     NodeStore
+	traversed ChunkSet
+	visited   map[string]bool
+}
+
+// Returns true if 'digest' doesn't need to be traversed, marks it as visited
+// otherwise.
+func (t *traverser) skip(digest []byte) bool {
+	if t.visited[string(digest)] {
+		return true
+	}
+	t.visited[string(digest)] = true
+	return t.traversed != nil && t.traversed.Has(digest)
+}
+
+// Records that 'digest' has been completely traversed.
+func (t *traverser) done(digest []byte) error {
+	if t.traversed != nil {
+		return t.traversed.Add(digest)
+	}
+	return nil
+}
+
+func (t *traverser) node(digest []byte) error {
+	if t.skip(digest) {
+		return nil
+	}
+	node, err := t.store.LoadNode(digest)
+	if err != nil {
+		return NodeNotFound{fmt.Sprintf("Missing node %s", altEncode(digest)),
+			err}
+	}
+	for _, child := range node.Children {
+		if err := t.node(child.Hash); err != nil {
+			return err
+		}
+	}
+	return t.done(digest)
+}
+
+func (t *traverser) commit(digest []byte) error {
+	if t.skip(digest) {
+		return nil
+	}
+	commit, err := t.store.LoadCommit(digest)
+	if err != nil {
+		return NodeNotFound{
+			fmt.Sprintf("Missing commit %s", altEncode(digest)), err}
+	}
+	if err := t.node(commit.Root); err != nil {
+		return err
+	}
+	for _, parent := range commit.Parent {
+		if err := t.commit(parent); err != nil {
+			return err
+		}
+	}
+	if commit.JournalInfo != nil {
+		if err := t.node(commit.JournalInfo); err != nil {
+			return err
+		}
+	}
+	return t.done(digest)
+}
+
+func newTraverser(store NodeStore, traversed ChunkSet) *traverser {
+	return &traverser{store, traversed, make(map[string]bool)}
+}
+
+// Traverses the entire tree of nodes starting with the node identified by
+// 'digest'.  This is mainly useful for its side effects, such as verifying
+// that the tree is intact or copying it from a peer through a
+// ReadThroughStore.
+//
+// 'traversed' may be nil.  If present, it is the set of nodes that have been
+// completely traversed: they are skipped, and digests are added to it after
+// their subtrees have been traversed.
+func TraverseNode(store NodeStore, digest []byte, traversed ChunkSet) error {
+	return newTraverser(store, traversed).node(digest)
+}
+
+// Traverses the commit identified by 'digest', its node tree, its journal
+// info and all of its ancestors.  'traversed' is as for TraverseNode().
+func TraverseCommit(store NodeStore, digest []byte,
+	traversed ChunkSet) error {
+
+	return newTraverser(store, traversed).commit(digest)
+}
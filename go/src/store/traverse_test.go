@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"errors"
+	pb "mawfs"
+	"testing"
+)
+
+// Counts the nodes and commits loaded from a store.
+type countingStore struct {
+	NodeStore
+	loads int
+}
+
+func (cs *countingStore) LoadNode(digest []byte) (*pb.Node, error) {
+	cs.loads++
+	return cs.NodeStore.LoadNode(digest)
+}
+
+func (cs *countingStore) LoadCommit(digest []byte) (*pb.Commit, error) {
+	cs.loads++
+	return cs.NodeStore.LoadCommit(digest)
+}
+
+// Returns the number of loads required to traverse 'digest'.
+func countTraversal(t *testing.T, store NodeStore, digest []byte,
+	traversed ChunkSet) int {
+
+	counter := &countingStore{NodeStore: store}
+	if err := TraverseCommit(counter, digest, traversed); err != nil {
+		t.Fatalf("TraverseCommit: %s", err)
+	}
+	return counter.loads
+}
+
+func TestTraverseCommit(t *testing.T) {
+	p := newPullTest(t)
+	p.commit(p.addFile(p.local, "a"))
+	digest := p.commit(p.addFile(p.local, "b"))
+
+	full := countTraversal(t, p.local, digest, nil)
+	Assert(t, full > 2)
+	Assert(t, countTraversal(t, p.local, digest, nil) == full)
+
+	// A delta traversal visits everything the first time, and nothing once
+	// the set records it.
+	traversed := p.local.GetTraversed()
+	Assert(t, !traversed.Has(digest))
+	Assert(t, countTraversal(t, p.local, digest, traversed) == full)
+	Assert(t, traversed.Has(digest))
+	Assert(t, countTraversal(t, p.local, digest, traversed) == 0)
+
+	// The set is persistent.
+	Assert(t, p.local.backing.Exists("traversed"))
+	Assert(t, NewChunkStore(p.fsInfo, p.local.backing).GetTraversed().Has(
+		digest))
+
+	// After another commit, only the new objects are visited.
+	newDigest := p.commit(p.addFile(p.local, "c"))
+	delta := countTraversal(t, p.local, newDigest, traversed)
+	Assert(t, delta > 0 && delta < full)
+	Assert(t, countTraversal(t, p.local, newDigest, nil) > full)
+}
+
+func TestTraverseMissingNode(t *testing.T) {
+	p := newPullTest(t)
+	digest := p.commit(p.addFile(p.remote, "a"))
+	commit, _ := p.remote.LoadCommit(digest)
+
+	// Only copy the commit, not its tree.
+	p.local.StoreCommit(commit)
+	err := TraverseCommit(p.local, digest, p.local.GetTraversed())
+	var notFound NodeNotFound
+	Assertf(t, errors.As(err, &notFound), "got error %v", err)
+	Assert(t, !p.local.GetTraversed().Has(digest))
+
+	// Through a ReadThroughStore, the traversal copies everything.
+	Assert(t, TraverseCommit(p.localView(), digest, nil) == nil)
+	Assert(t, TraverseCommit(p.local, digest, nil) == nil)
+
+	err = TraverseNode(p.local, []byte("missing"), nil)
+	Assert(t, errors.As(err, &notFound))
+}
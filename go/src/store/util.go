@@ -128,3 +128,14 @@ func altDecode(encoded string) ([]byte, error) {
 
 	return result.Bytes(), nil
 }
+
+// Encodes 'data' with altEncode().  This is the form in which digests are
+// shown to users and used in branch names.
+func AltEncode(data []byte) string {
+	return altEncode(data)
+}
+
+// Decodes a string encoded by AltEncode().
+func AltDecode(encoded string) ([]byte, error) {
+	return altDecode(encoded)
+}
@@ -0,0 +1,307 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Verification of the integrity of a store, the equivalent of "mawfs
+// verify".
+
+package blockstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The kinds of problems that Verify() reports.
+const (
+	// An object or ref couldn't be loaded.
+	VerifyMissing = "missing"
+
+	// An object doesn't match its digest.
+	VerifyCorrupt = "corrupt"
+
+	// An object matches its digest but can't be decrypted, the key or the
+	// cipher is wrong.
+	VerifyDecrypt = "decrypt"
+
+	// The size of a node doesn't match its contents or its children, or
+	// the size in an entry doesn't match the node it references.
+	VerifySize = "size"
+
+	// The org_checksum of an entry doesn't match the checksum of the node
+	// it references.
+	VerifyChecksum = "checksum"
+
+	// A journal can't be read or its changes aren't linked to each other
+	// and to the head of the branch.
+	VerifyJournal = "journal"
+)
+
+// A problem found by Verify().
+type VerifyProblem struct {
+	// One of the Verify* constants.
+	Kind string `json:"kind"`
+
+	// The branch that the problem was found from, the alt-encoded digest
+	// of the object (if it's about an object) and the path of the node in
+	// the branch (if it's about a node).
+	Branch string `json:"branch"`
+	Digest string `json:"digest,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// The result of Verify().  This is meant to be written as JSON.
+type VerifyReport struct {
+	Branches []string `json:"branches"`
+
+	// The number of distinct commits, nodes and journal changes that were
+	// checked.
+	Commits int `json:"commits"`
+	Nodes   int `json:"nodes"`
+	Changes int `json:"changes"`
+
+	Problems []*VerifyProblem `json:"problems"`
+}
+
+// Returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// What the verifier knows about a node it has already checked.
+type verifiedNode struct {
+	loaded   bool
+	size     uint64
+	checksum int32
+}
+
+type verifier struct {
+	store   NodeStore
+	report  *VerifyReport
+	branch  string
+	commits map[string]bool
+	nodes   map[string]*verifiedNode
+}
+
+func (v *verifier) problem(kind string, digest []byte, path string,
+	format string, args ...interface{}) {
+
+	problem := &VerifyProblem{Kind: kind, Branch: v.branch, Path: path,
+		Message: fmt.Sprintf(format, args...)}
+	if digest != nil {
+		problem.Digest = altEncode(digest)
+	}
+	v.report.Problems = append(v.report.Problems, problem)
+}
+
+// Reports the error from loading the object 'digest'.
+func (v *verifier) loadError(digest []byte, path string, err error) {
+	var corrupt *CorruptObject
+	var undecryptable *UndecryptableObject
+	if errors.As(err, &corrupt) {
+		v.problem(VerifyCorrupt, digest, path, "%s", corrupt.Err)
+	} else if errors.As(err, &undecryptable) {
+		v.problem(VerifyDecrypt, digest, path, "%s", undecryptable.Err)
+	} else {
+		v.problem(VerifyMissing, digest, path, "%s", err)
+	}
+}
+
+// Checks the node 'digest' at 'path' and everything under it.
+func (v *verifier) node(digest []byte, path string) *verifiedNode {
+	if info := v.nodes[string(digest)]; info != nil {
+		return info
+	}
+	info := &verifiedNode{}
+	v.nodes[string(digest)] = info
+	node, err := v.store.LoadNode(digest)
+	if err != nil {
+		v.loadError(digest, path, err)
+		return info
+	}
+	v.report.Nodes++
+	info.loaded = true
+	info.size = node.GetSize()
+	info.checksum = node.GetChecksum()
+
+	if len(node.Children) == 0 {
+		if size := uint64(len(node.GetContents())); size != info.size {
+			v.problem(VerifySize, digest, path,
+				"node size is %d, contents are %d bytes", info.size, size)
+		}
+		return info
+	}
+
+	var total uint64
+	for _, entry := range node.Children {
+		childPath := path
+		if entry.GetName() != "" {
+			childPath = strings.TrimSuffix(path, "/") + "/" +
+				entry.GetName()
+		}
+		total += entry.GetSize()
+		child := v.node(entry.Hash, childPath)
+		if !child.loaded {
+			continue
+		}
+		if entry.GetSize() != child.size {
+			v.problem(VerifySize, entry.Hash, childPath,
+				"entry size is %d, node size is %d", entry.GetSize(),
+				child.size)
+		}
+		if entry.OrgChecksum != nil &&
+			entry.GetOrgChecksum() != child.checksum {
+			v.problem(VerifyChecksum, entry.Hash, childPath,
+				"entry org_checksum is %d, node checksum is %d",
+				entry.GetOrgChecksum(), child.checksum)
+		}
+	}
+	if total != info.size {
+		v.problem(VerifySize, digest, path,
+			"node size is %d, children total %d", info.size, total)
+	}
+	return info
+}
+
+// Checks the commit 'digest', its tree and all of its ancestors.
+func (v *verifier) commit(digest []byte) {
+	pending := [][]byte{digest}
+	for len(pending) > 0 {
+		digest := pending[0]
+		pending = pending[1:]
+		if v.commits[string(digest)] {
+			continue
+		}
+		v.commits[string(digest)] = true
+		commit, err := v.store.LoadCommit(digest)
+		if err != nil {
+			v.loadError(digest, "", err)
+			continue
+		}
+		v.report.Commits++
+
+		if commit.Root == nil {
+			v.problem(VerifyMissing, digest, "", "commit has no root")
+		} else {
+			v.node(commit.Root, "/")
+		}
+
+		// The journal info is a node of session ids, it only needs to be
+		// loadable.
+		if commit.JournalInfo != nil &&
+			v.nodes[string(commit.JournalInfo)] == nil {
+			v.nodes[string(commit.JournalInfo)] = &verifiedNode{}
+			if _, err := v.store.LoadNode(commit.JournalInfo); err != nil {
+				v.loadError(commit.JournalInfo, "", err)
+			} else {
+				v.report.Nodes++
+			}
+		}
+		pending = append(pending, commit.Parent...)
+	}
+}
+
+// Checks that each change in the journal of the branch follows the one
+// before it, and that the first one is for 'head'.
+func (v *verifier) journal(head []byte) {
+	iter, err := v.store.MakeJournalIter(v.branch)
+	var last *ChangeEntry
+	for ; err == nil && iter.IsValid(); err = iter.Next() {
+		var entry *ChangeEntry
+		if entry, err = iter.Elem(); err != nil {
+			break
+		}
+		v.report.Changes++
+		change := &entry.change
+		if last == nil {
+			if !bytes.Equal(change.Commit, head) {
+				v.problem(VerifyJournal, entry.digest, "",
+					"first change is for commit %s, head is %s",
+					sig(change.Commit), sig(head))
+			}
+		} else if !bytes.Equal(change.LastChange, last.digest) {
+			v.problem(VerifyJournal, entry.digest, "",
+				"change follows %s, last change was %s",
+				sig(change.LastChange), sig(last.digest))
+		}
+		last = entry
+	}
+	if err != nil {
+		v.problem(VerifyJournal, nil, "", "can't read journal: %s", err)
+	}
+}
+
+// Verifies everything reachable from 'branches' in 'store': every commit
+// in their histories, every node in the trees of those commits and their
+// journals.  All objects are loaded, so a ChunkStore checks their digests
+// and decryption (see ChunkStore.load()).  Nodes must have sizes that match
+// their contents or the total of their entries, entries must have the sizes
+// (and org_checksums, if they have them) of the nodes they reference, and
+// the changes in each journal must be linked by their LastChange fields
+// from the head of the branch.
+//
+// Each object is only checked once, problems are reported for the first
+// branch and path that they're found from.
+func Verify(store NodeStore, branches []string) *VerifyReport {
+	v := &verifier{
+		store: store,
+		report: &VerifyReport{Branches: branches,
+			Problems: []*VerifyProblem{}},
+		commits: make(map[string]bool),
+		nodes:   make(map[string]*verifiedNode),
+	}
+	for _, branch := range branches {
+		v.branch = branch
+		head, err := store.GetHead(branch)
+		if err != nil {
+			v.problem(VerifyMissing, nil, "", "can't read head: %s", err)
+		} else {
+			v.commit(head)
+		}
+		v.journal(head)
+	}
+	return v.report
+}
+
+// Returns the names of all branches in 'backing' that have a head or a
+// journal.
+func ListBranches(backing FileSys) ([]string, error) {
+	names := make(map[string]bool)
+	for _, dir := range []string{"refs", "journals"} {
+		entries, err := backing.List(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir && !strings.HasSuffix(entry.Name, tempSuffix) &&
+				!(dir == "refs" && entry.Name == "root") {
+				names[entry.Name] = true
+			}
+		}
+	}
+
+	var branches []string
+	for name := range names {
+		branches = append(branches, name)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "mawfs"
+	"reflect"
+	"testing"
+)
+
+// Writes a directory with a file big enough to be split into chunks and a
+// small file to 'branch' and commits it, then writes a change to the
+// journal.
+func writeVerifyTestTree(t *testing.T, store NodeStore, branch string) {
+	head, err := NewCache(store).GetHead(branch)
+	if err != nil {
+		t.Fatalf("GetHead: %s", err)
+	}
+	root, _ := head.GetRoot()
+	dir, _ := root.AddChild("dir", &pb.Node{Mode: proto.Int32(MODE_DIR)}, 0)
+	big, _ := dir.AddChild("big", &pb.Node{}, 0)
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	big.Write(0, data, 0)
+	small, _ := root.AddChild("small", &pb.Node{}, 0)
+	small.Write(0, []byte("small"), 0)
+	if _, err := head.Commit(nil); err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+	small.Write(0, []byte("changed"), 0)
+}
+
+// Returns the kinds of the problems in 'report'.
+func problemKinds(report *VerifyReport) []string {
+	kinds := []string{}
+	for _, problem := range report.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	return kinds
+}
+
+func TestVerify(t *testing.T) {
+	store := NewMemStore(NewFSInfo("pw"))
+	writeVerifyTestTree(t, store, "master")
+	writeVerifyTestTree(t, store, "other")
+	report := Verify(store, []string{"master", "other"})
+	Assertf(t, report.OK(), "got problems %v", problemKinds(report))
+
+	// The branches share their initial commit.
+	Assert(t, report.Commits == 3 && report.Nodes > 10)
+	Assert(t, report.Changes == 2)
+
+	// A branch that doesn't exist.
+	report = Verify(store, []string{"nothing"})
+	Assert(t, reflect.DeepEqual(problemKinds(report),
+		[]string{VerifyMissing}))
+	Assert(t, report.Problems[0].Branch == "nothing")
+}
+
+func TestVerifyNodes(t *testing.T) {
+	store := NewMemStore(NewFSInfo("pw"))
+	storeNode := func(node *pb.Node) []byte {
+		digest, err := store.StoreNode(node)
+		if err != nil {
+			t.Fatalf("StoreNode: %s", err)
+		}
+		return digest
+	}
+	contents := storeNode(&pb.Node{Contents: proto.String("data"),
+		Size: proto.Uint64(4), Checksum: proto.Int32(1)})
+	badContents := storeNode(&pb.Node{Contents: proto.String("data"),
+		Size: proto.Uint64(5)})
+	dir := storeNode(&pb.Node{
+		Mode: proto.Int32(MODE_DIR),
+		Size: proto.Uint64(21),
+		Children: []*pb.Entry{
+			{Name: proto.String("a"), Hash: contents, Size: proto.Uint64(4),
+				OrgChecksum: proto.Int32(1)},
+			{Name: proto.String("b"), Hash: contents, Size: proto.Uint64(3)},
+			{Name: proto.String("c"), Hash: contents, Size: proto.Uint64(4),
+				OrgChecksum: proto.Int32(2)},
+			{Name: proto.String("d"), Hash: badContents,
+				Size: proto.Uint64(5)},
+			{Name: proto.String("e"), Hash: []byte("missing"),
+				Size: proto.Uint64(4)},
+		},
+	})
+	commit, _ := store.StoreCommit(&pb.Commit{Root: dir,
+		Parent: [][]byte{[]byte("missing commit")}})
+	store.SetHead("master", commit)
+
+	report := Verify(store, []string{"master"})
+	kinds := problemKinds(report)
+	Assertf(t, reflect.DeepEqual(kinds, []string{VerifySize,
+		VerifyChecksum, VerifySize, VerifyMissing, VerifySize,
+		VerifyMissing}), "got %v", kinds)
+	paths := []string{}
+	for _, problem := range report.Problems {
+		paths = append(paths, problem.Path)
+	}
+	Assertf(t, reflect.DeepEqual(paths, []string{"/b", "/c", "/d", "/e",
+		"/", ""}), "got %v", paths)
+	Assert(t, report.Problems[5].Digest == altEncode([]byte(
+		"missing commit")))
+}
+
+func TestVerifyJournal(t *testing.T) {
+	store := NewMemStore(NewFSInfo("pw"))
+	writeVerifyTestTree(t, store, "master")
+	head, _ := store.GetHead("master")
+	store.WriteToJournal("master", &pb.Change{Type: proto.Int32(
+		CHANGE_SETATTR), LastChange: []byte("bogus change")})
+	store.WriteToJournal("other", &pb.Change{Type: proto.Int32(
+		CHANGE_SETATTR), Commit: head})
+
+	report := Verify(store, []string{"master", "other"})
+	kinds := problemKinds(report)
+	Assertf(t, reflect.DeepEqual(kinds, []string{VerifyJournal,
+		VerifyMissing, VerifyJournal}), "got %v", kinds)
+	Assert(t, report.Problems[0].Branch == "master")
+	Assert(t, report.Problems[2].Branch == "other")
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	fs := NewFakeFileSys()
+	cs := NewChunkStore(NewFSInfo("pw"), fs)
+	writeVerifyTestTree(t, cs, "master")
+	Assert(t, Verify(cs, []string{"master"}).OK())
+
+	head, _ := cs.GetHead("master")
+	commit, _ := cs.LoadCommit(head)
+	name := objectName(commit.Root)
+	good := readFile(fs, name)
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-1] ^= 1
+	overwrite(fs, name, bad)
+	report := Verify(cs, []string{"master"})
+	Assert(t, reflect.DeepEqual(problemKinds(report),
+		[]string{VerifyCorrupt}))
+	Assert(t, report.Problems[0].Path == "/")
+	Assert(t, report.Problems[0].Digest == altEncode(commit.Root))
+
+	// With the wrong password, the objects are intact but undecryptable.
+	overwrite(fs, name, good)
+	report = Verify(NewChunkStore(NewFSInfo("wrong"), fs), []string{"master"})
+	Assertf(t, len(report.Problems) > 0 &&
+		report.Problems[0].Kind == VerifyDecrypt, "got %v",
+		problemKinds(report))
+}
+
+func TestListBranches(t *testing.T) {
+	fs := NewFakeFileSys()
+	branches, err := ListBranches(fs)
+	Assert(t, err == nil && len(branches) == 0)
+
+	cs := NewChunkStore(NewFSInfo("pw"), fs)
+	writeVerifyTestTree(t, cs, "master")
+	cs.SetHead("other", []byte("digest"))
+	cs.StoreRootDigest([]byte("digest"))
+	cs.WriteToJournal("journal-only", &pb.Change{Type: proto.Int32(
+		CHANGE_SETATTR)})
+	fs.Create("refs/x" + tempSuffix)
+
+	branches, err = ListBranches(fs)
+	Assertf(t, err == nil && reflect.DeepEqual(branches,
+		[]string{"journal-only", "master", "other"}), "got %v, %v",
+		branches, err)
+}